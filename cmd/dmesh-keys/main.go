@@ -0,0 +1,49 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	ugates "github.com/costinm/ugate/pkg/ugatesvc"
+	"github.com/costinm/wpgate/pkg/auth"
+)
+
+// Encrypt or decrypt the private keys in the config dir.
+//
+// The KEK is loaded from the KEK, KEY_PASSPHRASE or KEK_FD env variables, same
+// as dmesh. Example:
+//
+//	KEY_PASSPHRASE=... dmesh-keys encrypt ~/.ssh/
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage:", os.Args[0], "encrypt|decrypt [confdir]")
+	}
+	flag.Parse()
+	cmd := flag.Arg(0)
+	if cmd != "encrypt" && cmd != "decrypt" {
+		flag.Usage()
+		os.Exit(1)
+	}
+	dir := flag.Arg(1)
+	if dir == "" {
+		dir = os.Getenv("HOME") + "/.ssh/"
+	}
+
+	kek, err := auth.LoadKEK()
+	if err != nil {
+		log.Fatal("Invalid KEK: ", err)
+	}
+	if kek == nil {
+		log.Fatal("KEK, KEY_PASSPHRASE or KEK_FD required")
+	}
+
+	// Not using NewAuth - it would generate keys if missing.
+	a := &auth.Auth{Config: ugates.NewConf(dir), KEK: kek}
+	n, err := a.MigrateKeys(cmd == "encrypt")
+	if err != nil {
+		log.Fatal("Failed to migrate keys: ", err)
+	}
+	log.Printf("%s: %d keys in %s", cmd, n, dir)
+}
@@ -5,7 +5,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"syscall"
 
 	"github.com/costinm/wpgate/pkg/bootstrap"
 )
@@ -33,6 +35,15 @@ func main() {
 	go bootstrap.ClientUDSConnection(all.GW, all.Conf)
 	go bootstrap.ServerUDSConnection(all.GW, all.Conf)
 
+	// Drain the active streams before exit.
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, os.Interrupt)
+		<-sig
+		all.GW.Close()
+		os.Exit(0)
+	}()
+
 	//// Periodic registrations.
 	//m.Registry.RefreshNetworksPeriodic()
 
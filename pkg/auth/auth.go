@@ -10,6 +10,7 @@ import (
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/sha1"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
@@ -23,10 +24,12 @@ import (
 	"log"
 	"math/big"
 	"net"
+	"net/http"
 	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/costinm/ugate/pkg/auth"
@@ -43,11 +46,9 @@ import (
 //
 // The same identity is used for both SSH and TLS.
 //
-// Currently the 'primary' key is EC256 - mainly for Webpush integration and to simplify the code.
-//
-// TODO: add rsa - mainly for Istio and dropbear
-// TODO: add ed for IoT/arduino
-// TODO: root CA support - if the node is a VPN master, sign keys for members.
+// The 'primary' key is EC256 by default - mainly for Webpush integration and to simplify the code.
+// RSA (Istio, dropbear) and ED25519 (IoT/arduino) primary keys are also supported, see keys.go.
+// Root CA support - if the node is a VPN master, it can sign keys for members (ca.go).
 //
 // SSH config is broadly used and convenient for interop with ssh servers/clients ( and to not invent
 // a new thing ). Alternatives are more complex.
@@ -70,8 +71,36 @@ type Auth struct {
 	// Same as VIP6, but as uint64
 	VIP64 uint64
 
-	// Certificates associated with this node.
-	tlsCerts []tls.Certificate
+	// Certificates associated with this node. The first is the primary cert, may be
+	// replaced on rotation - protected by certMutex.
+	tlsCerts  []tls.Certificate
+	certMutex sync.RWMutex
+
+	// CertLifetime is the validity of generated self-signed certificates. Default 1 year.
+	CertLifetime time.Duration
+
+	// RenewBefore is the time before expiration when the primary cert is rotated.
+	// Default is 1/3 of the cert lifetime.
+	RenewBefore time.Duration
+
+	// If set, rotation will request a new cert from the CA instead of generating a
+	// self-signed one. CAClient must use the mTLS config of the node.
+	CAURL    string
+	CAClient *http.Client
+
+	// CARoot is the hex SHA-256 of the DER root certificate expected in the chains
+	// returned by the CA. If empty, the first root is trusted and saved - and
+	// chains with a different root are rejected after that.
+	CARoot string
+
+	onRotate []func(*tls.Certificate)
+
+	// KeyType of the primary key: KeyEC256, KeyED25519 or KeyRSA.
+	KeyType string
+
+	// Primary private key. This is a long-lived key, used as SSH server key and
+	// for TLS. The VIP is derived from the public key.
+	PrivateKey crypto.Signer
 
 	// Primary public key of the node.
 	// EC256: 65 bytes, uncompressed format
@@ -83,16 +112,15 @@ type Auth struct {
 	// Will be added to Crypto-Keys p256ecdsa header field.
 	PubKey string
 
-	// Private key to use in both server and client authentication. This is the base of the VIP of the node.
-	// ED22519: 32B
-	// EC256: 32
-	// RSA: DER
+	// Raw EC256 private key, 32 bytes. Used for Webpush encryption.
 	Priv []byte
 
-	// Primary private keys. This is a long-lived key, used as SSH server
-	// key.
+	// EC256 key, used for Webpush and VAPID. Same as the primary key for EC256 nodes.
 	EC256PrivateKey *ecdsa.PrivateKey
 
+	// EC256 public key, 65 bytes uncompressed format.
+	EC256Pub []byte
+
 	// Secondary private keys.
 	RSAPrivate *rsa.PrivateKey
 	EDPrivate  *ed25519.PrivateKey
@@ -101,10 +129,57 @@ type Auth struct {
 	// Key is the string(marshalled_form). For example EC256 it's a byte[65]
 	// Value is list of roles for the key.
 	Authorized map[string]string
+
+	// Known hosts, by "[host]:port" - see known.go. Keys of servers are pinned
+	// in known_hosts, or trusted on first use if TOFU is set.
 	Known      map[string]*AuthzInfo
+	knownMutex sync.RWMutex
+
+	// TOFU enables trust on first use for hosts not in Known. Set from the
+	// TOFU config, default ON.
+	TOFU bool
+
+	// Authorized, Authz and AuthzByID are loaded from authorized_keys and
+	// updated by AddAuthorized - protected by authzMutex.
+	Authz      map[string]*AuthzInfo
+	AuthzByID  map[uint64]*AuthzInfo
+	authzMutex sync.RWMutex
+
+	// SSH certificate authorities - see sshca.go.
+	UserCAs []*AuthzInfo
+	HostCAs []*AuthzInfo
 
-	Authz     map[string]*AuthzInfo
-	AuthzByID map[uint64]*AuthzInfo
+	// Revoked keys - see revoke.go. Key is the KeyBytes format.
+	revoked      map[string]*Revocation
+	revokedMutex sync.RWMutex
+	onRevoke     []func(pub []byte)
+
+	// Policy is the authorization policy - see policy.go. Nil allows all requests.
+	Policy      *Policy
+	policyMutex sync.RWMutex
+
+	// Issuers are the trusted OIDC token issuers - see oidc.go.
+	Issuers   []*OIDCIssuer
+	oidcMutex sync.RWMutex
+
+	// TrustDomain is the SPIFFE trust domain of the mesh, and SPIFFE the ID of
+	// this node in K8S - see spiffe.go.
+	TrustDomain string
+	SPIFFE      *SPIFFEID
+
+	// Roots of other SPIFFE trust domains, by trust domain.
+	TrustBundles map[string]*x509.CertPool
+	bundleMutex  sync.RWMutex
+
+	// KEK encrypts the private keys saved in the ConfStore - see keyenc.go.
+	// Loaded from the environment, nil if keys are saved in plain text.
+	KEK *KEK
+
+	// Set if the saved keys can't be decrypted - new keys are not saved.
+	keysLocked bool
+
+	// CA is set if this node is acting as a private CA for the mesh.
+	CA *CA
 
 	// cached
 	pub64 string
@@ -136,6 +211,10 @@ type ReqContext struct {
 	VIP net.IP
 
 	VAPID *auth.JWT
+
+	// Path is the list of VIPs the message was forwarded through, oldest first.
+	// Set only after the signed Via chain was verified, see CheckPath.
+	Path []string
 }
 
 // ID of the caller, validated based on certs.
@@ -156,6 +235,9 @@ type AuthzInfo struct {
 
 	Opts map[string]string
 
+	// Host patterns, for known_hosts entries.
+	Hosts []string
+
 	// key.(*ecdsa.PublicKey)
 	// key.(*rsa.PublicKey)
 	// key.(ed25519.PublicKey)
@@ -276,6 +358,9 @@ func NewVapid(publicKey, privateKey string) (v *Auth) {
 	v.Priv = privateUncomp
 	v.PubKey = publicKey
 	v.EC256PrivateKey = &pkey
+	v.EC256Pub = publicUncomp
+	v.PrivateKey = &pkey
+	v.KeyType = KeyEC256
 
 	return
 }
@@ -286,16 +371,28 @@ func _new() *Auth {
 		Known:      map[string]*AuthzInfo{},
 		Authz:      map[string]*AuthzInfo{},
 		AuthzByID:  map[uint64]*AuthzInfo{},
+		revoked:    map[string]*Revocation{},
 	}
 }
 
 // Initialize the certificates, loading or generating them.
 // If cfg is nil, will generate certs but not save.
 //
+// The primary key type is read from the KEY_TYPE config, default KeyEC256.
 func NewAuth(cfg ConfStore, name, domain string) *Auth {
+	return NewAuthWithKeyType(cfg, name, domain, Conf(cfg, "KEY_TYPE", KeyEC256))
+}
+
+// NewAuthWithKeyType is like NewAuth, using a primary key of the given type if
+// a new key is generated.
+func NewAuthWithKeyType(cfg ConfStore, name, domain, kt string) *Auth {
 	auth := _new()
 	auth.Config = cfg
 	auth.Domain = domain
+	auth.KeyType = kt
+	if kt == "" {
+		auth.KeyType = KeyEC256
+	}
 
 	if name == "" {
 		if os.Getenv("POD_NAME") != "" {
@@ -306,6 +403,14 @@ func NewAuth(cfg ConfStore, name, domain string) *Auth {
 	}
 
 	auth.Name = name
+	auth.TOFU = Conf(cfg, "TOFU", "ON") != "OFF"
+
+	kek, err := LoadKEK()
+	if err != nil {
+		log.Println("Invalid KEK, keys not encrypted: ", err)
+	}
+	auth.KEK = kek
+	auth.initSPIFFE()
 
 	// Use .ssh/ and the secondary config to load the keys.
 	if cfg != nil {
@@ -314,26 +419,33 @@ func NewAuth(cfg ConfStore, name, domain string) *Auth {
 			log.Println("Error loading cert: ", err)
 		}
 	}
-	if auth.EC256PrivateKey == nil {
-		// Can't load the EC256 certs - generate new ones.
+	if auth.PrivateKey == nil || auth.EC256PrivateKey == nil {
+		// Can't load the certs - generate new ones.
 		auth.generateCert()
 	}
 
 	auth.VIP64 = auth.NodeIDUInt()
-	// Based on the primary EC256 key
+	// Based on the primary key
 	auth.pub64 = base64.RawURLEncoding.EncodeToString(auth.Pub)
 
 	// Use SSH known hosts and auth to bootstrap
 	if cfg != nil {
 		auth.loadKnownHosts()
 		auth.loadAuth()
+		auth.loadTrustedUserCAs()
+		auth.loadRevoked()
+		auth.loadPolicy()
+		auth.loadOIDC()
 	}
+	auth.loadTrustBundles()
 	// TODO: additional sources for root certs and identity.
 
 	return auth
 }
 
 func (auth *Auth) DumpKnown() {
+	auth.knownMutex.RLock()
+	defer auth.knownMutex.RUnlock()
 	for _, ai := range auth.Known {
 		fmt.Printf("%s=%v\n", ai.Role, Pub2VIP(ai.Public))
 	}
@@ -348,12 +460,13 @@ func (auth *Auth) Dump() {
 
 	pub64 := base64.RawURLEncoding.EncodeToString(auth.Pub)
 
+	fmt.Println("TYPE=", auth.KeyType)
 	fmt.Println("PUB=", pub64)
 	h := strings.ReplaceAll(auth.VIP6.String()[6:], ":", "-")
-	sshPub := "ecdsa-sha2-nistp256 " + SSH_ECPREFIX + pub64 + " " +
-		auth.Name + "@" + h + "." + auth.Domain
-	fmt.Println("SSH=", sshPub)
+	fmt.Println("SSH=", auth.SSHPublicKey(auth.Name+"@"+h+"."+auth.Domain))
 
+	auth.authzMutex.RLock()
+	defer auth.authzMutex.RUnlock()
 	for _, ai := range auth.Authz {
 		fmt.Println("AUTHZ_", ai.Role, "=", Pub2VIP(ai.Public))
 	}
@@ -368,30 +481,42 @@ func (auth *Auth) AddAuthorized(key interface{}, role string) {
 		keyb = oub
 	}
 
-	if cp2, ok := key.(crypto.PublicKey); ok {
-		oub := KeyBytes(cp2)
-		key = oub
+	if keyb == nil {
+		keyb = KeyBytes(key)
 	}
 
+	auth.authzMutex.Lock()
 	auth.Authorized[string(keyb)] = role
 
 	// TODO: write back authorized file !!!
 	bw := bytes.Buffer{}
 	for k, v := range auth.Authorized {
-		kb := []byte(k)
-		if len(kb) == 65 {
-			bw.WriteString("ecdsa-sha2-nistp256 " + base64.StdEncoding.EncodeToString(kb) + " " + v)
+		pk, err := PubKeyFromBytes([]byte(k))
+		if err != nil {
+			continue
+		}
+		if l := sshAuthorizedLine(pk, v); l != "" {
+			bw.WriteString(l + "\n")
 		}
 	}
+	auth.authzMutex.Unlock()
 
-	auth.Config.Set("authorized_keys.save", bw.Bytes())
+	if auth.Config != nil {
+		auth.Config.Set("authorized_keys.save", bw.Bytes())
+	}
 }
 
 // Check if an identity is authorized for the role.
 // The key is in the marshalled format - use KeyBytes to convert a crypto.PublicKey.
 //
+// Revoked keys have no role.
 func (auth *Auth) Auth(key []byte, role string) string {
+	if auth.IsRevoked(key) {
+		return ""
+	}
+	auth.authzMutex.RLock()
 	roles := auth.Authorized[string(key)]
+	auth.authzMutex.RUnlock()
 
 	return roles
 }
@@ -431,9 +556,19 @@ func (auth *Auth) loadKnownHosts() error {
 		}
 		authb = rest
 
-		if marker == "@cert-authority" {
+		if marker == "cert-authority" {
 			// hosts should start with *.DOMAIN
-
+			if ai := newAuthzInfo(pubKey, "", nil); ai != nil {
+				ai.Hosts = hosts
+				auth.HostCAs = append(auth.HostCAs, ai)
+			}
+			continue
+		}
+		if marker == "revoked" {
+			if kb := SSHKeyBytes(pubKey); kb != nil {
+				auth.addRevoked(&Revocation{Pub: kb, Reason: "known_hosts"}, false)
+			}
+			continue
 		}
 
 		if cpk, ok := pubKey.(ssh.CryptoPublicKey); ok {
@@ -441,19 +576,19 @@ func (auth *Auth) loadKnownHosts() error {
 			kbytes := KeyBytes(pubk)
 			if kbytes != nil { // len(kbytes) == 65 {
 				for _, h := range hosts {
-					// TODO: filter :5222 and extract domain
-					// IP can be ignored.
+					// Entries without a port or with port 22 are the keys of
+					// SSH servers, not mesh nodes.
 					hn, p, _ := net.SplitHostPort(h)
-					if p != "0" && p != "5222" {
+					if hn == "" || p == "22" {
 						continue
 					}
 
 					//if len(opts) > 0 && opts[0] == ""
-					auth.Known[hn] = &AuthzInfo{
+					auth.Known[knownHostKey(hn, p)] = &AuthzInfo{
 						Role:   hn,
 						Key:    pubk,
 						Public: kbytes,
-						Opts:   map[string]string{},
+						Opts:   map[string]string{"port": p},
 					}
 				}
 				//log.Println("SSH HAUTH: ", pubKey.Type(), marker, hosts, comment, base64.StdEncoding.EncodeToString(kbytes))
@@ -508,30 +643,25 @@ func (auth *Auth) loadAuth() error {
 		}
 		authKeys = rest
 
-		if cpk, ok := pubKey.(ssh.CryptoPublicKey); ok {
-			pubk := cpk.CryptoPublicKey()
-			kbytes := KeyBytes(pubk)
-			if kbytes != nil {
-				auth.Authorized[string(kbytes)] = comment
-				ai := &AuthzInfo{
-					Role:   comment,
-					Key:    pubk,
-					Public: kbytes,
-					Opts:   map[string]string{},
-				}
-				auth.Authz[comment] = ai
-				auth.AuthzByID[Pub2ID(ai.Public)] = ai
-				for _, o := range opts {
-					if strings.Contains(o, "=") {
-						op := strings.SplitN(o, "=", 2)
-						ai.Opts[op[0]] = op[1]
-					} else {
-						ai.Opts[o] = ""
-					}
-				}
+		if _, ok := pubKey.(ssh.CryptoPublicKey); ok {
+			ai := newAuthzInfo(pubKey, comment, opts)
+			if ai == nil {
 				continue
 			}
-
+			if _, ok := ai.Opts["@revoked"]; ok {
+				auth.addRevoked(&Revocation{Pub: ai.Public, Reason: comment}, false)
+				continue
+			}
+			if _, ok := ai.Opts["cert-authority"]; ok {
+				// Trusted to sign user certs, not a user key.
+				auth.UserCAs = append(auth.UserCAs, ai)
+				continue
+			}
+			auth.authzMutex.Lock()
+			auth.Authorized[string(ai.Public)] = comment
+			auth.Authz[comment] = ai
+			auth.AuthzByID[Pub2ID(ai.Public)] = ai
+			auth.authzMutex.Unlock()
 			continue
 		} else {
 			log.Println("SSH UNKNOWN ", pubKey.Type())
@@ -561,29 +691,33 @@ func KeyBytes(key crypto.PublicKey) []byte {
 	return nil
 }
 
-// Load the primary cert - expects a PEM key file
+// Load the primary cert - expects a PEM key file.
+// The EC256 key is always loaded, the primary key is loaded based on KeyType.
 func (auth *Auth) loadCert() error {
-	keyPEM, err := auth.Config.Get("ec-key.pem")
-	if err != nil {
-		return err
+	ecCert, err := auth.loadKeyPair(KeyEC256)
+	if err == nil {
+		auth.setEC256(ecCert.PrivateKey.(*ecdsa.PrivateKey))
 	}
-	certPEM, err := auth.Config.Get("ec-cert.pem")
-	if err != nil {
-		return err
+
+	tlsCert := ecCert
+	if auth.KeyType != KeyEC256 {
+		tlsCert, err = auth.loadKeyPair(auth.KeyType)
 	}
-	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
 	if err != nil {
+		// Missing keys are generated by the caller.
 		return err
 	}
 
-	pk := tlsCert.PrivateKey.(*ecdsa.PrivateKey)
-
-	auth.tlsCerts = []tls.Certificate{tlsCert}
-	auth.EC256PrivateKey = pk
-	auth.Priv = pk.D.Bytes()
-	auth.Pub = elliptic.Marshal(Curve256, pk.X, pk.Y) // starts with 0x04 == uncompressed curve
+	auth.setPrimary(tlsCert.PrivateKey.(crypto.Signer))
+	auth.tlsCerts = []tls.Certificate{*tlsCert}
 
-	auth.VIP6 = Pub2VIP(auth.Pub)
+	// CA signed cert for the primary key, if not expired.
+	chain, err := auth.Config.Get(CertChainFile)
+	if err == nil && chain != nil {
+		if leaf, err := auth.SetCertChain(chain); err != nil || time.Now().After(leaf.NotAfter) {
+			auth.tlsCerts = []tls.Certificate{*tlsCert}
+		}
+	}
 
 	keyRSA, err := auth.Config.Get(".ssh/id_rsa")
 	if err == nil {
@@ -639,45 +773,57 @@ func RawToPrivate(priv, pub []byte) (*ecdsa.PrivateKey, error) {
 	return privk, nil
 }
 
-// generateCert will generate the keys and populate the Pub/Priv fields.
-// Will set privateKey, Priv, Pub
-// Pub, Priv should be saved
+// generateCert will generate the missing keys and populate the Pub/Priv fields.
+// Will set PrivateKey, EC256PrivateKey, Priv, Pub
+// The keys and self-signed certs are saved.
 func (auth *Auth) generateCert() {
-	// d, x,y
-	priv, x, y, err := elliptic.GenerateKey(Curve256, rand.Reader)
-	if err != nil {
-		log.Fatal("Unexpected eliptic error")
-	}
-
-	pk := ecdsa.PublicKey{X: x, Y: y, Curve: Curve256}
-	d := new(big.Int).SetBytes(priv[0:32])
-
-	auth.Priv = priv
-
-	auth.EC256PrivateKey = &ecdsa.PrivateKey{D: d, PublicKey: pk}
-	auth.Pub = elliptic.Marshal(Curve256, x, y) // starts with 0x04 == uncompressed curve
-	auth.PubKey = base64.RawURLEncoding.EncodeToString(auth.Pub)
-	auth.VIP6 = Pub2VIP(auth.Pub)
-	//b64 := base64.URLEncoding.WithPadding(base64.NoPadding)
-	//
-	//pub64 := b64.EncodeToString(pub)
-	//priv64 := b64.EncodeToString(priv)
+	if auth.PrivateKey == nil {
+		var k crypto.Signer
+		var err error
+		if auth.KeyType == KeyEC256 && auth.EC256PrivateKey != nil {
+			k = auth.EC256PrivateKey
+		} else {
+			k, err = generateKey(auth.KeyType)
+			if err != nil {
+				log.Fatal("Unexpected key generation error ", auth.KeyType, err)
+			}
+		}
+		auth.setPrimary(k)
 
-	if auth.Name == "" {
-		auth.Name = base64.RawURLEncoding.EncodeToString(auth.NodeID())
+		if auth.Name == "" {
+			auth.Name = base64.RawURLEncoding.EncodeToString(auth.NodeID())
+		}
+		keyPEM, certPEM := auth.generateAndSaveSelfSigned(k, auth.Name+"."+auth.Domain)
+		tlsCert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		auth.tlsCerts = []tls.Certificate{tlsCert}
 	}
-	keyPEM, certPEM := auth.generateAndSaveSelfSigned(auth.EC256PrivateKey, auth.Name+"."+auth.Domain)
-	tlsCert, _ := tls.X509KeyPair(certPEM, keyPEM)
-	auth.tlsCerts = []tls.Certificate{tlsCert}
 
+	if auth.EC256PrivateKey == nil {
+		if ec, ok := auth.PrivateKey.(*ecdsa.PrivateKey); ok {
+			auth.setEC256(ec)
+			return
+		}
+		// Secondary EC256 key, for Webpush.
+		k, err := ecdsa.GenerateKey(Curve256, rand.Reader)
+		if err != nil {
+			log.Fatal("Unexpected eliptic error")
+		}
+		auth.setEC256(k)
+		auth.generateAndSaveSelfSigned(k, auth.Name+"."+auth.Domain)
+	}
 }
 
-// Generate and save the primary self-signed Certificate
-func (auth *Auth) generateAndSaveSelfSigned(priv *ecdsa.PrivateKey, sans ...string) ([]byte, []byte) {
+// Generate and save a self-signed Certificate for the key. The files are
+// named based on the key type, see keyFiles.
+func (auth *Auth) generateAndSaveSelfSigned(priv crypto.Signer, sans ...string) ([]byte, []byte) {
 	var notBefore time.Time
 	notBefore = time.Now().Add(-1 * time.Hour)
 
-	notAfter := notBefore.Add(365 * 24 * time.Hour)
+	lifetime := auth.CertLifetime
+	if lifetime == 0 {
+		lifetime = 365 * 24 * time.Hour
+	}
+	notAfter := notBefore.Add(lifetime)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, _ := rand.Int(rand.Reader, serialNumberLimit)
@@ -691,30 +837,44 @@ func (auth *Auth) generateAndSaveSelfSigned(priv *ecdsa.PrivateKey, sans ...stri
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              certKeyUsage(priv.Public()),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		DNSNames:              sans,
 		IPAddresses:           []net.IP{auth.VIP6},
 	}
+	if auth.SPIFFE != nil {
+		template.URIs = []*url.URL{auth.SPIFFE.URL()}
+	}
 
 	// Sign with the private key.
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, priv.Public(), priv)
 	if err != nil {
 		panic(err)
 	}
 	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
 
-	ecb, _ := x509.MarshalECPrivateKey(priv)
-	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecb})
+	keyPEM := marshalPrivate(priv)
 
 	if auth.Config != nil {
-		auth.Config.Set("ec-key.pem", keyPEM)
-		auth.Config.Set("ec-cert.pem", certPEM)
-		pub64 := base64.StdEncoding.EncodeToString(auth.Pub)
-		sshPub := "ecdsa-sha2-nistp256 " + SSH_ECPREFIX + pub64 + " " + auth.Name + "@" + auth.Domain
-		auth.Config.Set("id_ecdsa.pub", []byte(sshPub))
+		kt := keyType(priv)
+		kf, cf := keyFiles(kt)
+		if err := auth.setPrivate(kf, keyPEM); err != nil {
+			// Keep the saved key and cert - the generated key is only used in memory.
+			log.Println("Failed to save key ", kf, err)
+			return keyPEM, certPEM
+		}
+		auth.Config.Set(cf, certPEM)
+		sshPub := sshAuthorizedLine(priv.Public(), auth.Name+"@"+auth.Domain)
+		switch kt {
+		case KeyED25519:
+			auth.Config.Set("id_ed25519.pub", []byte(sshPub))
+		case KeyRSA:
+			auth.Config.Set("id_rsa.pub", []byte(sshPub))
+		default:
+			auth.Config.Set("id_ecdsa.pub", []byte(sshPub))
+		}
 	}
 	return keyPEM, certPEM
 }
@@ -740,7 +900,7 @@ func (auth *Auth) GenerateDirectCert(pub crypto.PublicKey, hours time.Duration,
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		KeyUsage:              certKeyUsage(pub),
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
 		DNSNames:              name,
@@ -750,7 +910,7 @@ func (auth *Auth) GenerateDirectCert(pub crypto.PublicKey, hours time.Duration,
 
 	// Sign with the private key of the Cert.
 
-	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, auth.EC256PrivateKey)
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, pub, auth.PrivateKey)
 	if err != nil {
 		log.Println("Error creating cert", err)
 		return nil
@@ -804,26 +964,21 @@ func Pub2VIP(pub []byte) net.IP {
 }
 
 func (auth *Auth) PublicKey() crypto.PublicKey {
-	return auth.EC256PrivateKey.Public()
+	return auth.PrivateKey.Public()
 }
 
 // From a key pair, generate a tls config with cert.
 // Used for Auth and Client servers.
+//
+// The primary cert is returned by GetCertificate, so rotated certs are used by
+// existing listeners on new connections.
 func (auth *Auth) GenerateTLSConfigServer() *tls.Config {
-	var crt *tls.Certificate
-
-	crt = &auth.tlsCerts[0]
-
-	certs := []tls.Certificate{*crt}
-
 	certMap := auth.GetCerts()
-	certMap["*"] = crt
 
 	return &tls.Config{
-		Certificates: certs,
-		NextProtos:   []string{"h2"},
+		NextProtos: []string{"h2"},
 
-		// Will only be called if client supplies SNI and Certificates empty
+		// Certificates is empty - called for each connection.
 		GetCertificate: func(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
 			// Log on each new TCP connection, after client hello
 			//
@@ -833,7 +988,7 @@ func (auth *Auth) GenerateTLSConfigServer() *tls.Config {
 			if ok {
 				return c, nil
 			}
-			return crt, nil
+			return auth.Certificate(), nil
 		},
 	}
 }
@@ -887,13 +1042,31 @@ func (auth *Auth) GenerateTLSConfigClient() *tls.Config {
 		// VerifyPeerCertificate used instead
 		InsecureSkipVerify: true,
 
-		Certificates: auth.tlsCerts,
+		// Current primary cert, updated on rotation.
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return auth.Certificate(), nil
+		},
 		// not set on client !! Setting it also disables Auth !
 		//NextProtos: nextProtosH2,
 	}
 }
 
+// Sign data with the primary key. Sig must have SigSize() bytes.
+// EC256 signatures are R and S, 32 bytes each. RSA uses PKCS1v15 with SHA256.
 func (auth *Auth) Sign(data []byte, sig []byte) {
+	switch k := auth.PrivateKey.(type) {
+	case ed25519.PrivateKey:
+		copy(sig, ed25519.Sign(k, data))
+		return
+	case *rsa.PrivateKey:
+		hash := sha256.Sum256(data)
+		s, err := rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, hash[:])
+		if err != nil {
+			log.Println("RSA sign failed", err)
+		}
+		copy(sig, s)
+		return
+	}
 	for i := 0; i < 3; i++ {
 		hasher := crypto.SHA256.New()
 		hasher.Write(data) //[0:64]) // only public key, for debug
@@ -901,18 +1074,23 @@ func (auth *Auth) Sign(data []byte, sig []byte) {
 
 		r, s, _ := ecdsa.Sign(rand.Reader, auth.EC256PrivateKey, hash)
 
-		copy(sig, r.Bytes())
-		copy(sig[32:], s.Bytes())
+		// R and S are 32 bytes each, left-padded.
+		rb, sb := r.Bytes(), s.Bytes()
+		for i := range sig[0:64] {
+			sig[i] = 0
+		}
+		copy(sig[32-len(rb):], rb)
+		copy(sig[64-len(sb):], sb)
 
 		//log.Println("SND SIG: ", hex.EncodeToString(sig))
 		//log.Println("SND PUB: ", hex.EncodeToString(data[len(data)-64:]))
 		//log.Println("SND HASH: ", hex.EncodeToString(hash))
 		//log.Printf("SND PAYLOAD: %d %s", len(data), hex.EncodeToString(data))
-		err := Verify(data, auth.Pub[1:], sig)
+		err := Verify(data, auth.EC256Pub[1:], sig)
 		if err != nil {
 			log.Println("Bad msg", err)
 			log.Println("SIG: ", hex.EncodeToString(sig))
-			log.Println("PUB: ", hex.EncodeToString(auth.Pub))
+			log.Println("PUB: ", hex.EncodeToString(auth.EC256Pub))
 			log.Println("PRIV: ", hex.EncodeToString(auth.Priv))
 			log.Println("HASH: ", hex.EncodeToString(hash))
 		} else {
@@ -921,7 +1099,30 @@ func (auth *Auth) Sign(data []byte, sig []byte) {
 	}
 }
 
+// Verify a signature created by Sign. The key type is detected from the marshalled
+// public key: 32 bytes for ED25519, 64 or 65 (with the 0x04 prefix) for EC256, and
+// PKCS1 DER for RSA.
 func Verify(data []byte, pub []byte, sig []byte) error {
+	switch {
+	case len(pub) == ed25519.PublicKeySize:
+		if !ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+			return errors.New("Failed to validate signature ")
+		}
+		return nil
+	case len(pub) == 65 && pub[0] == 4:
+		pub = pub[1:]
+	case len(pub) != 64:
+		rsak, err := x509.ParsePKCS1PublicKey(pub)
+		if err != nil {
+			return err
+		}
+		hash := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(rsak, crypto.SHA256, hash[:], sig)
+	}
+	if len(sig) < 64 {
+		return errors.New("Invalid signature")
+	}
+
 	hasher := crypto.SHA256.New()
 	hasher.Write(data) //[0:64]) // only public key, for debug
 	hash := hasher.Sum(nil)
@@ -989,13 +1190,19 @@ func Verify(data []byte, pub []byte, sig []byte) error {
 func (auth *Auth) GetRoots() *x509.CertPool {
 	caCertPool := x509.NewCertPool()
 
-	caCert, err := auth.Config.Get("/certs/root-cert.pem")
-	if err == nil {
-		caCertPool.AppendCertsFromPEM(caCert)
+	if auth.CA != nil {
+		caCertPool.AddCert(auth.CA.Cert)
+	}
+
+	if auth.Config != nil {
+		caCert, err := auth.Config.Get(RootCertFile)
+		if err == nil && caCert != nil {
+			caCertPool.AppendCertsFromPEM(caCert)
+		}
 	}
 
 	caCertFile := "/etc/certs/root-cert.pem"
-	caCert, err = ioutil.ReadFile(caCertFile)
+	caCert, err := ioutil.ReadFile(caCertFile)
 	if err == nil {
 		caCertPool.AppendCertsFromPEM(caCert)
 	}
@@ -1031,8 +1238,10 @@ type h2Key int
 
 var h2Info = h2Key(1)
 
+// AuthContext returns the auth context of the request, nil if not set.
 func AuthContext(ctx context.Context) *ReqContext {
-	return ctx.Value(h2Info).(*ReqContext)
+	h2c, _ := ctx.Value(h2Info).(*ReqContext)
+	return h2c
 }
 
 func ContextWithAuth(ctx context.Context, h2c *ReqContext) context.Context {
@@ -0,0 +1,361 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Private CA mode: a node (typically the VPN master) holds a root key and signs
+// short-lived certificates for mesh members. Members still use their primary key -
+// the VIP doesn't change - but peers can verify the cert against the root
+// instead of pinning self-signed certs.
+//
+// The root key and cert are saved in the ConfStore as ca-key.pem and ca-cert.pem.
+// Members save the root as /certs/root-cert.pem, which is used by GetRoots.
+
+// CA signs certificates for mesh members.
+type CA struct {
+	// Private key of the root.
+	Key *ecdsa.PrivateKey
+
+	// Root certificate, self signed.
+	Cert *x509.Certificate
+
+	CertPEM []byte
+
+	// CertTTL is the validity of issued certificates.
+	CertTTL time.Duration
+
+	// Role required in authorized_keys to get a certificate signed.
+	// RoleAdmin is also accepted.
+	Role string
+
+	auth *Auth
+}
+
+const (
+	// RoleMember is the default role allowed to request certificates from the CA.
+	RoleMember = "member"
+
+	RoleAdmin = "admin"
+
+	caKeyFile  = "ca-key.pem"
+	caCertFile = "ca-cert.pem"
+
+	// RootCertFile is the ConfStore name of the trusted root.
+	RootCertFile = "/certs/root-cert.pem"
+
+	// CertChainFile is the ConfStore name of the CA-signed chain for the primary key.
+	CertChainFile = "cert-chain.pem"
+)
+
+// InitCA loads the root key from the ConfStore, or generates and saves a new one.
+// After this call the node can sign certificates and trusts its own root.
+func (auth *Auth) InitCA() (*CA, error) {
+	ca := &CA{
+		CertTTL: 24 * time.Hour,
+		Role:    RoleMember,
+		auth:    auth,
+	}
+	if auth.Config != nil {
+		keyPEM, err := auth.getPrivate(caKeyFile)
+		if err != nil {
+			// Encrypted root key without the KEK - don't replace it.
+			return nil, err
+		}
+		if keyPEM != nil {
+			certPEM, err := auth.Config.Get(caCertFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, err
+			}
+			k, ok := tlsCert.PrivateKey.(*ecdsa.PrivateKey)
+			if !ok {
+				return nil, errors.New("ca: root key must be EC256")
+			}
+			ca.Key = k
+			ca.CertPEM = certPEM
+			ca.Cert, err = x509.ParseCertificate(tlsCert.Certificate[0])
+			if err != nil {
+				return nil, err
+			}
+			auth.CA = ca
+			return ca, nil
+		}
+	}
+
+	k, err := ecdsa.GenerateKey(Curve256, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	notBefore := time.Now().Add(-1 * time.Hour)
+	template := x509.Certificate{
+		SerialNumber: serial(),
+		Subject: pkix.Name{
+			CommonName:   "root." + auth.Domain,
+			Organization: []string{auth.Domain},
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(10 * 365 * 24 * time.Hour),
+
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, &template, &k.PublicKey, k)
+	if err != nil {
+		return nil, err
+	}
+	ca.Key = k
+	ca.Cert, _ = x509.ParseCertificate(certDER)
+	ca.CertPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+
+	if auth.Config != nil {
+		ecb, _ := x509.MarshalECPrivateKey(k)
+		auth.setPrivate(caKeyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecb}))
+		auth.Config.Set(caCertFile, ca.CertPEM)
+	}
+	auth.CA = ca
+	return ca, nil
+}
+
+func serial() *big.Int {
+	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
+	serialNumber, _ := rand.Int(rand.Reader, serialNumberLimit)
+	return serialNumber
+}
+
+// SignCSR issues a certificate for the CSR public key. The SAN is the VIP6 derived
+// from the key - names requested in the CSR are ignored, the CA only vouches for
+// the key to VIP mapping and the domain.
+//
+// Returns the PEM encoded leaf followed by the root.
+func (ca *CA) SignCSR(csrBytes []byte) ([]byte, error) {
+	if b, _ := pem.Decode(csrBytes); b != nil {
+		csrBytes = b.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(csrBytes)
+	if err != nil {
+		return nil, err
+	}
+	if err := csr.CheckSignature(); err != nil {
+		return nil, err
+	}
+	pub := KeyBytes(csr.PublicKey)
+	if pub == nil {
+		return nil, errors.New("ca: unsupported key")
+	}
+	vip := Pub2VIP(pub)
+	name := strings.ReplaceAll(vip.String()[6:], ":", "-") + "." + ca.auth.Domain
+
+	notBefore := time.Now().Add(-5 * time.Minute)
+	template := x509.Certificate{
+		SerialNumber: serial(),
+		Subject: pkix.Name{
+			CommonName:   name,
+			Organization: []string{ca.auth.Domain},
+		},
+		NotBefore: notBefore,
+		NotAfter:  notBefore.Add(ca.CertTTL),
+
+		KeyUsage:              certKeyUsage(csr.PublicKey),
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{name},
+		IPAddresses:           []net.IP{vip},
+	}
+	certDER, err := x509.CreateCertificate(rand.Reader, &template, ca.Cert, csr.PublicKey, ca.Key)
+	if err != nil {
+		return nil, err
+	}
+	res := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certDER})
+	return append(res, ca.CertPEM...), nil
+}
+
+// HandleCSR signs a CSR posted by a member, over mTLS. The CSR key must be the same
+// as the client cert key, and the key must have the CA role in authorized_keys.
+func (ca *CA) HandleCSR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	pub := KeyBytes(r.TLS.PeerCertificates[0].PublicKey)
+	if !HasRole(ca.auth.Auth(pub, ""), ca.Role) && !HasRole(ca.auth.Auth(pub, ""), RoleAdmin) {
+		log.Println("CA: unauthorized CSR ", Pub2VIP(pub))
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 16*1024))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	if b, _ := pem.Decode(body); b != nil {
+		body = b.Bytes
+	}
+	csr, err := x509.ParseCertificateRequest(body)
+	if err != nil || !bytes.Equal(KeyBytes(csr.PublicKey), pub) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Invalid CSR"))
+		return
+	}
+	chain, err := ca.SignCSR(body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	log.Println("CA: signed ", Pub2VIP(pub))
+	w.Header().Set("Content-Type", "application/x-pem-file")
+	w.Write(chain)
+}
+
+// HasRole checks if the comma separated list of roles from authorized_keys includes role.
+func HasRole(roles string, role string) bool {
+	for _, r := range strings.Split(roles, ",") {
+		if strings.TrimSpace(r) == role {
+			return true
+		}
+	}
+	return false
+}
+
+// CSR creates a certificate signing request for the primary key.
+func (auth *Auth) CSR() ([]byte, error) {
+	template := &x509.CertificateRequest{
+		Subject: pkix.Name{
+			CommonName:   auth.Name + "." + auth.Domain,
+			Organization: []string{auth.Domain},
+		},
+		IPAddresses: []net.IP{auth.VIP6},
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, template, auth.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: der}), nil
+}
+
+// RequestCert gets a certificate for the primary key from the CA. The client must use
+// the mTLS config of this node. On success the signed chain is used as primary
+// certificate, and the chain and root are saved.
+func (auth *Auth) RequestCert(hc *http.Client, caURL string) (*x509.Certificate, error) {
+	csr, err := auth.CSR()
+	if err != nil {
+		return nil, err
+	}
+	res, err := hc.Post(caURL, "application/pkcs10", bytes.NewReader(csr))
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	chain, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != 200 {
+		return nil, fmt.Errorf("ca: sign failed %d %s", res.StatusCode, string(chain))
+	}
+	return auth.SetCertChain(chain)
+}
+
+// ErrRootMismatch is returned by SetCertChain if the root of the chain is not the
+// pinned CARoot or the saved root.
+var ErrRootMismatch = errors.New("ca: unexpected root")
+
+// SetCertChain sets the PEM chain - leaf for the primary key, followed by the root -
+// as primary certificate. The root is saved as trusted root.
+//
+// The root must match CARoot if set. A saved root is never replaced: the chain
+// must use the same root.
+func (auth *Auth) SetCertChain(chain []byte) (*x509.Certificate, error) {
+	tlsCert := tls.Certificate{PrivateKey: auth.PrivateKey}
+	rest := chain
+	for {
+		var b *pem.Block
+		b, rest = pem.Decode(rest)
+		if b == nil {
+			break
+		}
+		if b.Type == "CERTIFICATE" {
+			tlsCert.Certificate = append(tlsCert.Certificate, b.Bytes)
+		}
+	}
+	if len(tlsCert.Certificate) < 2 {
+		return nil, errors.New("ca: missing root in chain")
+	}
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(KeyBytes(leaf.PublicKey), auth.Pub) {
+		return nil, errors.New("ca: certificate for a different key")
+	}
+	root, err := x509.ParseCertificate(tlsCert.Certificate[len(tlsCert.Certificate)-1])
+	if err != nil {
+		return nil, err
+	}
+	if err := auth.checkRoot(root); err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+	if _, err := leaf.Verify(x509.VerifyOptions{Roots: roots,
+		KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageAny}}); err != nil {
+		return nil, err
+	}
+	tlsCert.Leaf = leaf
+
+	auth.setCert(tlsCert)
+	if auth.Config != nil {
+		auth.Config.Set(CertChainFile, chain)
+		auth.Config.Set(RootCertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: root.Raw}))
+	}
+	return leaf, nil
+}
+
+// checkRoot verifies the root of a CA chain against the pinned hash and the saved
+// root.
+func (auth *Auth) checkRoot(root *x509.Certificate) error {
+	if auth.CARoot != "" {
+		h := sha256.Sum256(root.Raw)
+		if !strings.EqualFold(auth.CARoot, hex.EncodeToString(h[:])) {
+			return ErrRootMismatch
+		}
+	}
+	if auth.Config == nil {
+		return nil
+	}
+	saved, err := auth.Config.Get(RootCertFile)
+	if err != nil || saved == nil {
+		return nil
+	}
+	b, _ := pem.Decode(saved)
+	if b == nil || !bytes.Equal(b.Bytes, root.Raw) {
+		return ErrRootMismatch
+	}
+	return nil
+}
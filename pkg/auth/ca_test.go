@@ -0,0 +1,130 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/confstore"
+)
+
+// memConf returns an in-memory store with the initial configs.
+func memConf(kv map[string][]byte) *confstore.MemStore {
+	ms := confstore.NewMemStore()
+	for k, v := range kv {
+		ms.Set(k, v)
+	}
+	return ms
+}
+
+// confData returns a saved config, nil if missing.
+func confData(cs ConfStore, name string) []byte {
+	d, _ := cs.Get(name)
+	return d
+}
+
+func TestCA(t *testing.T) {
+	caConf := confstore.NewMemStore()
+	caAuth := NewAuth(caConf, "ca", "m.webinf.info")
+	ca, err := caAuth.InitCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Reload from the ConfStore
+	ca2, err := NewAuth(caConf, "ca", "m.webinf.info").InitCA()
+	if err != nil || !ca2.Cert.Equal(ca.Cert) {
+		t.Fatal("Root not persisted", err)
+	}
+
+	memberConf := confstore.NewMemStore()
+	member := NewAuth(memberConf, "member", "m.webinf.info")
+	guest := NewAuth(nil, "guest", "m.webinf.info")
+	caAuth.AddAuthorized(member.Pub, "user,"+RoleMember)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ca/sign", ca.HandleCSR)
+	srv := httptest.NewUnstartedServer(mux)
+	srv.TLS = caAuth.GenerateTLSConfigServer()
+	srv.TLS.ClientAuth = tls.RequireAnyClientCert
+	srv.StartTLS()
+	defer srv.Close()
+
+	client := func(a *Auth) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: a.GenerateTLSConfigClient()}}
+	}
+
+	if _, err := guest.RequestCert(client(guest), srv.URL+"/ca/sign"); err == nil {
+		t.Error("Unauthorized CSR signed")
+	}
+
+	leaf, err := member.RequestCert(client(member), srv.URL+"/ca/sign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(leaf.IPAddresses) != 1 || !leaf.IPAddresses[0].Equal(member.VIP6) {
+		t.Error("Missing VIP6 SAN", leaf.IPAddresses)
+	}
+	if leaf.NotAfter.Sub(leaf.NotBefore) > ca.CertTTL {
+		t.Error("Cert not short lived", leaf.NotAfter)
+	}
+
+	// Both the CA and the member trust the root.
+	for _, a := range []*Auth{caAuth, member} {
+		_, err = leaf.Verify(x509.VerifyOptions{Roots: a.GetRoots(), CurrentTime: time.Now(),
+			KeyUsages: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}})
+		if err != nil {
+			t.Error("Cert not trusted", a.Name, err)
+		}
+	}
+
+	// Chain is loaded on restart
+	reloaded := NewAuth(memberConf, "member", "m.webinf.info")
+	if len(reloaded.tlsCerts[0].Certificate) != 2 {
+		t.Error("Chain not loaded")
+	}
+
+	// Cert for another key is rejected
+	if _, err := guest.SetCertChain(confData(memberConf, CertChainFile)); err == nil {
+		t.Error("Accepted chain for other key")
+	}
+	if leaf.KeyUsage&x509.KeyUsageKeyEncipherment != 0 {
+		t.Error("Key encipherment on EC cert")
+	}
+
+	// The saved root is not replaced by another CA.
+	other, err := NewAuth(nil, "other", "m.webinf.info").InitCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	csr, _ := member.CSR()
+	otherChain, err := other.SignCSR(csr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := member.SetCertChain(otherChain); err != ErrRootMismatch {
+		t.Error("Replaced the saved root", err)
+	}
+
+	// Pinned root.
+	h := sha256.Sum256(ca.Cert.Raw)
+	pinned := NewAuth(confstore.NewMemStore(), "member", "m.webinf.info")
+	pinned.CARoot = hex.EncodeToString(h[:])
+	csr, _ = pinned.CSR()
+	chain, _ := ca.SignCSR(csr)
+	if _, err := pinned.SetCertChain(chain); err != nil {
+		t.Error("Pinned root rejected", err)
+	}
+	pinned = NewAuth(confstore.NewMemStore(), "member", "m.webinf.info")
+	pinned.CARoot = hex.EncodeToString(h[:])
+	csr, _ = pinned.CSR()
+	chain, _ = other.SignCSR(csr)
+	if _, err := pinned.SetCertChain(chain); err != ErrRootMismatch {
+		t.Error("Accepted root not matching the pin", err)
+	}
+}
@@ -0,0 +1,275 @@
+package auth
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encryption at rest for the private keys saved in the ConfStore.
+//
+// Keys are encrypted with AES-256-GCM, using a key derived from a KEK. The KEK
+// is a random secret - derived with HKDF - or a passphrase, stretched with
+// scrypt. It is loaded from the environment, never from the ConfStore:
+//
+// - KEK: base64 encoded random secret, at least 32 bytes.
+// - KEY_PASSPHRASE: passphrase.
+// - KEK_FD: file descriptor to read the passphrase from - the Android app or a
+// parent process can pass it without exposing it in the environment.
+//
+// Encrypted keys are saved in PEM format, with the KDF and salt as headers, and
+// are decrypted transparently on load. Plain keys are still loaded, and can be
+// encrypted with MigrateKeys.
+
+const (
+	encryptedKeyType = "DMESH ENCRYPTED PRIVATE KEY"
+
+	kdfHKDF   = "hkdf-sha256"
+	kdfScrypt = "scrypt"
+
+	kekMinSize = 32
+)
+
+var (
+	ErrKeyEncrypted = errors.New("auth: private key is encrypted, KEK required")
+	ErrNoKEK        = errors.New("auth: no KEK configured")
+	ErrKeyDecrypt   = errors.New("auth: can't decrypt private key, wrong KEK")
+)
+
+// KEK is the key encryption key, protecting the private keys at rest.
+type KEK struct {
+	secret []byte
+
+	// Passphrases are stretched with scrypt, random secrets use HKDF.
+	passphrase bool
+}
+
+// NewKEK returns a KEK from a random secret, at least 32 bytes.
+func NewKEK(secret []byte) (*KEK, error) {
+	if len(secret) < kekMinSize {
+		return nil, errors.New("auth: KEK must have at least 32 bytes")
+	}
+	return &KEK{secret: secret}, nil
+}
+
+// NewPassphraseKEK returns a KEK from a passphrase.
+func NewPassphraseKEK(p string) *KEK {
+	return &KEK{secret: []byte(p), passphrase: true}
+}
+
+// LoadKEK loads the KEK from the KEK, KEY_PASSPHRASE or KEK_FD env variables.
+// Returns nil if none is set. The passphrase read from KEK_FD is cached - the
+// file descriptor is closed after the first read.
+func LoadKEK() (*KEK, error) {
+	if k := os.Getenv("KEK"); k != "" {
+		secret, err := base64.StdEncoding.DecodeString(k)
+		if err != nil {
+			return nil, err
+		}
+		return NewKEK(secret)
+	}
+	if p := os.Getenv("KEY_PASSPHRASE"); p != "" {
+		return NewPassphraseKEK(p), nil
+	}
+	if fds := os.Getenv("KEK_FD"); fds != "" {
+		kekFDMutex.Lock()
+		defer kekFDMutex.Unlock()
+		if kek := kekFD[fds]; kek != nil {
+			return kek, nil
+		}
+		fd, err := strconv.Atoi(fds)
+		if err != nil {
+			return nil, err
+		}
+		f := os.NewFile(uintptr(fd), "kek")
+		if f == nil {
+			return nil, errors.New("auth: invalid KEK_FD")
+		}
+		defer f.Close()
+		p, err := ioutil.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		kek := NewPassphraseKEK(strings.TrimRight(string(p), "\r\n"))
+		kekFD[fds] = kek
+		return kek, nil
+	}
+	return nil, nil
+}
+
+var (
+	kekFDMutex sync.Mutex
+	// kekFD has the KEKs read from KEK_FD, by fd.
+	kekFD = map[string]*KEK{}
+)
+
+func (k *KEK) aead(kdf string, salt []byte) (cipher.AEAD, error) {
+	var key []byte
+	var err error
+	switch kdf {
+	case kdfScrypt:
+		key, err = scrypt.Key(k.secret, salt, 1<<15, 8, 1, 32)
+	case kdfHKDF:
+		key = make([]byte, 32)
+		_, err = io.ReadFull(hkdf.New(sha256.New, k.secret, salt, []byte(encryptedKeyType)), key)
+	default:
+		err = errors.New("auth: unknown key KDF " + kdf)
+	}
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Encrypt returns the encrypted PEM for a private key PEM.
+func (k *KEK) Encrypt(keyPEM []byte) ([]byte, error) {
+	kdf := kdfHKDF
+	if k.passphrase {
+		kdf = kdfScrypt
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(kdf, salt)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type: encryptedKeyType,
+		Headers: map[string]string{
+			"KDF":  kdf,
+			"Salt": base64.StdEncoding.EncodeToString(salt),
+		},
+		Bytes: aead.Seal(nonce, nonce, keyPEM, nil),
+	}), nil
+}
+
+// Decrypt returns the private key PEM. Data that is not encrypted is returned
+// unchanged.
+func (k *KEK) Decrypt(data []byte) ([]byte, error) {
+	if !IsEncryptedKey(data) {
+		return data, nil
+	}
+	if k == nil {
+		return nil, ErrKeyEncrypted
+	}
+	b, _ := pem.Decode(data)
+	salt, err := base64.StdEncoding.DecodeString(b.Headers["Salt"])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := k.aead(b.Headers["KDF"], salt)
+	if err != nil {
+		return nil, err
+	}
+	ns := aead.NonceSize()
+	if len(b.Bytes) < ns {
+		return nil, errors.New("auth: invalid encrypted key")
+	}
+	plain, err := aead.Open(nil, b.Bytes[:ns], b.Bytes[ns:], nil)
+	if err != nil {
+		return nil, ErrKeyDecrypt
+	}
+	return plain, nil
+}
+
+// IsEncryptedKey returns true if the data is an encrypted private key.
+func IsEncryptedKey(data []byte) bool {
+	b, _ := pem.Decode(data)
+	return b != nil && b.Type == encryptedKeyType
+}
+
+// getPrivate loads a private key PEM from the ConfStore, decrypting it if needed.
+// If the key can't be decrypted, the keys are locked: generated keys are not
+// saved, to not replace the encrypted keys.
+func (auth *Auth) getPrivate(name string) ([]byte, error) {
+	data, err := auth.Config.Get(name)
+	if err != nil || data == nil {
+		return data, err
+	}
+	plain, err := auth.KEK.Decrypt(data)
+	if err != nil {
+		auth.keysLocked = true
+	}
+	return plain, err
+}
+
+// setPrivate saves a private key PEM, encrypted if a KEK is configured.
+func (auth *Auth) setPrivate(name string, keyPEM []byte) error {
+	if auth.keysLocked {
+		return ErrKeyEncrypted
+	}
+	if auth.KEK != nil {
+		enc, err := auth.KEK.Encrypt(keyPEM)
+		if err != nil {
+			return err
+		}
+		keyPEM = enc
+	}
+	return auth.Config.Set(name, keyPEM)
+}
+
+// privateKeyFiles are the private keys managed by Auth.
+func privateKeyFiles() []string {
+	res := []string{caKeyFile}
+	for _, kt := range []string{KeyEC256, KeyED25519, KeyRSA} {
+		kf, _ := keyFiles(kt)
+		res = append(res, kf)
+	}
+	return res
+}
+
+// MigrateKeys re-saves the private keys in the ConfStore: encrypted with the KEK
+// if encrypt is set, otherwise in plain text. Returns the number of keys
+// changed. Decrypting requires the KEK of the existing keys.
+func (auth *Auth) MigrateKeys(encrypt bool) (int, error) {
+	if encrypt && auth.KEK == nil {
+		return 0, ErrNoKEK
+	}
+	n := 0
+	for _, name := range privateKeyFiles() {
+		data, err := auth.Config.Get(name)
+		if err != nil {
+			return n, err
+		}
+		if data == nil || IsEncryptedKey(data) == encrypt {
+			continue
+		}
+		plain, err := auth.KEK.Decrypt(data)
+		if err != nil {
+			return n, err
+		}
+		if encrypt {
+			err = auth.setPrivate(name, plain)
+		} else {
+			err = auth.Config.Set(name, plain)
+		}
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
@@ -0,0 +1,187 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+)
+
+// Primary key types.
+//
+// The primary key is the identity of the node: the VIP is derived from it, and it
+// is used for TLS, SSH and signing messages. EC256 is the default - other types
+// are useful for interop: RSA for Istio and dropbear, ED25519 for IoT/arduino.
+// The gateway (see UGateConfig) only supports EC256, a node with another key type
+// would have different VIPs for wpgate and ugate.
+//
+// An EC256 key is always present (EC256PrivateKey), since Webpush encryption and
+// VAPID require it. For EC256 nodes it is the same as the primary key.
+//
+// Keys are saved in the ConfStore as PEM: ec-key.pem/ec-cert.pem, and for other
+// primary types ed-key.pem/ed-cert.pem or rsa-key.pem/rsa-cert.pem (PKCS8).
+const (
+	KeyEC256   = "ec256"
+	KeyED25519 = "ed25519"
+	KeyRSA     = "rsa"
+)
+
+// RSAKeySize is the size of generated RSA primary keys.
+var RSAKeySize = 2048
+
+var errKeyType = errors.New("auth: unsupported key type")
+
+// keyFiles returns the ConfStore names for the key and cert of a key type.
+func keyFiles(kt string) (string, string) {
+	switch kt {
+	case KeyED25519:
+		return "ed-key.pem", "ed-cert.pem"
+	case KeyRSA:
+		return "rsa-key.pem", "rsa-cert.pem"
+	}
+	return "ec-key.pem", "ec-cert.pem"
+}
+
+// certKeyUsage returns the x509 key usage for certificates of the public key.
+// Key encipherment is only valid for RSA - EC and ED25519 keys only sign.
+func certKeyUsage(pub crypto.PublicKey) x509.KeyUsage {
+	if _, ok := pub.(*rsa.PublicKey); ok {
+		return x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	}
+	return x509.KeyUsageDigitalSignature
+}
+
+// keyType returns the key type of a private or public key.
+func keyType(k interface{}) string {
+	switch k.(type) {
+	case ed25519.PrivateKey, ed25519.PublicKey:
+		return KeyED25519
+	case *rsa.PrivateKey, *rsa.PublicKey:
+		return KeyRSA
+	}
+	return KeyEC256
+}
+
+// generateKey creates a new private key of the given type.
+func generateKey(kt string) (crypto.Signer, error) {
+	switch kt {
+	case KeyED25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	case KeyRSA:
+		return rsa.GenerateKey(rand.Reader, RSAKeySize)
+	case KeyEC256, "":
+		return ecdsa.GenerateKey(Curve256, rand.Reader)
+	}
+	return nil, errKeyType
+}
+
+// marshalPrivate returns the PEM encoding of a private key. EC256 keys use the
+// "EC PRIVATE KEY" format, for compatibility with existing files.
+func marshalPrivate(k crypto.Signer) []byte {
+	if ec, ok := k.(*ecdsa.PrivateKey); ok {
+		ecb, _ := x509.MarshalECPrivateKey(ec)
+		return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: ecb})
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(k)
+	if err != nil {
+		return nil
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// setEC256 sets the EC256 key, used for Webpush and VAPID.
+func (auth *Auth) setEC256(pk *ecdsa.PrivateKey) {
+	auth.EC256PrivateKey = pk
+	auth.EC256Pub = elliptic.Marshal(Curve256, pk.X, pk.Y) // starts with 0x04 == uncompressed curve
+	d := pk.D.Bytes()
+	auth.Priv = make([]byte, 32)
+	copy(auth.Priv[32-len(d):], d)
+}
+
+// setPrimary sets the primary key and the identity derived from it.
+func (auth *Auth) setPrimary(k crypto.Signer) {
+	auth.PrivateKey = k
+	auth.KeyType = keyType(k)
+	auth.Pub = KeyBytes(k.Public())
+	auth.PubKey = base64.RawURLEncoding.EncodeToString(auth.Pub)
+	auth.VIP6 = Pub2VIP(auth.Pub)
+}
+
+// loadKeyPair loads a key and cert of the given type from the ConfStore.
+func (auth *Auth) loadKeyPair(kt string) (*tls.Certificate, error) {
+	kf, cf := keyFiles(kt)
+	keyPEM, err := auth.getPrivate(kf)
+	if err != nil {
+		return nil, err
+	}
+	certPEM, err := auth.Config.Get(cf)
+	if err != nil {
+		return nil, err
+	}
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	if keyType(tlsCert.PrivateKey) != kt {
+		return nil, errKeyType
+	}
+	return &tlsCert, nil
+}
+
+// SigSize returns the size of signatures created by Sign: 64 bytes for EC256 and
+// ED25519, the modulus size for RSA.
+func (auth *Auth) SigSize() int {
+	if k, ok := auth.PrivateKey.(*rsa.PrivateKey); ok {
+		return k.Size()
+	}
+	return 64
+}
+
+// SSHSigner returns a signer for the primary key, for use as SSH host or client key.
+func (auth *Auth) SSHSigner() (ssh.Signer, error) {
+	return ssh.NewSignerFromKey(auth.PrivateKey)
+}
+
+// SSHPublicKey returns the primary key in authorized_keys format, with the comment.
+func (auth *Auth) SSHPublicKey(comment string) string {
+	return sshAuthorizedLine(auth.PrivateKey.Public(), comment)
+}
+
+func sshAuthorizedLine(k crypto.PublicKey, comment string) string {
+	sk, err := ssh.NewPublicKey(k)
+	if err != nil {
+		return ""
+	}
+	l := strings.TrimSpace(string(ssh.MarshalAuthorizedKey(sk)))
+	if comment != "" {
+		l = l + " " + comment
+	}
+	return l
+}
+
+// PubKeyFromBytes converts a marshalled public key - as returned by KeyBytes - to
+// a crypto.PublicKey.
+func PubKeyFromBytes(pub []byte) (crypto.PublicKey, error) {
+	switch {
+	case len(pub) == ed25519.PublicKeySize:
+		return ed25519.PublicKey(pub), nil
+	case len(pub) == 65 && pub[0] == 4:
+		x, y := elliptic.Unmarshal(Curve256, pub)
+		if x == nil {
+			return nil, errors.New("Invalid public key")
+		}
+		return &ecdsa.PublicKey{Curve: Curve256, X: x, Y: y}, nil
+	}
+	return x509.ParsePKCS1PublicKey(pub)
+}
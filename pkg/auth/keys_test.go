@@ -0,0 +1,216 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	uauth "github.com/costinm/ugate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/confstore"
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+	"golang.org/x/crypto/ssh"
+)
+
+func TestKeyTypes(t *testing.T) {
+	confs := map[string]*confstore.MemStore{}
+	nodes := map[string]*Auth{}
+	for _, kt := range []string{KeyEC256, KeyED25519, KeyRSA} {
+		confs[kt] = memConf(map[string][]byte{"KEY_TYPE": []byte(kt)})
+		a := NewAuth(confs[kt], kt, "m.webinf.info")
+		nodes[kt] = a
+
+		if a.KeyType != kt || keyType(a.PrivateKey) != kt {
+			t.Fatal("Unexpected key type", kt, a.KeyType)
+		}
+		if !a.VIP6.Equal(Pub2VIP(KeyBytes(a.Leaf().PublicKey))) {
+			t.Error("Cert not using the primary key", kt)
+		}
+		if len(a.EC256Pub) != 65 || a.EC256PrivateKey == nil {
+			t.Error("Missing EC256 key", kt)
+		}
+
+		// Reload from the ConfStore - same identity
+		r := NewAuth(confs[kt], kt, "m.webinf.info")
+		if !r.VIP6.Equal(a.VIP6) || !bytes.Equal(r.EC256Pub, a.EC256Pub) {
+			t.Error("Key not persisted", kt)
+		}
+
+		// Webpush uses the EC256 key
+		sub := a.NewSubscription("")
+		enc, err := Encrypt(sub, []byte("hi"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d, err := a.Decrypt(sub, enc); err != nil || string(d) != "hi" {
+			t.Error("Webpush decrypt failed", kt, err)
+		}
+	}
+
+	t.Run("sign", func(t *testing.T) {
+		for kt, a := range nodes {
+			data := []byte("data")
+			sig := make([]byte, a.SigSize())
+			a.Sign(data, sig)
+			if err := Verify(data, a.Pub, sig); err != nil {
+				t.Error("Verify failed", kt, err)
+			}
+			if err := Verify([]byte("other"), a.Pub, sig); err == nil {
+				t.Error("Verified wrong data", kt)
+			}
+			for kt2, b := range nodes {
+				if kt2 != kt && Verify(data, b.Pub, sig) == nil {
+					t.Error("Verified with wrong key", kt, kt2)
+				}
+			}
+		}
+	})
+
+	t.Run("via", func(t *testing.T) {
+		ec, ed, rsa := nodes[KeyEC256], nodes[KeyED25519], nodes[KeyRSA]
+		dst := NewAuth(nil, "dst", "m.webinf.info")
+
+		m := &webpush.WebpushMessage{Id: "1", From: ed.Self(), Data: []byte("hi")}
+		ed.SignVia(m, "q", dst.Self(), rsa.Self())
+		rsa.SignVia(m, "q", dst.Self(), ec.Self())
+		ec.SignVia(m, "q", dst.Self(), dst.Self())
+		p, err := dst.VerifyPath(m, "q", dst.Self(), 0)
+		if err != nil || len(p) != 3 {
+			t.Fatal("Mixed path failed", err, p)
+		}
+		m.Data = []byte("changed")
+		if _, err := dst.VerifyPath(m, "q", dst.Self(), 0); err != ErrForged {
+			t.Error("Expected forged", err)
+		}
+	})
+
+	t.Run("tls", func(t *testing.T) {
+		for skt, srvAuth := range nodes {
+			var peer net.IP
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				peer = Pub2VIP(KeyBytes(r.TLS.PeerCertificates[0].PublicKey))
+			}))
+			cfg := srvAuth.GenerateTLSConfigServer()
+			cfg.ClientAuth = tls.RequireAnyClientCert
+			srv.Listener = tls.NewListener(srv.Listener, cfg)
+			srv.Start()
+
+			for ckt, clientAuth := range nodes {
+				hc := &http.Client{Transport: &http.Transport{TLSClientConfig: clientAuth.GenerateTLSConfigClient()}}
+				res, err := hc.Get("https://" + srv.Listener.Addr().String())
+				if err != nil {
+					t.Error("TLS failed", ckt, skt, err)
+					continue
+				}
+				res.Body.Close()
+				if !peer.Equal(clientAuth.VIP6) {
+					t.Error("Unexpected client identity", ckt, skt, peer)
+				}
+				if !Pub2VIP(KeyBytes(res.TLS.PeerCertificates[0].PublicKey)).Equal(srvAuth.VIP6) {
+					t.Error("Unexpected server identity", ckt, skt)
+				}
+			}
+			srv.Close()
+		}
+	})
+
+	t.Run("ssh", func(t *testing.T) {
+		vipOf := func(k ssh.PublicKey) net.IP {
+			return Pub2VIP(KeyBytes(k.(ssh.CryptoPublicKey).CryptoPublicKey()))
+		}
+		for skt, srvAuth := range nodes {
+			for ckt, clientAuth := range nodes {
+				hostKey, err := srvAuth.SSHSigner()
+				if err != nil {
+					t.Fatal(err)
+				}
+				scfg := &ssh.ServerConfig{
+					PublicKeyCallback: func(c ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+						if !vipOf(k).Equal(clientAuth.VIP6) {
+							return nil, errors.New("unexpected client")
+						}
+						return &ssh.Permissions{}, nil
+					},
+				}
+				scfg.AddHostKey(hostKey)
+
+				signer, err := clientAuth.SSHSigner()
+				if err != nil {
+					t.Fatal(err)
+				}
+				ccfg := &ssh.ClientConfig{
+					User: "test",
+					Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+					HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+						if !vipOf(k).Equal(srvAuth.VIP6) {
+							return errors.New("unexpected host")
+						}
+						return nil
+					},
+				}
+
+				l, err := net.Listen("tcp", "127.0.0.1:0")
+				if err != nil {
+					t.Fatal(err)
+				}
+				go func() {
+					sc, err := l.Accept()
+					if err != nil {
+						return
+					}
+					if conn, _, _, err := ssh.NewServerConn(sc, scfg); err == nil {
+						conn.Close()
+					}
+					sc.Close()
+				}()
+				conn, err := ssh.Dial("tcp", l.Addr().String(), ccfg)
+				l.Close()
+				if err != nil {
+					t.Error("SSH failed", ckt, skt, err)
+					continue
+				}
+				conn.Close()
+			}
+		}
+	})
+
+	// authorized_keys round trip for all key types
+	ca := NewAuth(confstore.NewMemStore(), "ca", "m.webinf.info")
+	for kt, a := range nodes {
+		ca.AddAuthorized(a.Pub, "role-"+kt)
+	}
+	reloaded := NewAuth(ca.Config, "ca", "m.webinf.info")
+	for kt, a := range nodes {
+		if reloaded.Auth(a.Pub, "") != "role-"+kt {
+			t.Error("Authorized key not saved", kt)
+		}
+	}
+}
+
+func TestUGateConfig(t *testing.T) {
+	secret := make([]byte, 32)
+	rand.Read(secret)
+	os.Setenv("KEK", base64.StdEncoding.EncodeToString(secret))
+	defer os.Unsetenv("KEK")
+
+	conf := confstore.NewMemStore()
+	a := NewAuth(conf, "node", "m.webinf.info")
+	ua := uauth.NewAuth(a.UGateConfig(conf), "node", "m.webinf.info")
+	if !bytes.Equal(ua.Pub, a.Pub) || !ua.VIP6.Equal(a.VIP6) {
+		t.Error("ugate auth not using the node key", ua.VIP6, a.VIP6)
+	}
+	if confData(conf, ugateKubeConfig) != nil {
+		t.Error("Plain text key saved for ugate")
+	}
+
+	ed := NewAuthWithKeyType(confstore.NewMemStore(), "node", "m.webinf.info", KeyED25519)
+	if _, err := ed.UGateConfig(confstore.NewMemStore()).Get(ugateKubeConfig); err != ErrUGateKeyType {
+		t.Error("Expected key type error", err)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"net"
+	"sort"
+)
+
+// Pinning of server keys, SSH known_hosts style.
+//
+// Mesh certificates are self-signed, the host name is not trusted - only the
+// public key. The key of a host is pinned in known_hosts, or recorded in
+// known_hosts.save the first time the host is seen (TOFU). A different key for
+// a known host is rejected.
+//
+// Hosts using a mesh address are verified against the VIP derived from the key.
+//
+// Keys are pinned per host and port, "[host]:port" as in known_hosts - nodes on
+// the same host use different ports.
+
+// KnownHostsSaveFile is the ConfStore name of the keys trusted on first use.
+const KnownHostsSaveFile = "known_hosts.save"
+
+// knownPort is the port used for the known_hosts.save entries of hosts
+// checked without a port.
+const knownPort = "5222"
+
+var (
+	ErrKeyMismatch = errors.New("auth: host key mismatch")
+	ErrUnknownHost = errors.New("auth: unknown host")
+)
+
+// KnownHost returns the pinned key of a host:port, or nil. The port defaults to
+// knownPort.
+func (auth *Auth) KnownHost(host string) *AuthzInfo {
+	auth.knownMutex.RLock()
+	defer auth.knownMutex.RUnlock()
+	return auth.Known[knownHostKey(knownHostName(host), knownHostPort(host))]
+}
+
+// CheckKnownHost verifies the public key - in KeyBytes format - presented by
+// host, which may include a port. If the host is not known and TOFU is set,
+// the key is saved and trusted for the next connections.
+func (auth *Auth) CheckKnownHost(host string, pub []byte) error {
+	if len(pub) == 0 {
+		return ErrKeyMismatch
+	}
+	if auth.IsRevoked(pub) {
+		return ErrRevoked
+	}
+	host, port := knownHostName(host), knownHostPort(host)
+
+	// Mesh addresses are derived from the key.
+	if ip := net.ParseIP(host); ip != nil && len(ip) == net.IPv6len &&
+		bytes.Equal(ip[0:8], MESH_NETWORK) {
+		if !Pub2VIP(pub).Equal(ip) {
+			return ErrKeyMismatch
+		}
+		return nil
+	}
+
+	key := knownHostKey(host, port)
+	auth.knownMutex.Lock()
+	if ai := auth.Known[key]; ai != nil {
+		auth.knownMutex.Unlock()
+		if !bytes.Equal(ai.Public, pub) {
+			log.Println("Host key mismatch ", key, Pub2VIP(pub), Pub2VIP(ai.Public))
+			return ErrKeyMismatch
+		}
+		return nil
+	}
+	if !auth.TOFU || host == "" {
+		auth.knownMutex.Unlock()
+		return ErrUnknownHost
+	}
+	pk, err := PubKeyFromBytes(pub)
+	if err != nil {
+		auth.knownMutex.Unlock()
+		return err
+	}
+	auth.Known[key] = &AuthzInfo{
+		Role:   host,
+		Key:    pk,
+		Public: pub,
+		Opts:   map[string]string{"port": port},
+	}
+	data := auth.knownHostsSave()
+	auth.knownMutex.Unlock()
+
+	log.Println("Known host ", key, Pub2VIP(pub))
+	if auth.Config != nil {
+		auth.Config.Set(KnownHostsSaveFile, data)
+	}
+	return nil
+}
+
+// knownHostsSave returns the known hosts in known_hosts format, sorted by host.
+// Called with knownMutex held.
+func (auth *Auth) knownHostsSave() []byte {
+	hosts := make([]string, 0, len(auth.Known))
+	for h := range auth.Known {
+		hosts = append(hosts, h)
+	}
+	sort.Strings(hosts)
+	bw := bytes.Buffer{}
+	for _, h := range hosts {
+		if l := sshAuthorizedLine(auth.Known[h].Key, ""); l != "" {
+			bw.WriteString(h + " " + l + "\n")
+		}
+	}
+	return bw.Bytes()
+}
+
+// knownHostKey returns the Known key of a host and port - the known_hosts
+// format, "[host]:port", or host for port 22.
+func knownHostKey(host, port string) string {
+	if port == "22" {
+		return host
+	}
+	return "[" + host + "]:" + port
+}
+
+func knownHostName(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+func knownHostPort(host string) string {
+	if _, p, err := net.SplitHostPort(host); err == nil {
+		return p
+	}
+	return knownPort
+}
@@ -0,0 +1,91 @@
+package auth
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestKnownHosts(t *testing.T) {
+	alice := NewAuth(nil, "alice", "m.webinf.info")
+	bob := NewAuth(nil, "bob", "m.webinf.info")
+	pinned := NewAuth(nil, "pinned", "m.webinf.info")
+
+	conf := memConf(map[string][]byte{
+		"known_hosts": []byte("[pinned.m.webinf.info]:5222 " + pinned.SSHPublicKey("") + "\n"),
+	})
+	node := NewAuth(conf, "node", "m.webinf.info")
+	if node.KnownHost("pinned.m.webinf.info") == nil {
+		t.Fatal("known_hosts not loaded")
+	}
+
+	if err := node.CheckKnownHost("pinned.m.webinf.info:5222", pinned.Pub); err != nil {
+		t.Error("Pinned key rejected", err)
+	}
+	if err := node.CheckKnownHost("pinned.m.webinf.info", alice.Pub); err != ErrKeyMismatch {
+		t.Error("Expected mismatch", err)
+	}
+
+	// First use
+	if err := node.CheckKnownHost("alice.example.com:5222", alice.Pub); err != nil {
+		t.Fatal("TOFU failed", err)
+	}
+	if err := node.CheckKnownHost("alice.example.com", bob.Pub); err != ErrKeyMismatch {
+		t.Error("Expected mismatch after first use", err)
+	}
+
+	// Mesh address matches the key
+	if err := node.CheckKnownHost(net.JoinHostPort(bob.VIP6.String(), "5222"), bob.Pub); err != nil {
+		t.Error("VIP rejected", err)
+	}
+	if err := node.CheckKnownHost(bob.VIP6.String(), alice.Pub); err != ErrKeyMismatch {
+		t.Error("Expected VIP mismatch", err)
+	}
+	if node.KnownHost(bob.VIP6.String()) != nil {
+		t.Error("VIP should not be saved")
+	}
+
+	// Saved with the dialed port.
+	if err := node.CheckKnownHost("127.0.0.1:8443", bob.Pub); err != nil {
+		t.Fatal("TOFU failed for IP", err)
+	}
+
+	// Two nodes on the same host, with different ports.
+	if err := node.CheckKnownHost("127.0.0.1:8444", alice.Pub); err != nil {
+		t.Fatal("Second node on the host rejected", err)
+	}
+	if err := node.CheckKnownHost("127.0.0.1:8443", alice.Pub); err != ErrKeyMismatch {
+		t.Error("Expected mismatch for the port", err)
+	}
+
+	// Persisted in known_hosts.save
+	if !strings.Contains(string(confData(conf, KnownHostsSaveFile)), "[127.0.0.1]:8443 ") {
+		t.Error("Port not saved", string(confData(conf, KnownHostsSaveFile)))
+	}
+	reloaded := NewAuth(conf, "node", "m.webinf.info")
+	if ai := reloaded.KnownHost("alice.example.com"); ai == nil || string(ai.Public) != string(alice.Pub) {
+		t.Error("First seen key not saved")
+	}
+	if err := reloaded.CheckKnownHost("127.0.0.1:8443", alice.Pub); err != ErrKeyMismatch {
+		t.Error("Expected mismatch for saved IP", err)
+	}
+	if err := reloaded.CheckKnownHost("127.0.0.1:8444", alice.Pub); err != nil {
+		t.Error("Saved key rejected for the second port", err)
+	}
+
+	// Without TOFU unknown hosts are rejected.
+	conf.Set("TOFU", []byte("OFF"))
+	strict := NewAuth(conf, "node", "m.webinf.info")
+	if err := strict.CheckKnownHost("bob.example.com", bob.Pub); err != ErrUnknownHost {
+		t.Error("Expected unknown host", err)
+	}
+	if err := strict.CheckKnownHost("alice.example.com", alice.Pub); err != nil {
+		t.Error("Saved key rejected", err)
+	}
+
+	// Revoked keys are rejected even if pinned.
+	node.Revoke(pinned.Pub, "test")
+	if err := node.CheckKnownHost("pinned.m.webinf.info", pinned.Pub); err != ErrRevoked {
+		t.Error("Expected revoked", err)
+	}
+}
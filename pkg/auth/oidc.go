@@ -0,0 +1,473 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JWT bearer tokens, issued by a trusted OIDC issuer.
+//
+// Kubernetes service account tokens, Istio and other OIDC tokens can be used
+// instead of VAPID or mTLS. The trusted issuers are loaded from the oidc.json
+// ConfStore file. The signing keys are fetched from the JWKS URL - explicit or
+// found with OIDC discovery - and refreshed when a token uses an unknown kid.
+//
+// Example:
+//
+//  [{"issuer": "https://kubernetes.default.svc.cluster.local",
+//    "audiences": ["dmesh"],
+//    "role_claim": "kubernetes.io.namespace",
+//    "roles": {"istio-system": "admin"},
+//    "role": "member"}]
+
+// OIDCFile is the ConfStore name of the trusted issuers.
+const OIDCFile = "oidc.json"
+
+const (
+	// Allowed clock skew for exp and nbf.
+	jwtSkew = 1 * time.Minute
+
+	// Minimum time between JWKS fetches for unknown kids.
+	jwksRefresh = 1 * time.Minute
+)
+
+var (
+	ErrBearerInvalid  = errors.New("auth: invalid bearer token")
+	ErrBearerExpired  = errors.New("auth: bearer token expired")
+	ErrBearerIssuer   = errors.New("auth: untrusted token issuer")
+	ErrBearerAudience = errors.New("auth: invalid token audience")
+)
+
+// OIDCIssuer is a trusted token issuer, and the mapping of the claims to the
+// caller identity.
+type OIDCIssuer struct {
+	// Issuer must match the iss claim.
+	Issuer string `json:"issuer"`
+
+	// JWKSURL is the URL of the signing keys. If empty, it is loaded from
+	// Issuer + /.well-known/openid-configuration.
+	JWKSURL string `json:"jwks_uri,omitempty"`
+
+	// Audiences accepted in the aud claim. Required - tokens issued for other
+	// services are rejected.
+	Audiences []string `json:"audiences"`
+
+	// SANClaim is the claim used as caller SAN, default "sub".
+	SANClaim string `json:"san_claim,omitempty"`
+
+	// RoleClaim, if set, is mapped to the caller role using Roles. Nested
+	// claims use ".", for example "kubernetes.io.namespace".
+	RoleClaim string            `json:"role_claim,omitempty"`
+	Roles     map[string]string `json:"roles,omitempty"`
+
+	// Role is used if RoleClaim is not set or not found in Roles - RoleGuest
+	// if empty.
+	Role string `json:"role,omitempty"`
+
+	// Client used to fetch the keys, http.DefaultClient if nil.
+	Client *http.Client `json:"-"`
+
+	mutex   sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// BearerIdentity is the caller identity from a verified token.
+type BearerIdentity struct {
+	Issuer  string
+	Subject string
+	SAN     string
+	Role    string
+
+	Expiry time.Time
+
+	// Claims is the decoded payload.
+	Claims map[string]interface{}
+}
+
+// jwk is a JSON web key - only RSA and EC P-256 keys are used.
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// ParseOIDC parses a list of trusted issuers.
+func ParseOIDC(data []byte) ([]*OIDCIssuer, error) {
+	res := []*OIDCIssuer{}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return nil, err
+	}
+	for _, iss := range res {
+		if iss.Issuer == "" {
+			return nil, errors.New("auth: OIDC issuer missing")
+		}
+		if len(iss.Audiences) == 0 {
+			return nil, errors.New("auth: OIDC audiences missing for " + iss.Issuer)
+		}
+	}
+	return res, nil
+}
+
+// SetIssuers replaces the trusted issuers.
+func (auth *Auth) SetIssuers(issuers []*OIDCIssuer) {
+	auth.oidcMutex.Lock()
+	auth.Issuers = issuers
+	auth.oidcMutex.Unlock()
+}
+
+// loadOIDC loads the trusted issuers, if configured.
+func (auth *Auth) loadOIDC() error {
+	data, err := auth.Config.Get(OIDCFile)
+	if err != nil || data == nil {
+		return err
+	}
+	issuers, err := ParseOIDC(data)
+	if err != nil {
+		log.Println("Invalid OIDC issuers ", err)
+		return err
+	}
+	auth.SetIssuers(issuers)
+	return nil
+}
+
+func (auth *Auth) issuer(iss string) *OIDCIssuer {
+	auth.oidcMutex.RLock()
+	defer auth.oidcMutex.RUnlock()
+	for _, i := range auth.Issuers {
+		if i.Issuer == iss {
+			return i
+		}
+	}
+	return nil
+}
+
+// VerifyBearer verifies a JWT signed by a trusted issuer, and maps the claims
+// to the caller identity. RS256 and ES256 are supported.
+func (auth *Auth) VerifyBearer(token string) (*BearerIdentity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrBearerInvalid
+	}
+	head := struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}{}
+	if err := decodeJWTPart(parts[0], &head); err != nil {
+		return nil, ErrBearerInvalid
+	}
+	claims := map[string]interface{}{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, ErrBearerInvalid
+	}
+	iss, _ := claims["iss"].(string)
+	oi := auth.issuer(iss)
+	if oi == nil {
+		return nil, ErrBearerIssuer
+	}
+	key, err := oi.key(head.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrBearerInvalid
+	}
+	if err := verifyJWTSig(head.Alg, key, parts[0]+"."+parts[1], sig); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtSkew)) {
+		return nil, ErrBearerExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtSkew).Before(time.Unix(int64(nbf), 0)) {
+		return nil, ErrBearerInvalid
+	}
+	if !matchAudience(claims["aud"], oi.Audiences) {
+		return nil, ErrBearerAudience
+	}
+
+	id := &BearerIdentity{
+		Issuer: iss,
+		Expiry: time.Unix(int64(exp), 0),
+		Claims: claims,
+	}
+	id.Subject, _ = claims["sub"].(string)
+	sanClaim := oi.SANClaim
+	if sanClaim == "" {
+		sanClaim = "sub"
+	}
+	id.SAN = claimString(claims, sanClaim)
+	id.Role = oi.Role
+	if oi.RoleClaim != "" {
+		if r, ok := oi.Roles[claimString(claims, oi.RoleClaim)]; ok {
+			id.Role = r
+		}
+	}
+	if id.Role == "" {
+		id.Role = RoleGuest
+	}
+	return id, nil
+}
+
+func decodeJWTPart(p string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(p)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifyJWTSig(alg string, key crypto.PublicKey, signed string, sig []byte) error {
+	h := sha256.Sum256([]byte(signed))
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return ErrBearerInvalid
+		}
+		if rsa.VerifyPKCS1v15(k, crypto.SHA256, h[:], sig) != nil {
+			return ErrBearerInvalid
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return ErrBearerInvalid
+		}
+		r := new(big.Int).SetBytes(sig[:32])
+		s := new(big.Int).SetBytes(sig[32:])
+		if !ecdsa.Verify(k, h[:], r, s) {
+			return ErrBearerInvalid
+		}
+		return nil
+	}
+	return ErrBearerInvalid
+}
+
+// matchAudience checks the aud claim - a string or a list.
+func matchAudience(aud interface{}, allowed []string) bool {
+	var auds []string
+	switch a := aud.(type) {
+	case string:
+		auds = []string{a}
+	case []interface{}:
+		for _, v := range a {
+			if s, ok := v.(string); ok {
+				auds = append(auds, s)
+			}
+		}
+	}
+	for _, a := range auds {
+		for _, w := range allowed {
+			if a == w {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// claimString returns a string claim. Nested claims are separated by ".".
+// For a list, the first element is returned.
+func claimString(claims map[string]interface{}, name string) string {
+	var v interface{} = claims
+	parts := strings.Split(name, ".")
+	for len(parts) > 0 {
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		// Longest match first - claim names may contain ".", like kubernetes.io
+		j := len(parts)
+		for ; j > 0; j-- {
+			if nv, found := m[strings.Join(parts[:j], ".")]; found {
+				v = nv
+				break
+			}
+		}
+		if j == 0 {
+			return ""
+		}
+		parts = parts[j:]
+	}
+	switch s := v.(type) {
+	case string:
+		return s
+	case []interface{}:
+		if len(s) > 0 {
+			r, _ := s[0].(string)
+			return r
+		}
+	}
+	return ""
+}
+
+// key returns the issuer key with the kid, fetching the JWKS if the kid is not
+// known.
+func (oi *OIDCIssuer) key(kid string) (crypto.PublicKey, error) {
+	oi.mutex.Lock()
+	defer oi.mutex.Unlock()
+	if k := oi.findKey(kid); k != nil {
+		return k, nil
+	}
+	if time.Since(oi.fetched) < jwksRefresh {
+		return nil, ErrBearerInvalid
+	}
+	oi.fetched = time.Now()
+	keys, err := oi.fetchKeys()
+	if err != nil {
+		log.Println("OIDC: failed to fetch keys ", oi.Issuer, err)
+		return nil, err
+	}
+	oi.keys = keys
+	if k := oi.findKey(kid); k != nil {
+		return k, nil
+	}
+	return nil, ErrBearerInvalid
+}
+
+// findKey returns the key with the kid. Tokens without kid can use the only key.
+func (oi *OIDCIssuer) findKey(kid string) crypto.PublicKey {
+	if kid == "" && len(oi.keys) == 1 {
+		for _, k := range oi.keys {
+			return k
+		}
+	}
+	return oi.keys[kid]
+}
+
+func (oi *OIDCIssuer) get(url string, v interface{}) error {
+	hc := oi.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Get(url)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("auth: GET %s: %d", url, res.StatusCode)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (oi *OIDCIssuer) fetchKeys() (map[string]crypto.PublicKey, error) {
+	jwksURL := oi.JWKSURL
+	if jwksURL == "" {
+		disc := struct {
+			JWKSURI string `json:"jwks_uri"`
+		}{}
+		err := oi.get(strings.TrimSuffix(oi.Issuer, "/")+"/.well-known/openid-configuration", &disc)
+		if err != nil {
+			return nil, err
+		}
+		if disc.JWKSURI == "" {
+			return nil, errors.New("auth: OIDC discovery without jwks_uri")
+		}
+		jwksURL = disc.JWKSURI
+	}
+	jwks := struct {
+		Keys []*jwk `json:"keys"`
+	}{}
+	if err := oi.get(jwksURL, &jwks); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		pk, err := k.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[k.Kid] = pk
+	}
+	return keys, nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	dec := base64.RawURLEncoding
+	switch k.Kty {
+	case "RSA":
+		n, err := dec.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := dec.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, errors.New("auth: unsupported curve " + k.Crv)
+		}
+		x, err := dec.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := dec.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+	return nil, errors.New("auth: unsupported key type " + k.Kty)
+}
+
+// BearerCredentials adds a bearer token to each gRPC request - it implements
+// grpc credentials.PerRPCCredentials.
+//
+// If File is set, the token is read on each call - K8S projected service
+// account tokens are rotated.
+type BearerCredentials struct {
+	Token string
+	File  string
+}
+
+func (bc *BearerCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	t := bc.Token
+	if bc.File != "" {
+		data, err := ioutil.ReadFile(bc.File)
+		if err != nil {
+			return nil, err
+		}
+		t = strings.TrimSpace(string(data))
+	}
+	return map[string]string{"authorization": "Bearer " + t}, nil
+}
+
+// RequireTransportSecurity returns true - tokens are not sent in plain text.
+func (bc *BearerCredentials) RequireTransportSecurity() bool {
+	return true
+}
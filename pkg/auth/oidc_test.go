@@ -0,0 +1,142 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// signJWT returns a RS256 or ES256 token.
+func signJWT(t *testing.T, kid string, key crypto.Signer, claims map[string]interface{}) string {
+	enc := base64.RawURLEncoding
+	alg := "ES256"
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		alg = "RS256"
+	}
+	head, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := enc.EncodeToString(head) + "." + enc.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+
+	var sig []byte
+	if ek, ok := key.(*ecdsa.PrivateKey); ok {
+		r, s, err := ecdsa.Sign(rand.Reader, ek, h[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig = make([]byte, 64)
+		r.FillBytes(sig[:32])
+		s.FillBytes(sig[32:])
+	} else {
+		var err error
+		sig, err = key.Sign(rand.Reader, h[:], crypto.SHA256)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return signed + "." + enc.EncodeToString(sig)
+}
+
+func TestBearer(t *testing.T) {
+	rk, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ek, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	enc := base64.RawURLEncoding
+
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer, "jwks_uri": issuer + "/keys"})
+	})
+	mux.HandleFunc("/keys", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []*jwk{
+			{Kty: "RSA", Kid: "rsa", N: enc.EncodeToString(rk.N.Bytes()),
+				E: enc.EncodeToString(big.NewInt(int64(rk.E)).Bytes())},
+			{Kty: "EC", Kid: "ec", Crv: "P-256", X: enc.EncodeToString(ek.X.Bytes()),
+				Y: enc.EncodeToString(ek.Y.Bytes())},
+		}})
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	issuer = srv.URL
+
+	conf := memConf(map[string][]byte{
+		OIDCFile: []byte(`[{"issuer": "` + issuer + `", "audiences": ["dmesh"],
+			"role_claim": "kubernetes.io.namespace", "roles": {"istio-system": "admin"},
+			"role": "member"}]`),
+	})
+	a := NewAuth(conf, "node", "m.webinf.info")
+	if len(a.Issuers) != 1 {
+		t.Fatal("Issuers not loaded")
+	}
+
+	exp := time.Now().Add(1 * time.Hour).Unix()
+	claims := func(ns string, aud interface{}) map[string]interface{} {
+		return map[string]interface{}{
+			"iss": issuer, "aud": aud, "exp": exp,
+			"sub":           "system:serviceaccount:" + ns + ":default",
+			"kubernetes.io": map[string]interface{}{"namespace": ns},
+		}
+	}
+
+	id, err := a.VerifyBearer(signJWT(t, "rsa", rk, claims("istio-system", []string{"dmesh"})))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != "admin" || id.SAN != "system:serviceaccount:istio-system:default" {
+		t.Error("Unexpected identity", id)
+	}
+	id, err = a.VerifyBearer(signJWT(t, "ec", ek, claims("default", "dmesh")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.Role != "member" {
+		t.Error("Unexpected role", id.Role)
+	}
+
+	if _, err := a.VerifyBearer(signJWT(t, "ec", ek, claims("default", "other"))); err != ErrBearerAudience {
+		t.Error("Expected audience error", err)
+	}
+	expired := claims("default", "dmesh")
+	expired["exp"] = time.Now().Add(-1 * time.Hour).Unix()
+	if _, err := a.VerifyBearer(signJWT(t, "ec", ek, expired)); err != ErrBearerExpired {
+		t.Error("Expected expired", err)
+	}
+	// Signed with the wrong key
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if _, err := a.VerifyBearer(signJWT(t, "ec", other, claims("default", "dmesh"))); err != ErrBearerInvalid {
+		t.Error("Expected invalid signature", err)
+	}
+	untrusted := claims("default", "dmesh")
+	untrusted["iss"] = "https://example.com"
+	if _, err := a.VerifyBearer(signJWT(t, "ec", ek, untrusted)); err != ErrBearerIssuer {
+		t.Error("Expected untrusted issuer", err)
+	}
+
+	// Issuers without audiences are rejected.
+	if _, err := ParseOIDC([]byte(`[{"issuer": "` + issuer + `"}]`)); err == nil {
+		t.Error("Accepted issuer without audiences")
+	}
+	a.SetIssuers([]*OIDCIssuer{{Issuer: issuer}})
+	if _, err := a.VerifyBearer(signJWT(t, "ec", ek, claims("default", "dmesh"))); err != ErrBearerAudience {
+		t.Error("Expected audience error without audiences", err)
+	}
+
+	var _ credentials.PerRPCCredentials = &BearerCredentials{}
+	md, _ := (&BearerCredentials{Token: "tok"}).GetRequestMetadata(context.Background())
+	if md["authorization"] != "Bearer tok" {
+		t.Error("Unexpected metadata", md)
+	}
+}
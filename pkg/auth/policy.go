@@ -0,0 +1,331 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Role based authorization policy, for HTTP, gRPC, SSH and messages.
+//
+// The policy is loaded from the policy.json ConfStore file - a list of rules,
+// evaluated in order. The first matching rule decides, if no rule matches the
+// default action is used. Without a policy file all requests are allowed, and
+// the transports only apply their built-in checks for guests. A policy file that
+// can't be read or parsed denies all requests.
+//
+// Example:
+//
+//  {"default": "deny", "rules": [
+//    {"action": "allow", "roles": ["admin"]},
+//    {"action": "allow", "roles": ["guest"], "kinds": ["http"], "paths": ["/push/*"]},
+//    {"action": "allow", "roles": ["member"], "kinds": ["ssh"], "hosts": ["[*.svc]:80"]},
+//    {"action": "deny", "vips": ["fd00::/8"], "topics": ["revoke"]}
+//  ]}
+
+// PolicyFile is the ConfStore name of the authorization policy.
+const PolicyFile = "policy.json"
+
+const (
+	PolicyAllow = "allow"
+	PolicyDeny  = "deny"
+
+	// RoleGuest is the role of callers with a key not in authorized_keys.
+	RoleGuest = "guest"
+)
+
+// Kinds of requests checked by the policy.
+const (
+	PolicyHTTP = "http"
+	PolicyGRPC = "grpc"
+	PolicySSH  = "ssh"
+	PolicyMsg  = "msg"
+
+	// PolicySOCKS is checked for SOCKS streams, with the user role and the
+	// destination host.
+	PolicySOCKS = "socks"
+)
+
+var ErrPolicyDenied = errors.New("auth: denied by policy")
+
+// Policy is an ordered list of rules.
+type Policy struct {
+	Rules []*PolicyRule `json:"rules"`
+
+	// Default action if no rule matches - PolicyAllow if empty.
+	Default string `json:"default,omitempty"`
+}
+
+// PolicyRule matches a request if all the non-empty fields match. A list
+// matches if any of the elements match.
+type PolicyRule struct {
+	Name string `json:"name,omitempty"`
+
+	// Action is PolicyAllow or PolicyDeny.
+	Action string `json:"action"`
+
+	// Roles of the caller, "*" for any role.
+	Roles []string `json:"roles,omitempty"`
+
+	// VIPs or CIDR ranges of the caller.
+	VIPs []string `json:"vips,omitempty"`
+
+	// SANs of the caller cert. A trailing "*" matches a prefix.
+	SANs []string `json:"sans,omitempty"`
+
+	// Kinds of request: http, grpc, ssh, msg, socks.
+	Kinds []string `json:"kinds,omitempty"`
+
+	// HTTP paths or gRPC methods. A trailing "*" matches a prefix.
+	Paths []string `json:"paths,omitempty"`
+
+	// HTTP methods or SSH request types.
+	Methods []string `json:"methods,omitempty"`
+
+	// Destination host:port, for SSH forwarding. Same format as known_hosts
+	// patterns: [host]:port, or host for any port.
+	Hosts []string `json:"hosts,omitempty"`
+
+	// Message topics. A trailing "*" matches a prefix.
+	Topics []string `json:"topics,omitempty"`
+
+	nets []*net.IPNet
+}
+
+// PolicyRequest holds the attributes of a request checked by the policy.
+type PolicyRequest struct {
+	Kind string
+
+	// Role of the caller - may be a comma separated list.
+	Role string
+	VIP  net.IP
+	SAN  []string
+
+	// HTTP path or gRPC method.
+	Path string
+
+	// HTTP method, or SSH request type (direct-tcpip, tcpip-forward).
+	Method string
+
+	// Destination host:port.
+	Host string
+
+	Topic string
+}
+
+// ParsePolicy parses a policy in JSON format.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := json.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+	if p.Default != "" && p.Default != PolicyAllow && p.Default != PolicyDeny {
+		return nil, errors.New("auth: invalid policy default " + p.Default)
+	}
+	for _, r := range p.Rules {
+		if r.Action != PolicyAllow && r.Action != PolicyDeny {
+			return nil, errors.New("auth: invalid policy action " + r.Action)
+		}
+		for _, v := range r.VIPs {
+			if !strings.Contains(v, "/") {
+				if strings.Contains(v, ":") {
+					v = v + "/128"
+				} else {
+					v = v + "/32"
+				}
+			}
+			_, n, err := net.ParseCIDR(v)
+			if err != nil {
+				return nil, err
+			}
+			r.nets = append(r.nets, n)
+		}
+	}
+	return p, nil
+}
+
+// Check returns the matching rule and the decision for a request. A nil policy
+// allows all requests.
+func (p *Policy) Check(r *PolicyRequest) (*PolicyRule, bool) {
+	if p == nil {
+		return nil, true
+	}
+	for _, rule := range p.Rules {
+		if rule.match(r) {
+			return rule, rule.Action == PolicyAllow
+		}
+	}
+	return nil, p.Default != PolicyDeny
+}
+
+func (rule *PolicyRule) match(r *PolicyRequest) bool {
+	if len(rule.Kinds) > 0 && !matchAny(rule.Kinds, r.Kind, false) {
+		return false
+	}
+	if len(rule.Roles) > 0 {
+		found := false
+		for _, role := range rule.Roles {
+			if role == "*" || HasRole(r.Role, role) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.nets) > 0 {
+		found := false
+		for _, n := range rule.nets {
+			if r.VIP != nil && n.Contains(r.VIP) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.SANs) > 0 {
+		found := false
+		for _, san := range r.SAN {
+			if matchAny(rule.SANs, san, true) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if len(rule.Paths) > 0 && !matchAny(rule.Paths, r.Path, true) {
+		return false
+	}
+	if len(rule.Methods) > 0 && !matchAny(rule.Methods, r.Method, false) {
+		return false
+	}
+	if len(rule.Hosts) > 0 && (r.Host == "" || !matchHosts(rule.Hosts, r.Host)) {
+		return false
+	}
+	if len(rule.Topics) > 0 && !matchAny(rule.Topics, r.Topic, true) {
+		return false
+	}
+	return true
+}
+
+// matchAny returns true if v is equal to one of the values. If prefix is set,
+// values ending with "*" match a prefix.
+func matchAny(values []string, v string, prefix bool) bool {
+	for _, p := range values {
+		if p == "*" || p == v {
+			return true
+		}
+		if prefix && strings.HasSuffix(p, "*") && strings.HasPrefix(v, p[:len(p)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Authorize checks the request against the policy. Denied requests are logged.
+func (auth *Auth) Authorize(r *PolicyRequest) error {
+	auth.policyMutex.RLock()
+	p := auth.Policy
+	auth.policyMutex.RUnlock()
+
+	rule, ok := p.Check(r)
+	if ok {
+		return nil
+	}
+	name := "default"
+	if rule != nil {
+		name = rule.Name
+	}
+	log.Printf("Policy deny rule=%q kind=%s role=%q vip=%v path=%q host=%q topic=%q",
+		name, r.Kind, r.Role, r.VIP, r.Path, r.Host, r.Topic)
+	return ErrPolicyDenied
+}
+
+// AuthorizeE2E checks an E2E circuit from the key to a local port, as a SSH
+// direct-tcpip request to 127.0.0.1:port - the authorized_keys options and
+// the policy apply. Guests are denied: they can only use the mesh ports,
+// which are reached without E2E.
+func (auth *Auth) AuthorizeE2E(pub []byte, port int) error {
+	if auth.IsRevoked(pub) {
+		return ErrRevoked
+	}
+	ai := auth.AuthzByPub(pub)
+	if ai == nil || ai.Role == "" {
+		return ErrPolicyDenied
+	}
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	// The source is a relay - keys restricted with "from" are denied.
+	if err := auth.keyPermissions(ai, nil, perms); err != nil {
+		return err
+	}
+	if err := SSHPermitOpen(perms, "localhost", uint32(port)); err != nil {
+		if err := SSHPermitOpen(perms, "127.0.0.1", uint32(port)); err != nil {
+			return err
+		}
+	}
+	return auth.Authorize(&PolicyRequest{
+		Kind:   PolicySSH,
+		Role:   ai.Role,
+		VIP:    Pub2VIP(pub),
+		Method: "direct-tcpip",
+		Host:   net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+	})
+}
+
+// SetPolicy replaces the policy.
+func (auth *Auth) SetPolicy(p *Policy) {
+	auth.policyMutex.Lock()
+	auth.Policy = p
+	auth.policyMutex.Unlock()
+}
+
+// RoleByVIP returns the role of a mesh VIP, based on authorized_keys, or
+// RoleGuest if the VIP is not known. Addresses outside MESH_NETWORK are guests -
+// other IPv6 addresses can use any interface ID.
+func (auth *Auth) RoleByVIP(vip net.IP) string {
+	if len(vip) != net.IPv6len || !bytes.Equal(vip[0:8], MESH_NETWORK) {
+		return RoleGuest
+	}
+	auth.authzMutex.RLock()
+	ai := auth.AuthzByID[binary.BigEndian.Uint64(vip[8:])]
+	auth.authzMutex.RUnlock()
+	if ai == nil || auth.IsRevoked(ai.Public) || ai.Role == "" {
+		return RoleGuest
+	}
+	return ai.Role
+}
+
+// loadPolicy loads the policy file, if present. On errors all requests are
+// denied - a typo should not open all destinations.
+func (auth *Auth) loadPolicy() error {
+	data, err := auth.Config.Get(PolicyFile)
+	if err == nil && data == nil {
+		return nil
+	}
+	var p *Policy
+	if err == nil {
+		p, err = ParsePolicy(data)
+	}
+	if err != nil {
+		log.Println("Invalid policy, denying all requests ", err)
+		auth.SetPolicy(&Policy{Default: PolicyDeny})
+		return err
+	}
+	auth.SetPolicy(p)
+	return nil
+}
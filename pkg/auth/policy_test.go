@@ -0,0 +1,95 @@
+package auth
+
+import (
+	"net"
+	"testing"
+)
+
+func TestPolicy(t *testing.T) {
+	member := NewAuth(nil, "member", "m.webinf.info")
+	conf := memConf(map[string][]byte{
+		"authorized_keys": []byte(member.SSHPublicKey("member") + "\n"),
+		PolicyFile: []byte(`{"default": "deny", "rules": [
+		{"name": "admin", "action": "allow", "roles": ["admin"]},
+		{"name": "push", "action": "allow", "kinds": ["http"], "paths": ["/push/*"], "methods": ["POST"]},
+		{"name": "grpc", "action": "allow", "roles": ["member"], "kinds": ["grpc"], "paths": ["/envoy.service.discovery.v3.*"]},
+		{"name": "noRevoke", "action": "deny", "kinds": ["msg"], "topics": ["revoke"]},
+		{"name": "msg", "action": "allow", "roles": ["member"], "kinds": ["msg"]},
+		{"name": "svc", "action": "allow", "roles": ["member"], "kinds": ["ssh"], "methods": ["direct-tcpip"],
+			"hosts": ["[*.svc]:80", "!secret.svc"]},
+		{"name": "lan", "action": "allow", "vips": ["10.1.0.0/16", "fd00::1"], "kinds": ["ssh"]},
+		{"name": "istio", "action": "allow", "sans": ["spiffe://cluster.local/ns/istio-system/*"]}
+	]}`),
+	})
+	node := NewAuth(conf, "node", "m.webinf.info")
+	if node.Policy == nil || len(node.Policy.Rules) != 8 {
+		t.Fatal("Policy not loaded")
+	}
+	if r := node.RoleByVIP(member.VIP6); r != "member" {
+		t.Error("Unexpected role", r)
+	}
+	if r := node.RoleByVIP(net.ParseIP("fd00::5")); r != RoleGuest {
+		t.Error("Unexpected role", r)
+	}
+	// Same interface ID as the member VIP, outside the mesh network.
+	public := net.ParseIP("2001:db8::")
+	copy(public[8:], member.VIP6[8:])
+	if r := node.RoleByVIP(public); r != RoleGuest {
+		t.Error("Role for a public address", public, r)
+	}
+
+	for _, tc := range []struct {
+		name string
+		req  *PolicyRequest
+		ok   bool
+	}{
+		{name: "admin", req: &PolicyRequest{Kind: PolicySSH, Role: "user,admin", Host: "any:22"}, ok: true},
+		{name: "push", req: &PolicyRequest{Kind: PolicyHTTP, Role: RoleGuest, Path: "/push/abc", Method: "POST"}, ok: true},
+		{name: "pushGet", req: &PolicyRequest{Kind: PolicyHTTP, Role: RoleGuest, Path: "/push/abc", Method: "GET"}},
+		{name: "path", req: &PolicyRequest{Kind: PolicyHTTP, Role: "member", Path: "/debug"}},
+		{name: "grpc", req: &PolicyRequest{Kind: PolicyGRPC, Role: "member",
+			Path: "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources"}, ok: true},
+		{name: "grpcGuest", req: &PolicyRequest{Kind: PolicyGRPC, Role: RoleGuest,
+			Path: "/envoy.service.discovery.v3.AggregatedDiscoveryService/StreamAggregatedResources"}},
+		{name: "msg", req: &PolicyRequest{Kind: PolicyMsg, Role: "member", Topic: "net"}, ok: true},
+		{name: "msgRevoke", req: &PolicyRequest{Kind: PolicyMsg, Role: "member", Topic: "revoke"}},
+		{name: "adminRevoke", req: &PolicyRequest{Kind: PolicyMsg, Role: "admin", Topic: "revoke"}, ok: true},
+		{name: "svc", req: &PolicyRequest{Kind: PolicySSH, Role: "member", Method: "direct-tcpip", Host: "a.svc:80"}, ok: true},
+		{name: "svcPort", req: &PolicyRequest{Kind: PolicySSH, Role: "member", Method: "direct-tcpip", Host: "a.svc:22"}},
+		{name: "svcNegated", req: &PolicyRequest{Kind: PolicySSH, Role: "member", Method: "direct-tcpip", Host: "secret.svc:80"}},
+		{name: "svcForward", req: &PolicyRequest{Kind: PolicySSH, Role: "member", Method: "tcpip-forward", Host: "a.svc:80"}},
+		{name: "lan", req: &PolicyRequest{Kind: PolicySSH, Role: RoleGuest, VIP: net.ParseIP("10.1.2.3")}, ok: true},
+		{name: "lanVIP", req: &PolicyRequest{Kind: PolicySSH, Role: RoleGuest, VIP: net.ParseIP("fd00::1")}, ok: true},
+		{name: "wan", req: &PolicyRequest{Kind: PolicySSH, Role: RoleGuest, VIP: net.ParseIP("10.2.2.3")}},
+		{name: "san", req: &PolicyRequest{Kind: PolicyHTTP, SAN: []string{"spiffe://cluster.local/ns/istio-system/sa/istiod"}}, ok: true},
+		{name: "sanOther", req: &PolicyRequest{Kind: PolicyHTTP, SAN: []string{"spiffe://cluster.local/ns/default/sa/default"}}},
+	} {
+		if err := node.Authorize(tc.req); (err == nil) != tc.ok {
+			t.Error("Unexpected result", tc.name, err)
+		}
+	}
+
+	// No policy - all allowed.
+	if err := NewAuth(nil, "open", "m.webinf.info").Authorize(&PolicyRequest{Kind: PolicyHTTP}); err != nil {
+		t.Error("Expected allow without policy", err)
+	}
+
+	for _, p := range []string{
+		`{"rules": [{"action": "maybe"}]}`,
+		`{"default": "none"}`,
+		`{"rules": [{"action": "allow", "vips": ["bad"]}]}`,
+	} {
+		if _, err := ParsePolicy([]byte(p)); err == nil {
+			t.Error("Expected invalid policy", p)
+		}
+	}
+}
+
+func TestPolicyInvalidFile(t *testing.T) {
+	node := NewAuth(memConf(map[string][]byte{
+		PolicyFile: []byte(`{"default": "allow", "rules": [`),
+	}), "node", "m.webinf.info")
+	if err := node.Authorize(&PolicyRequest{Kind: PolicyMsg, Role: "admin", Topic: "net"}); err != ErrPolicyDenied {
+		t.Error("Invalid policy file allowed requests", err)
+	}
+}
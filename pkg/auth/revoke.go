@@ -0,0 +1,195 @@
+package auth
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Revocation of compromised keys.
+//
+// Revoked keys are loaded from @revoked lines in known_hosts and authorized_keys,
+// and from the revoked_keys ConfStore file (authorized_keys format, the comment is
+// the reason), which also holds the revocations received from the mesh.
+//
+// A revoked key has no role - Auth returns "" - and is rejected by the transports,
+// which close existing sessions using OnRevoke. Certs signed by a revoked CA are
+// rejected as well.
+//
+// Revocations are propagated as signed messages. The signer must have the admin
+// role or be the node itself. Each revocation is accepted once, nodes forward
+// new revocations to their peers.
+
+// RevokedKeysFile is the ConfStore name of the revoked keys.
+const RevokedKeysFile = "revoked_keys"
+
+// TopicRevoke is the messaging topic for signed revocations.
+const TopicRevoke = "revoke"
+
+var (
+	ErrRevoked         = errors.New("auth: key revoked")
+	ErrRevokeForbidden = errors.New("auth: revocation not signed by an admin")
+)
+
+// Revocation of a public key, signed by an admin.
+type Revocation struct {
+	// Revoked key, in KeyBytes format.
+	Pub []byte `json:"pub"`
+
+	Reason string `json:"reason,omitempty"`
+
+	// Unix time of the revocation.
+	Time int64 `json:"time"`
+
+	// Public key of the signer and signature of Pub, Reason and Time.
+	By  []byte `json:"by,omitempty"`
+	Sig []byte `json:"sig,omitempty"`
+}
+
+func (r *Revocation) signData() []byte {
+	h := sha256.New()
+	lenBuf := make([]byte, 8)
+	for _, b := range [][]byte{r.Pub, []byte(r.Reason)} {
+		binary.BigEndian.PutUint64(lenBuf, uint64(len(b)))
+		h.Write(lenBuf)
+		h.Write(b)
+	}
+	binary.BigEndian.PutUint64(lenBuf, uint64(r.Time))
+	h.Write(lenBuf)
+	return h.Sum(nil)
+}
+
+// IsRevoked returns true if the key - in KeyBytes format - was revoked.
+func (auth *Auth) IsRevoked(pub []byte) bool {
+	if len(pub) == 0 {
+		return false
+	}
+	auth.revokedMutex.RLock()
+	_, ok := auth.revoked[string(pub)]
+	auth.revokedMutex.RUnlock()
+	return ok
+}
+
+// Revoked returns the list of revoked keys.
+func (auth *Auth) Revoked() []*Revocation {
+	auth.revokedMutex.RLock()
+	defer auth.revokedMutex.RUnlock()
+	res := make([]*Revocation, 0, len(auth.revoked))
+	for _, r := range auth.revoked {
+		res = append(res, r)
+	}
+	return res
+}
+
+// OnRevoke registers a callback, called with the key when a new revocation is
+// added. Used to close existing sessions.
+func (auth *Auth) OnRevoke(f func(pub []byte)) {
+	auth.revokedMutex.Lock()
+	auth.onRevoke = append(auth.onRevoke, f)
+	auth.revokedMutex.Unlock()
+}
+
+// addRevoked adds a revocation, returning false if the key was already revoked.
+// If save is set, the revoked_keys file is updated.
+func (auth *Auth) addRevoked(r *Revocation, save bool) bool {
+	auth.revokedMutex.Lock()
+	if _, ok := auth.revoked[string(r.Pub)]; ok {
+		auth.revokedMutex.Unlock()
+		return false
+	}
+	auth.revoked[string(r.Pub)] = r
+	cb := auth.onRevoke
+	var data []byte
+	if save && auth.Config != nil {
+		bw := bytes.Buffer{}
+		for _, rr := range auth.revoked {
+			pk, err := PubKeyFromBytes(rr.Pub)
+			if err != nil {
+				continue
+			}
+			if l := sshAuthorizedLine(pk, rr.Reason); l != "" {
+				bw.WriteString(l + "\n")
+			}
+		}
+		data = bw.Bytes()
+	}
+	auth.revokedMutex.Unlock()
+
+	if data != nil {
+		auth.Config.Set(RevokedKeysFile, data)
+	}
+	log.Println("Revoked ", Pub2VIP(r.Pub), r.Reason)
+	for _, f := range cb {
+		f(r.Pub)
+	}
+	return true
+}
+
+// Revoke revokes a key and returns the signed revocation, to be sent to the mesh.
+// The key is revoked locally even if this node is not an admin, but other nodes
+// will only accept the revocation from admins.
+func (auth *Auth) Revoke(pub []byte, reason string) *Revocation {
+	r := &Revocation{
+		Pub:    pub,
+		Reason: reason,
+		Time:   time.Now().Unix(),
+		By:     auth.Pub,
+	}
+	r.Sig = make([]byte, auth.SigSize())
+	auth.Sign(r.signData(), r.Sig)
+	auth.addRevoked(r, true)
+	return r
+}
+
+// HandleRevocation processes a signed revocation received from the mesh. Returns
+// the revocation if it is new and should be forwarded to peers, nil if the key
+// was already revoked.
+func (auth *Auth) HandleRevocation(data []byte) (*Revocation, error) {
+	r := &Revocation{}
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, err
+	}
+	if len(r.Pub) == 0 || len(r.By) == 0 {
+		return nil, errors.New("auth: invalid revocation")
+	}
+	if auth.IsRevoked(r.Pub) {
+		return nil, nil
+	}
+	if auth.IsRevoked(r.By) {
+		return nil, ErrRevoked
+	}
+	if !bytes.Equal(r.By, auth.Pub) && !HasRole(auth.Auth(r.By, ""), RoleAdmin) {
+		return nil, ErrRevokeForbidden
+	}
+	if err := Verify(r.signData(), r.By, r.Sig); err != nil {
+		return nil, err
+	}
+	if !auth.addRevoked(r, true) {
+		return nil, nil
+	}
+	return r, nil
+}
+
+// loadRevoked loads the revoked_keys file.
+func (auth *Auth) loadRevoked() {
+	data, err := auth.Config.Get(RevokedKeysFile)
+	if err != nil || data == nil {
+		return
+	}
+	for len(data) > 0 {
+		pubKey, comment, _, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return
+		}
+		data = rest
+		if kb := SSHKeyBytes(pubKey); kb != nil {
+			auth.addRevoked(&Revocation{Pub: kb, Reason: comment}, false)
+		}
+	}
+}
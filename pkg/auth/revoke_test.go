@@ -0,0 +1,108 @@
+package auth
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestRevoke(t *testing.T) {
+	admin := NewAuth(nil, "admin", "m.webinf.info")
+	member := NewAuthWithKeyType(nil, "member", "m.webinf.info", KeyED25519)
+	bad := NewAuth(nil, "bad", "m.webinf.info")
+	old := NewAuth(nil, "old", "m.webinf.info")
+	oldHost := NewAuth(nil, "oldhost", "m.webinf.info")
+
+	conf := memConf(map[string][]byte{
+		"authorized_keys": []byte(admin.SSHPublicKey("admin") + "\n" +
+			member.SSHPublicKey("member") + "\n" +
+			bad.SSHPublicKey("member") + "\n" +
+			"@revoked " + old.SSHPublicKey("compromised") + "\n"),
+		"known_hosts": []byte("@revoked * " + oldHost.SSHPublicKey("") + "\n"),
+	})
+	node := NewAuth(conf, "node", "m.webinf.info")
+	if !node.IsRevoked(old.Pub) || !node.IsRevoked(oldHost.Pub) {
+		t.Fatal("@revoked not loaded")
+	}
+	if node.Auth(old.Pub, "") != "" {
+		t.Error("Revoked key authorized")
+	}
+
+	revoked := 0
+	node.OnRevoke(func(pub []byte) {
+		revoked++
+	})
+
+	msg := func(r *Revocation) []byte {
+		b, _ := json.Marshal(r)
+		return b
+	}
+
+	// Non-admin can't revoke.
+	if _, err := node.HandleRevocation(msg(member.Revoke(bad.Pub, "test"))); err != ErrRevokeForbidden {
+		t.Error("Expected forbidden", err)
+	}
+	if !member.IsRevoked(bad.Pub) {
+		t.Error("Not revoked locally")
+	}
+
+	// Forged signature
+	r := admin.Revoke(bad.Pub, "test")
+	r.Reason = "changed"
+	if _, err := node.HandleRevocation(msg(r)); err == nil {
+		t.Error("Forged revocation accepted")
+	}
+	if revoked != 0 || node.Auth(bad.Pub, "") == "" {
+		t.Fatal("Unexpected revocation")
+	}
+
+	r = admin.Revoke(bad.Pub, "test")
+	if fwd, err := node.HandleRevocation(msg(r)); err != nil || fwd == nil {
+		t.Fatal("Revocation failed", err)
+	}
+	if fwd, err := node.HandleRevocation(msg(r)); err != nil || fwd != nil {
+		t.Error("Revocation should be processed once", err)
+	}
+	if revoked != 1 || node.Auth(bad.Pub, "") != "" {
+		t.Error("Revocation not applied")
+	}
+
+	// Persisted
+	reloaded := NewAuth(conf, "node", "m.webinf.info")
+	if !reloaded.IsRevoked(bad.Pub) || reloaded.IsRevoked(member.Pub) {
+		t.Error("Revocation not saved")
+	}
+
+	// Revoked signer
+	if _, err := node.HandleRevocation(msg(bad.Revoke(member.Pub, ""))); err != ErrRevoked {
+		t.Error("Expected revoked signer", err)
+	}
+
+	// SSH certs: for a revoked key or signed by a revoked CA
+	conf.Set("authorized_keys", []byte("cert-authority "+admin.SSHPublicKey("member")+"\n"+
+		"cert-authority "+old.SSHPublicKey("member")+"\n"+admin.SSHPublicKey("admin")+"\n"))
+	node = NewAuth(conf, "node", "m.webinf.info")
+	now := uint64(time.Now().Unix())
+	cm := &testConnMeta{user: "dmesh", remote: &net.TCPAddr{IP: net.IPv6loopback}}
+	for _, tc := range []struct {
+		name   string
+		ca     *Auth
+		client *Auth
+		ok     bool
+	}{
+		{name: "valid", ca: admin, client: member, ok: true},
+		{name: "revokedKey", ca: admin, client: bad},
+		{name: "revokedCA", ca: old, client: member},
+	} {
+		c, err := tc.ca.SignSSHCert(tc.client.PublicKey(), ssh.UserCert, []string{"dmesh"}, now-10, now+3600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := node.AuthenticateSSHCert(cm, c); (err == nil) != tc.ok {
+			t.Error("Unexpected cert result", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package auth
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"time"
+)
+
+// Certificate rotation.
+//
+// The primary key doesn't change - it is the identity of the node and the base of
+// the VIP. Only the certificate is re-issued: self-signed, or by the CA if CAURL is set.
+// TLS configs created by GenerateTLSConfigServer/Client use callbacks, so running
+// listeners and clients use the new cert on new connections. Other users - like the
+// SSH server or the messaging mux - can register with OnRotate.
+
+// Certificate returns the current primary certificate.
+func (auth *Auth) Certificate() *tls.Certificate {
+	auth.certMutex.RLock()
+	defer auth.certMutex.RUnlock()
+	if len(auth.tlsCerts) == 0 {
+		return nil
+	}
+	c := auth.tlsCerts[0]
+	return &c
+}
+
+// OnRotate registers a callback, called after the primary cert is replaced.
+func (auth *Auth) OnRotate(f func(*tls.Certificate)) {
+	auth.certMutex.Lock()
+	auth.onRotate = append(auth.onRotate, f)
+	auth.certMutex.Unlock()
+}
+
+func (auth *Auth) setCert(c tls.Certificate) {
+	auth.certMutex.Lock()
+	if len(auth.tlsCerts) == 0 {
+		auth.tlsCerts = []tls.Certificate{c}
+	} else {
+		auth.tlsCerts[0] = c
+	}
+	cb := auth.onRotate
+	auth.certMutex.Unlock()
+
+	for _, f := range cb {
+		f(&c)
+	}
+}
+
+// Leaf returns the parsed primary certificate.
+func (auth *Auth) Leaf() *x509.Certificate {
+	c := auth.Certificate()
+	if c == nil || len(c.Certificate) == 0 {
+		return nil
+	}
+	if c.Leaf != nil {
+		return c.Leaf
+	}
+	leaf, err := x509.ParseCertificate(c.Certificate[0])
+	if err != nil {
+		return nil
+	}
+	return leaf
+}
+
+// NeedsRotation returns true if the primary cert expires in less than RenewBefore.
+func (auth *Auth) NeedsRotation(now time.Time) bool {
+	leaf := auth.Leaf()
+	if leaf == nil {
+		return true
+	}
+	renew := auth.RenewBefore
+	if renew == 0 {
+		renew = leaf.NotAfter.Sub(leaf.NotBefore) / 3
+	}
+	return now.After(leaf.NotAfter.Add(-renew))
+}
+
+// RotateCert replaces the primary certificate, using the same key.
+func (auth *Auth) RotateCert() error {
+	if auth.CAURL != "" && auth.CAClient != nil {
+		_, err := auth.RequestCert(auth.CAClient, auth.CAURL)
+		return err
+	}
+	keyPEM, certPEM := auth.generateAndSaveSelfSigned(auth.PrivateKey, auth.Name+"."+auth.Domain)
+	tlsCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return err
+	}
+	tlsCert.Leaf, _ = x509.ParseCertificate(tlsCert.Certificate[0])
+	auth.setCert(tlsCert)
+	return nil
+}
+
+// StartRotation checks the primary cert periodically and rotates it when needed,
+// until the context is done.
+func (auth *Auth) StartRotation(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if auth.NeedsRotation(time.Now()) {
+				if err := auth.RotateCert(); err != nil {
+					log.Println("Cert rotation failed ", err)
+				} else if leaf := auth.Leaf(); leaf != nil {
+					log.Println("Cert rotated, expires ", leaf.NotAfter)
+				}
+			}
+			select {
+			case <-t.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
@@ -0,0 +1,76 @@
+package auth
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/confstore"
+)
+
+func TestRotate(t *testing.T) {
+	srvAuth := NewAuth(confstore.NewMemStore(), "srv", "m.webinf.info")
+	clientAuth := NewAuth(nil, "client", "m.webinf.info")
+
+	if srvAuth.NeedsRotation(time.Now()) {
+		t.Error("New cert needs rotation")
+	}
+
+	clientSerial := ""
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientSerial = r.TLS.PeerCertificates[0].SerialNumber.String()
+	}))
+	// Not using StartTLS - it sets a test cert in Certificates.
+	cfg := srvAuth.GenerateTLSConfigServer()
+	cfg.ClientAuth = tls.RequireAnyClientCert
+	srv.Listener = tls.NewListener(srv.Listener, cfg)
+	srv.Start()
+	defer srv.Close()
+	url := "https://" + srv.Listener.Addr().String()
+
+	get := func() string {
+		hc := &http.Client{Transport: &http.Transport{TLSClientConfig: clientAuth.GenerateTLSConfigClient()}}
+		res, err := hc.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		return res.TLS.PeerCertificates[0].SerialNumber.String()
+	}
+
+	s1 := get()
+	c1 := clientSerial
+
+	rotated := 0
+	srvAuth.OnRotate(func(c *tls.Certificate) {
+		rotated++
+	})
+	srvAuth.CertLifetime = 3 * time.Hour
+	srvAuth.RenewBefore = time.Hour
+	if err := srvAuth.RotateCert(); err != nil {
+		t.Fatal(err)
+	}
+	clientAuth.RotateCert()
+
+	s2 := get()
+	if s1 == s2 || c1 == clientSerial {
+		t.Error("Rotated cert not used by running server or client")
+	}
+	if rotated != 1 {
+		t.Error("OnRotate not called")
+	}
+	// Same key, same identity
+	if !srvAuth.VIP6.Equal(Pub2VIP(KeyBytes(srvAuth.Leaf().PublicKey))) {
+		t.Error("Key changed on rotation")
+	}
+
+	// Cert is valid for 2 hours from now (notBefore is 1h in the past)
+	if srvAuth.NeedsRotation(time.Now()) {
+		t.Error("Unexpected rotation")
+	}
+	if !srvAuth.NeedsRotation(time.Now().Add(90 * time.Minute)) {
+		t.Error("Expected rotation in renew window")
+	}
+}
@@ -0,0 +1,242 @@
+package auth
+
+import (
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// SPIFFE identities, for interop with Istio and other SPIFFE workloads.
+//
+// In K8S the node cert includes a spiffe://<trust domain>/ns/<ns>/sa/<sa> URI
+// SAN, based on POD_NAMESPACE and SERVICE_ACCOUNT. Certs with a SPIFFE ID are
+// verified against the roots of their trust domain - the mesh roots for our
+// own trust domain, the Istio root for the Istio trust domain, and bundles
+// loaded from the ConfStore as spiffe/<trust domain>.pem.
+
+const (
+	spiffeScheme = "spiffe"
+
+	// TrustBundlePrefix is the ConfStore prefix of the trust domain roots.
+	TrustBundlePrefix = "spiffe/"
+
+	// Default Istio trust domain.
+	istioTrustDomain = "cluster.local"
+)
+
+var (
+	ErrNoSPIFFEID          = errors.New("auth: no SPIFFE ID")
+	ErrInvalidSPIFFEID     = errors.New("auth: invalid SPIFFE ID")
+	ErrUnknownTrustDomain  = errors.New("auth: unknown trust domain")
+	ErrMultipleSPIFFEIDs   = errors.New("auth: multiple SPIFFE IDs")
+	ErrTrustDomainMismatch = errors.New("auth: SPIFFE ID not in the trust domain of the root")
+)
+
+// Locations of the Istio root cert - Istio agent and the legacy Citadel secret.
+var istioRootFiles = []string{
+	"./var/run/secrets/istio/root-cert.pem",
+	"/var/run/secrets/istio/root-cert.pem",
+	"/etc/certs/root-cert.pem",
+}
+
+// SPIFFEID is a parsed spiffe://trust-domain/path ID.
+type SPIFFEID struct {
+	TrustDomain string
+
+	// Path, starting with "/".
+	Path string
+}
+
+// ParseSPIFFEID parses and validates a SPIFFE ID.
+func ParseSPIFFEID(s string) (*SPIFFEID, error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, ErrInvalidSPIFFEID
+	}
+	return spiffeFromURL(u)
+}
+
+func spiffeFromURL(u *url.URL) (*SPIFFEID, error) {
+	if u.Scheme != spiffeScheme || u.Host == "" || u.User != nil || u.Port() != "" ||
+		u.RawQuery != "" || u.Fragment != "" || u.Opaque != "" {
+		return nil, ErrInvalidSPIFFEID
+	}
+	if strings.ToLower(u.Host) != u.Host || len(u.Path) < 2 || strings.HasSuffix(u.Path, "/") {
+		return nil, ErrInvalidSPIFFEID
+	}
+	return &SPIFFEID{TrustDomain: u.Host, Path: u.Path}, nil
+}
+
+// NewSPIFFEID returns the Istio style ID of a K8S service account.
+func NewSPIFFEID(td, ns, sa string) *SPIFFEID {
+	return &SPIFFEID{TrustDomain: td, Path: "/ns/" + ns + "/sa/" + sa}
+}
+
+func (id *SPIFFEID) String() string {
+	return spiffeScheme + "://" + id.TrustDomain + id.Path
+}
+
+// URL returns the ID as URL, for the cert URI SAN.
+func (id *SPIFFEID) URL() *url.URL {
+	return &url.URL{Scheme: spiffeScheme, Host: id.TrustDomain, Path: id.Path}
+}
+
+// Namespace and ServiceAccount return the K8S namespace and service account,
+// for Istio style IDs. Empty if the path has a different format.
+func (id *SPIFFEID) Namespace() string {
+	p := strings.Split(id.Path, "/")
+	if len(p) == 5 && p[1] == "ns" && p[3] == "sa" {
+		return p[2]
+	}
+	return ""
+}
+
+func (id *SPIFFEID) ServiceAccount() string {
+	p := strings.Split(id.Path, "/")
+	if len(p) == 5 && p[1] == "ns" && p[3] == "sa" {
+		return p[4]
+	}
+	return ""
+}
+
+// SPIFFEIDFromCert returns the SPIFFE ID of a cert. A SVID has exactly one
+// spiffe URI SAN.
+func SPIFFEIDFromCert(cert *x509.Certificate) (*SPIFFEID, error) {
+	var res *SPIFFEID
+	for _, u := range cert.URIs {
+		if u.Scheme != spiffeScheme {
+			continue
+		}
+		if res != nil {
+			return nil, ErrMultipleSPIFFEIDs
+		}
+		id, err := spiffeFromURL(u)
+		if err != nil {
+			return nil, err
+		}
+		res = id
+	}
+	if res == nil {
+		return nil, ErrNoSPIFFEID
+	}
+	return res, nil
+}
+
+// AddTrustBundle adds PEM roots for a trust domain.
+func (auth *Auth) AddTrustBundle(td string, rootsPEM []byte) error {
+	auth.bundleMutex.Lock()
+	defer auth.bundleMutex.Unlock()
+	if auth.TrustBundles == nil {
+		auth.TrustBundles = map[string]*x509.CertPool{}
+	}
+	pool := auth.TrustBundles[td]
+	if pool == nil {
+		pool = x509.NewCertPool()
+	}
+	if !pool.AppendCertsFromPEM(rootsPEM) {
+		return errors.New("auth: no roots in trust bundle for " + td)
+	}
+	auth.TrustBundles[td] = pool
+	return nil
+}
+
+// TrustBundle returns the roots of a trust domain. Our own trust domain uses
+// the mesh roots.
+func (auth *Auth) TrustBundle(td string) *x509.CertPool {
+	auth.bundleMutex.RLock()
+	pool := auth.TrustBundles[td]
+	auth.bundleMutex.RUnlock()
+	if pool == nil && td == auth.TrustDomain {
+		return auth.GetRoots()
+	}
+	return pool
+}
+
+// VerifySVID verifies a cert chain - leaf first - against the roots of the
+// trust domain of its SPIFFE ID.
+func (auth *Auth) VerifySVID(chain []*x509.Certificate) (*SPIFFEID, error) {
+	if len(chain) == 0 {
+		return nil, ErrNoSPIFFEID
+	}
+	id, err := SPIFFEIDFromCert(chain[0])
+	if err != nil {
+		return nil, err
+	}
+	roots := auth.TrustBundle(id.TrustDomain)
+	if roots == nil {
+		return nil, ErrUnknownTrustDomain
+	}
+	inter := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		inter.AddCert(c)
+	}
+	_, err = chain[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return id, nil
+}
+
+// initSPIFFE sets the trust domain and, in K8S, the SPIFFE ID of the node.
+// The trust domain is read from the TRUST_DOMAIN config, default the mesh
+// domain.
+func (auth *Auth) initSPIFFE() {
+	td := auth.Domain
+	if td == "" {
+		td = istioTrustDomain
+	}
+	auth.TrustDomain = Conf(auth.Config, "TRUST_DOMAIN", td)
+
+	ns := os.Getenv("POD_NAMESPACE")
+	if ns == "" || os.Getenv("POD_NAME") == "" {
+		return
+	}
+	sa := os.Getenv("SERVICE_ACCOUNT")
+	if sa == "" {
+		sa = "default"
+	}
+	auth.SPIFFE = NewSPIFFEID(auth.TrustDomain, ns, sa)
+}
+
+// loadTrustBundles loads the roots of other trust domains from the ConfStore,
+// and the Istio root if found.
+func (auth *Auth) loadTrustBundles() {
+	if auth.Config != nil {
+		names, _ := auth.Config.List(TrustBundlePrefix, "")
+		for _, n := range names {
+			if !strings.HasSuffix(n, ".pem") {
+				continue
+			}
+			data, err := auth.Config.Get(n)
+			if err != nil || data == nil {
+				continue
+			}
+			td := strings.TrimSuffix(strings.TrimPrefix(n, TrustBundlePrefix), ".pem")
+			if err := auth.AddTrustBundle(td, data); err != nil {
+				log.Println("Invalid trust bundle ", n, err)
+			}
+		}
+	}
+
+	istioTD := Conf(auth.Config, "ISTIO_TRUST_DOMAIN", istioTrustDomain)
+	for _, f := range istioRootFiles {
+		data, err := ioutil.ReadFile(f)
+		if err != nil {
+			continue
+		}
+		if err := auth.AddTrustBundle(istioTD, data); err != nil {
+			log.Println("Invalid Istio root ", f, err)
+			continue
+		}
+		log.Println("Loaded Istio root ", f, istioTD)
+		return
+	}
+}
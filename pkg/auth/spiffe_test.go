@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+)
+
+// testSVID returns a root PEM, and a chain with a leaf with the URI SANs.
+func testSVID(t *testing.T, uris ...string) ([]byte, []*x509.Certificate) {
+	rk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	rootT := &x509.Certificate{
+		SerialNumber:          serial(),
+		Subject:               pkix.Name{Organization: []string{"test"}},
+		NotBefore:             time.Now().Add(-1 * time.Hour),
+		NotAfter:              time.Now().Add(1 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootT, rootT, rk.Public(), rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, _ := x509.ParseCertificate(rootDER)
+
+	lk, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafT := &x509.Certificate{
+		SerialNumber: serial(),
+		NotBefore:    time.Now().Add(-1 * time.Hour),
+		NotAfter:     time.Now().Add(1 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	for _, u := range uris {
+		pu, _ := url.Parse(u)
+		leafT.URIs = append(leafT.URIs, pu)
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafT, root, lk.Public(), rk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(leafDER)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}),
+		[]*x509.Certificate{leaf, root}
+}
+
+func TestSPIFFEID(t *testing.T) {
+	id, err := ParseSPIFFEID("spiffe://cluster.local/ns/istio-system/sa/istiod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id.TrustDomain != "cluster.local" || id.Namespace() != "istio-system" ||
+		id.ServiceAccount() != "istiod" {
+		t.Error("Unexpected ID", id)
+	}
+	if id.String() != "spiffe://cluster.local/ns/istio-system/sa/istiod" {
+		t.Error("Unexpected string", id)
+	}
+	for _, s := range []string{"https://cluster.local/ns/a", "spiffe://cluster.local",
+		"spiffe://cluster.local/", "spiffe://Cluster.local/a", "spiffe://cluster.local:80/a",
+		"spiffe://u@cluster.local/a", "spiffe://cluster.local/a?q=1"} {
+		if _, err := ParseSPIFFEID(s); err == nil {
+			t.Error("Invalid ID accepted", s)
+		}
+	}
+}
+
+func TestSVID(t *testing.T) {
+	istioRoot, istioChain := testSVID(t, "spiffe://cluster.local/ns/default/sa/app")
+	otherRoot, otherChain := testSVID(t, "spiffe://example.com/ns/a/sa/b")
+
+	os.Setenv("POD_NAME", "app-1")
+	os.Setenv("POD_NAMESPACE", "dmesh")
+	defer os.Unsetenv("POD_NAME")
+	defer os.Unsetenv("POD_NAMESPACE")
+
+	a := NewAuth(memConf(map[string][]byte{
+		"spiffe/example.com.pem": otherRoot,
+		"TRUST_DOMAIN":           []byte("mesh.local"),
+	}), "", "m.webinf.info")
+	if a.SPIFFE == nil || a.SPIFFE.String() != "spiffe://mesh.local/ns/dmesh/sa/default" {
+		t.Fatal("Unexpected SPIFFE ID", a.SPIFFE)
+	}
+	leaf, err := x509.ParseCertificate(a.Certificate().Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := SPIFFEIDFromCert(leaf); err != nil || id.String() != a.SPIFFE.String() {
+		t.Error("Missing SPIFFE SAN in cert", leaf.URIs, err)
+	}
+
+	if id, err := a.VerifySVID(otherChain); err != nil || id.Namespace() != "a" {
+		t.Error("Trust bundle from config", err)
+	}
+	if _, err := a.VerifySVID(istioChain); err != ErrUnknownTrustDomain {
+		t.Error("Expected unknown trust domain", err)
+	}
+	if err := a.AddTrustBundle("cluster.local", istioRoot); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := a.VerifySVID(istioChain); err != nil || id.ServiceAccount() != "app" {
+		t.Error("Istio SVID", err)
+	}
+
+	// Leaf signed by a different root than the one of its trust domain.
+	_, fake := testSVID(t, "spiffe://cluster.local/ns/default/sa/app")
+	if _, err := a.VerifySVID(fake); err == nil {
+		t.Error("SVID with untrusted root accepted")
+	}
+	_, multi := testSVID(t, "spiffe://cluster.local/a", "spiffe://cluster.local/b")
+	if _, err := a.VerifySVID(multi); err != ErrMultipleSPIFFEIDs {
+		t.Error("Expected multiple IDs error", err)
+	}
+}
@@ -0,0 +1,381 @@
+package auth
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SSH certificate authorities.
+//
+// User CAs are loaded from authorized_keys lines with the cert-authority option,
+// and from trusted_user_ca_keys (same format as the sshd TrustedUserCAKeys file).
+// The comment is used as role for users with certs signed by the CA, unless the
+// key in the cert has its own authorized_keys entry. The principals="a,b" option
+// restricts the principals accepted from the CA - otherwise the cert must include
+// the SSH user name.
+//
+// Host CAs are loaded from known_hosts @cert-authority lines:
+//   @cert-authority *.dmesh.com,[10.*]:5222 ecdsa-sha2-nistp256 AAAA...
+//
+// Patterns without port match any port.
+//
+// Supported critical options are source-address and force-command. Certs with
+// other critical options are rejected, as well as certs for revoked keys or
+// signed by revoked CAs. Like OpenSSH, forwarding requires the
+// permit-port-forwarding extension.
+
+// TrustedUserCAKeysFile is the ConfStore name of the trusted user CA keys.
+const TrustedUserCAKeysFile = "trusted_user_ca_keys"
+
+const (
+	SSHOptSourceAddress = "source-address"
+	SSHOptForceCommand  = "force-command"
+
+	SSHExtPermitPortForwarding = "permit-port-forwarding"
+
+	// SSHExtCA is set in the permissions of cert authenticated clients, to the
+	// KeyBytes of the CA.
+	SSHExtCA = "ca"
+)
+
+var errNoPrincipals = errors.New("ssh: certificate lacks principals")
+
+// sshCertChecker returns the checker used for user and host certs.
+func (auth *Auth) sshCertChecker() *ssh.CertChecker {
+	return &ssh.CertChecker{
+		SupportedCriticalOptions: []string{SSHOptSourceAddress, SSHOptForceCommand},
+		IsUserAuthority: func(k ssh.PublicKey) bool {
+			return auth.sshUserCA(k) != nil
+		},
+		IsHostAuthority: func(k ssh.PublicKey, address string) bool {
+			return auth.sshHostCA(k, address) != nil
+		},
+		IsRevoked: func(cert *ssh.Certificate) bool {
+			return auth.IsRevoked(SSHKeyBytes(cert.Key)) || auth.IsRevoked(SSHKeyBytes(cert.SignatureKey))
+		},
+	}
+}
+
+// SSHKeyBytes returns the KeyBytes of an SSH public key, or nil if not supported.
+func SSHKeyBytes(k ssh.PublicKey) []byte {
+	if cpk, ok := k.(ssh.CryptoPublicKey); ok {
+		return KeyBytes(cpk.CryptoPublicKey())
+	}
+	return nil
+}
+
+func (auth *Auth) sshUserCA(k ssh.PublicKey) *AuthzInfo {
+	kb := SSHKeyBytes(k)
+	if kb == nil {
+		return nil
+	}
+	for _, ca := range auth.UserCAs {
+		if bytes.Equal(ca.Public, kb) {
+			return ca
+		}
+	}
+	return nil
+}
+
+func (auth *Auth) sshHostCA(k ssh.PublicKey, address string) *AuthzInfo {
+	kb := SSHKeyBytes(k)
+	if kb == nil {
+		return nil
+	}
+	for _, ca := range auth.HostCAs {
+		if bytes.Equal(ca.Public, kb) && matchHosts(ca.Hosts, address) {
+			return ca
+		}
+	}
+	return nil
+}
+
+// matchHosts checks an address (host:port) against a list of known_hosts patterns.
+// Negated patterns take precedence.
+func matchHosts(patterns []string, address string) bool {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	host = strings.ToLower(host)
+	res := false
+	for _, p := range patterns {
+		neg := strings.HasPrefix(p, "!")
+		if neg {
+			p = p[1:]
+		}
+		pp := ""
+		if strings.HasPrefix(p, "[") {
+			if h, prt, err := net.SplitHostPort(p); err == nil {
+				p, pp = strings.Trim(h, "[]"), prt
+			}
+		}
+		if pp != "" && pp != port {
+			continue
+		}
+		if ok, _ := path.Match(strings.ToLower(p), host); !ok {
+			continue
+		}
+		if neg {
+			return false
+		}
+		res = true
+	}
+	return res
+}
+
+// AuthenticateSSHCert validates a user certificate presented by a client: the signer
+// must be a trusted user CA, the principals, validity and critical options are
+// checked. Returns the permissions, including the critical options, and the role.
+//
+// The options of the cert-authority line - from, expiry-time, restrict,
+// permitopen, ... - apply to all certs of the CA, as for plain keys.
+func (auth *Auth) AuthenticateSSHCert(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, string, error) {
+	if cert.CertType != ssh.UserCert {
+		return nil, "", fmt.Errorf("ssh: cert has type %d", cert.CertType)
+	}
+	ca := auth.sshUserCA(cert.SignatureKey)
+	if ca == nil {
+		return nil, "", errors.New("ssh: certificate signed by unrecognized authority")
+	}
+	if len(cert.ValidPrincipals) == 0 {
+		return nil, "", errNoPrincipals
+	}
+
+	principal := conn.User()
+	if pl, ok := ca.Opts["principals"]; ok {
+		principal = ""
+		for _, p := range cert.ValidPrincipals {
+			if HasRole(pl, p) {
+				principal = p
+				break
+			}
+		}
+		if principal == "" {
+			return nil, "", fmt.Errorf("ssh: no allowed principals in %q", cert.ValidPrincipals)
+		}
+	}
+	if err := auth.sshCertChecker().CheckCert(principal, cert); err != nil {
+		return nil, "", err
+	}
+	if err := checkSourceAddress(conn.RemoteAddr(), cert.CriticalOptions[SSHOptSourceAddress]); err != nil {
+		return nil, "", err
+	}
+
+	role := auth.Auth(SSHKeyBytes(cert.Key), "")
+	if role == "" {
+		role = ca.Role
+	}
+
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	for k, v := range cert.CriticalOptions {
+		perms.CriticalOptions[k] = v
+	}
+	for k, v := range cert.Extensions {
+		perms.Extensions[k] = v
+	}
+	perms.Extensions[SSHExtCA] = string(SSHKeyBytes(cert.SignatureKey))
+
+	// The more restrictive of the cert and the CA line wins.
+	caPerms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	if err := auth.keyPermissions(ca, conn.RemoteAddr(), caPerms); err != nil {
+		return nil, "", err
+	}
+	if cmd, ok := caPerms.CriticalOptions[SSHOptForceCommand]; ok {
+		if c, ok := perms.CriticalOptions[SSHOptForceCommand]; ok && c != cmd {
+			return nil, "", errors.New("ssh: cert and cert-authority force different commands")
+		}
+		perms.CriticalOptions[SSHOptForceCommand] = cmd
+	}
+	for k, v := range caPerms.Extensions {
+		perms.Extensions[k] = v
+	}
+	return perms, role, nil
+}
+
+// CheckSSHHostCert validates a host certificate presented by a server. Addr is the
+// host:port used to connect, the host must be one of the principals.
+func (auth *Auth) CheckSSHHostCert(addr string, remote net.Addr, cert *ssh.Certificate) error {
+	if len(cert.ValidPrincipals) == 0 {
+		return errNoPrincipals
+	}
+	return auth.sshCertChecker().CheckHostKey(addr, remote, cert)
+}
+
+// checkSourceAddress checks the remote address against a comma separated list of
+// addresses or CIDRs.
+func checkSourceAddress(addr net.Addr, sourceAddrs string) error {
+	if sourceAddrs == "" {
+		return nil
+	}
+	var ip net.IP
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip = a.IP
+	case *net.UDPAddr:
+		ip = a.IP
+	default:
+		if addr != nil {
+			h, _, err := net.SplitHostPort(addr.String())
+			if err == nil {
+				ip = net.ParseIP(h)
+			}
+		}
+	}
+	if ip == nil {
+		return errors.New("ssh: source-address requires an IP address")
+	}
+	for _, sa := range strings.Split(sourceAddrs, ",") {
+		sa = strings.TrimSpace(sa)
+		if allowed := net.ParseIP(sa); allowed != nil {
+			if allowed.Equal(ip) {
+				return nil
+			}
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(sa)
+		if err != nil {
+			return fmt.Errorf("ssh: invalid source-address %q", sa)
+		}
+		if ipNet.Contains(ip) {
+			return nil
+		}
+	}
+	return fmt.Errorf("ssh: remote address %v is not allowed by source-address", addr)
+}
+
+// loadTrustedUserCAs loads the trusted_user_ca_keys file.
+func (auth *Auth) loadTrustedUserCAs() {
+	data, err := auth.Config.Get(TrustedUserCAKeysFile)
+	if err != nil || data == nil {
+		return
+	}
+	for len(data) > 0 {
+		pubKey, comment, opts, rest, err := ssh.ParseAuthorizedKey(data)
+		if err != nil {
+			return
+		}
+		data = rest
+		if ai := newAuthzInfo(pubKey, comment, opts); ai != nil {
+			auth.UserCAs = append(auth.UserCAs, ai)
+		}
+	}
+}
+
+// newAuthzInfo creates an AuthzInfo from a parsed authorized_keys or known_hosts line.
+func newAuthzInfo(pubKey ssh.PublicKey, role string, opts []string) *AuthzInfo {
+	cpk, ok := pubKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil
+	}
+	pubk := cpk.CryptoPublicKey()
+	kbytes := KeyBytes(pubk)
+	if kbytes == nil {
+		return nil
+	}
+	ai := &AuthzInfo{
+		Role:   role,
+		Key:    pubk,
+		Public: kbytes,
+		Opts:   map[string]string{},
+	}
+	for _, o := range opts {
+		if strings.Contains(o, "=") {
+			op := strings.SplitN(o, "=", 2)
+			v := strings.Trim(op[1], "\"")
+			if prev, ok := ai.Opts[op[0]]; ok && sshMultiOpts[op[0]] {
+				v = prev + "," + v
+			}
+			ai.Opts[op[0]] = v
+		} else {
+			ai.Opts[o] = ""
+		}
+	}
+	return ai
+}
+
+// SSHUserSigner returns the signer used as SSH client. If a user cert for the
+// primary key is saved as id_<type>-cert.pub, it is presented to servers.
+func (auth *Auth) SSHUserSigner() (ssh.Signer, error) {
+	return auth.sshCertSigner("id_" + sshKeyName(auth.KeyType) + "-cert.pub")
+}
+
+// SSHHostSigner returns the signer used as SSH server. If a host cert for the
+// primary key is saved as ssh_host_<type>_key-cert.pub, it is presented to clients.
+func (auth *Auth) SSHHostSigner() (ssh.Signer, error) {
+	return auth.sshCertSigner("ssh_host_" + sshKeyName(auth.KeyType) + "_key-cert.pub")
+}
+
+func (auth *Auth) sshCertSigner(name string) (ssh.Signer, error) {
+	signer, err := auth.SSHSigner()
+	if err != nil || auth.Config == nil {
+		return signer, err
+	}
+	data, err := auth.Config.Get(name)
+	if err != nil || data == nil {
+		return signer, nil
+	}
+	pk, _, _, _, err := ssh.ParseAuthorizedKey(data)
+	if err != nil {
+		return nil, err
+	}
+	cert, ok := pk.(*ssh.Certificate)
+	if !ok || !bytes.Equal(cert.Key.Marshal(), signer.PublicKey().Marshal()) {
+		return nil, errors.New("ssh: " + name + " is not a cert for the primary key")
+	}
+	return ssh.NewCertSigner(cert, signer)
+}
+
+func sshKeyName(kt string) string {
+	if kt == KeyEC256 || kt == "" {
+		return "ecdsa"
+	}
+	return kt
+}
+
+// SignSSHCert signs a SSH certificate for the public key, using the primary key
+// of this node as CA. Used to issue host or user certs to mesh members, and in tests.
+func (auth *Auth) SignSSHCert(pub crypto.PublicKey, certType uint32, principals []string,
+	validAfter, validBefore uint64, criticalOptions map[string]string) (*ssh.Certificate, error) {
+	sk, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := auth.SSHSigner()
+	if err != nil {
+		return nil, err
+	}
+	cert := &ssh.Certificate{
+		Key:             sk,
+		Serial:          serial().Uint64(),
+		CertType:        certType,
+		KeyId:           Pub2VIP(KeyBytes(pub)).String(),
+		ValidPrincipals: principals,
+		ValidAfter:      validAfter,
+		ValidBefore:     validBefore,
+		Permissions: ssh.Permissions{
+			CriticalOptions: criticalOptions,
+		},
+	}
+	if certType == ssh.UserCert {
+		cert.Extensions = map[string]string{SSHExtPermitPortForwarding: "", "permit-pty": ""}
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		return nil, err
+	}
+	return cert, nil
+}
@@ -0,0 +1,280 @@
+package auth
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testConnMeta struct {
+	user   string
+	remote net.Addr
+}
+
+func (c *testConnMeta) User() string          { return c.user }
+func (c *testConnMeta) SessionID() []byte     { return nil }
+func (c *testConnMeta) ClientVersion() []byte { return nil }
+func (c *testConnMeta) ServerVersion() []byte { return nil }
+func (c *testConnMeta) RemoteAddr() net.Addr  { return c.remote }
+func (c *testConnMeta) LocalAddr() net.Addr   { return c.remote }
+
+func TestSSHCA(t *testing.T) {
+	ca := NewAuthWithKeyType(nil, "ca", "m.webinf.info", KeyED25519)
+	other := NewAuth(nil, "other", "m.webinf.info")
+	client := NewAuth(nil, "client", "m.webinf.info")
+	caPub := ca.SSHPublicKey("")
+
+	srvConf := memConf(map[string][]byte{
+		"authorized_keys": []byte("cert-authority,principals=\"dmesh,admin\" " + caPub + " user,member\n"),
+		"known_hosts":     []byte("@cert-authority *.m.webinf.info,[10.1.*]:5222,!bad.m.webinf.info " + caPub + "\n"),
+	})
+	srv := NewAuth(srvConf, "srv", "m.webinf.info")
+	if len(srv.UserCAs) != 1 || len(srv.HostCAs) != 1 {
+		t.Fatal("CAs not loaded", srv.UserCAs, srv.HostCAs)
+	}
+	if srv.Auth(ca.Pub, "") != "" {
+		t.Error("CA key authorized as user")
+	}
+
+	now := uint64(time.Now().Unix())
+	remote := &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}
+	sign := func(signer *Auth, certType uint32, principals []string, after, before uint64, opts map[string]string) *ssh.Certificate {
+		c, err := signer.SignSSHCert(client.PublicKey(), certType, principals, after, before, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	for _, tc := range []struct {
+		name string
+		cert *ssh.Certificate
+		user string
+		ok   bool
+	}{
+		{name: "valid", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now-10, now+3600, nil), ok: true},
+		{name: "expired", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now-7200, now-3600, nil)},
+		{name: "notYetValid", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now+3600, now+7200, nil)},
+		{name: "principal", cert: sign(ca, ssh.UserCert, []string{"bob"}, now-10, now+3600, nil)},
+		{name: "noPrincipals", cert: sign(ca, ssh.UserCert, nil, now-10, now+3600, nil)},
+		{name: "unknownCA", cert: sign(other, ssh.UserCert, []string{"dmesh"}, now-10, now+3600, nil)},
+		{name: "hostCert", cert: sign(ca, ssh.HostCert, []string{"dmesh"}, now-10, now+3600, nil)},
+		{name: "criticalOption", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now-10, now+3600,
+			map[string]string{"verify-required": ""})},
+		{name: "sourceAddress", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now-10, now+3600,
+			map[string]string{SSHOptSourceAddress: "10.1.0.0/16,::1"}), ok: true},
+		{name: "sourceAddressDenied", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now-10, now+3600,
+			map[string]string{SSHOptSourceAddress: "192.168.1.1"})},
+		{name: "forced", cert: sign(ca, ssh.UserCert, []string{"dmesh"}, now-10, now+3600,
+			map[string]string{SSHOptForceCommand: "/bin/true"}), ok: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			user := tc.user
+			if user == "" {
+				user = "dmesh"
+			}
+			perms, role, err := srv.AuthenticateSSHCert(&testConnMeta{user: user, remote: remote}, tc.cert)
+			if (err == nil) != tc.ok {
+				t.Fatal("Unexpected result", err)
+			}
+			if err != nil {
+				return
+			}
+			if role != "user,member" {
+				t.Error("Unexpected role", role)
+			}
+			for k, v := range tc.cert.CriticalOptions {
+				if perms.CriticalOptions[k] != v {
+					t.Error("Missing critical option", k)
+				}
+			}
+		})
+	}
+
+	// Authorized key role takes precedence over the CA role.
+	srv.AddAuthorized(client.Pub, "admin")
+	if _, role, _ := srv.AuthenticateSSHCert(&testConnMeta{user: "dmesh", remote: remote},
+		sign(ca, ssh.UserCert, []string{"admin"}, now-10, now+3600, nil)); role != "admin" {
+		t.Error("Expected key role", role)
+	}
+
+	// Host certs
+	for _, tc := range []struct {
+		addr       string
+		principals []string
+		ok         bool
+	}{
+		{addr: "h1.m.webinf.info:5222", principals: []string{"h1.m.webinf.info"}, ok: true},
+		{addr: "10.1.2.3:5222", principals: []string{"10.1.2.3"}, ok: true},
+		{addr: "10.1.2.3:22", principals: []string{"10.1.2.3"}},
+		{addr: "h1.other.com:5222", principals: []string{"h1.other.com"}},
+		{addr: "bad.m.webinf.info:5222", principals: []string{"bad.m.webinf.info"}},
+		{addr: "h2.m.webinf.info:5222", principals: []string{"h1.m.webinf.info"}},
+		{addr: "h1.m.webinf.info:5222"},
+	} {
+		c := sign(ca, ssh.HostCert, tc.principals, now-10, now+3600, nil)
+		if err := srv.CheckSSHHostCert(tc.addr, remote, c); (err == nil) != tc.ok {
+			t.Error("Unexpected host cert result", tc.addr, tc.principals, err)
+		}
+	}
+	if err := srv.CheckSSHHostCert("h1.m.webinf.info:5222", remote,
+		sign(ca, ssh.UserCert, []string{"h1.m.webinf.info"}, now-10, now+3600, nil)); err == nil {
+		t.Error("User cert accepted as host cert")
+	}
+}
+
+// Options of the cert-authority line restrict all certs of the CA.
+func TestSSHCAOptions(t *testing.T) {
+	ca := NewAuth(nil, "ca", "m.webinf.info")
+	client := NewAuth(nil, "client", "m.webinf.info")
+	srv := NewAuth(memConf(map[string][]byte{
+		"authorized_keys": []byte(`cert-authority,restrict,from="10.0.0.0/8",permitopen="localhost:8080" ` +
+			ca.SSHPublicKey("") + " member\n" +
+			`cert-authority,command="/bin/msgs" ` + client.SSHPublicKey("") + " member\n"),
+	}), "srv", "m.webinf.info")
+
+	now := uint64(time.Now().Unix())
+	cert, err := ca.SignSSHCert(client.PublicKey(), ssh.UserCert, []string{"dmesh"}, now-10, now+3600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lan := &testConnMeta{user: "dmesh", remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+	perms, _, err := srv.AuthenticateSSHCert(lan, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SSHPermitOpen(perms, "localhost", 8080); err != ErrSSHNoForwarding {
+		t.Error("restrict not applied to the cert", err)
+	}
+	if perms.Extensions[SSHOptPermitOpen] != "localhost:8080" {
+		t.Error("permitopen not applied to the cert", perms.Extensions)
+	}
+
+	wan := &testConnMeta{user: "dmesh", remote: &net.TCPAddr{IP: net.ParseIP("192.168.1.1"), Port: 1234}}
+	if _, _, err := srv.AuthenticateSSHCert(wan, cert); err != ErrSSHFrom {
+		t.Error("from not applied to the cert", err)
+	}
+
+	// A CA forcing a command - the cert can't force another one.
+	cert, _ = client.SignSSHCert(client.PublicKey(), ssh.UserCert, []string{"dmesh"}, now-10, now+3600, nil)
+	if perms, _, err := srv.AuthenticateSSHCert(lan, cert); err != nil || perms.CriticalOptions[SSHOptForceCommand] != "/bin/msgs" {
+		t.Error("CA command not applied", err)
+	}
+	cert, _ = client.SignSSHCert(client.PublicKey(), ssh.UserCert, []string{"dmesh"}, now-10, now+3600,
+		map[string]string{SSHOptForceCommand: "/bin/sh"})
+	if _, _, err := srv.AuthenticateSSHCert(lan, cert); err == nil {
+		t.Error("Conflicting force-command accepted")
+	}
+}
+
+// End to end: server presents a host cert, client a user cert, both signed by the CA.
+func TestSSHCAHandshake(t *testing.T) {
+	ca := NewAuth(nil, "ca", "m.webinf.info")
+	caPub := ca.SSHPublicKey("")
+	now := uint64(time.Now().Unix())
+
+	mkNode := func(name string, certType uint32, principal string) *Auth {
+		conf := memConf(map[string][]byte{
+			"authorized_keys": []byte("cert-authority " + caPub + " member\n"),
+			"known_hosts":     []byte("@cert-authority *.m.webinf.info " + caPub + "\n"),
+		})
+		a := NewAuth(conf, name, "m.webinf.info")
+		c, err := ca.SignSSHCert(a.PublicKey(), certType, []string{principal}, now-10, now+3600, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file := "id_ecdsa-cert.pub"
+		if certType == ssh.HostCert {
+			file = "ssh_host_ecdsa_key-cert.pub"
+		}
+		conf.Set(file, ssh.MarshalAuthorizedKey(c))
+		return a
+	}
+	srvAuth := mkNode("srv", ssh.HostCert, "srv.m.webinf.info")
+	clientAuth := mkNode("client", ssh.UserCert, "dmesh")
+
+	hostKey, err := srvAuth.SSHHostSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hostKey.PublicKey().(*ssh.Certificate); !ok {
+		t.Fatal("Host cert not loaded")
+	}
+	role := make(chan string, 1)
+	scfg := &ssh.ServerConfig{
+		PublicKeyCallback: func(c ssh.ConnMetadata, k ssh.PublicKey) (*ssh.Permissions, error) {
+			cert, ok := k.(*ssh.Certificate)
+			if !ok {
+				return nil, errors.New("cert required")
+			}
+			p, r, err := srvAuth.AuthenticateSSHCert(c, cert)
+			if err == nil {
+				role <- r
+			}
+			return p, err
+		},
+	}
+	scfg.AddHostKey(hostKey)
+
+	signer, err := clientAuth.SSHUserSigner()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ccfg := &ssh.ClientConfig{
+		User: "dmesh",
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: func(hostname string, remote net.Addr, k ssh.PublicKey) error {
+			cert, ok := k.(*ssh.Certificate)
+			if !ok {
+				return errors.New("host cert required")
+			}
+			return clientAuth.CheckSSHHostCert(hostname, remote, cert)
+		},
+		HostKeyAlgorithms: []string{ssh.CertAlgoECDSA256v01},
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			sc, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if conn, _, _, err := ssh.NewServerConn(sc, scfg); err == nil {
+				conn.Close()
+			}
+			sc.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	dial := func(host string) error {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return err
+		}
+		c, _, _, err := ssh.NewClientConn(conn, net.JoinHostPort(host, port), ccfg)
+		if err != nil {
+			return err
+		}
+		c.Close()
+		return nil
+	}
+	if err := dial("srv.m.webinf.info"); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-role; r != "member" {
+		t.Error("Unexpected role", r)
+	}
+	if err := dial("other.m.webinf.info"); err == nil || !strings.Contains(err.Error(), "principal") {
+		t.Error("Expected principal mismatch", err)
+	}
+}
@@ -0,0 +1,289 @@
+package auth
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"path"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// OpenSSH compatible authorized_keys options, for locked-down keys:
+//
+//  from="10.1.0.0/16,192.168.1.*,!10.1.2.3",expiry-time="20250101",restrict,port-forwarding,permitopen="localhost:8080" ssh-ed25519 AAAA... device
+//
+// - from: patterns or CIDR ranges for the source IP, "!" negates.
+// - expiry-time: YYYYMMDD[HHMM[SS]], local time or UTC with a Z suffix.
+// - no-port-forwarding, restrict: disable -L and -R. With restrict, port-forwarding
+// re-enables forwarding.
+// - permitopen: host:port allowed for -L, "*" matches any host or port. Can be repeated.
+// - permitlisten: [host:]port allowed for -R. Can be repeated.
+// - command: runs instead of the requested shell or exec, same as force-command
+// in certs. The gate only implements the message stream commands, sessions
+// of keys forced to run other commands are refused.
+//
+// The options are checked when the key is authenticated, and returned in the
+// ssh.Permissions for the server to enforce on forwarding requests.
+
+const (
+	SSHOptFrom             = "from"
+	SSHOptExpiryTime       = "expiry-time"
+	SSHOptNoPortForwarding = "no-port-forwarding"
+	SSHOptPortForwarding   = "port-forwarding"
+	SSHOptRestrict         = "restrict"
+	SSHOptPermitOpen       = "permitopen"
+	SSHOptPermitListen     = "permitlisten"
+	SSHOptCommand          = "command"
+)
+
+var (
+	ErrSSHKeyExpired   = errors.New("ssh: key expired")
+	ErrSSHFrom         = errors.New("ssh: source address not allowed for key")
+	ErrSSHNoForwarding = errors.New("ssh: port forwarding disabled for key")
+	ErrSSHPermitOpen   = errors.New("ssh: destination not permitted for key")
+	ErrSSHPermitListen = errors.New("ssh: listen port not permitted for key")
+	ErrSSHCommand      = errors.New("ssh: forced command not supported")
+)
+
+// sshMsgCommands are the session commands implemented by the gate, all running
+// the message stream on stdin and stdout. Matched by base name, the client
+// runs /usr/local/bin/dmeshc.
+var sshMsgCommands = map[string]bool{
+	"dmeshc":   true,
+	"dmeshMsg": true,
+}
+
+// sshMultiOpts are options that can be repeated - values are joined with ",".
+var sshMultiOpts = map[string]bool{
+	SSHOptPermitOpen:   true,
+	SSHOptPermitListen: true,
+}
+
+// AuthzByPub returns the authorized_keys entry for a key, in KeyBytes format.
+func (auth *Auth) AuthzByPub(pub []byte) *AuthzInfo {
+	if len(pub) == 0 {
+		return nil
+	}
+	auth.authzMutex.RLock()
+	ai := auth.AuthzByID[Pub2ID(pub)]
+	auth.authzMutex.RUnlock()
+	if ai == nil || !bytes.Equal(ai.Public, pub) {
+		return nil
+	}
+	return ai
+}
+
+// AuthenticateSSHKey checks the authorized_keys options of a plain key used by
+// a client, and returns the permissions to be enforced by the server. Keys not
+// in authorized_keys have no restrictions - they are guests.
+func (auth *Auth) AuthenticateSSHKey(conn ssh.ConnMetadata, pub []byte) (*ssh.Permissions, error) {
+	perms := &ssh.Permissions{
+		CriticalOptions: map[string]string{},
+		Extensions:      map[string]string{},
+	}
+	if auth.IsRevoked(pub) {
+		return nil, ErrRevoked
+	}
+	return perms, auth.keyPermissions(auth.AuthzByPub(pub), conn.RemoteAddr(), perms)
+}
+
+// keyPermissions checks the options of an authorized_keys entry and adds them
+// to perms. A nil remote fails the "from" option - the source is not known.
+func (auth *Auth) keyPermissions(ai *AuthzInfo, remote net.Addr, perms *ssh.Permissions) error {
+	if ai == nil {
+		return nil
+	}
+	if exp, ok := ai.Opts[SSHOptExpiryTime]; ok {
+		t, err := parseSSHExpiry(exp)
+		if err != nil {
+			return err
+		}
+		if time.Now().After(t) {
+			return ErrSSHKeyExpired
+		}
+	}
+	if from, ok := ai.Opts[SSHOptFrom]; ok {
+		if remote == nil || !matchFrom(from, remote) {
+			return ErrSSHFrom
+		}
+	}
+	if cmd, ok := ai.Opts[SSHOptCommand]; ok {
+		perms.CriticalOptions[SSHOptForceCommand] = cmd
+	}
+
+	_, noFwd := ai.Opts[SSHOptNoPortForwarding]
+	if _, ok := ai.Opts[SSHOptRestrict]; ok {
+		if _, ok := ai.Opts[SSHOptPortForwarding]; !ok {
+			noFwd = true
+		}
+	}
+	if noFwd {
+		perms.Extensions[SSHOptNoPortForwarding] = ""
+	}
+	for _, o := range []string{SSHOptPermitOpen, SSHOptPermitListen} {
+		if v, ok := ai.Opts[o]; ok {
+			perms.Extensions[o] = v
+		}
+	}
+	return nil
+}
+
+// SSHSessionCommand returns the command to run for a shell or exec request,
+// from the permissions returned by AuthenticateSSHKey or AuthenticateSSHCert.
+// A force-command replaces the requested command, and must be one of the
+// message stream commands - running the stream instead would give the key
+// more access than the command it is restricted to.
+func SSHSessionCommand(perms *ssh.Permissions, command string) (string, error) {
+	if perms == nil {
+		return command, nil
+	}
+	force, ok := perms.CriticalOptions[SSHOptForceCommand]
+	if !ok {
+		return command, nil
+	}
+	f := strings.Fields(force)
+	if len(f) == 0 || !sshMsgCommands[path.Base(f[0])] {
+		return "", ErrSSHCommand
+	}
+	return force, nil
+}
+
+// sshForwarding returns ErrSSHNoForwarding if forwarding is disabled for the
+// key, or if the client used a cert without the permit-port-forwarding extension.
+func sshForwarding(perms *ssh.Permissions) error {
+	if _, ok := perms.Extensions[SSHOptNoPortForwarding]; ok {
+		return ErrSSHNoForwarding
+	}
+	if _, ok := perms.Extensions[SSHExtCA]; ok {
+		if _, ok := perms.Extensions[SSHExtPermitPortForwarding]; !ok {
+			return ErrSSHNoForwarding
+		}
+	}
+	return nil
+}
+
+// SSHPermitOpen checks a -L (direct-tcpip) destination against the permissions
+// returned by AuthenticateSSHKey or AuthenticateSSHCert.
+func SSHPermitOpen(perms *ssh.Permissions, host string, port uint32) error {
+	if perms == nil {
+		return nil
+	}
+	if err := sshForwarding(perms); err != nil {
+		return err
+	}
+	allowed, ok := perms.Extensions[SSHOptPermitOpen]
+	if !ok {
+		return nil
+	}
+	for _, p := range strings.Split(allowed, ",") {
+		ph, pp, err := net.SplitHostPort(strings.TrimSpace(p))
+		if err != nil {
+			continue
+		}
+		if matchPort(pp, port) && matchHostPattern(ph, host) {
+			return nil
+		}
+	}
+	return ErrSSHPermitOpen
+}
+
+// SSHPermitListen checks a -R (tcpip-forward) bind address against the
+// permissions returned by AuthenticateSSHKey or AuthenticateSSHCert.
+func SSHPermitListen(perms *ssh.Permissions, host string, port uint32) error {
+	if perms == nil {
+		return nil
+	}
+	if err := sshForwarding(perms); err != nil {
+		return err
+	}
+	allowed, ok := perms.Extensions[SSHOptPermitListen]
+	if !ok {
+		return nil
+	}
+	for _, p := range strings.Split(allowed, ",") {
+		p = strings.TrimSpace(p)
+		ph, pp, err := net.SplitHostPort(p)
+		if err != nil {
+			// Port only - any bind address.
+			ph, pp = "*", p
+		}
+		if matchPort(pp, port) && matchHostPattern(ph, host) {
+			return nil
+		}
+	}
+	return ErrSSHPermitListen
+}
+
+func matchPort(pattern string, port uint32) bool {
+	if pattern == "*" {
+		return true
+	}
+	p, err := net.LookupPort("tcp", pattern)
+	return err == nil && uint32(p) == port
+}
+
+func matchHostPattern(pattern, host string) bool {
+	if pattern == "*" {
+		return true
+	}
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return ok
+}
+
+// matchFrom checks the remote address against a from= pattern list. Patterns
+// are CIDR ranges or IP wildcards, negated patterns take precedence.
+func matchFrom(patterns string, remote net.Addr) bool {
+	host := remote.String()
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	res := false
+	for _, p := range strings.Split(patterns, ",") {
+		p = strings.TrimSpace(p)
+		neg := strings.HasPrefix(p, "!")
+		if neg {
+			p = p[1:]
+		}
+		var ok bool
+		if strings.Contains(p, "/") {
+			_, n, err := net.ParseCIDR(p)
+			ok = err == nil && ip != nil && n.Contains(ip)
+		} else {
+			ok = matchHostPattern(p, host)
+		}
+		if !ok {
+			continue
+		}
+		if neg {
+			return false
+		}
+		res = true
+	}
+	return res
+}
+
+// parseSSHExpiry parses an expiry-time value: YYYYMMDD[HHMM[SS]], in local time
+// unless it has a Z suffix.
+func parseSSHExpiry(v string) (time.Time, error) {
+	loc := time.Local
+	if strings.HasSuffix(v, "Z") {
+		loc = time.UTC
+		v = v[:len(v)-1]
+	}
+	var layout string
+	switch len(v) {
+	case 8:
+		layout = "20060102"
+	case 12:
+		layout = "200601021504"
+	case 14:
+		layout = "20060102150405"
+	default:
+		return time.Time{}, errors.New("ssh: invalid expiry-time " + v)
+	}
+	return time.ParseInLocation(layout, v, loc)
+}
@@ -0,0 +1,188 @@
+package auth
+
+import (
+	"crypto/rand"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestSSHKeyOptions(t *testing.T) {
+	keys := map[string]*Auth{}
+	for _, n := range []string{"open", "device", "restricted", "fwd", "expired", "valid", "cmd", "msg", "bad"} {
+		keys[n] = NewAuth(nil, n, "m.webinf.info")
+	}
+	future := time.Now().Add(24*time.Hour).UTC().Format("20060102") + "Z"
+	conf := memConf(map[string][]byte{
+		"authorized_keys": []byte(keys["open"].SSHPublicKey("member") + "\n" +
+			`from="10.1.0.0/16,192.168.1.*,!10.1.2.3",permitopen="localhost:8080",permitopen="[::1]:*",permitlisten="9000",permitlisten="127.0.0.1:9001" ` +
+			keys["device"].SSHPublicKey("device") + "\n" +
+			"restrict " + keys["restricted"].SSHPublicKey("device") + "\n" +
+			"restrict,port-forwarding " + keys["fwd"].SSHPublicKey("device") + "\n" +
+			"expiry-time=\"20200101\" " + keys["expired"].SSHPublicKey("device") + "\n" +
+			"expiry-time=\"" + future + "\",no-port-forwarding " + keys["valid"].SSHPublicKey("device") + "\n" +
+			"command=\"/bin/msgs\" " + keys["cmd"].SSHPublicKey("device") + "\n" +
+			"command=\"/usr/local/bin/dmeshc\" " + keys["msg"].SSHPublicKey("device") + "\n" +
+			"expiry-time=\"2020\" " + keys["bad"].SSHPublicKey("device") + "\n"),
+	})
+	node := NewAuth(conf, "node", "m.webinf.info")
+	lan := &testConnMeta{user: "dmesh", remote: &net.TCPAddr{IP: net.ParseIP("10.1.5.5"), Port: 1234}}
+
+	for _, tc := range []struct {
+		key    string
+		remote string
+		ok     bool
+	}{
+		{key: "open", remote: "8.8.8.8", ok: true},
+		{key: "device", remote: "10.1.5.5", ok: true},
+		{key: "device", remote: "192.168.1.20", ok: true},
+		{key: "device", remote: "10.1.2.3"},
+		{key: "device", remote: "10.2.5.5"},
+		{key: "expired", remote: "10.1.5.5"},
+		{key: "valid", remote: "10.1.5.5", ok: true},
+		{key: "bad", remote: "10.1.5.5"},
+	} {
+		cm := &testConnMeta{user: "dmesh", remote: &net.TCPAddr{IP: net.ParseIP(tc.remote), Port: 1234}}
+		if _, err := node.AuthenticateSSHKey(cm, keys[tc.key].Pub); (err == nil) != tc.ok {
+			t.Error("Unexpected auth result", tc.key, tc.remote, err)
+		}
+	}
+
+	perms := func(k string) *ssh.Permissions {
+		p, err := node.AuthenticateSSHKey(lan, keys[k].Pub)
+		if err != nil {
+			t.Fatal(k, err)
+		}
+		return p
+	}
+	for _, tc := range []struct {
+		key    string
+		listen bool
+		host   string
+		port   uint32
+		ok     bool
+	}{
+		{key: "open", host: "example.com", port: 22, ok: true},
+		{key: "open", listen: true, host: "0.0.0.0", port: 80, ok: true},
+		{key: "device", host: "localhost", port: 8080, ok: true},
+		{key: "device", host: "localhost", port: 8081},
+		{key: "device", host: "example.com", port: 8080},
+		{key: "device", host: "::1", port: 22, ok: true},
+		{key: "device", listen: true, host: "0.0.0.0", port: 9000, ok: true},
+		{key: "device", listen: true, host: "0.0.0.0", port: 9001},
+		{key: "device", listen: true, host: "127.0.0.1", port: 9001, ok: true},
+		{key: "device", listen: true, host: "0.0.0.0", port: 5222},
+		{key: "restricted", host: "localhost", port: 8080},
+		{key: "restricted", listen: true, host: "0.0.0.0", port: 5222},
+		{key: "fwd", host: "localhost", port: 8080, ok: true},
+		{key: "valid", host: "localhost", port: 8080},
+	} {
+		p := perms(tc.key)
+		var err error
+		if tc.listen {
+			err = SSHPermitListen(p, tc.host, tc.port)
+		} else {
+			err = SSHPermitOpen(p, tc.host, tc.port)
+		}
+		if (err == nil) != tc.ok {
+			t.Error("Unexpected forward result", tc.key, tc.listen, tc.host, tc.port, err)
+		}
+	}
+
+	if c := perms("cmd").CriticalOptions[SSHOptForceCommand]; c != "/bin/msgs" {
+		t.Error("Expected forced command", c)
+	}
+	// The gate only runs the message stream - other forced commands are refused.
+	if c, err := SSHSessionCommand(perms("cmd"), ""); err != ErrSSHCommand {
+		t.Error("Expected refused command", c, err)
+	}
+	if c, err := SSHSessionCommand(perms("msg"), "/bin/sh"); err != nil || c != "/usr/local/bin/dmeshc" {
+		t.Error("Expected message command", c, err)
+	}
+	if c, err := SSHSessionCommand(perms("open"), "/bin/sh"); err != nil || c != "/bin/sh" {
+		t.Error("Unexpected command", c, err)
+	}
+}
+
+func TestAuthorizeE2E(t *testing.T) {
+	keys := map[string]*Auth{}
+	for _, n := range []string{"member", "device", "lan", "revoked", "guest"} {
+		keys[n] = NewAuth(nil, n, "m.webinf.info")
+	}
+	conf := memConf(map[string][]byte{
+		"authorized_keys": []byte(keys["member"].SSHPublicKey("member") + "\n" +
+			`permitopen="localhost:8080" ` + keys["device"].SSHPublicKey("device") + "\n" +
+			`from="10.0.0.0/8" ` + keys["lan"].SSHPublicKey("device") + "\n" +
+			keys["revoked"].SSHPublicKey("member") + "\n"),
+		PolicyFile: []byte(`{"rules": [{"action": "deny", "kinds": ["ssh"], "hosts": ["[127.0.0.1]:22"]}]}`),
+	})
+	node := NewAuth(conf, "node", "m.webinf.info")
+	node.Revoke(keys["revoked"].Pub, "test")
+
+	for _, tc := range []struct {
+		key  string
+		port int
+		ok   bool
+	}{
+		{key: "member", port: 8080, ok: true},
+		{key: "member", port: 22},
+		{key: "device", port: 8080, ok: true},
+		{key: "device", port: 8081},
+		{key: "lan", port: 8080},
+		{key: "revoked", port: 8080},
+		{key: "guest", port: 8080},
+	} {
+		if err := node.AuthorizeE2E(keys[tc.key].Pub, tc.port); (err == nil) != tc.ok {
+			t.Error("Unexpected E2E result", tc.key, tc.port, err)
+		}
+	}
+}
+
+// Certs without the permit-port-forwarding extension can't forward.
+func TestSSHCertForwarding(t *testing.T) {
+	ca := NewAuth(nil, "ca", "m.webinf.info")
+	client := NewAuth(nil, "client", "m.webinf.info")
+	srv := NewAuth(memConf(map[string][]byte{
+		"authorized_keys": []byte("cert-authority " + ca.SSHPublicKey("") + " member\n"),
+	}), "srv", "m.webinf.info")
+	cm := &testConnMeta{user: "dmesh", remote: &net.TCPAddr{IP: net.ParseIP("10.1.2.3"), Port: 1234}}
+
+	now := uint64(time.Now().Unix())
+	cert, err := ca.SignSSHCert(client.PublicKey(), ssh.UserCert, []string{"dmesh"}, now-10, now+3600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	perms, _, err := srv.AuthenticateSSHCert(cm, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if SSHPermitOpen(perms, "localhost", 8080) != nil || SSHPermitListen(perms, "", 9000) != nil {
+		t.Error("Forwarding denied with permit-port-forwarding")
+	}
+
+	// No extensions.
+	sk, _ := ssh.NewPublicKey(client.PublicKey())
+	signer, _ := ca.SSHSigner()
+	cert = &ssh.Certificate{
+		Key:             sk,
+		CertType:        ssh.UserCert,
+		ValidPrincipals: []string{"dmesh"},
+		ValidAfter:      now - 10,
+		ValidBefore:     now + 3600,
+	}
+	if err := cert.SignCert(rand.Reader, signer); err != nil {
+		t.Fatal(err)
+	}
+	perms, _, err = srv.AuthenticateSSHCert(cm, cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SSHPermitOpen(perms, "localhost", 8080); err != ErrSSHNoForwarding {
+		t.Error("-L allowed without permit-port-forwarding", err)
+	}
+	if err := SSHPermitListen(perms, "", 9000); err != ErrSSHNoForwarding {
+		t.Error("-R allowed without permit-port-forwarding", err)
+	}
+}
@@ -0,0 +1,74 @@
+package auth
+
+import (
+	"crypto"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+
+	uauth "github.com/costinm/ugate/pkg/auth"
+)
+
+// The ugate auth - used by the ugate gateway, messaging and the H2 transport -
+// loads its key and cert from kube.json, and saves a new plain text key if
+// missing. It gets the node key instead, so the node has a single identity and
+// the key is only saved here - encrypted if a KEK is set.
+
+// ugateKubeConfig is the ConfStore name of the ugate key and cert.
+const ugateKubeConfig = "kube.json"
+
+// ErrUGateKeyType is returned for kube.json if the node key is not EC256: the
+// ugate auth would derive a different VIP from other key types.
+var ErrUGateKeyType = errors.New("auth: ugate requires an EC256 node key")
+
+// UGateConfig returns the ConfStore for the ugate auth: kube.json has the
+// current node key and cert, writes to it are dropped. Other names use cs.
+func (auth *Auth) UGateConfig(cs ConfStore) ConfStore {
+	return &ugateConf{ConfStore: cs, auth: auth}
+}
+
+type ugateConf struct {
+	ConfStore
+	auth *Auth
+}
+
+func (uc *ugateConf) Get(name string) ([]byte, error) {
+	if name != ugateKubeConfig {
+		return uc.ConfStore.Get(name)
+	}
+	if uc.auth.KeyType != KeyEC256 {
+		return nil, ErrUGateKeyType
+	}
+	c := uc.auth.Certificate()
+	if c == nil {
+		return nil, errors.New("auth: no node key")
+	}
+	k, ok := c.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("auth: no node key")
+	}
+	certPEM := []byte{}
+	for _, der := range c.Certificate {
+		certPEM = append(certPEM, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})...)
+	}
+	kc := &uauth.KubeConfig{
+		ApiVersion: "v1",
+		Kind:       "Config",
+		Users: []uauth.KubeNamedUser{
+			{Name: "default",
+				User: uauth.KubeUser{
+					ClientKeyData:         marshalPrivate(k),
+					ClientCertificateData: certPEM,
+				},
+			},
+		},
+	}
+	return json.Marshal(kc)
+}
+
+func (uc *ugateConf) Set(name string, data []byte) error {
+	if name == ugateKubeConfig {
+		return nil
+	}
+	return uc.ConfStore.Set(name, data)
+}
@@ -0,0 +1,79 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"net/url"
+	"time"
+
+	"github.com/costinm/ugate/pkg/auth"
+)
+
+// RFC8292 - VAPID
+
+var (
+	// encoded {"typ":"JWT","alg":"ES256"}
+	vapidPrefix = []byte("eyJ0eXAiOiJKV1QiLCJhbGciOiJFUzI1NiJ9.")
+	dot         = []byte(".")
+)
+
+// VAPIDToken creates a token for the push service URL, using the EC256 key
+// and a 1h expiration.
+//
+// The Sub field is a contact URI, as required by RFC8292: mailto:Name@Domain,
+// or https://Domain if the name is not set.
+// The result is the value of the Authorization header, using the 'vapid' scheme.
+func (a *Auth) VAPIDToken(aud string) string {
+	jwt := auth.JWT{}
+	u, err := url.Parse(aud)
+	if err != nil || len(u.Host) == 0 {
+		jwt.Aud = aud
+	} else {
+		jwt.Aud = u.Scheme + "://" + u.Host
+	}
+	if a.Domain != "" {
+		jwt.Sub = "https://" + a.Domain
+		if a.Name != "" {
+			jwt.Sub = "mailto:" + a.Name + "@" + a.Domain
+		}
+	}
+	jwt.Exp = time.Now().Unix() + 3600
+	t, _ := json.Marshal(jwt)
+
+	return a.VAPIDSign(t)
+}
+
+// VAPIDSign signs a JWT payload, returning the Authorization header.
+func (a *Auth) VAPIDSign(t []byte) string {
+	enc := base64.RawURLEncoding
+
+	token := make([]byte, 0, len(vapidPrefix)+enc.EncodedLen(len(t))+90)
+	token = append(token, vapidPrefix...)
+	t64 := make([]byte, enc.EncodedLen(len(t)))
+	enc.Encode(t64, t)
+	token = append(token, t64...)
+
+	hasher := crypto.SHA256.New()
+	hasher.Write(token)
+
+	r, s, err := ecdsa.Sign(rand.Reader, a.EC256PrivateKey, hasher.Sum(nil))
+	if err != nil {
+		return ""
+	}
+	// R and S are 32 bytes each, padded.
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):], rb)
+	copy(sig[64-len(sb):], sb)
+
+	sigB64 := make([]byte, enc.EncodedLen(len(sig)))
+	enc.Encode(sigB64, sig)
+
+	token = append(token, dot...)
+	token = append(token, sigB64...)
+
+	return "vapid t=" + string(token) + ", k=" + enc.EncodeToString(a.EC256Pub)
+}
@@ -0,0 +1,34 @@
+package auth
+
+import (
+	"testing"
+	"time"
+
+	"github.com/costinm/ugate/pkg/auth"
+)
+
+func TestVAPIDToken(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		sub  string
+	}{
+		{name: "ua", sub: "mailto:ua@m.webinf.info"},
+		{name: "", sub: "https://m.webinf.info"},
+	} {
+		a := NewAuth(nil, "ua", "m.webinf.info")
+		a.Name = tc.name
+		jwt, pub, err := auth.CheckVAPID(a.VAPIDToken("https://push.example.com/m/1"), time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if jwt.Sub != tc.sub {
+			t.Error("Invalid sub", jwt.Sub, tc.sub)
+		}
+		if jwt.Aud != "https://push.example.com" {
+			t.Error("Invalid aud", jwt.Aud)
+		}
+		if string(pub) != string(a.EC256Pub) {
+			t.Error("Invalid key")
+		}
+	}
+}
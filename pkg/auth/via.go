@@ -0,0 +1,141 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+)
+
+// Signed message path.
+//
+// Each hop forwarding a WebpushMessage appends a Via with its VIP, the time and a
+// signature. The signature covers the message (ID, From, TTL, Data), the routing
+// fields that are not part of the message (topic and final destination), all
+// previous hops including their signatures, and the VIP of the next hop - so a
+// relay can't modify the message, redirect it, remove or reorder hops or send it
+// to a different node than the one the previous hop intended.
+//
+// Sig is the 2-byte length of the public key of the hop, the public key in the
+// KeyBytes format and the signature. The VIP must match the public key, so no key
+// lookup is needed. Any primary key type can be used.
+
+// MaxHops is the default limit on the number of Via entries.
+var MaxHops = 8
+
+var (
+	ErrLoop        = errors.New("via: loop detected")
+	ErrTooManyHops = errors.New("via: too many hops")
+	ErrForged      = errors.New("via: invalid signature")
+)
+
+// viaSignData returns the digest signed by hop n.
+func viaSignData(m *webpush.WebpushMessage, topic, to string, n int, next string) []byte {
+	h := sha256.New()
+	lenBuf := make([]byte, 8)
+	write := func(b []byte) {
+		binary.BigEndian.PutUint64(lenBuf, uint64(len(b)))
+		h.Write(lenBuf)
+		h.Write(b)
+	}
+	write([]byte(m.Id))
+	write([]byte(m.From))
+	write([]byte(topic))
+	write([]byte(to))
+	binary.BigEndian.PutUint64(lenBuf, uint64(m.Ttl))
+	h.Write(lenBuf)
+	write(m.Data)
+	for i := 0; i <= n; i++ {
+		via := m.Path[i]
+		write([]byte(via.Vip))
+		binary.BigEndian.PutUint64(lenBuf, uint64(via.Time))
+		h.Write(lenBuf)
+		if i < n {
+			write(via.Sig)
+		}
+	}
+	write([]byte(next))
+	return h.Sum(nil)
+}
+
+// SignVia appends a signed Via for this node to the message path. Topic and to
+// are the topic and final destination the message is routed with, next is the VIP
+// of the node the message will be sent to.
+func (a *Auth) SignVia(m *webpush.WebpushMessage, topic, to, next string) *webpush.Via {
+	via := &webpush.Via{
+		Time: time.Now().Unix(),
+		Vip:  a.Self(),
+	}
+	m.Path = append(m.Path, via)
+
+	sig := make([]byte, 2+len(a.Pub)+a.SigSize())
+	binary.BigEndian.PutUint16(sig, uint16(len(a.Pub)))
+	copy(sig[2:], a.Pub)
+	a.Sign(viaSignData(m, topic, to, len(m.Path)-1, next), sig[2+len(a.Pub):])
+	via.Sig = sig
+	return via
+}
+
+// VerifyPath validates the signed path of a message received by this node with the
+// topic and final destination, returning the VIPs of the hops. Messages with unsigned
+// or forged hops, with more than maxHops entries or that were already forwarded by
+// this node are rejected.
+//
+// If maxHops is 0, MaxHops is used.
+func (a *Auth) VerifyPath(m *webpush.WebpushMessage, topic, to string, maxHops int) ([]string, error) {
+	if maxHops == 0 {
+		maxHops = MaxHops
+	}
+	if len(m.Path) > maxHops {
+		return nil, ErrTooManyHops
+	}
+	self := a.Self()
+	seen := map[string]bool{}
+	res := make([]string, 0, len(m.Path))
+	for i, via := range m.Path {
+		if via.Vip == self || seen[via.Vip] {
+			return nil, ErrLoop
+		}
+		seen[via.Vip] = true
+
+		if len(via.Sig) < 2 {
+			return nil, ErrForged
+		}
+		pubLen := int(binary.BigEndian.Uint16(via.Sig))
+		if len(via.Sig) < 2+pubLen+64 {
+			return nil, ErrForged
+		}
+		pub := via.Sig[2 : 2+pubLen]
+		if Pub2VIP(pub).String() != via.Vip {
+			return nil, ErrForged
+		}
+		next := self
+		if i < len(m.Path)-1 {
+			next = m.Path[i+1].Vip
+		}
+		if err := Verify(viaSignData(m, topic, to, i, next), pub, via.Sig[2+pubLen:]); err != nil {
+			return nil, ErrForged
+		}
+		res = append(res, via.Vip)
+	}
+	if m.From != "" && len(res) > 0 && res[0] != m.From {
+		return nil, ErrForged
+	}
+	return res, nil
+}
+
+// CheckPath verifies the message path and sets the verified path in the request
+// context. The last hop must be the authenticated peer.
+func (a *Auth) CheckPath(rc *ReqContext, m *webpush.WebpushMessage, topic, to string) error {
+	p, err := a.VerifyPath(m, topic, to, 0)
+	if err != nil {
+		return err
+	}
+	if len(p) > 0 && (rc.VIP == nil || p[len(p)-1] != rc.VIP.String()) {
+		return ErrForged
+	}
+	rc.Path = p
+	return nil
+}
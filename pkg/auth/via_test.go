@@ -0,0 +1,94 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestVia(t *testing.T) {
+	a := NewAuth(nil, "a", "m.webinf.info")
+	b := NewAuth(nil, "b", "m.webinf.info")
+	c := NewAuth(nil, "c", "m.webinf.info")
+	d := NewAuth(nil, "d", "m.webinf.info")
+
+	// a -> b -> c
+	newMsg := func() *webpush.WebpushMessage {
+		m := &webpush.WebpushMessage{Id: "1", From: a.Self(), Data: []byte("hi")}
+		a.SignVia(m, "q", c.Self(), b.Self())
+		if _, err := b.VerifyPath(m, "q", c.Self(), 0); err != nil {
+			t.Fatal("First hop failed", err)
+		}
+		b.SignVia(m, "q", c.Self(), c.Self())
+		return m
+	}
+
+	m := newMsg()
+	p, err := c.VerifyPath(m, "q", c.Self(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p) != 2 || p[0] != a.Self() || p[1] != b.Self() {
+		t.Error("Unexpected path", p)
+	}
+
+	rc := &ReqContext{VIP: b.VIP6}
+	if err := c.CheckPath(rc, m, "q", c.Self()); err != nil || len(rc.Path) != 2 {
+		t.Error("CheckPath failed", err, rc.Path)
+	}
+	if err := c.CheckPath(&ReqContext{VIP: d.VIP6}, m, "q", c.Self()); err != ErrForged {
+		t.Error("Expected last hop mismatch", err)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		mod    func(m *webpush.WebpushMessage)
+		verify *Auth
+		topic  string
+		to     *Auth
+		max    int
+		err    error
+	}{
+		{name: "data", mod: func(m *webpush.WebpushMessage) { m.Data = []byte("changed") }, err: ErrForged},
+		{name: "from", mod: func(m *webpush.WebpushMessage) { m.From = d.Self() }, err: ErrForged},
+		{name: "ttl", mod: func(m *webpush.WebpushMessage) { m.Ttl = 3600 }, err: ErrForged},
+		{name: "topic", topic: "ack", err: ErrForged},
+		{name: "to", to: d, err: ErrForged},
+		{name: "removeHop", mod: func(m *webpush.WebpushMessage) { m.Path = m.Path[1:] }, err: ErrForged},
+		{name: "time", mod: func(m *webpush.WebpushMessage) { m.Path[0].Time++ }, err: ErrForged},
+		{name: "vip", mod: func(m *webpush.WebpushMessage) { m.Path[1].Vip = d.Self() }, err: ErrForged},
+		{name: "unsigned", mod: func(m *webpush.WebpushMessage) { m.Path[1].Sig = nil }, err: ErrForged},
+		// b intended the message for c
+		{name: "reroute", verify: d, err: ErrForged},
+		{name: "loop", mod: func(m *webpush.WebpushMessage) { c.SignVia(m, "q", c.Self(), a.Self()) }, verify: a, err: ErrLoop},
+		{name: "maxHops", max: 1, err: ErrTooManyHops},
+		{name: "proto", mod: func(m *webpush.WebpushMessage) {
+			b, _ := proto.Marshal(m)
+			m.Reset()
+			proto.Unmarshal(b, m)
+		}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			m := newMsg()
+			if tc.mod != nil {
+				tc.mod(m)
+			}
+			v := tc.verify
+			if v == nil {
+				v = c
+			}
+			topic, to := tc.topic, tc.to
+			if topic == "" {
+				topic = "q"
+			}
+			if to == nil {
+				to = c
+			}
+			_, err := v.VerifyPath(m, topic, to.Self(), tc.max)
+			if err != tc.err {
+				t.Error("Unexpected result", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,125 @@
+package auth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+var b64 = base64.RawURLEncoding
+
+func d64(s string) []byte {
+	b, _ := b64.DecodeString(s)
+	return b
+}
+
+// RFC8291 Appendix A
+func TestRfcVector(t *testing.T) {
+	salt := d64("DGv6ra1nlYgDCS1FRnbzlw")
+	origSalt := randomSalt
+	randomSalt = func() ([]byte, error) { return salt, nil }
+	defer func() { randomSalt = origSalt }()
+
+	sub := &Subscription{
+		Key:  d64("BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"),
+		Auth: d64("BTBZMqHH6r4Tts7J_aSIgg"),
+	}
+	ec := NewContextSend(sub)
+	ec.SendPrivate = d64("yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw")
+	ec.SendPublic = d64("BP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A8")
+
+	msg := "When I grow up, I want to be a watermelon"
+	res, err := ec.Encrypt([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+	if b64.EncodeToString(res) != exp {
+		t.Error("Unexpected result ", b64.EncodeToString(res))
+	}
+
+	dc := &EncryptionContext{
+		UAPublic:  sub.Key,
+		UAPrivate: d64("q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"),
+		Auth:      sub.Auth,
+	}
+	plain, err := dc.Decrypt(res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(plain) != msg {
+		t.Error("Unexpected plaintext ", string(plain))
+	}
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	ua := NewAuth(nil, "ua", "m.webinf.info")
+	sub := ua.NewSubscription("https://example.com/push/1")
+
+	big := bytes.Repeat([]byte("0123456789"), 1000)
+
+	for _, tc := range []struct {
+		name    string
+		msg     []byte
+		rs      int
+		padding int
+		reuse   bool
+	}{
+		{name: "empty", msg: []byte{}},
+		{name: "small", msg: []byte("hello")},
+		{name: "padding", msg: []byte("hello"), padding: 100},
+		{name: "multi", msg: big, rs: 1024},
+		{name: "exactRecord", msg: big[0 : 1024-17], rs: 1024},
+		{name: "multiPadding", msg: big, rs: 100, padding: 250},
+		{name: "reuse", msg: []byte("hello"), reuse: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ec := NewContextSend(sub)
+			if tc.rs != 0 {
+				ec.RecordSize = tc.rs
+			}
+			ec.Padding = tc.padding
+			if tc.reuse {
+				ec.ReuseKey()
+			}
+			enc, err := ec.Encrypt(tc.msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.padding > 0 && len(enc) < headerSize+len(tc.msg)+tc.padding {
+				t.Error("Missing padding", len(enc))
+			}
+			if tc.reuse {
+				enc2, _ := ec.Encrypt(tc.msg)
+				if !bytes.Equal(enc[21:headerSize], enc2[21:headerSize]) {
+					t.Error("Key not reused")
+				}
+				if bytes.Equal(enc, enc2) {
+					t.Error("Salt reused")
+				}
+			}
+
+			plain, err := ua.Decrypt(sub, enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(plain, tc.msg) {
+				t.Error("Invalid decrypted message", len(plain), len(tc.msg))
+			}
+
+			// Truncated stream
+			if len(enc) > headerSize+ec.RecordSize {
+				_, err = ua.Decrypt(sub, enc[0:headerSize+ec.RecordSize])
+				if err == nil {
+					t.Error("Truncated message accepted")
+				}
+			}
+
+			// Wrong auth
+			_, err = ua.Decrypt(&Subscription{Auth: make([]byte, 16)}, enc)
+			if err == nil {
+				t.Error("Wrong auth accepted")
+			}
+		})
+	}
+}
@@ -2,11 +2,16 @@ package bootstrap
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/costinm/ugate"
@@ -16,15 +21,29 @@ import (
 	"github.com/costinm/ugate/pkg/uds/uds"
 	ugates "github.com/costinm/ugate/pkg/ugatesvc"
 	"github.com/costinm/wpgate/dns"
+	wpauth "github.com/costinm/wpgate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/confstore"
 	"github.com/costinm/wpgate/pkg/h2"
 	"github.com/costinm/wpgate/pkg/mesh"
+	"github.com/costinm/wpgate/pkg/mesh/connmgr"
+	"github.com/costinm/wpgate/pkg/mesh/e2e"
+	"github.com/costinm/wpgate/pkg/mesh/relay"
+	"github.com/costinm/wpgate/pkg/mesh/route"
+	"github.com/costinm/wpgate/pkg/msgstore"
+	"github.com/costinm/wpgate/pkg/push"
+	"github.com/costinm/wpgate/pkg/streams"
 	"github.com/costinm/wpgate/pkg/transport/eventstream"
+	"github.com/costinm/wpgate/pkg/transport/h3"
 	"github.com/costinm/wpgate/pkg/transport/httpproxy"
+	"github.com/costinm/wpgate/pkg/transport/proxyproto"
+	"github.com/costinm/wpgate/pkg/transport/sni"
+	"github.com/costinm/wpgate/pkg/transport/socks"
 	sshgate "github.com/costinm/wpgate/pkg/transport/ssh"
 	"github.com/costinm/wpgate/pkg/transport/websocket"
 	"github.com/costinm/wpgate/pkg/transport/xds"
 	"github.com/costinm/wpgate/pkg/ui"
 	rtc2 "github.com/costinm/wpgate/rtc"
+	"golang.org/x/crypto/ssh"
 )
 
 // bootstrap loads all the components of wpgate together
@@ -64,6 +83,9 @@ var (
 	//  sni based router - could be multiplexed on 443
 	SNI = 25
 
+	// E2E encrypted circuits - reached by other nodes over the mesh.
+	E2E = 29
+
 	// ---- Other ports ----
 	// XDS, etc - istiod port
 	GRPC = 12
@@ -103,6 +125,13 @@ type ServerAll struct {
 	UDPNat *udp.UDPGate
 	Conf   ugate.ConfStore
 	sshg   *sshgate.SSHGate
+
+	// Auth is the wpgate identity - same key as the ugate auth, used for
+	// the CA and cert rotation.
+	Auth *wpauth.Auth
+
+	// Push is the RFC8030 push service, under /wp/ on the mTLS mux.
+	Push *push.Service
 }
 
 func (sa *ServerAll) Close() {
@@ -110,8 +139,8 @@ func (sa *ServerAll) Close() {
 }
 
 func StartAll(a *ServerAll) {
-	// File-based config
-	config := ugates.NewConf(a.ConfDir, "./var/lib/dmesh/")
+	// File-based config, or K8S Secret in a pod.
+	config := newConfStore(a.ConfDir)
 	a.Conf = config
 
 	cfg := &ugate.GateCfg{
@@ -126,7 +155,14 @@ func StartAll(a *ServerAll) {
 		}
 	}
 
-	authz := auth.NewAuth(config, cfg.Name, cfg.Domain)
+	// The node key is loaded - and decrypted - once, and shared with the ugate
+	// auth, which would otherwise save its own plain text key.
+	a.Auth = wpauth.NewAuth(config, cfg.Name, cfg.Domain)
+	if a.Auth.KeyType != wpauth.KeyEC256 {
+		// ugate, messaging and E2E would use a different VIP.
+		log.Fatal("Unsupported KEY_TYPE ", a.Auth.KeyType, ", the gateway requires ", wpauth.KeyEC256)
+	}
+	authz := auth.NewAuth(a.Auth.UGateConfig(config), cfg.Name, cfg.Domain)
 	// By default, pass through using net.Dialer
 	ug := ugates.NewGate(&net.Dialer{}, authz, cfg, nil)
 
@@ -138,6 +174,50 @@ func StartAll(a *ServerAll) {
 	a.GW = mesh.New(authz, cfg)
 	a.GW.UGate = ug
 
+	// Idle timeouts and limits for the proxied streams.
+	if data, err := config.Get(connmgr.ConfFile); err == nil && data != nil {
+		ccfg, err := connmgr.ParseConfig(data)
+		if err != nil {
+			log.Println("Error parsing ", connmgr.ConfFile, err)
+		} else {
+			a.GW.Conns.SetConfig(ccfg)
+		}
+	}
+
+	// Bandwidth and byte quotas, by caller VIP or role.
+	a.GW.Quotas = streams.NewQuotas(config)
+	a.GW.Quotas.Role = a.Auth.RoleByVIP
+	go a.GW.Quotas.SavePeriodic(context.Background(), time.Minute)
+
+	// Static forwarders and reverse proxies, reloaded when ugate.json changes.
+	a.GW.Forward.Config = config
+	a.GW.Forward.Certificate = a.Auth.Certificate
+	go a.GW.Forward.Watch(context.Background(), config, 10*time.Second)
+
+	// Backends getting a PROXY header with the caller address, VIP and role.
+	if data, err := config.Get(proxyproto.BackendsFile); err == nil && data != nil {
+		pb, err := proxyproto.ParseBackends(data)
+		if err != nil {
+			log.Println("Error parsing ", proxyproto.BackendsFile, err)
+		} else {
+			a.GW.ProxyBackends = pb
+		}
+	}
+	a.GW.Role = a.Auth.RoleByVIP
+
+	// E2E circuits, if E2E is ON: accepted from authorized keys, with the
+	// same checks as SSH -L to 127.0.0.1, and used for dialing.
+	a.GW.E2EPort = a.BasePort + E2E
+	if ugate.ConfStr(config, "E2E", "OFF") == "ON" {
+		e2es := &e2e.E2E{Certificate: a.Auth.Certificate, Authorize: a.Auth.AuthorizeE2E}
+		if el, err := net.Listen("tcp", a.laddr(E2E)); err == nil {
+			go e2es.Serve(el)
+		} else {
+			log.Println("E2E listener failed ", err)
+		}
+		a.GW.E2E = e2es
+	}
+
 	// Create the H2
 	h2s, err := h2.NewTransport(authz)
 	if err != nil {
@@ -146,7 +226,7 @@ func StartAll(a *ServerAll) {
 	a.H2 = h2s
 
 	// GRPC XDS transport
-	wp := &xds.GrpcService{}
+	wp := xds.NewXDS(msgs.DefaultMux)
 	xds.RegisterAggregatedDiscoveryServiceServer(h2s.GRPC, wp)
 
 	// Experimental: noise transport
@@ -157,9 +237,66 @@ func StartAll(a *ServerAll) {
 	sshg := sshgate.NewSSHGate(a.GW, authz)
 	a.sshg = sshg
 	a.GW.SSHGate = sshg
+	// SSH certs signed by CAs in authorized_keys and known_hosts.
+	sshg.CA = a.Auth
 	sshg.InitServer()
 	sshg.ListenSSH(a.addr(SSH))
 
+	// Cert rotation: H2, H3 and SSH use the current cert for new connections.
+	h2s.CertSource = a.Auth
+	h3.CertSource = a.Auth
+	a.Auth.OnRotate(func(c *tls.Certificate) {
+		sshg.InitServer()
+		exp := ""
+		if leaf := a.Auth.Leaf(); leaf != nil {
+			exp = leaf.NotAfter.Format(time.RFC3339)
+		}
+		msgs.Send("/auth/rotate", "vip", a.Auth.Self(), "expires", exp)
+	})
+	if caURL := ugate.ConfStr(config, "CA_URL", ""); caURL != "" {
+		a.Auth.CAURL = caURL
+		a.Auth.CAClient = h2s.Client(caURL)
+		// Hex SHA-256 of the expected root cert.
+		a.Auth.CARoot = ugate.ConfStr(config, "CA_ROOT", "")
+	}
+	a.Auth.StartRotation(context.Background(), 1*time.Hour)
+
+	// Relays for external destinations, raced with the direct path.
+	if data, err := config.Get(relay.File); err == nil && data != nil {
+		relays := map[string]string{}
+		if err := json.Unmarshal(data, &relays); err != nil {
+			log.Println("Error parsing ", relay.File, err)
+		}
+		for name, url := range relays {
+			hc := h2s.Client(url)
+			if strings.HasPrefix(name, "quic") {
+				hc = h3.InitQuicClient(authz, url)
+			}
+			a.GW.Relays[name] = relay.NewClient(url, hc)
+		}
+	}
+
+	// Revocation: reject revoked keys and close their existing sessions.
+	h2s.Revocation = a.Auth
+
+	// Server keys are pinned in known_hosts or trusted on first use.
+	h2s.KnownHosts = a.Auth
+
+	// JWTs from the issuers in oidc.json - K8S and Istio tokens.
+	h2s.Bearer = a.Auth
+
+	// SPIFFE certs - Istio sidecars and other trust domains.
+	h2s.SVID = a.Auth
+
+	// Authorization policy for HTTP, gRPC, SSH forwarding and messages.
+	h2s.Policy = a.Auth
+	sshg.Policy = a.Auth
+	wp.Revocation = a.Auth
+	a.Auth.OnRevoke(func(pub []byte) {
+		sshg.CloseRevoked(pub)
+		wp.CloseRevoked(pub)
+	})
+
 	// TODO: init socks on TLS, for inbound
 
 	// Connect to a mesh node
@@ -187,9 +324,45 @@ func StartAll(a *ServerAll) {
 	a.H2.MTLSMux.HandleFunc("/push/", msgs.DefaultMux.HTTPHandlerWebpush)
 	a.H2.MTLSMux.HandleFunc("/subscribe", msgs.SubscribeHandler)
 	a.H2.MTLSMux.HandleFunc("/p/", eventstream.Handler(msgs.DefaultMux))
+	a.H2.MTLSMux.HandleFunc(relay.Prefix, relay.Handler(a.GW))
+
+	// Private CA - sign certs for members with the 'member' role in authorized_keys.
+	if ugate.ConfStr(a.Conf, "CA", "") == "ON" {
+		ca, err := a.Auth.InitCA()
+		if err != nil {
+			log.Println("Failed to init CA ", err)
+		} else {
+			a.H2.MTLSMux.HandleFunc("/ca/sign", ca.HandleCSR)
+		}
+	}
+
+	a.Push = push.NewService("/wp")
+	a.Push.InitMux(a.H2.MTLSMux)
+	go func() {
+		for range time.Tick(1 * time.Minute) {
+			a.Push.Sweep()
+		}
+	}()
 	h2s.InitMTLSServer(a.BasePort+H2, h2s.MTLSMux)
 }
 
+// newConfStore returns the file based config. In K8S, if CONF_SECRET is set,
+// the Secret is used to load and save keys and authorized_keys, with fallback to
+// the files - ~/.ssh doesn't need to be mounted. DM_ env variables override both.
+func newConfStore(confDir string) ugate.ConfStore {
+	files := ugates.NewConf(confDir, "./var/lib/dmesh/")
+	secret := os.Getenv("CONF_SECRET")
+	if secret == "" || !confstore.InCluster() {
+		return files
+	}
+	ks, err := confstore.NewK8SSecret("", secret)
+	if err != nil {
+		log.Println("K8S config not available ", err)
+		return files
+	}
+	return confstore.NewLayered(ks, confstore.NewEnvStore("DM_"), ks, files)
+}
+
 func (a *ServerAll) laddr(off int) string {
 	return fmt.Sprintf("127.0.0.1:%d", a.BasePort+off)
 }
@@ -206,20 +379,177 @@ func (a *ServerAll) StartMsg() {
 	// /ws - registered on the HTTPS server
 	websocket.WSTransport(msgs.DefaultMux, a.H2.MTLSMux)
 
-	msgs.DefaultMux.AddHandler(mesh.TopicConnectUP, msgs.HandlerCallbackFunc(func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+	// Store and forward: messages on the 'q' topic are queued for the 'to' VIP
+	// until acked, and redelivered when the peer connects.
+	fs, err := msgstore.NewFileStore(filepath.Join(a.ConfDir, "msgs"))
+	if err != nil {
+		log.Println("Failed to open message store ", err)
+	} else {
+		msgstore.Default = msgstore.NewQueue(fs)
+		msgstore.Default.Auth = a.Auth
+		// The signed path is checked first - the policy uses the 'from'. The
+		// last hop must be the peer the message was received from.
+		msgs.DefaultMux.AddHandler(msgstore.TopicQueue, func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+			m, err := msgstore.Default.Verify(msgPeer(ctx, meta), msgstore.TopicQueue, meta, data)
+			if err != nil {
+				log.Println("Invalid message path ", meta["from"], err)
+				return
+			}
+			a.authorizeMsg(msgstore.TopicQueue, func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+				// Messages for this node were delivered - and acked by the
+				// transport.
+				if to := meta["to"]; to == "" || to == a.Auth.Self() {
+					return
+				}
+				if err := msgstore.Default.Send(meta["to"], m); err != nil {
+					log.Println("Queue failed ", meta["to"], err)
+				}
+			})(ctx, cmdS, meta, data)
+		})
+		// Acks from peers without a message stream - for example eventstream.
+		// Only the queue of the authenticated peer can be acked.
+		msgs.DefaultMux.AddHandler(msgstore.TopicAck, a.authorizeMsg(msgstore.TopicAck, func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+			if peer := msgPeer(ctx, meta); peer != "" {
+				msgstore.Default.Ack(peer, meta["id"])
+			}
+		}))
+		go func() {
+			for range time.Tick(10 * time.Second) {
+				msgstore.Default.Sweep(time.Now())
+			}
+		}()
+	}
+
+	// Signed revocations from admins - applied once and forwarded to the peers.
+	msgs.DefaultMux.AddHandler(wpauth.TopicRevoke, a.authorizeMsg(wpauth.TopicRevoke, func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+		r, err := a.Auth.HandleRevocation(data)
+		if err != nil {
+			log.Println("Invalid revocation ", meta["from"], err)
+			return
+		}
+		if r != nil {
+			msgs.DefaultMux.SendMessage(msgs.NewMessage("/"+wpauth.TopicRevoke, map[string]string{}).SetDataJSON(r))
+		}
+	}))
+	// Local admin: POST an authorized_keys line to revoke the key.
+	a.H2.LocalMux.HandleFunc("/revoke", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		pk, reason, _, _, err := ssh.ParseAuthorizedKey(body)
+		if err != nil {
+			http.Error(w, err.Error(), 400)
+			return
+		}
+		rev := a.Auth.Revoke(wpauth.SSHKeyBytes(pk), reason)
+		msgs.DefaultMux.SendMessage(msgs.NewMessage("/"+wpauth.TopicRevoke, map[string]string{}).SetDataJSON(rev))
+	})
+
+	msgs.DefaultMux.AddHandler(mesh.TopicConnectUP, a.authorizeMsg(mesh.TopicConnectUP, func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
 		log.Println(cmdS, meta, data)
 	}))
 
-	msgs.DefaultMux.AddHandler("net", msgs.HandlerCallbackFunc(func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+	// Mesh routes: adverts from the neighbors update the routing table, our
+	// routes are sent periodically.
+	msgs.DefaultMux.AddHandler(route.TopicRoute, a.authorizeMsg(route.TopicRoute, func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+		adv := &route.Advert{}
+		if err := json.Unmarshal(data, adv); err != nil {
+			return
+		}
+		adv.From = meta["from"]
+		a.GW.Routes.HandleAdvert(adv)
+	}))
+	go a.GW.AdvertiseRoutes(context.Background(), route.DefaultInterval, func(adv *route.Advert) {
+		msgs.DefaultMux.SendMessage(msgs.NewMessage("/"+route.TopicRoute, map[string]string{}).SetDataJSON(adv))
+	})
+
+	msgs.DefaultMux.AddHandler("net", a.authorizeMsg("net", func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
 		// net/status
 		log.Println(cmdS, meta, data)
 	}))
 }
 
+// msgPeer returns the VIP of the connection a message was received from - from
+// the auth context of HTTP requests, or set by the stream transports.
+func msgPeer(ctx context.Context, meta map[string]string) string {
+	if ctx != nil {
+		if rc := h2.RequestContext(ctx); rc != nil {
+			if rc.VIP == nil {
+				return ""
+			}
+			return rc.VIP.String()
+		}
+	}
+	return meta[msgstore.MetaPeer]
+}
+
+// authorizeMsg wraps a message handler, checking the topic against the policy,
+// using the role of the sender VIP. Messages from this node are not checked.
+func (a *ServerAll) authorizeMsg(topic string, h msgs.HandlerCallbackFunc) msgs.HandlerCallbackFunc {
+	return func(ctx context.Context, cmdS string, meta map[string]string, data []byte) {
+		if from := meta["from"]; from != "" && from != a.Auth.Self() {
+			vip := net.ParseIP(from)
+			err := a.Auth.Authorize(&wpauth.PolicyRequest{
+				Kind:  wpauth.PolicyMsg,
+				Role:  a.Auth.RoleByVIP(vip),
+				VIP:   vip,
+				Topic: topic,
+			})
+			if err != nil {
+				return
+			}
+		}
+		h(ctx, cmdS, meta, data)
+	}
+}
+
 func (a *ServerAll) StartExtra() {
 	a.hgw = httpproxy.NewHTTPGate(a.GW, a.H2)
 	a.hgw.HttpProxyCapture(a.laddr(HTTP_PROXY))
 
+	// SOCKS5 capture. With users in socks_users.json, auth is required and the
+	// user roles are checked by the policy.
+	ss := &socks.Server{GW: a.GW}
+	if data, err := a.Conf.Get(socks.UsersFile); err == nil && data != nil {
+		users, err := socks.ParseUsers(data)
+		if err != nil {
+			log.Println("Invalid SOCKS users ", err)
+		} else {
+			ss.Users = users
+			ss.Authorize = func(role string, client net.Addr, dest string) error {
+				var vip net.IP
+				if ta, ok := client.(*net.TCPAddr); ok {
+					vip = ta.IP
+				}
+				return a.Auth.Authorize(&wpauth.PolicyRequest{
+					Kind: wpauth.PolicySOCKS,
+					Role: role,
+					VIP:  vip,
+					Host: dest,
+				})
+			}
+		}
+	}
+	if sl, err := net.Listen("tcp", a.laddr(SOCKS)); err == nil {
+		go ss.Serve(sl)
+	} else {
+		log.Println("SOCKS listener failed ", err)
+	}
+
+	// SNI router - names without a route in sni_routes.json go to port 443.
+	sr := &sni.Router{GW: a.GW}
+	if data, err := a.Conf.Get(sni.RoutesFile); err == nil && data != nil {
+		routes := map[string]string{}
+		if err := json.Unmarshal(data, &routes); err != nil {
+			log.Println("Invalid SNI routes ", err)
+		} else {
+			sr.SetRoutes(routes)
+		}
+	}
+	if sl, err := net.Listen("tcp", a.laddr(SNI)); err == nil {
+		go sr.Serve(sl)
+	} else {
+		log.Println("SNI listener failed ", err)
+	}
+
 	// Local DNS resolver. Can forward up.
 	dnss, _ := dns.NewDmDns(a.BasePort + DNS)
 	dnss.Start(a.H2.MTLSMux)
@@ -0,0 +1,50 @@
+package confstore
+
+import (
+	"os"
+	"strings"
+)
+
+// EnvStore reads configs from environment variables. The variable name is the
+// Prefix followed by the config name, with "." and "/" replaced by "_" - same
+// as the ugate file store. For example authorized_keys is read from
+// DM_authorized_keys if the Prefix is "DM_".
+//
+// Env variables are read only.
+type EnvStore struct {
+	Prefix string
+}
+
+func NewEnvStore(prefix string) *EnvStore {
+	return &EnvStore{Prefix: prefix}
+}
+
+func envName(name string) string {
+	name = strings.ReplaceAll(name, ".", "_")
+	return strings.ReplaceAll(name, "/", "_")
+}
+
+func (es *EnvStore) Get(name string) ([]byte, error) {
+	v, ok := os.LookupEnv(es.Prefix + envName(name))
+	if !ok || v == "" {
+		return nil, nil
+	}
+	return []byte(v), nil
+}
+
+func (es *EnvStore) Set(name string, data []byte) error {
+	return ErrReadOnly
+}
+
+// List returns the names of the variables with the prefix, without the prefix.
+// Since "." is mapped to "_", the names may not match the original config names.
+func (es *EnvStore) List(name string, tp string) ([]string, error) {
+	all := map[string]bool{}
+	for _, kv := range os.Environ() {
+		k := strings.SplitN(kv, "=", 2)[0]
+		if strings.HasPrefix(k, es.Prefix) {
+			all[k[len(es.Prefix):]] = true
+		}
+	}
+	return sortedKeys(all, envName(name)), nil
+}
@@ -0,0 +1,354 @@
+package confstore
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// K8SStore keeps configs as keys in a Kubernetes Secret or ConfigMap.
+//
+// It uses the REST API directly, with the pod service account - client-go is a
+// large dependency for 3 calls. Config names are used as keys, with "/" replaced
+// by "_". A missing object is created on the first Set. Set patches a single key,
+// the labels, annotations and owners of the object are kept.
+type K8SStore struct {
+	// Server is the API server URL. In cluster it is based on
+	// KUBERNETES_SERVICE_HOST and KUBERNETES_SERVICE_PORT.
+	Server string
+
+	Namespace string
+
+	// Name of the Secret or ConfigMap.
+	Name string
+
+	// ConfigMap selects a ConfigMap instead of a Secret.
+	ConfigMap bool
+
+	// Token for the API server. If TokenFile is set, it is read for each request -
+	// projected tokens are rotated.
+	Token     string
+	TokenFile string
+
+	Client *http.Client
+
+	// Serializes Set.
+	mutex sync.Mutex
+}
+
+const (
+	k8sSADir           = "/var/run/secrets/kubernetes.io/serviceaccount/"
+	k8sConflictRetries = 5
+)
+
+var errK8SNotFound = errors.New("confstore: k8s object not found")
+
+// InCluster returns true if running in a Kubernetes pod.
+func InCluster() bool {
+	return os.Getenv("KUBERNETES_SERVICE_HOST") != ""
+}
+
+// NewK8SSecret returns a store using a Secret, with the in-cluster service account.
+// If namespace is empty, the pod namespace is used.
+func NewK8SSecret(namespace, name string) (*K8SStore, error) {
+	return newInCluster(namespace, name, false)
+}
+
+// NewK8SConfigMap returns a store using a ConfigMap, with the in-cluster service
+// account. If namespace is empty, the pod namespace is used.
+func NewK8SConfigMap(namespace, name string) (*K8SStore, error) {
+	return newInCluster(namespace, name, true)
+}
+
+func newInCluster(namespace, name string, cm bool) (*K8SStore, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" {
+		return nil, errors.New("confstore: not running in kubernetes")
+	}
+	if port == "" {
+		port = "443"
+	}
+	if namespace == "" {
+		namespace = os.Getenv("POD_NAMESPACE")
+	}
+	if namespace == "" {
+		ns, err := ioutil.ReadFile(k8sSADir + "namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(ns))
+	}
+	caPEM, err := ioutil.ReadFile(k8sSADir + "ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(caPEM) {
+		return nil, errors.New("confstore: invalid k8s ca.crt")
+	}
+	return &K8SStore{
+		Server:    "https://" + net.JoinHostPort(host, port),
+		Namespace: namespace,
+		Name:      name,
+		ConfigMap: cm,
+		TokenFile: k8sSADir + "token",
+		Client: &http.Client{
+			Timeout: 10 * time.Second,
+			Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+			},
+		},
+	}, nil
+}
+
+type k8sMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+// k8sObject is a Secret or ConfigMap. Secret data and ConfigMap binaryData are
+// base64 encoded in JSON, ConfigMap data is a string.
+type k8sObject struct {
+	APIVersion string          `json:"apiVersion"`
+	Kind       string          `json:"kind"`
+	Metadata   k8sMeta         `json:"metadata"`
+	Data       json.RawMessage `json:"data,omitempty"`
+	BinaryData json.RawMessage `json:"binaryData,omitempty"`
+}
+
+func k8sKey(name string) string {
+	return strings.ReplaceAll(name, "/", "_")
+}
+
+func (ks *K8SStore) resource() string {
+	if ks.ConfigMap {
+		return "configmaps"
+	}
+	return "secrets"
+}
+
+func (ks *K8SStore) url(name string) string {
+	u := ks.Server + "/api/v1/namespaces/" + ks.Namespace + "/" + ks.resource()
+	if name != "" {
+		u = u + "/" + name
+	}
+	return u
+}
+
+func (ks *K8SStore) do(method, url string, body []byte) ([]byte, int, error) {
+	req, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, 0, err
+	}
+	token := ks.Token
+	if ks.TokenFile != "" {
+		t, err := ioutil.ReadFile(ks.TokenFile)
+		if err != nil {
+			return nil, 0, err
+		}
+		token = strings.TrimSpace(string(t))
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	req.Header.Set("Accept", "application/json")
+	if method == "PATCH" {
+		req.Header.Set("Content-Type", "application/merge-patch+json")
+	} else if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	hc := ks.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	res, err := hc.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer res.Body.Close()
+	data, err := ioutil.ReadAll(res.Body)
+	return data, res.StatusCode, err
+}
+
+// load returns the object and its data, decoded.
+func (ks *K8SStore) load() (*k8sObject, map[string][]byte, error) {
+	data, code, err := ks.do("GET", ks.url(ks.Name), nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if code == http.StatusNotFound {
+		return nil, nil, errK8SNotFound
+	}
+	if code != http.StatusOK {
+		return nil, nil, fmt.Errorf("confstore: k8s get %s/%s: %d %s", ks.Namespace, ks.Name, code, data)
+	}
+	obj := &k8sObject{}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, nil, err
+	}
+	kv := map[string][]byte{}
+	if ks.ConfigMap {
+		sd := map[string]string{}
+		if len(obj.Data) > 0 {
+			if err := json.Unmarshal(obj.Data, &sd); err != nil {
+				return nil, nil, err
+			}
+		}
+		for k, v := range sd {
+			kv[k] = []byte(v)
+		}
+		if len(obj.BinaryData) > 0 {
+			if err := json.Unmarshal(obj.BinaryData, &kv); err != nil {
+				return nil, nil, err
+			}
+		}
+	} else if len(obj.Data) > 0 {
+		if err := json.Unmarshal(obj.Data, &kv); err != nil {
+			return nil, nil, err
+		}
+	}
+	return obj, kv, nil
+}
+
+func (ks *K8SStore) Get(name string) ([]byte, error) {
+	_, kv, err := ks.load()
+	if err == errK8SNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return kv[k8sKey(name)], nil
+}
+
+// Set updates the key with a JSON merge patch, creating the object if missing.
+// Other keys and the metadata are not changed. If another pod creates the
+// object first, the patch is retried.
+func (ks *K8SStore) Set(name string, value []byte) error {
+	ks.mutex.Lock()
+	defer ks.mutex.Unlock()
+
+	key := k8sKey(name)
+	if value == nil {
+		value = []byte{}
+	}
+	patch, err := json.Marshal(ks.patch(key, value))
+	if err != nil {
+		return err
+	}
+	for i := 0; i < k8sConflictRetries; i++ {
+		data, code, err := ks.do("PATCH", ks.url(ks.Name), patch)
+		if err != nil {
+			return err
+		}
+		if code == http.StatusOK {
+			return nil
+		}
+		if code != http.StatusNotFound {
+			return fmt.Errorf("confstore: k8s update %s/%s: %d %s", ks.Namespace, ks.Name, code, data)
+		}
+
+		obj := &k8sObject{
+			APIVersion: "v1",
+			Kind:       "Secret",
+			Metadata:   k8sMeta{Name: ks.Name, Namespace: ks.Namespace},
+		}
+		if ks.ConfigMap {
+			obj.Kind = "ConfigMap"
+		}
+		if err := ks.encode(obj, map[string][]byte{key: value}); err != nil {
+			return err
+		}
+		body, err := json.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		data, code, err = ks.do("POST", ks.url(""), body)
+		if err != nil {
+			return err
+		}
+		if code == http.StatusConflict {
+			continue
+		}
+		if code != http.StatusOK && code != http.StatusCreated {
+			return fmt.Errorf("confstore: k8s create %s/%s: %d %s", ks.Namespace, ks.Name, code, data)
+		}
+		return nil
+	}
+	return fmt.Errorf("confstore: k8s update %s/%s: too many conflicts", ks.Namespace, ks.Name)
+}
+
+// patch returns the merge patch setting the key. A ConfigMap key moving between
+// data and binaryData is removed from the other map - null deletes in a merge
+// patch.
+func (ks *K8SStore) patch(key string, value []byte) map[string]map[string]interface{} {
+	if !ks.ConfigMap {
+		return map[string]map[string]interface{}{"data": {key: value}}
+	}
+	if utf8.Valid(value) {
+		return map[string]map[string]interface{}{
+			"data":       {key: string(value)},
+			"binaryData": {key: nil},
+		}
+	}
+	return map[string]map[string]interface{}{
+		"data":       {key: nil},
+		"binaryData": {key: value},
+	}
+}
+
+// encode sets the data of the object. ConfigMaps use data for UTF-8 values and
+// binaryData for the rest.
+func (ks *K8SStore) encode(obj *k8sObject, kv map[string][]byte) error {
+	var err error
+	if !ks.ConfigMap {
+		obj.Data, err = json.Marshal(kv)
+		return err
+	}
+	sd := map[string]string{}
+	bd := map[string][]byte{}
+	for k, v := range kv {
+		if utf8.Valid(v) {
+			sd[k] = string(v)
+		} else {
+			bd[k] = v
+		}
+	}
+	obj.Data, obj.BinaryData = nil, nil
+	if len(sd) > 0 {
+		if obj.Data, err = json.Marshal(sd); err != nil {
+			return err
+		}
+	}
+	if len(bd) > 0 {
+		obj.BinaryData, err = json.Marshal(bd)
+	}
+	return err
+}
+
+func (ks *K8SStore) List(name string, tp string) ([]string, error) {
+	_, kv, err := ks.load()
+	if err == errK8SNotFound {
+		return []string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]bool{}
+	for k := range kv {
+		all[k] = true
+	}
+	return sortedKeys(all, k8sKey(name)), nil
+}
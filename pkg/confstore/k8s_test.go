@@ -0,0 +1,193 @@
+package confstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/costinm/wpgate/pkg/auth"
+)
+
+// fakeAPIServer implements the Secret and ConfigMap get, create and merge patch
+// APIs, with create conflicts.
+type fakeAPIServer struct {
+	mutex   sync.Mutex
+	objects map[string]map[string]interface{}
+	version int
+
+	// conflicts is the number of creates to reject with 409.
+	conflicts int
+}
+
+func (f *fakeAPIServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if r.Header.Get("Authorization") != "Bearer test-token" {
+		w.WriteHeader(401)
+		return
+	}
+	// /api/v1/namespaces/NS/KIND[/NAME]
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/namespaces/"), "/")
+	key := strings.Join(parts, "/")
+	switch r.Method {
+	case "GET":
+		o := f.objects[key]
+		if o == nil {
+			w.WriteHeader(404)
+			return
+		}
+		json.NewEncoder(w).Encode(o)
+	case "POST":
+		body, _ := ioutil.ReadAll(r.Body)
+		o := map[string]interface{}{}
+		json.Unmarshal(body, &o)
+		meta := o["metadata"].(map[string]interface{})
+		key = key + "/" + meta["name"].(string)
+		if f.conflicts > 0 || f.objects[key] != nil {
+			f.conflicts--
+			w.WriteHeader(409)
+			return
+		}
+		f.version++
+		meta["resourceVersion"] = strconv.Itoa(f.version)
+		f.objects[key] = o
+		w.WriteHeader(201)
+		json.NewEncoder(w).Encode(o)
+	case "PATCH":
+		if r.Header.Get("Content-Type") != "application/merge-patch+json" {
+			w.WriteHeader(415)
+			return
+		}
+		o := f.objects[key]
+		if o == nil {
+			w.WriteHeader(404)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		patch := map[string]map[string]interface{}{}
+		json.Unmarshal(body, &patch)
+		for field, kv := range patch {
+			m, _ := o[field].(map[string]interface{})
+			if m == nil {
+				m = map[string]interface{}{}
+			}
+			for k, v := range kv {
+				if v == nil {
+					delete(m, k)
+				} else {
+					m[k] = v
+				}
+			}
+			o[field] = m
+		}
+		f.version++
+		o["metadata"].(map[string]interface{})["resourceVersion"] = strconv.Itoa(f.version)
+		json.NewEncoder(w).Encode(o)
+	}
+}
+
+func TestK8SStore(t *testing.T) {
+	f := &fakeAPIServer{objects: map[string]map[string]interface{}{
+		// Secret created by kubectl, base64 data.
+		"ns1/secrets/dmesh": {
+			"apiVersion": "v1", "kind": "Secret",
+			"type": "Opaque",
+			"metadata": map[string]interface{}{"name": "dmesh", "resourceVersion": "1",
+				"labels":          map[string]interface{}{"app": "dmesh"},
+				"ownerReferences": []interface{}{map[string]interface{}{"kind": "Deployment", "name": "dmesh"}}},
+			"data": map[string]interface{}{"authorized_keys": "a2V5cw=="},
+		},
+		"ns1/configmaps/dmesh": {
+			"apiVersion": "v1", "kind": "ConfigMap",
+			"metadata": map[string]interface{}{"name": "dmesh", "resourceVersion": "1"},
+			"data":     map[string]interface{}{"ugate.json": "{}"},
+		},
+	}, version: 1}
+	s := httptest.NewServer(f)
+	defer s.Close()
+
+	secret := &K8SStore{Server: s.URL, Namespace: "ns1", Name: "dmesh", Token: "test-token"}
+	cm := &K8SStore{Server: s.URL, Namespace: "ns1", Name: "dmesh", Token: "test-token", ConfigMap: true}
+
+	if d, err := secret.Get("authorized_keys"); err != nil || string(d) != "keys" {
+		t.Error("Secret get", string(d), err)
+	}
+	if d, err := cm.Get("ugate.json"); err != nil || string(d) != "{}" {
+		t.Error("ConfigMap get", string(d), err)
+	}
+	if d, err := secret.Get("missing"); err != nil || d != nil {
+		t.Error("Expected missing", d, err)
+	}
+
+	// Binary and text values in a ConfigMap.
+	if err := cm.Set("bin", []byte{0xff, 0xfe}); err != nil {
+		t.Fatal(err)
+	}
+	if err := cm.Set("dir/file", []byte("text")); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := cm.Get("bin"); string(d) != string([]byte{0xff, 0xfe}) {
+		t.Error("Binary value", d)
+	}
+	if d, _ := cm.Get("dir/file"); string(d) != "text" {
+		t.Error("Text value", string(d))
+	}
+	if names, _ := cm.List("", ""); strings.Join(names, ",") != "bin,dir_file,ugate.json" {
+		t.Error("Unexpected list", names)
+	}
+	if err := cm.Set("bin", []byte("now text")); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := cm.Get("bin"); string(d) != "now text" {
+		t.Error("Binary value not replaced", string(d))
+	}
+
+	// Set only changes the key - metadata and type are kept.
+	if err := secret.Set("authorized_keys", []byte("keys2")); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := secret.Get("authorized_keys"); string(d) != "keys2" {
+		t.Error("Secret set", string(d))
+	}
+	o := f.objects["ns1/secrets/dmesh"]
+	meta := o["metadata"].(map[string]interface{})
+	if o["type"] != "Opaque" || meta["labels"] == nil || meta["ownerReferences"] == nil {
+		t.Error("Metadata not kept", o)
+	}
+
+	// Create conflicts, from other pods, are retried.
+	f.conflicts = k8sConflictRetries
+	race := &K8SStore{Server: s.URL, Namespace: "ns1", Name: "race", Token: "test-token"}
+	if err := race.Set("x", []byte("1")); err == nil {
+		t.Error("Expected conflict error")
+	}
+	f.conflicts = 1
+	if err := race.Set("x", []byte("1")); err != nil {
+		t.Error("Create not retried", err)
+	}
+	f.conflicts = 0
+
+	// Missing secret is created - keys generated by auth are saved in K8S.
+	pod := &K8SStore{Server: s.URL, Namespace: "ns1", Name: "pod-1", Token: "test-token"}
+	if d, err := pod.Get("ec-key.pem"); err != nil || d != nil {
+		t.Error("Expected missing secret", err)
+	}
+	a := auth.NewAuth(pod, "pod-1", "m.webinf.info")
+	if f.objects["ns1/secrets/pod-1"] == nil {
+		t.Fatal("Secret not created")
+	}
+	a2 := auth.NewAuth(pod, "pod-1", "m.webinf.info")
+	if string(a.Pub) != string(a2.Pub) {
+		t.Error("Key not reloaded from the secret")
+	}
+
+	bad := &K8SStore{Server: s.URL, Namespace: "ns1", Name: "dmesh", Token: "wrong"}
+	if _, err := bad.Get("authorized_keys"); err == nil {
+		t.Error("Expected auth error")
+	}
+}
@@ -0,0 +1,42 @@
+package confstore
+
+import (
+	"sync"
+)
+
+// MemStore keeps configs in memory - used for tests and nodes without storage.
+type MemStore struct {
+	mutex sync.RWMutex
+	data  map[string][]byte
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{data: map[string][]byte{}}
+}
+
+func (ms *MemStore) Get(name string) ([]byte, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	d, ok := ms.data[name]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte{}, d...), nil
+}
+
+func (ms *MemStore) Set(name string, data []byte) error {
+	ms.mutex.Lock()
+	ms.data[name] = append([]byte{}, data...)
+	ms.mutex.Unlock()
+	return nil
+}
+
+func (ms *MemStore) List(name string, tp string) ([]string, error) {
+	ms.mutex.RLock()
+	defer ms.mutex.RUnlock()
+	all := map[string]bool{}
+	for k := range ms.data {
+		all[k] = true
+	}
+	return sortedKeys(all, name), nil
+}
@@ -0,0 +1,96 @@
+// Package confstore implements ConfStore backends - the Get/Set/List blob
+// interface used by auth and ugate for keys, authorized_keys and config.
+//
+// Besides the file store in ugate, configs can be loaded from environment
+// variables, Kubernetes Secrets and ConfigMaps, or memory. A Layered store
+// reads from several backends and writes to one - a pod can load keys from a
+// Secret and override settings with env variables, without mounting ~/.ssh.
+package confstore
+
+import (
+	"errors"
+	"sort"
+	"strings"
+)
+
+// ConfStore is the interface implemented by all stores - same as auth.ConfStore
+// and ugate.ConfStore.
+type ConfStore interface {
+	// Get a config blob by name. Returns nil, nil if not found.
+	Get(name string) ([]byte, error)
+
+	// Save a config blob
+	Set(conf string, data []byte) error
+
+	// List the configs starting with a prefix, of a given type
+	List(name string, tp string) ([]string, error)
+}
+
+// ErrReadOnly is returned by Set on stores that can't be modified.
+var ErrReadOnly = errors.New("confstore: read only")
+
+// Layered reads from a list of stores, in order, and writes to one of them.
+type Layered struct {
+	// Stores are searched in order, the first store with the config wins.
+	Stores []ConfStore
+
+	// Writer is used for Set. If nil, Set returns ErrReadOnly.
+	Writer ConfStore
+}
+
+// NewLayered returns a store reading from stores, writing to w.
+func NewLayered(w ConfStore, stores ...ConfStore) *Layered {
+	return &Layered{Writer: w, Stores: stores}
+}
+
+func (l *Layered) Get(name string) ([]byte, error) {
+	var firstErr error
+	for _, s := range l.Stores {
+		data, err := s.Get(name)
+		if err != nil {
+			// A failing backend - for example K8S not reachable - doesn't
+			// hide the other layers.
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if data != nil {
+			return data, nil
+		}
+	}
+	return nil, firstErr
+}
+
+func (l *Layered) Set(name string, data []byte) error {
+	if l.Writer == nil {
+		return ErrReadOnly
+	}
+	return l.Writer.Set(name, data)
+}
+
+// List returns the sorted union of the configs in all stores.
+func (l *Layered) List(name string, tp string) ([]string, error) {
+	all := map[string]bool{}
+	for _, s := range l.Stores {
+		names, err := s.List(name, tp)
+		if err != nil {
+			continue
+		}
+		for _, n := range names {
+			all[n] = true
+		}
+	}
+	return sortedKeys(all, ""), nil
+}
+
+func sortedKeys(m map[string]bool, prefix string) []string {
+	res := []string{}
+	for k := range m {
+		if strings.HasPrefix(k, prefix) {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,70 @@
+package confstore
+
+import (
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/costinm/wpgate/pkg/auth"
+)
+
+var (
+	_ auth.ConfStore = &MemStore{}
+	_ auth.ConfStore = &EnvStore{}
+	_ auth.ConfStore = &Layered{}
+	_ auth.ConfStore = &K8SStore{}
+)
+
+func TestLayered(t *testing.T) {
+	os.Setenv("DMTEST_authorized_keys", "env-keys")
+	os.Setenv("DMTEST_ugate_json", "{}")
+	defer os.Unsetenv("DMTEST_authorized_keys")
+	defer os.Unsetenv("DMTEST_ugate_json")
+
+	base := NewMemStore()
+	base.Set("authorized_keys", []byte("base-keys"))
+	base.Set("known_hosts", []byte("base-hosts"))
+	w := NewMemStore()
+	l := NewLayered(w, NewEnvStore("DMTEST_"), w, base)
+
+	for name, want := range map[string]string{
+		"authorized_keys": "env-keys",
+		"ugate.json":      "{}",
+		"known_hosts":     "base-hosts",
+		"missing":         "",
+	} {
+		d, err := l.Get(name)
+		if err != nil || string(d) != want {
+			t.Error("Unexpected value", name, string(d), err)
+		}
+	}
+
+	if err := l.Set("known_hosts", []byte("saved")); err != nil {
+		t.Fatal(err)
+	}
+	if d, _ := l.Get("known_hosts"); string(d) != "saved" {
+		t.Error("Writer not used first", string(d))
+	}
+	if d, _ := base.Get("known_hosts"); string(d) != "base-hosts" {
+		t.Error("Lower layer modified", string(d))
+	}
+
+	names, _ := l.List("", "")
+	if !reflect.DeepEqual(names, []string{"authorized_keys", "known_hosts", "ugate_json"}) {
+		t.Error("Unexpected list", names)
+	}
+
+	if err := NewLayered(nil, base).Set("x", nil); err != ErrReadOnly {
+		t.Error("Expected read only", err)
+	}
+	if err := NewEnvStore("").Set("x", nil); err != ErrReadOnly {
+		t.Error("Expected read only", err)
+	}
+
+	// Keys generated by auth are saved to the writer and reloaded.
+	a := auth.NewAuth(l, "node", "m.webinf.info")
+	a2 := auth.NewAuth(NewLayered(nil, w), "node", "m.webinf.info")
+	if string(a.Pub) != string(a2.Pub) {
+		t.Error("Key not reloaded from the layered store")
+	}
+}
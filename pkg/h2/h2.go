@@ -1,6 +1,7 @@
 package h2
 
 import (
+	"context"
 	"crypto/tls"
 	"crypto/x509"
 	"errors"
@@ -15,9 +16,12 @@ import (
 	"time"
 
 	"github.com/costinm/ugate/pkg/auth"
+	wpauth "github.com/costinm/wpgate/pkg/auth"
 	"github.com/costinm/wpgate/pkg/streams"
 	"golang.org/x/net/http2"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // H2 provides network communication over HTTP/2, QUIC, SSH
@@ -45,9 +49,65 @@ type H2 struct {
 
 	Certs *auth.Auth
 
+	// CertSource, if set, provides the current certificate for new connections,
+	// instead of the cert loaded at startup from Certs. Used for rotation.
+	CertSource CertSource
+
+	// Revocation, if set, is checked for each request. Requests from revoked
+	// keys are rejected.
+	Revocation Revocation
+
+	// KnownHosts, if set, verifies the keys of servers for the H2 clients.
+	// Without it only the cert expiry is checked.
+	KnownHosts KnownHosts
+
+	// Policy, if set, authorizes the HTTP and gRPC requests.
+	Policy Authorizer
+
+	// Bearer, if set, verifies JWT bearer tokens - used instead of VAPID or mTLS.
+	Bearer BearerVerifier
+
+	// SVID, if set, verifies certs with a SPIFFE ID against the roots of their
+	// trust domain. Verified IDs are used as SAN. Servers - like Istio sidecars -
+	// are still checked against known_hosts, and rejected if the SVID is invalid.
+	SVID SVIDVerifier
+
 	GRPC *grpc.Server
 }
 
+// CertSource returns the current certificate - implemented by wpgate auth.Auth.
+type CertSource interface {
+	Certificate() *tls.Certificate
+}
+
+// Revocation checks if a public key was revoked - implemented by wpgate auth.Auth.
+type Revocation interface {
+	IsRevoked(pub []byte) bool
+}
+
+// KnownHosts checks the public key presented by a server against the pinned or
+// first-seen key of the host - implemented by wpgate auth.Auth.
+type KnownHosts interface {
+	CheckKnownHost(host string, pub []byte) error
+}
+
+// Authorizer checks a request against the authorization policy - implemented
+// by wpgate auth.Auth.
+type Authorizer interface {
+	Authorize(r *wpauth.PolicyRequest) error
+}
+
+// SVIDVerifier verifies a SPIFFE cert chain - implemented by wpgate auth.Auth.
+type SVIDVerifier interface {
+	VerifySVID(chain []*x509.Certificate) (*wpauth.SPIFFEID, error)
+}
+
+// BearerVerifier verifies a JWT issued by a trusted OIDC issuer - implemented
+// by wpgate auth.Auth.
+type BearerVerifier interface {
+	VerifyBearer(token string) (*wpauth.BearerIdentity, error)
+}
+
 var (
 	// Set to the address of the AP master
 	AndroidAPMaster string
@@ -72,18 +132,33 @@ func NewTransport(authz *auth.Auth) (*H2, error) {
 		MTLSMux:     &http.ServeMux{},
 		LocalMux:    &http.ServeMux{},
 		quicClients: map[string]*http.Client{},
-		GRPC:        grpc.NewServer(),
 	}
+	h2.GRPC = grpc.NewServer(
+		grpc.UnaryInterceptor(h2.grpcUnaryPolicy),
+		grpc.StreamInterceptor(h2.grpcStreamPolicy))
 
 	h2.Certs = authz
 
 	ctls := h2.Certs.GenerateTLSConfigClient()
-	ctls.VerifyPeerCertificate = verify("")
+	certs := ctls.Certificates
+	ctls.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		if h2.CertSource != nil {
+			return h2.CertSource.Certificate(), nil
+		}
+		if len(certs) > 0 {
+			return &certs[0], nil
+		}
+		return &tls.Certificate{}, nil
+	}
 	h2.tlsConfig = ctls
 
 	t := &http.Transport{
 		// This is enough to disable h2 automatically.
 		TLSClientConfig: ctls,
+		// The server is verified against the dialed address.
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return h2.dialTLS(ctx, network, addr)
+		},
 	}
 
 	// Will modify t to add NPN. If H2, t1.TLSNextProto will be set so it upgrades.
@@ -106,6 +181,17 @@ func NewTransport(authz *auth.Auth) (*H2, error) {
 	return h2, nil
 }
 
+// dialTLS dials a mesh server, verifying the cert against addr.
+func (h2 *H2) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	cfg := h2.tlsConfig.Clone()
+	cfg.VerifyConnection = h2.verify(addr)
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	d := &tls.Dialer{Config: cfg}
+	return d.DialContext(ctx, network, addr)
+}
+
 func CleanQuic(httpClient *http.Client) {
 	//hrt, ok := httpClient.Transport.(*h2quic.RoundTripper)
 	hrt, ok := httpClient.Transport.(io.Closer)
@@ -204,6 +290,19 @@ func (h2 *H2) InitH2ServerListener(tcpConn *net.TCPListener, handler http.Handle
 		//tlsServerConfig.ClientAuth = tls.RequireAnyClientCert
 		tlsServerConfig.ClientAuth = tls.RequestClientCert
 	}
+	if h2.CertSource != nil {
+		tlsServerConfig.Certificates = nil
+		getCert := tlsServerConfig.GetCertificate
+		tlsServerConfig.GetCertificate = func(ch *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if getCert != nil && ch.ServerName != "" {
+				// ACME and istio certs, by SNI. The startup primary cert is replaced.
+				if c, err := getCert(ch); err == nil && c != nil && c.PrivateKey != h2.Certs.EC256Cert.PrivateKey {
+					return c, nil
+				}
+			}
+			return h2.CertSource.Certificate(), nil
+		}
+	}
 	hw := h2.HandlerWrapper(handler)
 	// Self-signed cert
 	s := &http.Server{
@@ -218,18 +317,21 @@ func (h2 *H2) InitH2ServerListener(tcpConn *net.TCPListener, handler http.Handle
 	return nil
 }
 
-// Verify a server cert. Not enough context to verify name at this point
-func verify(pub string) func(der [][]byte, verifiedChains [][]*x509.Certificate) error {
-	return func(der [][]byte, verifiedChains [][]*x509.Certificate) error {
-		var err error
-		x509Cert := make([]*x509.Certificate, len(der))
-		for i, b := range der {
-			// err already checked
-			x509Cert[i], _ = x509.ParseCertificate(b)
+// Verify a server cert. Certs are self-signed and the domain name is not
+// trusted - just the pub key, matched against the known hosts using the
+// equivalent of SSH known_hosts as database.
+//
+// addr is the host:port actually dialed - the ServerName of the connection is
+// empty when dialing an IP or VIP. A valid SVID doesn't replace the key check,
+// the SPIFFE ID is not bound to the host.
+func (h2 *H2) verify(addr string) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("missing server certificate")
 		}
 
 		// verify the leaf is not expired
-		leaf := x509Cert[0]
+		leaf := cs.PeerCertificates[0]
 		now := time.Now()
 		if now.Before(leaf.NotBefore) {
 			return errors.New("certificate is not valid yet")
@@ -238,12 +340,16 @@ func verify(pub string) func(der [][]byte, verifiedChains [][]*x509.Certificate)
 			return errors.New("expired certificate")
 		}
 
-		// TODO: match the pub key against the trust DB
-		// certs are self-signed, and domain name is not trusted - just the pub key
-
-		// Use the equivalent of SSH known-hosts as database.
-
-		return err
+		// A SPIFFE ID that doesn't verify is rejected.
+		if h2.SVID != nil {
+			if _, err := h2.SVID.VerifySVID(cs.PeerCertificates); err != nil && err != wpauth.ErrNoSPIFFEID {
+				return err
+			}
+		}
+		if h2.KnownHosts == nil {
+			return nil
+		}
+		return h2.KnownHosts.CheckKnownHost(addr, auth.MarshalPublicKey(leaf.PublicKey))
 	}
 }
 
@@ -277,8 +383,20 @@ func (hw *handlerWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 
+	var bearer *wpauth.BearerIdentity
 	vapidH := r.Header["Authorization"]
-	if len(vapidH) > 0 {
+	if len(vapidH) > 0 && strings.HasPrefix(vapidH[0], "Bearer ") {
+		if hw.h2.Bearer != nil {
+			id, err := hw.h2.Bearer.VerifyBearer(vapidH[0][7:])
+			if err != nil {
+				log.Println("H2: invalid bearer token ", err, r.RemoteAddr)
+				w.WriteHeader(http.StatusUnauthorized)
+				w.Write([]byte("Invalid token"))
+				return
+			}
+			bearer = id
+		}
+	} else if len(vapidH) > 0 {
 		tok, pub, err := auth.CheckVAPID(vapidH[0], time.Now())
 		if err == nil {
 			h2c.Pub = pub
@@ -289,41 +407,126 @@ func (hw *handlerWrapper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
 		pk1 := r.TLS.PeerCertificates[0].PublicKey
 		h2c.Pub = auth.MarshalPublicKey(pk1)
-		// TODO: Istio-style, signed by a trusted CA. This is also for SSH-with-cert
-		h2c.SAN, _ = auth.GetSAN(r.TLS.PeerCertificates[0])
+		if hw.h2.SVID != nil {
+			// Istio-style, signed by the root of the trust domain. Unverified
+			// SANs are not used.
+			if id, err := hw.h2.SVID.VerifySVID(r.TLS.PeerCertificates); err == nil {
+				h2c.SAN = []string{id.String()}
+			}
+		} else {
+			h2c.SAN, _ = auth.GetSAN(r.TLS.PeerCertificates[0])
+		}
+	}
+	if h2c.Pub == nil && bearer == nil {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Missing VAPID, bearer token or mTLS"))
+		return
 	}
-	if h2c.Pub == nil {
+	if h2c.Pub != nil && hw.h2.Revocation != nil && hw.h2.Revocation.IsRevoked(h2c.Pub) {
+		log.Println("H2: revoked key ", auth.Pub2VIP(h2c.Pub), r.RemoteAddr)
 		w.WriteHeader(http.StatusForbidden)
-		w.Write([]byte("Missing VAPID or mTLS"))
+		w.Write([]byte("Revoked"))
 		return
 	}
 
-	h2c.VIP = auth.Pub2VIP(h2c.Pub)
-	// ssh-style, known pub leaf
+	// ssh-style, known pub leaf. The token role is used if the key is not
+	// authorized, or with bearer-only auth.
 	var role string
-	if role = hw.h2.Certs.Authorized[string(h2c.Pub)]; role == "" {
+	if h2c.Pub != nil {
+		h2c.VIP = auth.Pub2VIP(h2c.Pub)
+		role = hw.h2.Certs.Authorized[string(h2c.Pub)]
+	}
+	if bearer != nil {
+		if bearer.SAN != "" {
+			h2c.SAN = append(h2c.SAN, bearer.SAN)
+		}
+		if role == "" {
+			role = bearer.Role
+		}
+	}
+	if role == "" {
 		role = "guest"
 	}
 	h2c.Role = role
 
-	ctx := auth.ContextWithAuth(r.Context(), h2c)
+	ctx := context.WithValue(auth.ContextWithAuth(r.Context(), h2c), reqContextKey{}, h2c)
 	if hw.h2.GRPC != nil && r.ProtoMajor == 2 && strings.HasPrefix(
 		r.Header.Get("Content-Type"), "application/grpc") {
+		// Policy checked by the interceptors, using the method name.
 		hw.h2.GRPC.ServeHTTP(w, r.WithContext(ctx))
 		return
 	}
 
+	if hw.h2.Policy != nil {
+		err := hw.h2.Policy.Authorize(&wpauth.PolicyRequest{
+			Kind:   wpauth.PolicyHTTP,
+			Role:   role,
+			VIP:    h2c.VIP,
+			SAN:    h2c.SAN,
+			Path:   r.URL.Path,
+			Method: r.Method,
+		})
+		if err != nil {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Denied by policy"))
+			return
+		}
+	}
+
 	hw.handler.ServeHTTP(w, r.WithContext(ctx))
 }
 
 // Common RBAC/Policy
 //
-// Input: context - VIP6 src/dest, ports, etc.
-// For HTTP: path
-//
-// Map to 'group'
+// Input: context - VIP6 src/dest, ports, SAN, role.
+// For HTTP: path and method, for gRPC the full method name.
 //
-// Use Authorized_keys or groups to match
+// The rules are defined in wpgate auth policy.go.
+
+func (h2 *H2) grpcAuthorize(ctx context.Context, method string) error {
+	if h2.Policy == nil {
+		return nil
+	}
+	req := &wpauth.PolicyRequest{
+		Kind: wpauth.PolicyGRPC,
+		Role: wpauth.RoleGuest,
+		Path: method,
+	}
+	if h2c := RequestContext(ctx); h2c != nil {
+		req.Role = h2c.Role
+		req.VIP = h2c.VIP
+		req.SAN = h2c.SAN
+	}
+	if err := h2.Policy.Authorize(req); err != nil {
+		return status.Error(codes.PermissionDenied, err.Error())
+	}
+	return nil
+}
+
+func (h2 *H2) grpcUnaryPolicy(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := h2.grpcAuthorize(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (h2 *H2) grpcStreamPolicy(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := h2.grpcAuthorize(ss.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// reqContextKey holds the auth context set by handlerWrapper, in addition to
+// the ugate key - auth.AuthContext panics if the context is missing.
+type reqContextKey struct{}
+
+// RequestContext returns the auth context set by handlerWrapper, or nil if the
+// request didn't go through the wrapper.
+func RequestContext(ctx context.Context) *auth.ReqContext {
+	h2c, _ := ctx.Value(reqContextKey{}).(*auth.ReqContext)
+	return h2c
+}
 
 var (
 	accessLogs = true
@@ -2,10 +2,13 @@ package h2
 
 import (
 	"crypto/tls"
+	"net"
 	"net/http"
 	"net/url"
 	"strings"
 	"time"
+
+	"github.com/costinm/ugate/pkg/auth"
 )
 
 // Helpers for using H2/H3 clients
@@ -22,6 +25,28 @@ func (h2 *H2) Client(host string) *http.Client {
 	return h2.httpsClient
 }
 
+// Peer is the identity of a server, verified by the H2 client.
+type Peer struct {
+	// Public key, in marshalled format.
+	Pub []byte
+	VIP net.IP
+	SAN []string
+}
+
+// PeerIdentity returns the identity of the server that sent the response. Responses
+// from H2.Client are verified against the known hosts, if KnownHosts is set.
+// Returns nil for plain text responses.
+func PeerIdentity(res *http.Response) *Peer {
+	if res == nil || res.TLS == nil || len(res.TLS.PeerCertificates) == 0 {
+		return nil
+	}
+	leaf := res.TLS.PeerCertificates[0]
+	p := &Peer{Pub: auth.MarshalPublicKey(leaf.PublicKey)}
+	p.VIP = auth.Pub2VIP(p.Pub)
+	p.SAN, _ = auth.GetSAN(leaf)
+	return p
+}
+
 // NewSocksHttpClient returns a new client using SOCKS5 server.
 func NewSocksHttpClient(socksAddr string) *http.Client {
 	if socksAddr == "" {
@@ -0,0 +1,50 @@
+package h2_test
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/costinm/ugate/pkg/auth"
+	wpauth "github.com/costinm/wpgate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/confstore"
+	"github.com/costinm/wpgate/pkg/h2"
+)
+
+// Servers dialed by IP are verified against the IP - the TLS ServerName is empty.
+func TestClientKnownHostIP(t *testing.T) {
+	bH2, _ := h2.NewTransport(auth.NewAuth(nil, "bob", "m.webinf.info"))
+	err := bH2.InitH2Server("127.0.0.1:16011", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(200)
+	}), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ms := confstore.NewMemStore()
+	aH2, _ := h2.NewTransport(auth.NewAuth(nil, "alice", "m.webinf.info"))
+	aH2.KnownHosts = wpauth.NewAuth(ms, "alice", "m.webinf.info")
+	res, err := aH2.Client("127.0.0.1:16011").Get("https://127.0.0.1:16011/hello")
+	if err != nil {
+		t.Fatal("Get error ", err)
+	}
+	res.Body.Close()
+	if p := h2.PeerIdentity(res); p == nil || res.StatusCode != 200 {
+		t.Fatal("Unexpected response", res.StatusCode)
+	}
+	saved, _ := ms.Get(wpauth.KnownHostsSaveFile)
+	if !strings.HasPrefix(string(saved), "[127.0.0.1]:16011 ") {
+		t.Error("Key not saved with the dialed host and port", string(saved))
+	}
+
+	// A different key pinned for the IP is rejected.
+	other := wpauth.NewAuth(nil, "other", "m.webinf.info")
+	pinned := confstore.NewMemStore()
+	pinned.Set("known_hosts", []byte("[127.0.0.1]:16011 "+other.SSHPublicKey("")+"\n"))
+	cH2, _ := h2.NewTransport(auth.NewAuth(nil, "carol", "m.webinf.info"))
+	cH2.KnownHosts = wpauth.NewAuth(pinned, "carol", "m.webinf.info")
+	if res, err := cH2.Client("127.0.0.1:16011").Get("https://127.0.0.1:16011/hello"); err == nil {
+		res.Body.Close()
+		t.Error("Expected key mismatch")
+	}
+}
@@ -0,0 +1,65 @@
+package h2_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/costinm/ugate/pkg/auth"
+	wpauth "github.com/costinm/wpgate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/h2"
+)
+
+// Tokens verified by a fake issuer.
+type bearers map[string]*wpauth.BearerIdentity
+
+func (b bearers) VerifyBearer(token string) (*wpauth.BearerIdentity, error) {
+	if id, ok := b[token]; ok {
+		return id, nil
+	}
+	return nil, wpauth.ErrBearerInvalid
+}
+
+func TestHandlerBearer(t *testing.T) {
+	h, _ := h2.NewTransport(auth.NewAuth(nil, "bob", "m.webinf.info"))
+	h.Bearer = bearers{
+		"good": {Subject: "sa", SAN: "spiffe://cluster.local/ns/default/sa/sa", Role: "member"},
+	}
+
+	var got *auth.ReqContext
+	hw := h.HandlerWrapper(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = auth.AuthContext(r.Context())
+	}))
+
+	serve := func(authz string) int {
+		req := httptest.NewRequest("GET", "/hello", nil)
+		if authz != "" {
+			req.Header.Set("Authorization", authz)
+		}
+		w := httptest.NewRecorder()
+		hw.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if c := serve("Bearer good"); c != 200 {
+		t.Fatal("Valid token rejected", c)
+	}
+	if got == nil || got.Role != "member" || len(got.SAN) != 1 ||
+		got.SAN[0] != "spiffe://cluster.local/ns/default/sa/sa" {
+		t.Error("Unexpected context", got)
+	}
+
+	got = nil
+	if c := serve("Bearer bad"); c != http.StatusUnauthorized || got != nil {
+		t.Error("Invalid token accepted", c)
+	}
+	if c := serve(""); c != http.StatusForbidden || got != nil {
+		t.Error("Request without auth accepted", c)
+	}
+
+	// Without a verifier, the token is not used.
+	h.Bearer = nil
+	if c := serve("Bearer good"); c != http.StatusForbidden || got != nil {
+		t.Error("Token accepted without verifier", c)
+	}
+}
@@ -0,0 +1,332 @@
+// Package connmgr decides which proxied streams to keep.
+//
+// Streams are closed when idle or after a max lifetime. The timeouts can be
+// set per destination host and per capture type - SOCKS, SSHR, TUN, ... The
+// number of concurrent streams of a client VIP is limited, and on shutdown
+// new streams are rejected while the active ones finish, for DrainTimeout.
+//
+// The gateway owns the streams - the manager only tracks the counts, and
+// returns the streams to evict on each sweep.
+package connmgr
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ConfFile is the ConfStore name of the config.
+const ConfFile = "conns.json"
+
+// Eviction reasons.
+const (
+	ReasonIdle     = "idle"
+	ReasonLifetime = "lifetime"
+	ReasonLimit    = "limit"
+	ReasonDrain    = "drain"
+)
+
+var (
+	ErrTooManyStreams = errors.New("connmgr: too many streams for client")
+	ErrDraining       = errors.New("connmgr: draining")
+)
+
+// Duration is a time.Duration using the "10m" format in JSON. Numbers are
+// seconds.
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s interface{}
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	switch v := s.(type) {
+	case float64:
+		*d = Duration(time.Duration(v * float64(time.Second)))
+	case string:
+		dd, err := time.ParseDuration(v)
+		if err != nil {
+			return err
+		}
+		*d = Duration(dd)
+	default:
+		return errors.New("connmgr: invalid duration " + string(b))
+	}
+	return nil
+}
+
+// Policy has the timeouts for a set of streams. Zero values are inherited
+// from the less specific policy.
+type Policy struct {
+	// Idle is the max time without reads or writes.
+	Idle Duration `json:"idle,omitempty"`
+
+	// MaxLifetime is the max duration of a stream, even if active.
+	MaxLifetime Duration `json:"max_lifetime,omitempty"`
+}
+
+func (p *Policy) merge(o *Policy) {
+	if o == nil {
+		return
+	}
+	if o.Idle != 0 {
+		p.Idle = o.Idle
+	}
+	if o.MaxLifetime != 0 {
+		p.MaxLifetime = o.MaxLifetime
+	}
+}
+
+// Config for the manager, loaded from ConfFile.
+type Config struct {
+	// Default policy.
+	Policy
+
+	// Type has the policies by capture type - the first part of the stream
+	// type, before "-".
+	Type map[string]*Policy `json:"type,omitempty"`
+
+	// Dest has the policies by destination - host:port or host. More specific
+	// than Type.
+	Dest map[string]*Policy `json:"dest,omitempty"`
+
+	// MaxStreamsPerClient limits the active streams of a client VIP. 0 means
+	// no limit.
+	MaxStreamsPerClient int `json:"max_streams_per_client,omitempty"`
+
+	// Sweep is the interval between checks for idle streams.
+	Sweep Duration `json:"sweep,omitempty"`
+
+	// Drain is the max time to wait for active streams on shutdown.
+	Drain Duration `json:"drain,omitempty"`
+}
+
+// DefaultConfig matches the previous behavior - 61 minutes idle timeout,
+// no limits.
+func DefaultConfig() *Config {
+	return &Config{
+		Policy: Policy{Idle: Duration(61 * time.Minute)},
+		Sweep:  Duration(1 * time.Minute),
+		Drain:  Duration(10 * time.Second),
+	}
+}
+
+// ParseConfig parses a JSON config, using the defaults for missing fields.
+func ParseConfig(data []byte) (*Config, error) {
+	cfg := DefaultConfig()
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Stream is the info about an active stream, used in Sweep.
+type Stream struct {
+	ID int
+
+	// Dest is the host:port of the destination.
+	Dest string
+
+	// Type of the stream - capture type and hops.
+	Type string
+
+	Open      time.Time
+	LastRead  time.Time
+	LastWrite time.Time
+}
+
+// Stats are the manager counters, exposed at /dmesh/conns.
+type Stats struct {
+	Clients  map[string]int `json:"clients"`
+	Evicted  map[string]int `json:"evicted"`
+	Draining bool           `json:"draining,omitempty"`
+	Config   *Config        `json:"config"`
+}
+
+// Manager tracks the streams per client, and applies the policies.
+type Manager struct {
+	mutex    sync.Mutex
+	cfg      *Config
+	clients  map[string]int
+	evicted  map[string]int
+	draining bool
+}
+
+// New returns a manager using the config, or the defaults if nil.
+func New(cfg *Config) *Manager {
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	return &Manager{
+		cfg:     cfg,
+		clients: map[string]int{},
+		evicted: map[string]int{},
+	}
+}
+
+// SetConfig replaces the config. Active streams use the new policies on the
+// next sweep.
+func (m *Manager) SetConfig(cfg *Config) {
+	m.mutex.Lock()
+	m.cfg = cfg
+	m.mutex.Unlock()
+}
+
+// Config returns the current config.
+func (m *Manager) Config() *Config {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.cfg
+}
+
+// Policy returns the policy for a destination and stream type: the dest
+// policy, then the type policy, then the default.
+func (m *Manager) Policy(dest, stype string) Policy {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.policy(dest, stype)
+}
+
+func (m *Manager) policy(dest, stype string) Policy {
+	p := m.cfg.Policy
+	if i := strings.Index(stype, "-"); i >= 0 {
+		stype = stype[:i]
+	}
+	p.merge(m.cfg.Type[stype])
+	if host, _, err := net.SplitHostPort(dest); err == nil {
+		p.merge(m.cfg.Dest[host])
+	}
+	p.merge(m.cfg.Dest[dest])
+	return p
+}
+
+// Client returns the key of a client address - the IP, or the address if
+// not an IP:port.
+func Client(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	if ta, ok := addr.(*net.TCPAddr); ok {
+		return ta.IP.String()
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Open records a new stream of the client.
+func (m *Manager) Open(client string) {
+	m.mutex.Lock()
+	m.clients[client]++
+	m.mutex.Unlock()
+}
+
+// Close records the end of a stream of the client.
+func (m *Manager) Close(client string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.clients[client] <= 1 {
+		delete(m.clients, client)
+		return
+	}
+	m.clients[client]--
+}
+
+// Admit checks if an opened stream of the client may be dialed. Returns an
+// error when draining, or if the client has more than MaxStreamsPerClient.
+func (m *Manager) Admit(client string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.draining {
+		m.evicted[ReasonDrain]++
+		return ErrDraining
+	}
+	if max := m.cfg.MaxStreamsPerClient; max > 0 && m.clients[client] > max {
+		m.evicted[ReasonLimit]++
+		return ErrTooManyStreams
+	}
+	return nil
+}
+
+// Sweep returns the streams to evict, with the reason, and updates the
+// counters.
+func (m *Manager) Sweep(now time.Time, streams []*Stream) map[int]string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	res := map[int]string{}
+	for _, s := range streams {
+		p := m.policy(s.Dest, s.Type)
+		last := s.Open
+		if s.LastRead.After(last) {
+			last = s.LastRead
+		}
+		if s.LastWrite.After(last) {
+			last = s.LastWrite
+		}
+		if p.MaxLifetime > 0 && now.Sub(s.Open) > time.Duration(p.MaxLifetime) {
+			res[s.ID] = ReasonLifetime
+		} else if p.Idle > 0 && now.Sub(last) > time.Duration(p.Idle) {
+			res[s.ID] = ReasonIdle
+		} else {
+			continue
+		}
+		m.evicted[res[s.ID]]++
+	}
+	return res
+}
+
+// SweepInterval returns the interval between sweeps, using the default if the
+// config has no positive value.
+func (m *Manager) SweepInterval() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.cfg.Sweep <= 0 {
+		return time.Duration(DefaultConfig().Sweep)
+	}
+	return time.Duration(m.cfg.Sweep)
+}
+
+// Drain rejects new streams. Returns the max time to wait for the active
+// streams.
+func (m *Manager) Drain() time.Duration {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.draining = true
+	return time.Duration(m.cfg.Drain)
+}
+
+// Evicted adds n streams closed for the reason - for example the streams
+// still active at the end of the drain.
+func (m *Manager) Evicted(reason string, n int) {
+	m.mutex.Lock()
+	m.evicted[reason] += n
+	m.mutex.Unlock()
+}
+
+// Stats returns a copy of the counters.
+func (m *Manager) Stats() *Stats {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	s := &Stats{
+		Clients:  map[string]int{},
+		Evicted:  map[string]int{},
+		Draining: m.draining,
+		Config:   m.cfg,
+	}
+	for k, v := range m.clients {
+		s.Clients[k] = v
+	}
+	for k, v := range m.evicted {
+		s.Evicted[k] = v
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package connmgr
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestPolicy(t *testing.T) {
+	cfg, err := ParseConfig([]byte(`{
+		"idle": "10m",
+		"type": {"SOCKS": {"idle": "1m", "max_lifetime": "1h"}},
+		"dest": {"example.com": {"idle": 30}, "example.com:22": {"max_lifetime": "2h"}},
+		"max_streams_per_client": 2}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := New(cfg)
+
+	if p := m.Policy("other.com:443", "TUN-DIRECT"); p.Idle != Duration(10*time.Minute) || p.MaxLifetime != 0 {
+		t.Error("Default policy", p)
+	}
+	if p := m.Policy("other.com:443", "SOCKS-ISSHP"); p.Idle != Duration(time.Minute) || p.MaxLifetime != Duration(time.Hour) {
+		t.Error("Type policy", p)
+	}
+	if p := m.Policy("example.com:22", "SOCKS"); p.Idle != Duration(30*time.Second) || p.MaxLifetime != Duration(2*time.Hour) {
+		t.Error("Dest policy", p)
+	}
+	if time.Duration(cfg.Sweep) != time.Minute {
+		t.Error("Missing default", cfg.Sweep)
+	}
+	m.SetConfig(&Config{Sweep: Duration(-time.Second)})
+	if d := m.SweepInterval(); d != time.Minute {
+		t.Error("Expected default sweep", d)
+	}
+	if _, err := ParseConfig([]byte(`{"idle": "x"}`)); err == nil {
+		t.Error("Invalid duration")
+	}
+}
+
+func TestManager(t *testing.T) {
+	m := New(&Config{
+		Policy:              Policy{Idle: Duration(time.Minute)},
+		Type:                map[string]*Policy{"SSHR": {MaxLifetime: Duration(time.Hour)}},
+		MaxStreamsPerClient: 2,
+		Drain:               Duration(time.Second),
+	})
+	client := Client(&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 5})
+	if client != "fd00::1" {
+		t.Error("Client", client)
+	}
+
+	for i := 0; i < 3; i++ {
+		m.Open(client)
+	}
+	if err := m.Admit(client); err != ErrTooManyStreams {
+		t.Error("Expected limit", err)
+	}
+	m.Close(client)
+	if err := m.Admit(client); err != nil {
+		t.Error("Expected admit", err)
+	}
+	if err := m.Admit("fd00::2"); err != nil {
+		t.Error("Other client", err)
+	}
+
+	now := time.Now()
+	ev := m.Sweep(now, []*Stream{
+		{ID: 1, Type: "SOCKS", Open: now.Add(-2 * time.Minute)},
+		{ID: 2, Type: "SOCKS", Open: now.Add(-2 * time.Minute), LastRead: now},
+		{ID: 3, Type: "SSHR-MR", Open: now.Add(-2 * time.Hour), LastWrite: now},
+		{ID: 4, Type: "SSHR", Open: now},
+	})
+	if len(ev) != 2 || ev[1] != ReasonIdle || ev[3] != ReasonLifetime {
+		t.Error("Unexpected evictions", ev)
+	}
+
+	if d := m.Drain(); d != time.Second {
+		t.Error("Drain timeout", d)
+	}
+	if err := m.Admit("fd00::3"); err != ErrDraining {
+		t.Error("Expected draining", err)
+	}
+	m.Evicted(ReasonDrain, 2)
+
+	s := m.Stats()
+	if s.Evicted[ReasonIdle] != 1 || s.Evicted[ReasonLifetime] != 1 || s.Evicted[ReasonLimit] != 1 ||
+		s.Evicted[ReasonDrain] != 3 || s.Clients[client] != 2 || !s.Draining {
+		t.Error("Unexpected stats", s)
+	}
+	m.Close(client)
+	m.Close(client)
+	if len(m.Stats().Clients) != 0 {
+		t.Error("Clients not removed", m.Stats().Clients)
+	}
+}
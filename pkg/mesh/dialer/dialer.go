@@ -0,0 +1,301 @@
+// Package dialer races the candidate paths to a destination.
+//
+// A destination may be reachable directly, through the SSH VPN, the SSH
+// upstream, or a H2/QUIC relay. Instead of trying each path in order and
+// waiting for timeouts, the paths are started in order of preference with a
+// short delay between them (happy eyeballs, RFC 8305) and the first connected
+// path wins. The winner is remembered per destination and tried first next
+// time, and paths that fail are skipped for an exponential backoff.
+//
+// Fallback paths are only started after all the other paths failed - for
+// example a direct connection when the VPN is required for external hosts.
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate"
+)
+
+const (
+	// DefaultDelay between starting 2 paths.
+	DefaultDelay = 250 * time.Millisecond
+
+	// DefaultTimeout for a dial, including all paths.
+	DefaultTimeout = 20 * time.Second
+
+	// DefaultMaxBackoff for a failed path. The backoff starts at 1s and
+	// doubles with each failure.
+	DefaultMaxBackoff = 5 * time.Minute
+
+	minBackoff = 1 * time.Second
+)
+
+var ErrNoPath = errors.New("dialer: no path to destination")
+
+// Conn is the result of a dial - the stream to the destination.
+type Conn struct {
+	In  io.ReadCloser
+	Out io.Writer
+}
+
+// Close closes both directions of the stream.
+func (c *Conn) Close() {
+	if c.In != nil {
+		c.In.Close()
+	}
+	if cl, ok := c.Out.(io.Closer); ok {
+		cl.Close()
+	}
+}
+
+// Path is a candidate way to reach the destination.
+type Path struct {
+	// Name of the path, recorded in the stats and in TcpProxy.Type. For
+	// example "DIRECT", "ISSHP" for the SSH VPN, "IH2" for a H2 relay.
+	Name string
+
+	Dial func(ctx context.Context) (*Conn, error)
+
+	// Fallback paths are started only after the other paths failed, and
+	// are not moved ahead of them when they win.
+	Fallback bool
+}
+
+// MuxPath returns a path using a muxed connection - SSH or a relay. Each
+// attempt dials a copy of the stream.
+func MuxPath(name string, mc ugate.MuxedConn, s ugate.Stream) *Path {
+	return &Path{Name: name, Dial: func(ctx context.Context) (*Conn, error) {
+		s := s
+		if err := mc.DialProxy(&s); err != nil {
+			return nil, err
+		}
+		return &Conn{In: s.In, Out: s.Out}, nil
+	}}
+}
+
+// PathStats tracks the dials using a path, for one destination.
+type PathStats struct {
+	Success   int    `json:"ok,omitempty"`
+	Fail      int    `json:"fail,omitempty"`
+	LastError string `json:"err,omitempty"`
+
+	// Time to connect, for the last successful dial.
+	Latency time.Duration `json:"latency,omitempty"`
+
+	// The path is skipped until BackoffUntil, after a failure.
+	BackoffUntil time.Time `json:"backoff,omitempty"`
+	backoff      time.Duration
+}
+
+// HostStats has the stats for a destination: the traffic, updated when the
+// proxied streams are closed, and the dial state.
+type HostStats struct {
+	Open time.Time
+	Last time.Time
+
+	SentBytes   int
+	SentPackets int
+	RcvdBytes   int
+	RcvdPackets int
+	Count       int
+
+	LastLatency time.Duration
+	LastBPS     int
+
+	// Winner is the last path that connected first.
+	Winner string `json:"winner,omitempty"`
+
+	// Paths by name.
+	Paths map[string]*PathStats `json:"paths,omitempty"`
+}
+
+// Dialer races the paths, using the stats in Hosts.
+type Dialer struct {
+	// Delay between starting the paths.
+	Delay time.Duration
+
+	// Timeout for the dial, all paths included.
+	Timeout time.Duration
+
+	// MaxBackoff for failed paths.
+	MaxBackoff time.Duration
+
+	// Hosts has the stats, by destination. Guarded by Lock - shared with the
+	// stream accounting.
+	Hosts map[string]*HostStats
+	Lock  sync.Locker
+}
+
+// New returns a dialer using the hosts map, guarded by lock.
+func New(hosts map[string]*HostStats, lock sync.Locker) *Dialer {
+	return &Dialer{
+		Delay:      DefaultDelay,
+		Timeout:    DefaultTimeout,
+		MaxBackoff: DefaultMaxBackoff,
+		Hosts:      hosts,
+		Lock:       lock,
+	}
+}
+
+// Host returns the stats for a destination, creating them. Must be called
+// with the Lock held.
+func (d *Dialer) Host(dest string) *HostStats {
+	hs := d.Hosts[dest]
+	if hs == nil {
+		hs = &HostStats{Open: time.Now()}
+		d.Hosts[dest] = hs
+	}
+	if hs.Paths == nil {
+		hs.Paths = map[string]*PathStats{}
+	}
+	return hs
+}
+
+// order returns the paths to try: the last winner first, then the others in
+// the original order, and the fallback paths last. Paths in backoff are
+// skipped, unless all paths are.
+func (d *Dialer) order(dest string, paths []*Path, now time.Time) []*Path {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	hs := d.Host(dest)
+	res := []*Path{}
+	for _, p := range paths {
+		if ps := hs.Paths[p.Name]; ps != nil && now.Before(ps.BackoffUntil) {
+			continue
+		}
+		res = append(res, p)
+	}
+	if len(res) == 0 {
+		res = append(res, paths...)
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Fallback != res[j].Fallback {
+			return !res[i].Fallback
+		}
+		return res[i].Name == hs.Winner && res[j].Name != hs.Winner
+	})
+	return res
+}
+
+func (d *Dialer) record(dest string, p *Path, latency time.Duration, err error) {
+	d.Lock.Lock()
+	defer d.Lock.Unlock()
+	hs := d.Host(dest)
+	ps := hs.Paths[p.Name]
+	if ps == nil {
+		ps = &PathStats{}
+		hs.Paths[p.Name] = ps
+	}
+	if err == nil {
+		ps.Success++
+		ps.Latency = latency
+		ps.backoff = 0
+		ps.BackoffUntil = time.Time{}
+		return
+	}
+	ps.Fail++
+	ps.LastError = err.Error()
+	ps.backoff *= 2
+	if ps.backoff < minBackoff {
+		ps.backoff = minBackoff
+	}
+	if ps.backoff > d.MaxBackoff {
+		ps.backoff = d.MaxBackoff
+	}
+	ps.BackoffUntil = time.Now().Add(ps.backoff)
+}
+
+type result struct {
+	path    *Path
+	conn    *Conn
+	err     error
+	latency time.Duration
+}
+
+// Dial races the paths to dest. A path is started when the previous one
+// fails or after Delay - fallback paths when no other path is pending.
+// Returns the first connected path - the other connections are closed.
+func (d *Dialer) Dial(ctx context.Context, dest string, paths []*Path) (*Path, *Conn, error) {
+	if len(paths) == 0 {
+		return nil, nil, ErrNoPath
+	}
+	ctx, cancel := context.WithTimeout(ctx, d.Timeout)
+	defer cancel()
+
+	cands := d.order(dest, paths, time.Now())
+	results := make(chan *result, len(cands))
+	primary := 0 // non-fallback paths still dialing
+	start := func(p *Path) {
+		if !p.Fallback {
+			primary++
+		}
+		go func() {
+			t0 := time.Now()
+			c, err := p.Dial(ctx)
+			if err == nil && c == nil {
+				err = ErrNoPath
+			}
+			results <- &result{path: p, conn: c, err: err, latency: time.Since(t0)}
+		}()
+	}
+
+	next, pending := 0, 0
+	var lastErr error
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-timer.C:
+			if next < len(cands) && (!cands[next].Fallback || primary == 0) {
+				start(cands[next])
+				next++
+				pending++
+				timer.Reset(d.Delay)
+			}
+		case r := <-results:
+			pending--
+			if !r.path.Fallback {
+				primary--
+			}
+			d.record(dest, r.path, r.latency, r.err)
+			if r.err == nil {
+				d.Lock.Lock()
+				d.Host(dest).Winner = r.path.Name
+				d.Lock.Unlock()
+				go closeLate(results, pending)
+				return r.path, r.conn, nil
+			}
+			lastErr = r.err
+			if next < len(cands) && (!cands[next].Fallback || primary == 0) {
+				// Start the next path now.
+				if !timer.Stop() {
+					select {
+					case <-timer.C:
+					default:
+					}
+				}
+				timer.Reset(0)
+			} else if pending == 0 {
+				return nil, nil, lastErr
+			}
+		case <-ctx.Done():
+			go closeLate(results, pending)
+			return nil, nil, ctx.Err()
+		}
+	}
+}
+
+// closeLate waits for the n paths still dialing, and closes the connections.
+func closeLate(results chan *result, n int) {
+	for i := 0; i < n; i++ {
+		if r := <-results; r.err == nil {
+			r.conn.Close()
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package dialer
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeConn struct {
+	closed bool
+}
+
+func (f *fakeConn) Read([]byte) (int, error)    { return 0, io.EOF }
+func (f *fakeConn) Write(b []byte) (int, error) { return len(b), nil }
+func (f *fakeConn) Close() error                { f.closed = true; return nil }
+
+// path returns a path that connects or fails after the delay.
+func path(name string, delay time.Duration, err error, calls *int32) *Path {
+	return &Path{Name: name, Dial: func(ctx context.Context) (*Conn, error) {
+		atomic.AddInt32(calls, 1)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if err != nil {
+			return nil, err
+		}
+		c := &fakeConn{}
+		return &Conn{In: c, Out: c}, nil
+	}}
+}
+
+func TestDial(t *testing.T) {
+	mu := &sync.Mutex{}
+	d := New(map[string]*HostStats{}, mu)
+	d.Delay = 20 * time.Millisecond
+	ctx := context.Background()
+	errDown := errors.New("down")
+
+	// The first path is slow - the second starts after Delay and wins.
+	var slow, fast, broken int32
+	p, c, err := d.Dial(ctx, "h1", []*Path{
+		path("slow", 300*time.Millisecond, nil, &slow),
+		path("fast", 0, nil, &fast),
+	})
+	if err != nil || p.Name != "fast" || c == nil {
+		t.Fatal("Dial", p, err)
+	}
+	mu.Lock()
+	if hs := d.Hosts["h1"]; hs.Winner != "fast" || hs.Paths["fast"].Success != 1 {
+		t.Error("Winner not recorded", hs)
+	}
+	mu.Unlock()
+
+	// The winner is tried first.
+	p, _, err = d.Dial(ctx, "h1", []*Path{
+		path("slow", 300*time.Millisecond, nil, &slow),
+		path("fast", 0, nil, &fast),
+	})
+	if err != nil || p.Name != "fast" || atomic.LoadInt32(&slow) != 1 {
+		t.Error("Winner not preferred", p, slow)
+	}
+
+	// A failure starts the next path without waiting.
+	t0 := time.Now()
+	d.Delay = time.Second
+	p, _, err = d.Dial(ctx, "h2", []*Path{
+		path("broken", 0, errDown, &broken),
+		path("fast", 0, nil, &fast),
+	})
+	if err != nil || p.Name != "fast" || time.Since(t0) > 500*time.Millisecond {
+		t.Error("Failover", p, err, time.Since(t0))
+	}
+
+	// The failed path is in backoff and skipped.
+	p, _, err = d.Dial(ctx, "h2", []*Path{
+		path("broken", 0, errDown, &broken),
+		path("fast", 0, nil, &fast),
+	})
+	if err != nil || p.Name != "fast" || atomic.LoadInt32(&broken) != 1 {
+		t.Error("Backoff not applied", p, broken)
+	}
+	mu.Lock()
+	if ps := d.Hosts["h2"].Paths["broken"]; ps.Fail != 1 || ps.LastError != "down" ||
+		!ps.BackoffUntil.After(time.Now()) {
+		t.Error("Failure not recorded", ps)
+	}
+	mu.Unlock()
+
+	// All paths in backoff - all are tried again.
+	_, _, err = d.Dial(ctx, "h3", []*Path{path("broken", 0, errDown, &broken)})
+	if err != errDown {
+		t.Error("Expected error", err)
+	}
+	_, _, err = d.Dial(ctx, "h3", []*Path{path("broken", 0, errDown, &broken)})
+	if err != errDown || atomic.LoadInt32(&broken) != 3 {
+		t.Error("Expected retry", err, broken)
+	}
+	mu.Lock()
+	if ps := d.Hosts["h3"].Paths["broken"]; ps.Fail != 2 || ps.backoff != 2*minBackoff {
+		t.Error("Backoff not increased", ps)
+	}
+	mu.Unlock()
+
+	// Timeout
+	d.Timeout = 50 * time.Millisecond
+	_, _, err = d.Dial(ctx, "h4", []*Path{path("slow", time.Second, nil, &slow)})
+	if err != context.DeadlineExceeded {
+		t.Error("Expected timeout", err)
+	}
+
+	if _, _, err = d.Dial(ctx, "h5", nil); err != ErrNoPath {
+		t.Error("Expected no path", err)
+	}
+}
+
+func TestDialCloseLosers(t *testing.T) {
+	d := New(map[string]*HostStats{}, &sync.Mutex{})
+	d.Delay = 0
+	release := make(chan struct{})
+	late := &fakeConn{}
+	done := make(chan struct{})
+	loser := &Path{Name: "late", Dial: func(ctx context.Context) (*Conn, error) {
+		<-release
+		return &Conn{In: late, Out: &closeNotify{done: done}}, nil
+	}}
+	var n int32
+	p, _, err := d.Dial(context.Background(), "h", []*Path{loser, path("fast", 10*time.Millisecond, nil, &n)})
+	if err != nil || p.Name != "fast" {
+		t.Fatal("Dial", p, err)
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Late connection not closed")
+	}
+	if !late.closed {
+		t.Error("Late connection not closed")
+	}
+}
+
+type closeNotify struct {
+	done chan struct{}
+}
+
+func (c *closeNotify) Write(b []byte) (int, error) { return len(b), nil }
+func (c *closeNotify) Close() error                { close(c.done); return nil }
+
+func TestDialFallback(t *testing.T) {
+	mu := &sync.Mutex{}
+	d := New(map[string]*HostStats{}, mu)
+	d.Delay = 10 * time.Millisecond
+	ctx := context.Background()
+
+	// The fallback is not raced with a slow path.
+	var vpn, direct int32
+	fb := path("direct", 0, nil, &direct)
+	fb.Fallback = true
+	p, _, err := d.Dial(ctx, "h1", []*Path{fb, path("vpn", 100*time.Millisecond, nil, &vpn)})
+	if err != nil || p.Name != "vpn" || atomic.LoadInt32(&direct) != 0 {
+		t.Fatal("Fallback started", p, err, direct)
+	}
+
+	// Used after the other paths fail, and not preferred when it wins.
+	p, _, err = d.Dial(ctx, "h2", []*Path{path("vpn", 0, errors.New("down"), &vpn), fb})
+	if err != nil || p.Name != "direct" {
+		t.Fatal("Fallback not used", p, err)
+	}
+	mu.Lock()
+	d.Hosts["h2"].Paths["vpn"].BackoffUntil = time.Time{}
+	mu.Unlock()
+	p, _, err = d.Dial(ctx, "h2", []*Path{fb, path("vpn", 50*time.Millisecond, nil, &vpn)})
+	if err != nil || p.Name != "vpn" || atomic.LoadInt32(&direct) != 1 {
+		t.Error("Fallback preferred", p, err, direct)
+	}
+}
@@ -0,0 +1,228 @@
+// Package e2e implements end to end encrypted circuits between mesh nodes.
+//
+// Streams to a mesh VIP may be relayed by several jump hosts - each hop sees
+// the content. With E2E, the originator dials the E2E port of the destination
+// and runs a TLS 1.3 handshake over the relayed stream. The destination cert
+// key must match the VIP - Pub2VIP - so relays can't intercept the circuit,
+// and only see ciphertext. After the handshake the originator sends the real
+// destination port, and the destination forwards the stream to it.
+package e2e
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/costinm/ugate/pkg/auth"
+)
+
+const (
+	// DefaultPort is the mesh port for E2E circuits - base port + 29.
+	DefaultPort = 5229
+
+	// ALPN for the E2E handshake.
+	alpn = "dmesh-e2e"
+
+	handshakeTimeout = 10 * time.Second
+)
+
+var (
+	ErrVIPMismatch = errors.New("e2e: destination key doesn't match the VIP")
+	ErrNoCert      = errors.New("e2e: missing peer certificate")
+	ErrDenied      = errors.New("e2e: circuit not authorized")
+)
+
+// E2E holds the node identity, used for both ends of the circuits.
+type E2E struct {
+	// Certificate returns the current cert of the node.
+	Certificate func() *tls.Certificate
+
+	// Authorize is called by the destination with the originator key and the
+	// requested port, before forwarding. Circuits are denied if not set.
+	Authorize func(pub []byte, port int) error
+
+	// Dial connects the destination to the local port. Default is a TCP dial
+	// to 127.0.0.1.
+	Dial func(port int) (net.Conn, error)
+}
+
+func (e *E2E) getCert() (*tls.Certificate, error) {
+	c := e.Certificate()
+	if c == nil {
+		return nil, errors.New("e2e: no certificate")
+	}
+	return c, nil
+}
+
+// verifyVIP checks that the peer key matches the VIP.
+func verifyVIP(vip net.IP) func(cs tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return ErrNoCert
+		}
+		leaf := cs.PeerCertificates[0]
+		now := time.Now()
+		if now.Before(leaf.NotBefore) || now.After(leaf.NotAfter) {
+			return errors.New("e2e: certificate expired")
+		}
+		pv := auth.Pub2VIP(auth.MarshalPublicKey(leaf.PublicKey))
+		// The node ID is the last 8 bytes - the prefix depends on the mesh.
+		if len(vip) != net.IPv6len || !bytes.Equal(pv[8:], vip[8:]) {
+			return ErrVIPMismatch
+		}
+		return nil
+	}
+}
+
+// Client runs the E2E handshake over a relayed stream to the VIP, and
+// requests the port on the destination. The returned conn should be used
+// instead of the stream.
+func (e *E2E) Client(conn net.Conn, vip net.IP, port int) (*tls.Conn, error) {
+	tc := tls.Client(conn, &tls.Config{
+		// The cert chain is not verified - the key must match the VIP instead.
+		InsecureSkipVerify: true,
+		VerifyConnection:   verifyVIP(vip),
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return e.getCert()
+		},
+		ServerName: vip.String(),
+		NextProtos: []string{alpn},
+		MinVersion: tls.VersionTLS13,
+	})
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	hdr := make([]byte, 2)
+	binary.BigEndian.PutUint16(hdr, uint16(port))
+	if _, err := tc.Write(hdr); err != nil {
+		return nil, err
+	}
+	return tc, nil
+}
+
+// Server runs the destination side of the handshake. Returns the conn, the
+// requested port and the originator key.
+func (e *E2E) Server(conn net.Conn) (*tls.Conn, int, []byte, error) {
+	tc := tls.Server(conn, &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return e.getCert()
+		},
+		ClientAuth: tls.RequireAnyClientCert,
+		NextProtos: []string{alpn},
+		MinVersion: tls.VersionTLS13,
+	})
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	if err := tc.Handshake(); err != nil {
+		return nil, 0, nil, err
+	}
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(tc, hdr); err != nil {
+		return nil, 0, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+
+	cs := tc.ConnectionState()
+	pub := auth.MarshalPublicKey(cs.PeerCertificates[0].PublicKey)
+	return tc, int(binary.BigEndian.Uint16(hdr)), pub, nil
+}
+
+// Serve accepts E2E circuits, forwarding them to the local ports.
+func (e *E2E) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go e.handle(c)
+	}
+}
+
+func (e *E2E) handle(c net.Conn) {
+	tc, port, pub, err := e.Server(c)
+	if err != nil {
+		log.Println("E2E: handshake failed ", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	err = ErrDenied
+	if e.Authorize != nil {
+		err = e.Authorize(pub, port)
+	}
+	if err != nil {
+		log.Println("E2E: denied ", auth.Pub2VIP(pub), port, err)
+		tc.Close()
+		return
+	}
+	dial := e.Dial
+	if dial == nil {
+		dial = func(port int) (net.Conn, error) {
+			return net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+		}
+	}
+	lc, err := dial(port)
+	if err != nil {
+		log.Println("E2E: dial failed ", port, err)
+		tc.Close()
+		return
+	}
+	go func() {
+		io.Copy(lc, tc)
+		if cw, ok := lc.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		} else {
+			lc.Close()
+		}
+	}()
+	io.Copy(tc, lc)
+	tc.Close()
+	lc.Close()
+}
+
+// StreamConn adapts the In and Out of a relayed stream to a net.Conn, to
+// run the handshake.
+type StreamConn struct {
+	In  io.ReadCloser
+	Out io.Writer
+}
+
+func (sc *StreamConn) Read(b []byte) (int, error)  { return sc.In.Read(b) }
+func (sc *StreamConn) Write(b []byte) (int, error) { return sc.Out.Write(b) }
+
+func (sc *StreamConn) Close() error {
+	if c, ok := sc.Out.(io.Closer); ok {
+		c.Close()
+	}
+	return sc.In.Close()
+}
+
+func (sc *StreamConn) LocalAddr() net.Addr  { return &net.TCPAddr{} }
+func (sc *StreamConn) RemoteAddr() net.Addr { return &net.TCPAddr{} }
+
+// Deadlines are applied if the stream supports them.
+func (sc *StreamConn) SetDeadline(t time.Time) error {
+	sc.SetReadDeadline(t)
+	return sc.SetWriteDeadline(t)
+}
+
+func (sc *StreamConn) SetReadDeadline(t time.Time) error {
+	if d, ok := sc.In.(interface{ SetReadDeadline(time.Time) error }); ok {
+		return d.SetReadDeadline(t)
+	}
+	return nil
+}
+
+func (sc *StreamConn) SetWriteDeadline(t time.Time) error {
+	if d, ok := sc.Out.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
@@ -0,0 +1,128 @@
+package e2e
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+
+	wpauth "github.com/costinm/wpgate/pkg/auth"
+)
+
+// relay copies between 2 conns, recording the bytes seen by the relay.
+type relay struct {
+	mutex sync.Mutex
+	seen  bytes.Buffer
+}
+
+func (r *relay) copy(dst, src net.Conn) {
+	buf := make([]byte, 1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			r.mutex.Lock()
+			r.seen.Write(buf[:n])
+			r.mutex.Unlock()
+			dst.Write(buf[:n])
+		}
+		if err != nil {
+			dst.Close()
+			return
+		}
+	}
+}
+
+func TestE2E(t *testing.T) {
+	alice := wpauth.NewAuth(nil, "alice", "m.webinf.info")
+	bob := wpauth.NewAuth(nil, "bob", "m.webinf.info")
+	ae := &E2E{Certificate: alice.Certificate}
+	be := &E2E{Certificate: bob.Certificate}
+
+	// Local service on bob
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	echoPort := echo.Addr().(*net.TCPAddr).Port
+
+	var authPub []byte
+	be.Authorize = func(pub []byte, port int) error {
+		authPub = pub
+		if port != echoPort {
+			return errors.New("denied")
+		}
+		return nil
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go be.Serve(l)
+
+	// alice -> relay -> bob E2E port
+	r := &relay{}
+	ac, rc := net.Pipe()
+	bc, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go r.copy(bc, rc)
+	go r.copy(rc, bc)
+
+	tc, err := ae.Client(ac, bob.VIP6, echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := []byte("secret message over the relay")
+	tc.Write(secret)
+	res := make([]byte, len(secret))
+	if _, err := io.ReadFull(tc, res); err != nil || !bytes.Equal(res, secret) {
+		t.Fatal("Echo failed", err, string(res))
+	}
+	tc.Close()
+	if bytes.Contains(r.seen.Bytes(), secret) {
+		t.Error("Relay can see the plain text")
+	}
+	if !bytes.Equal(authPub, alice.Pub) {
+		t.Error("Originator key not passed to Authorize")
+	}
+
+	// Without Authorize, circuits are denied.
+	be.Authorize = nil
+	bc, err = net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc, err = ae.Client(bc, bob.VIP6, echoPort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tc.Write(secret)
+	if n, _ := io.ReadFull(tc, res); n != 0 {
+		t.Error("Expected denied circuit")
+	}
+	tc.Close()
+
+	// Destination with a different key than the VIP
+	ac, bc2 := net.Pipe()
+	go be.Server(bc2)
+	if _, err := ae.Client(ac, alice.VIP6, echoPort); !errors.Is(err, ErrVIPMismatch) {
+		t.Error("Expected VIP mismatch", err)
+	}
+}
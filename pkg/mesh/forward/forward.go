@@ -0,0 +1,385 @@
+// Package forward has the static port forwarders and reverse proxies.
+//
+// Each listener accepts on a local address and forwards the streams to a
+// mesh VIP:port or hostname:port, using the gateway - the same paths,
+// policies and quotas as the captured streams. The remote can get a PROXY
+// protocol header with the original client address, and TLS can be
+// terminated on the listener - for example to expose a plain text mesh
+// service with a public cert. Behind a load balancer, the listener can read
+// the PROXY header for the client address.
+//
+// The listeners are declared in the "forward" list of ugate.json, and
+// reloaded when the config changes.
+package forward
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate"
+	"github.com/costinm/wpgate/pkg/transport/proxyproto"
+)
+
+// ConfFile is the ConfStore name of the config - the forwarders are in the
+// "forward" list, next to the gateway settings.
+const ConfFile = "ugate.json"
+
+const handshakeTimeout = 10 * time.Second
+
+// ProxyDialer dials the stream for an accepted connection, and returns the
+// function proxying the client. Implemented by mesh.Gateway.
+type ProxyDialer interface {
+	DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+		ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error)
+}
+
+// Listener is the config of a forwarder.
+type Listener struct {
+	// Local address to listen on, for example 127.0.0.1:8080 or :443.
+	Local string `json:"local"`
+
+	// Remote is the mesh VIP:port or hostname:port of the destination.
+	Remote string `json:"remote"`
+
+	// ProxyProtocol, if set to v1 or v2, sends a PROXY header with the
+	// client address to the remote.
+	ProxyProtocol string `json:"proxyProtocol,omitempty"`
+
+	// AcceptProxy reads the PROXY header sent by a load balancer in front of
+	// the listener, for the client address. The caller VIP and role TLVs
+	// are passed to the remote. Requires Trusted.
+	AcceptProxy bool `json:"acceptProxy,omitempty"`
+
+	// Trusted are the CIDRs of the peers sending the PROXY header. The header
+	// is required from these peers, and ignored - not parsed - from others.
+	Trusted []string `json:"trusted,omitempty"`
+
+	// TLS, if set, terminates TLS on the listener.
+	TLS *TLS `json:"tls,omitempty"`
+}
+
+// TLS has the ConfStore names of the PEM cert and key. If empty, the node
+// cert is used. The files are loaded when the listener config changes.
+type TLS struct {
+	Cert string `json:"cert,omitempty"`
+	Key  string `json:"key,omitempty"`
+}
+
+// ErrUntrusted is returned for listeners accepting the PROXY header from any
+// peer - which could send a forged client address, VIP and role.
+var ErrUntrusted = errors.New("forward: acceptProxy requires trusted")
+
+// validTrust checks the trusted CIDRs.
+func (l *Listener) validTrust() error {
+	if l.AcceptProxy && len(l.Trusted) == 0 {
+		return ErrUntrusted
+	}
+	_, err := proxyproto.TrustCIDRs(l.Trusted)
+	return err
+}
+
+func (l *Listener) equal(o *Listener) bool {
+	a, _ := json.Marshal(l)
+	b, _ := json.Marshal(o)
+	return bytes.Equal(a, b)
+}
+
+// ParseConfig returns the listeners in a ugate.json file.
+func ParseConfig(data []byte) ([]*Listener, error) {
+	cfg := struct {
+		Forward []*Listener `json:"forward"`
+	}{}
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return nil, err
+	}
+	for _, l := range cfg.Forward {
+		if l.Local == "" || l.Remote == "" {
+			return nil, fmt.Errorf("forward: missing local or remote %v", l)
+		}
+		if l.ProxyProtocol != "" && l.ProxyProtocol != proxyproto.V1 && l.ProxyProtocol != proxyproto.V2 {
+			return nil, proxyproto.ErrVersion
+		}
+		if err := l.validTrust(); err != nil {
+			return nil, err
+		}
+	}
+	return cfg.Forward, nil
+}
+
+// Forwarder runs the listeners.
+type Forwarder struct {
+	GW ProxyDialer
+
+	// Config is used to load the TLS certs.
+	Config ugate.ConfStore
+
+	// Certificate returns the node cert, for TLS listeners without a cert.
+	Certificate func() *tls.Certificate
+
+	mutex  sync.Mutex
+	active map[string]*listener
+}
+
+// listener is an active forwarder. The config can be replaced without
+// closing the port.
+type listener struct {
+	l net.Listener
+
+	mutex   sync.RWMutex
+	cfg     *Listener
+	tls     *tls.Config
+	trusted func(addr net.Addr) bool
+}
+
+// New returns a forwarder without listeners.
+func New(gw ProxyDialer, cs ugate.ConfStore) *Forwarder {
+	return &Forwarder{
+		GW:     gw,
+		Config: cs,
+		active: map[string]*listener{},
+	}
+}
+
+// Apply starts, updates and closes the listeners to match the config. The
+// streams of a closed listener are not interrupted. Returns the last error,
+// the other listeners are still applied.
+func (f *Forwarder) Apply(cfg []*Listener) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	want := map[string]*Listener{}
+	for _, l := range cfg {
+		want[l.Local] = l
+	}
+	for local, al := range f.active {
+		if _, ok := want[local]; !ok {
+			al.l.Close()
+			delete(f.active, local)
+		}
+	}
+
+	var lastErr error
+	for local, l := range want {
+		tc, err := f.tlsConfig(l)
+		if err != nil {
+			log.Println("Forward: invalid TLS ", local, err)
+			lastErr = err
+			continue
+		}
+		if err := l.validTrust(); err != nil {
+			log.Println("Forward: invalid trusted ", local, err)
+			lastErr = err
+			continue
+		}
+		var trusted func(addr net.Addr) bool
+		if len(l.Trusted) > 0 {
+			trusted, _ = proxyproto.TrustCIDRs(l.Trusted)
+		}
+		if al, ok := f.active[local]; ok {
+			al.mutex.Lock()
+			if !al.cfg.equal(l) {
+				al.cfg = l
+				al.tls = tc
+				al.trusted = trusted
+			}
+			al.mutex.Unlock()
+			continue
+		}
+		nl, err := net.Listen("tcp", local)
+		if err != nil {
+			log.Println("Forward: listen failed ", local, err)
+			lastErr = err
+			continue
+		}
+		al := &listener{l: nl, cfg: l, tls: tc, trusted: trusted}
+		f.active[local] = al
+		go f.serve(al)
+	}
+	return lastErr
+}
+
+// Load applies the listeners in a ugate.json file.
+func (f *Forwarder) Load(data []byte) error {
+	cfg, err := ParseConfig(data)
+	if err != nil {
+		return err
+	}
+	return f.Apply(cfg)
+}
+
+// Watch loads the config from the ConfStore, and reloads it when it changes,
+// checking at each interval until the context is done.
+func (f *Forwarder) Watch(ctx context.Context, cs ugate.ConfStore, interval time.Duration) {
+	var last []byte
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		data, err := cs.Get(ConfFile)
+		if err == nil && data != nil && !bytes.Equal(data, last) {
+			last = data
+			if err := f.Load(data); err != nil {
+				log.Println("Forward: config error ", err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Listeners returns the active config, sorted by local address.
+func (f *Forwarder) Listeners() []*Listener {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	res := []*Listener{}
+	for _, al := range f.active {
+		al.mutex.RLock()
+		res = append(res, al.cfg)
+		al.mutex.RUnlock()
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Local < res[j].Local })
+	return res
+}
+
+// Addr returns the address of an active listener, nil if not found.
+func (f *Forwarder) Addr(local string) net.Addr {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if al, ok := f.active[local]; ok {
+		return al.l.Addr()
+	}
+	return nil
+}
+
+// Close stops all the listeners.
+func (f *Forwarder) Close() {
+	f.Apply(nil)
+}
+
+func (f *Forwarder) tlsConfig(l *Listener) (*tls.Config, error) {
+	if l.TLS == nil {
+		return nil, nil
+	}
+	if l.TLS.Cert == "" && l.TLS.Key == "" {
+		if f.Certificate == nil {
+			return nil, errors.New("forward: no node certificate")
+		}
+		// The current cert, for rotation.
+		return &tls.Config{
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return f.Certificate(), nil
+			},
+		}, nil
+	}
+	if f.Config == nil {
+		return nil, errors.New("forward: no config store")
+	}
+	certPEM, err := f.Config.Get(l.TLS.Cert)
+	if err != nil {
+		return nil, err
+	}
+	keyPEM, err := f.Config.Get(l.TLS.Key)
+	if err != nil {
+		return nil, err
+	}
+	c, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{Certificates: []tls.Certificate{c}}, nil
+}
+
+func (f *Forwarder) serve(al *listener) {
+	for {
+		c, err := al.l.Accept()
+		if err != nil {
+			return
+		}
+		al.mutex.RLock()
+		cfg, tc, trusted := al.cfg, al.tls, al.trusted
+		al.mutex.RUnlock()
+		go f.handle(c, cfg, tc, trusted)
+	}
+}
+
+func (f *Forwarder) handle(c net.Conn, cfg *Listener, tc *tls.Config, trusted func(addr net.Addr) bool) {
+	meta := []string{"listener", cfg.Local}
+
+	// Caller VIP and role from a trusted proxy, sent to the remote. Other
+	// peers can't set the identity.
+	var tlvs []proxyproto.TLV
+	if cfg.AcceptProxy && trusted != nil && trusted(c.RemoteAddr()) {
+		pc := proxyproto.NewConn(c, true)
+		h, err := pc.Header()
+		if err != nil {
+			log.Println("Forward: invalid PROXY header ", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		if vip := h.VIP(); vip != nil {
+			meta = append(meta, "vip", vip.String())
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeVIP, Value: vip})
+		}
+		if role := h.Role(); role != "" {
+			meta = append(meta, "role", role)
+			tlvs = append(tlvs, proxyproto.TLV{Type: proxyproto.TypeRole, Value: []byte(role)})
+		}
+		c = pc
+	}
+	if tc != nil {
+		tlsc := tls.Server(c, tc)
+		tlsc.SetDeadline(time.Now().Add(handshakeTimeout))
+		if err := tlsc.Handshake(); err != nil {
+			log.Println("Forward: TLS handshake failed ", c.RemoteAddr(), err)
+			c.Close()
+			return
+		}
+		tlsc.SetDeadline(time.Time{})
+		c = tlsc
+	}
+	rc, pf, err := f.GW.DialProxy(context.Background(), stringAddr(cfg.Remote), c.RemoteAddr(),
+		"FWD", meta...)
+	if err != nil {
+		log.Println("Forward: dial failed ", cfg.Local, cfg.Remote, err)
+		c.Close()
+		return
+	}
+	if cfg.ProxyProtocol != "" {
+		h := &proxyproto.Header{Version: cfg.ProxyProtocol, TLVs: tlvs}
+		h.Source, _ = c.RemoteAddr().(*net.TCPAddr)
+		h.Dest, _ = c.LocalAddr().(*net.TCPAddr)
+		b, err := h.Format()
+		if err == nil {
+			_, err = rc.Write(b)
+		}
+		if err != nil {
+			log.Println("Forward: PROXY header failed ", cfg.Remote, err)
+			rc.Close()
+			c.Close()
+			return
+		}
+	}
+
+	// Blocking
+	pf(c)
+}
+
+type stringAddr string
+
+func (s stringAddr) Network() string {
+	return "addr"
+}
+
+func (s stringAddr) String() string {
+	return string(s)
+}
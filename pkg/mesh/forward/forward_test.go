@@ -0,0 +1,282 @@
+package forward
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/confstore"
+	"github.com/costinm/wpgate/pkg/transport/proxyproto"
+)
+
+type testGW struct{}
+
+func (gw *testGW) DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+	ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error) {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func(client net.Conn) error {
+		go func() {
+			io.Copy(c, client)
+			c.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(client, c)
+		client.Close()
+		return c.Close()
+	}, nil
+}
+
+// lineServer replies with the first line received, prefixed by the name.
+func lineServer(t *testing.T, name string) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				line, _ := bufio.NewReader(c).ReadString('\n')
+				c.Write([]byte(name + " " + line))
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func roundTrip(t *testing.T, c net.Conn, msg string) string {
+	defer c.Close()
+	c.Write([]byte(msg + "\n"))
+	res, _ := ioutil.ReadAll(c)
+	return string(res)
+}
+
+func testCert(t *testing.T) ([]byte, []byte) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "fwd.test"},
+		DNSNames:     []string{"fwd.test"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kb, _ := x509.MarshalECPrivateKey(key)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kb})
+}
+
+func TestParseConfig(t *testing.T) {
+	ls, err := ParseConfig([]byte(`{"basePort": 15000, "forward": [
+		{"local": "127.0.0.1:8080", "remote": "fd00::1:80", "proxyProtocol": "v1"},
+		{"local": ":8443", "remote": "web.mesh:80", "tls": {}}]}`))
+	if err != nil || len(ls) != 2 || ls[0].ProxyProtocol != proxyproto.V1 || ls[1].TLS == nil {
+		t.Fatal("Unexpected config", ls, err)
+	}
+	if _, err := ParseConfig([]byte(`{"forward": [{"local": ":1"}]}`)); err == nil {
+		t.Error("Expected missing remote")
+	}
+	if _, err := ParseConfig([]byte(`{"forward": [{"local": ":1", "remote": "a:1", "proxyProtocol": "v9"}]}`)); err != proxyproto.ErrVersion {
+		t.Error("Expected invalid PROXY version", err)
+	}
+	if ls, err := ParseConfig([]byte(`{}`)); err != nil || len(ls) != 0 {
+		t.Error("Expected no listeners", ls, err)
+	}
+}
+
+func TestForwarder(t *testing.T) {
+	a := lineServer(t, "a")
+	defer a.Close()
+	b := lineServer(t, "b")
+	defer b.Close()
+
+	f := New(&testGW{}, nil)
+	defer f.Close()
+	local := "127.0.0.1:0"
+	err := f.Apply([]*Listener{{Local: local, Remote: a.Addr().String()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := f.Addr(local).String()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := roundTrip(t, c, "hi"); res != "a hi\n" {
+		t.Error("Unexpected response", res)
+	}
+
+	// Reload with a new remote and the PROXY header - same port.
+	err = f.Apply([]*Listener{{Local: local, Remote: b.Addr().String(), ProxyProtocol: proxyproto.V1}})
+	if err != nil || f.Addr(local).String() != addr {
+		t.Fatal("Listener not kept", err)
+	}
+	c, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "b PROXY TCP4 127.0.0.1 127.0.0.1 " +
+		strings.Split(c.LocalAddr().String(), ":")[1] + " " + strings.Split(addr, ":")[1] + "\r\n"
+	if res := roundTrip(t, c, "hi"); res != want {
+		t.Error("Unexpected PROXY header", res, want)
+	}
+	if ls := f.Listeners(); len(ls) != 1 || ls[0].Remote != b.Addr().String() {
+		t.Error("Unexpected listeners", ls)
+	}
+
+	// Removed from the config - the port is closed.
+	if err := f.Load([]byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if f.Addr(local) != nil || len(f.Listeners()) != 0 {
+		t.Error("Listener not removed")
+	}
+	if c, err := net.Dial("tcp", addr); err == nil {
+		c.Close()
+		t.Error("Expected closed port")
+	}
+}
+
+func TestAcceptProxy(t *testing.T) {
+	// The remote gets the client address and the TLVs from the load balancer.
+	hl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hl.Close()
+	headers := make(chan *proxyproto.Header, 1)
+	go func() {
+		for {
+			c, err := hl.Accept()
+			if err != nil {
+				return
+			}
+			h, _ := proxyproto.Read(bufio.NewReader(c))
+			c.Close()
+			headers <- h
+		}
+	}()
+
+	f := New(&testGW{}, nil)
+	defer f.Close()
+	err = f.Apply([]*Listener{{Local: "127.0.0.1:0", Remote: hl.Addr().String(),
+		AcceptProxy: true, Trusted: []string{"127.0.0.0/8"}, ProxyProtocol: proxyproto.V2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := net.Dial("tcp", f.Addr("127.0.0.1:0").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	vip := net.ParseIP("fd00::7")
+	b, _ := (&proxyproto.Header{Version: proxyproto.V2,
+		Source: &net.TCPAddr{IP: net.ParseIP("203.0.113.5"), Port: 4000},
+		Dest:   &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+		TLVs: []proxyproto.TLV{
+			{Type: proxyproto.TypeVIP, Value: vip},
+			{Type: proxyproto.TypeRole, Value: []byte("admin")},
+			{Type: proxyproto.TypeUniqueID, Value: []byte("lb-1")},
+		},
+	}).Format()
+	c.Write(b)
+
+	select {
+	case h := <-headers:
+		if h == nil || h.Version != proxyproto.V2 || h.Source.String() != "203.0.113.5:4000" ||
+			h.Dest.String() != "198.51.100.1:443" || !h.VIP().Equal(vip) || h.Role() != "admin" ||
+			h.TLV(proxyproto.TypeUniqueID) != nil {
+			t.Error("Unexpected header", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No header")
+	}
+
+	// Identity from an untrusted peer is not forwarded.
+	err = f.Apply([]*Listener{{Local: "127.0.0.1:0", Remote: hl.Addr().String(),
+		AcceptProxy: true, Trusted: []string{"10.0.0.0/8"}, ProxyProtocol: proxyproto.V2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	uc, err := net.Dial("tcp", f.Addr("127.0.0.1:0").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	uc.Write(b)
+	select {
+	case h := <-headers:
+		if h == nil || h.VIP() != nil || h.Role() != "" || h.Source.String() != uc.LocalAddr().String() {
+			t.Error("Untrusted identity forwarded", h)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No header")
+	}
+
+	if _, err := ParseConfig([]byte(`{"forward": [{"local": ":1", "remote": "a:1", "trusted": ["x"]}]}`)); err == nil {
+		t.Error("Expected invalid CIDR")
+	}
+	if _, err := ParseConfig([]byte(`{"forward": [{"local": ":1", "remote": "a:1", "acceptProxy": true}]}`)); err != ErrUntrusted {
+		t.Error("Expected trusted required", err)
+	}
+	if err := f.Apply([]*Listener{{Local: "127.0.0.1:0", Remote: "a:1", AcceptProxy: true}}); err != ErrUntrusted {
+		t.Error("Expected trusted required", err)
+	}
+}
+
+func TestTLS(t *testing.T) {
+	a := lineServer(t, "a")
+	defer a.Close()
+	certPEM, keyPEM := testCert(t)
+	conf := confstore.NewMemStore()
+	conf.Set("fwd.crt", certPEM)
+	conf.Set("fwd.key", keyPEM)
+	f := New(&testGW{}, conf)
+	defer f.Close()
+
+	err := f.Apply([]*Listener{
+		{Local: "127.0.0.1:0", Remote: a.Addr().String(), TLS: &TLS{Cert: "fwd.crt", Key: "fwd.key"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM(certPEM)
+	c, err := tls.Dial("tcp", f.Addr("127.0.0.1:0").String(), &tls.Config{
+		ServerName: "fwd.test",
+		RootCAs:    roots,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res := roundTrip(t, c, "tls"); res != "a tls\n" {
+		t.Error("Unexpected response", res)
+	}
+
+	// No node cert.
+	if err := f.Apply([]*Listener{{Local: "127.0.0.1:0", Remote: "a:1", TLS: &TLS{}}}); err == nil {
+		t.Error("Expected missing cert")
+	}
+}
@@ -3,9 +3,10 @@ package mesh
 // Package capture provide different methods to capture local traffic:
 // - TUN device, using a soft tcp/dup stack (netstacktun/)
 // - Istio-style iptables (iptables/)
-// - socks5 (socks5_capture)
+// - socks5 (transport/socks)
+// - TLS SNI routing, without terminating TLS (transport/sni)
 // - http proxy and connect (httpproxy_capture)
-// - localhost ports (port_capture) - also used for creating reverse proxies
+// - localhost ports (forward) - also used for creating reverse proxies
 //
 // Applications with support for http proxy or socks5 can use env variables or settings.
 // Applications without support for proxies can be captured transparently- but requires root or CAP_NET.
@@ -14,16 +15,25 @@ import (
 	"context"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
+	"sort"
+	"strconv"
 	"strings"
 
 	"github.com/costinm/ugate"
 	"github.com/costinm/ugate/pkg/auth"
 	ugates "github.com/costinm/ugate/pkg/ugatesvc"
+	"github.com/costinm/wpgate/pkg/mesh/connmgr"
+	"github.com/costinm/wpgate/pkg/mesh/dialer"
+	"github.com/costinm/wpgate/pkg/mesh/e2e"
+	"github.com/costinm/wpgate/pkg/mesh/forward"
+	"github.com/costinm/wpgate/pkg/mesh/route"
 	"github.com/costinm/wpgate/pkg/streams"
+	"github.com/costinm/wpgate/pkg/transport/proxyproto"
 
 	"net"
 	"sync"
@@ -58,6 +68,14 @@ var (
 	// For HTTP client and server. The local2remote is handled by http stack.
 	// This tracks how many times we called Close() on the interception/socks/etc writer.
 	remoteToLocalClose = streams.Metrics.NewCounter("gate:closeremotetolocal:total", "TCP over H2 Client - Close http client writer", "15m10s")
+
+	// Streams closed or rejected by the connection manager, by reason.
+	tcpEvicted = map[string]streams.Metric{
+		connmgr.ReasonIdle:     streams.Metrics.NewCounter("gate:evict:idle", "Streams closed when idle", "15m10s"),
+		connmgr.ReasonLifetime: streams.Metrics.NewCounter("gate:evict:lifetime", "Streams closed after max lifetime", "15m10s"),
+		connmgr.ReasonLimit:    streams.Metrics.NewCounter("gate:evict:limit", "Streams rejected - too many for client", "15m10s"),
+		connmgr.ReasonDrain:    streams.Metrics.NewCounter("gate:evict:drain", "Streams rejected or closed on shutdown", "15m10s"),
+	}
 )
 
 // Gateway is the main capture API.
@@ -76,7 +94,32 @@ type Gateway struct {
 	tcpLock   sync.RWMutex
 	ActiveTcp map[int]*streams.TcpProxy
 
-	AllTcpCon map[string]*ugate.HostStats
+	// AllTcpCon has the stats by destination, including the dial paths.
+	AllTcpCon map[string]*dialer.HostStats
+
+	// Dialer races the paths to non-mesh destinations, using AllTcpCon.
+	Dialer *dialer.Dialer
+
+	// Conns applies the idle, lifetime and per client limits to ActiveTcp.
+	Conns *connmgr.Manager
+
+	// stopSweep stops the periodic FreeIdleSockets.
+	stopSweep context.CancelFunc
+
+	// Quotas, if set, limits the bandwidth and bytes of the streams by caller
+	// VIP or role.
+	Quotas *streams.Quotas
+
+	// Forward runs the static port forwarders and reverse proxies declared
+	// in ugate.json.
+	Forward *forward.Forwarder
+
+	// ProxyBackends get a PROXY header on direct dials, with the caller VIP
+	// and role TLVs in v2.
+	ProxyBackends proxyproto.Backends
+
+	// Role returns the role of a caller VIP, for the PROXY header.
+	Role func(vip net.IP) string
 
 	// DNS forward DNS requests, may resolve local addresses
 	DNS ugate.IPResolver
@@ -87,14 +130,29 @@ type Gateway struct {
 	// Client to VPN
 	SSHClient ugate.MuxedConn
 
+	// JumpHosts are the connected neighbors, by VIP6 - used as next hop for
+	// the mesh routes.
 	JumpHosts map[string]ugate.MuxedConn
 
+	// Routes to nodes reachable through the JumpHosts, possibly several hops away.
+	Routes *route.Table
+
+	// E2E, if set, encrypts the mesh circuits end to end - relays only see
+	// ciphertext. The destination must listen on E2EPort.
+	E2E     *e2e.E2E
+	E2EPort int
+
 	// Client to mesh expansion - not trusted, set when mesh expansion is in use.
 	// Used as a jump host to connect to the next destination.
 	// TODO: allow multiple addresses.
 	// TODO: this can also be used as 'egressGateway'
 	SSHClientUp ugate.MuxedConn
 
+	// Relays are H2 or QUIC connections to relay nodes, by path name - for
+	// example "h2" or "quic". Used as candidate paths by Dial. Loaded from
+	// relay.File, guarded by m.
+	Relays map[string]ugate.MuxedConn
+
 	Auth *auth.Auth
 }
 
@@ -110,19 +168,113 @@ func New(certs *auth.Auth, gcfg *ugate.GateCfg) *Gateway {
 		//ActiveUdp: make(map[string]*UdpNat),
 		ActiveTcp: make(map[int]*streams.TcpProxy),
 		//AllUdpCon: make(map[string]*HostStats),
-		AllTcpCon: make(map[string]*ugate.HostStats),
+		AllTcpCon: make(map[string]*dialer.HostStats),
 		JumpHosts: map[string]ugate.MuxedConn{},
+		Relays:    map[string]ugate.MuxedConn{},
 		//upstreamMessageChannel: make(chan packet, 100),
 		Auth:           certs,
 	}
+	gw.Dialer = dialer.New(gw.AllTcpCon, &gw.tcpLock)
+	gw.Conns = connmgr.New(nil)
+	gw.Forward = forward.New(gw, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	gw.stopSweep = cancel
+	go gw.sweep(ctx)
+	if certs != nil {
+		gw.Routes = route.NewTable(certs.VIP6.String())
+	}
 
 	return gw
 }
 
+// AddJumpHost registers a connected neighbor, used as next hop for the routes.
+func (gw *Gateway) AddJumpHost(vip net.IP, mc ugate.MuxedConn) {
+	gw.m.Lock()
+	gw.JumpHosts[vip.String()] = mc
+	gw.m.Unlock()
+	if gw.Routes != nil {
+		gw.Routes.SetNeighbor(vip.String(), 1)
+	}
+}
+
+// RemoveJumpHost removes the neighbor, if mc is still the active connection.
+func (gw *Gateway) RemoveJumpHost(vip net.IP, mc ugate.MuxedConn) {
+	gw.m.Lock()
+	if cur := gw.JumpHosts[vip.String()]; cur != mc {
+		gw.m.Unlock()
+		return
+	}
+	delete(gw.JumpHosts, vip.String())
+	gw.m.Unlock()
+	if gw.Routes != nil {
+		gw.Routes.RemoveNeighbor(vip.String())
+	}
+}
+
+func (gw *Gateway) jumpHost(vip string) ugate.MuxedConn {
+	gw.m.RLock()
+	defer gw.m.RUnlock()
+	return gw.JumpHosts[vip]
+}
+
+// AdvertiseRoutes sends the routes to the neighbors periodically, using send.
+// Connected neighbors are refreshed, and neighbors without adverts expire.
+// Blocks until ctx is done.
+func (gw *Gateway) AdvertiseRoutes(ctx context.Context, interval time.Duration, send func(adv *route.Advert)) {
+	if gw.Routes == nil {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		gw.m.RLock()
+		for vip := range gw.JumpHosts {
+			gw.Routes.SetNeighbor(vip, 1)
+		}
+		gw.m.RUnlock()
+		gw.Routes.Expire(time.Now())
+		send(gw.Routes.Advert())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// Close drains the gateway: new streams are rejected, and the active streams
+// have the Drain time of the Conns config to finish before they are closed.
+// The forwarders stop accepting first.
 func (gw *Gateway) Close() {
-	// close all http listeners
+	gw.stopSweep()
+	gw.Forward.Close()
+	if gw.Quotas != nil {
+		defer gw.Quotas.Save()
+	}
+	deadline := time.Now().Add(gw.Conns.Drain())
+	for time.Now().Before(deadline) {
+		gw.tcpLock.RLock()
+		n := len(gw.ActiveTcp)
+		gw.tcpLock.RUnlock()
+		if n == 0 {
+			return
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
 
-	//s.session.Close()
+	gw.tcpLock.RLock()
+	active := make([]*streams.TcpProxy, 0, len(gw.ActiveTcp))
+	for _, tp := range gw.ActiveTcp {
+		active = append(active, tp)
+	}
+	gw.tcpLock.RUnlock()
+	log.Println("GW: drain timeout, closing ", len(active))
+	gw.Conns.Evicted(connmgr.ReasonDrain, len(active))
+	tcpEvicted[connmgr.ReasonDrain].Add(float64(len(active)))
+	for _, tp := range active {
+		gw.closeProxy(tp)
+	}
 }
 
 // Used for debug/status in main app
@@ -180,51 +332,67 @@ func (gw *Gateway) IsMeshAddr(host net.IP) bool {
 	return host.To4() == nil && host[0] == 0xFD && host[1] == 0
 }
 
-var tcpClose = 61 * time.Minute
-
-func (gw *Gateway) FreeIdleSockets() {
-	gw.tcpLock.Lock()
-	t0 := time.Now()
-	var tcpClientsToTimeout []int
-
-	for client, remote := range gw.ActiveTcp {
-		if t0.Sub(remote.LastWrite) > tcpClose &&
-			t0.Sub(remote.LastRead) > tcpClose {
-			log.Printf("UDPC: %s:%d rcv=%d/%d snd=%d/%d ac=%v ra=%v op=%v la=%s",
-				remote.DestAddr.IP, remote.DestAddr.Port,
-				remote.RcvdPackets, remote.RcvdBytes,
-				remote.SentPackets, remote.SentBytes,
-				time.Since(remote.LastWrite), time.Since(remote.LastRead), time.Since(remote.Open),
-				client)
-
-			tcpClientsToTimeout = append(tcpClientsToTimeout, client)
+// sweep calls FreeIdleSockets periodically, using the Sweep interval of the
+// current Conns config - or the default if not positive.
+func (gw *Gateway) sweep(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(gw.Conns.SweepInterval()):
 		}
+		gw.FreeIdleSockets()
 	}
-	for _, client := range tcpClientsToTimeout {
-		tp := gw.ActiveTcp[client]
-
-		tp.Close()
+}
 
-		if tp.RemoteCtx != nil {
-			tp.RemoteCtx()
+// FreeIdleSockets closes the streams that are idle or past their max lifetime,
+// using the Conns policies for the destination and capture type.
+func (gw *Gateway) FreeIdleSockets() {
+	gw.tcpLock.RLock()
+	active := make([]*connmgr.Stream, 0, len(gw.ActiveTcp))
+	for id, tp := range gw.ActiveTcp {
+		active = append(active, &connmgr.Stream{ID: id, Dest: tp.Dest, Type: tp.Type,
+			Open: tp.Open, LastRead: tp.LastRead, LastWrite: tp.LastWrite})
+	}
+	gw.tcpLock.RUnlock()
+
+	for id, reason := range gw.Conns.Sweep(time.Now(), active) {
+		gw.tcpLock.RLock()
+		tp := gw.ActiveTcp[id]
+		gw.tcpLock.RUnlock()
+		if tp == nil {
+			continue
 		}
-
-		delete(gw.ActiveTcp, client)
+		log.Printf("TCPC: evict %s %d dst=%s rcv=%d/%d snd=%d/%d la=%v ra=%v op=%v %s",
+			reason, id, tp.Dest,
+			tp.RcvdPackets, tp.RcvdBytes,
+			tp.SentPackets, tp.SentBytes,
+			time.Since(tp.LastWrite), time.Since(tp.LastRead), time.Since(tp.Open),
+			tp.Type)
+		tcpEvicted[reason].Add(1)
+		gw.closeProxy(tp)
 	}
+}
 
-	gw.tcpLock.Unlock()
-
+// closeProxy closes both sides of the stream - OnProxyClose removes it from
+// ActiveTcp.
+func (gw *Gateway) closeProxy(tp *streams.TcpProxy) {
+	tp.Close()
+	if tp.RemoteCtx != nil {
+		tp.RemoteCtx()
+	}
 }
 
 // DialMesh creates a circuit to a mesh host:
 // - if a local address is known, will be used directly
 // - if an IP address is known, will be used directly
+// - if a route is known, the next hop jump host is used - it will route the
+// stream in the same way, until it reaches the destination
 // - otherwise, will send up to the parent
 //
-// The circuit is currently NOT encrypted E2E - each host on the path can see the content,
-// similar with the ISP or a Wifi access point. After the circuit is created e2e encryption
-// should be added - typically this is used for HTTPS connections. Tor-like obfuscation is not
-// supported yet.
+// Unless E2E is set, the circuit is NOT encrypted E2E - each host on the path can see the content,
+// similar with the ISP or a Wifi access point. With E2E, a TLS handshake with the destination
+// key is done over the circuit. Tor-like obfuscation is not supported yet.
 //
 // dest - the destionation, in [IP6]:port format
 // addr - the address.
@@ -246,6 +414,10 @@ func (gw *Gateway) DialMesh(tp *streams.TcpProxy) error {
 		return gw.dialDirect(tp, "", []byte{127, 0, 0, 1}, tp.DestPort)
 	}
 
+	if gw.E2E != nil && tp.DestPort != gw.E2EPort {
+		return gw.dialMeshE2E(tp)
+	}
+
 	node, f := gw.GetNodeByID(key)
 	if f {
 		ok := gw.DialMeshLocal(tp, node)
@@ -255,6 +427,10 @@ func (gw *Gateway) DialMesh(tp *streams.TcpProxy) error {
 		}
 	}
 
+	if err := gw.dialRoute(tp); err == nil {
+		return nil
+	}
+
 	if gw.SSHClient != nil {
 		// We have an active connection to SSHVpn - use it instead of H2.
 		// TODO: for testing H2 vs SSHClientConn perf disable SSHClient
@@ -289,6 +465,74 @@ func (gw *Gateway) DialMesh(tp *streams.TcpProxy) error {
 	return fmt.Errorf("No valid Gateway")
 }
 
+// dialMeshE2E dials the E2E port of the destination, and runs the handshake
+// over the circuit. The destination key is verified against the VIP.
+func (gw *Gateway) dialMeshE2E(tp *streams.TcpProxy) error {
+	vip, port := tp.DestIP, tp.DestPort
+	if err := tp.SetDest(net.JoinHostPort(vip.String(), strconv.Itoa(gw.E2EPort))); err != nil {
+		return err
+	}
+	if err := gw.DialMesh(tp); err != nil {
+		return err
+	}
+	tc, err := gw.E2E.Client(&e2e.StreamConn{In: tp.In, Out: tp.Out}, vip, port)
+	if err != nil {
+		log.Println("DIAL: E2E handshake failed ", vip, err)
+		tp.In.Close()
+		return err
+	}
+	tp.In = tc
+	tp.Out = tc
+	tp.Type = tp.Type + "-E2E"
+	return nil
+}
+
+// dialRoute uses the routing table to find the next hop for a mesh
+// destination, and dials the stream through the jump host.
+//
+// The nodes that routed the stream are carried in PrevPath: streams that
+// already passed this node or route.Infinity nodes are not routed again - the
+// tables may have loops while converging.
+func (gw *Gateway) dialRoute(tp *streams.TcpProxy) error {
+	if gw.Routes == nil {
+		return errNoRoute
+	}
+	self := gw.Auth.VIP6.String()
+	if len(tp.PrevPath) >= route.Infinity {
+		log.Println("DIAL: MESH route hop limit ", tp.Dest, tp.PrevPath)
+		return errHopLimit
+	}
+	for _, p := range tp.PrevPath {
+		if p == self {
+			log.Println("DIAL: MESH route loop ", tp.Dest, tp.PrevPath)
+			return errHopLimit
+		}
+	}
+	via, r := gw.Routes.NextHop(tp.DestIP.String())
+	if r == nil {
+		return errNoRoute
+	}
+	jh := gw.jumpHost(via)
+	if jh == nil {
+		return errNoRoute
+	}
+	tp.PrevPath = append(tp.PrevPath, self)
+	err := jh.DialProxy(&tp.Stream)
+	if err != nil {
+		tp.PrevPath = tp.PrevPath[:len(tp.PrevPath)-1]
+		log.Println("DIAL: MESH route failed ", tp.Dest, via, err)
+		return err
+	}
+	tp.Type = tp.Type + "-MR"
+	log.Println("DIAL: MESH route ", tp.Dest, via, r.Cost)
+	return nil
+}
+
+var (
+	errNoRoute  = errors.New("no route")
+	errHopLimit = errors.New("route: hop limit or loop")
+)
+
 // DialMeshLocal will connect to a node that is locally known - has a MUX connection, local IP or
 // external IP.
 func (gw *Gateway) DialMeshLocal(tp *streams.TcpProxy, node *ugate.DMNode) bool {
@@ -370,6 +614,10 @@ func (gw *Gateway) dialDirect(tp *streams.TcpProxy, addr string, dstIP net.IP, d
 		log.Println("TCPO: ERR", dstAddr, err)
 		return err
 	}
+	if err := gw.sendProxyHeader(tp, addr, c1); err != nil {
+		c1.Close()
+		return err
+	}
 
 	tp.In = c1
 	tp.Out = c1
@@ -396,6 +644,15 @@ func (gw *Gateway) dialDirect(tp *streams.TcpProxy, addr string, dstIP net.IP, d
 //
 // In case of error, caller should close local in/out streams
 func (gw *Gateway) Dial(tp *streams.TcpProxy, dest string, addr *net.TCPAddr) error {
+	if err := gw.Conns.Admit(connClient(tp)); err != nil {
+		log.Println("DIAL: rejected ", tp.ClientAddr, dest, err)
+		if err == connmgr.ErrDraining {
+			tcpEvicted[connmgr.ReasonDrain].Add(1)
+		} else {
+			tcpEvicted[connmgr.ReasonLimit].Add(1)
+		}
+		return err
+	}
 
 	// I have an IP resolved already. May be mesh or next hop.
 	// Happens for iptables, tun, SOCKS/IP.
@@ -438,41 +695,126 @@ func (gw *Gateway) Dial(tp *streams.TcpProxy, dest string, addr *net.TCPAddr) er
 		return gw.dialDirect(tp, dest, tp.DestIP, tp.DestPort)
 	}
 
+	// dest can be an IP:port or hostname:port or MESHID/[....]
+	// TODO: support literal form of MESH hosts
+	return gw.dialPaths(tp, dest)
+}
+
+// dialPaths races the candidate paths to a public destination - the SSH VPN
+// if vpn_ext is set, the SSH upstream, the relays and a direct connection, in
+// this order of preference. With the VPN, the other paths are only used if it
+// fails - external traffic doesn't leak while the VPN is connecting. The path
+// that won is added to the Type.
+func (gw *Gateway) dialPaths(tp *streams.TcpProxy, dest string) error {
+	paths := []*dialer.Path{}
+
 	c, _ := gw.Auth.Config.Get("vpn_ext")
-	if gw.SSHClient != nil && c != nil && (string(c) == "true") {
-		// We have an active connection to SSHVpn - use it instead of H2.
-		// TODO: for testing H2 vs SSHClientConn perf disable SSHClient
-		tp.Type = tp.Type + "-ISSHP"
-		//log.Println("DIAL: NET SSHC OUT TO PARENT ", dest, addr, host, port)
-		err := gw.SSHClient.DialProxy(&tp.Stream)
-		if err == nil {
-			return nil
-		}
+	vpn := gw.SSHClient != nil && c != nil && (string(c) == "true")
+	if vpn {
+		// We have an active connection to SSHVpn - prefer it to direct.
+		paths = append(paths, dialer.MuxPath("ISSHP", gw.SSHClient, tp.Stream))
 	}
-
 	if gw.SSHClientUp != nil {
-		// We have an active connection to SSHVpn - use it instead of H2.
 		// TODO: reconnect
-		// TODO: when net is lost, stop trying
-		tp.Type = tp.Type + "-ISSHU"
-		//log.Println("DIAL: NET SSHC Up OUT TO PARENT ", dest, addr, host, port)
-		err := gw.SSHClientUp.DialProxy(&tp.Stream)
-		if err == nil {
-			return nil
-		}
+		paths = append(paths, dialer.MuxPath("ISSHU", gw.SSHClientUp, tp.Stream))
 	}
 
-	// dest can be an IP:port or hostname:port or MESHID/[....]
-	// TODO: support literal form of MESH hosts
-	//if g.Vpn != "" {
-	//	tp.Type = tp.Type + "-IH2"
-	//	log.Println("DIAL: NET HTTP VPN ", g.Vpn, dest, addr, host, port)
-	//	return tp.DialViaHTTP(g.Vpn, dest)
-	//}
+	// Streams from a relay are not relayed again.
+	if !strings.HasPrefix(tp.Type, "RELAY") {
+		gw.m.RLock()
+		relays := make([]string, 0, len(gw.Relays))
+		for n := range gw.Relays {
+			relays = append(relays, n)
+		}
+		sort.Strings(relays)
+		for _, n := range relays {
+			paths = append(paths, dialer.MuxPath("I"+strings.ToUpper(n), gw.Relays[n], tp.Stream))
+		}
+		gw.m.RUnlock()
+	}
 
 	// Direct connection to destination, should be a public address
-	//log.Println("DIAL: DIRECT ", dest, addr, host, port)
-	return gw.dialDirect(tp, dest, tp.DestIP, tp.DestPort)
+	dstIP, dstPort := tp.DestIP, tp.DestPort
+	paths = append(paths, &dialer.Path{Name: "DIRECT", Dial: func(ctx context.Context) (*dialer.Conn, error) {
+		c1, err := dialTCP(ctx, dest, dstIP, dstPort)
+		if err != nil {
+			return nil, err
+		}
+		if err := gw.sendProxyHeader(tp, dest, c1); err != nil {
+			c1.Close()
+			return nil, err
+		}
+		return &dialer.Conn{In: c1, Out: c1}, nil
+	}})
+	if vpn {
+		for _, p := range paths[1:] {
+			p.Fallback = true
+		}
+	}
+
+	p, con, err := gw.Dialer.Dial(context.Background(), tp.Dest, paths)
+	if err != nil {
+		log.Println("DIAL: no path ", tp.Dest, err)
+		return err
+	}
+	if tc, ok := con.In.(*net.TCPConn); ok && tp.DestIP == nil {
+		tp.DestIP = tc.RemoteAddr().(*net.TCPAddr).IP
+	}
+	tp.In = con.In
+	tp.Out = con.Out
+	tp.Type = tp.Type + "-" + p.Name
+	return nil
+}
+
+// sendProxyHeader writes the PROXY header, if the backend is in
+// ProxyBackends. The source is the original client, the v2 TLVs have the
+// caller VIP - mesh clients or set by the capture - and role.
+func (gw *Gateway) sendProxyHeader(tp *streams.TcpProxy, dest string, c net.Conn) error {
+	v := gw.ProxyBackends.Version(c.RemoteAddr().String())
+	if v == "" {
+		v = gw.ProxyBackends.Version(dest)
+	}
+	if v == "" {
+		return nil
+	}
+	h := &proxyproto.Header{Version: v}
+	h.Source, _ = tp.ClientAddr.(*net.TCPAddr)
+	h.Dest, _ = c.RemoteAddr().(*net.TCPAddr)
+
+	vip := tp.VIP
+	if vip == nil && h.Source != nil && gw.IsMeshAddr(h.Source.IP) {
+		vip = h.Source.IP
+	}
+	role := tp.Role
+	if vip != nil {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TypeVIP, Value: vip.To16()})
+		if role == "" && gw.Role != nil {
+			role = gw.Role(vip)
+		}
+	}
+	if role != "" {
+		h.TLVs = append(h.TLVs, proxyproto.TLV{Type: proxyproto.TypeRole, Value: []byte(role)})
+	}
+	b, err := h.Format()
+	if err != nil {
+		return err
+	}
+	_, err = c.Write(b)
+	return err
+}
+
+// dialTCP connects to the IP, or resolves the address if the IP is not known.
+func dialTCP(ctx context.Context, addr string, dstIP net.IP, dstPort int) (net.Conn, error) {
+	if dstIP != nil {
+		addr = net.JoinHostPort(dstIP.String(), strconv.Itoa(dstPort))
+	}
+	d := &net.Dialer{}
+	c1, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		log.Println("TCPO: ERR", addr, err)
+		return nil, err
+	}
+	return c1, nil
 }
 
 
@@ -544,16 +886,54 @@ func (gw *Gateway) DialProxy(ctx context.Context,
 
 	tp := gw.NewTcpProxy(directClientAddr, ctype,
 		nil, nil, nil)
+	// meta are key, value pairs - "role" is set for callers authenticated by
+	// the capture, like SOCKS users, "vip" for callers behind a trusted proxy.
+	for i := 0; i+1 < len(meta); i += 2 {
+		switch meta[i] {
+		case "role":
+			tp.Role = meta[i+1]
+		case "vip":
+			gw.setVIP(tp, net.ParseIP(meta[i+1]))
+		}
+	}
+	// The quota of the authenticated caller, instead of the proxy address.
+	if gw.Quotas != nil {
+		if tp.Role != "" {
+			tp.Quota = gw.Quotas.ForRole(tp.Role)
+		} else if tp.VIP != nil {
+			tp.Quota = gw.Quotas.ForVIP(tp.VIP)
+		}
+	}
 	err := gw.Dial(tp, dest, addrTCP)
 	if err != nil {
+		gw.OnProxyClose(tp)
 		return nil, nil, err
 	}
 	return tp, tp.ProxyConnClose, nil
 }
 
+// connClient returns the connmgr key of the caller - the VIP for callers behind
+// a trusted proxy, else the client IP.
+func connClient(tp *streams.TcpProxy) string {
+	if tp.VIP != nil {
+		return tp.VIP.String()
+	}
+	return connmgr.Client(tp.ClientAddr)
+}
+
+// setVIP sets the VIP of a tracked stream, moving it to the VIP in connmgr.
+func (gw *Gateway) setVIP(tp *streams.TcpProxy, vip net.IP) {
+	gw.tcpLock.Lock()
+	gw.Conns.Close(connClient(tp))
+	tp.VIP = vip
+	gw.Conns.Open(connClient(tp))
+	gw.tcpLock.Unlock()
+}
+
 func (gw *Gateway) trackTcpProxy(proxy *streams.TcpProxy) {
 	gw.tcpLock.Lock()
 	gw.ActiveTcp[proxy.StreamId] = proxy
+	gw.Conns.Open(connClient(proxy))
 	tcpConActive.Add(1)
 	tcpConTotal.Add(1)
 	gw.tcpLock.Unlock()
@@ -598,6 +978,9 @@ func (gw *Gateway) NewTcpProxy(src net.Addr,
 		ClientIn:     clientIn,
 		ClientOut:    clientOut,
 	}
+	if gw.Quotas != nil {
+		tp.Quota = gw.Quotas.For(src)
+	}
 
 	gw.trackTcpProxy(tp)
 
@@ -651,6 +1034,7 @@ func (gw *Gateway) OnProxyClose(tp *streams.TcpProxy) {
 	}
 
 	delete(gw.ActiveTcp, tp.StreamId)
+	gw.Conns.Close(connClient(tp))
 
 	if tp.Closer != nil {
 		tp.Closer()
@@ -672,12 +1056,7 @@ func (gw *Gateway) OnProxyClose(tp *streams.TcpProxy) {
 	tcpConActive.Add(-1)
 
 	gw.tcpLock.Lock()
-	hs, f := gw.AllTcpCon[tp.Dest]
-
-	if !f {
-		hs = &ugate.HostStats{Open: time.Now()}
-		gw.AllTcpCon[tp.Dest] = hs
-	}
+	hs := gw.Dialer.Host(tp.Dest)
 	hs.Last = time.Now()
 	hs.SentPackets += tp.SentPackets
 	hs.SentBytes += tp.SentBytes
@@ -701,6 +1080,17 @@ func (gw *Gateway) HttpGetNodes(w http.ResponseWriter, r *http.Request) {
 	je.Encode(gw.UGate.Nodes)
 }
 
+// HttpGetRoutes (/dmesh/routes) returns the routes with their metrics.
+func (gw *Gateway) HttpGetRoutes(w http.ResponseWriter, r *http.Request) {
+	if gw.Routes == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	je := json.NewEncoder(w)
+	je.SetIndent(" ", " ")
+	je.Encode(gw.Routes.Stats())
+}
+
 // HttpGetNodes (/dmesh/ip6) returns the list of known nodes, both direct and indirect.
 // This allows nodes to sync the mesh routing table.
 func (gw *Gateway) HttpNodesFilter(w http.ResponseWriter, r *http.Request) {
@@ -724,6 +1114,17 @@ func (gw *Gateway) HttpAllTCP(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(gw.AllTcpCon)
 }
 
+// HttpConns (/dmesh/conns) returns the connection manager config, the streams
+// per client and the eviction counters.
+func (gw *Gateway) HttpConns(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(gw.Conns.Stats())
+}
+
+// HttpForward (/dmesh/forward) returns the active forwarders.
+func (gw *Gateway) HttpForward(w http.ResponseWriter, r *http.Request) {
+	json.NewEncoder(w).Encode(gw.Forward.Listeners())
+}
+
 func (gw *Gateway) HttpTCP(w http.ResponseWriter, r *http.Request) {
 	gw.tcpLock.RLock()
 	defer gw.tcpLock.RUnlock()
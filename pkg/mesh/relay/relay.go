@@ -0,0 +1,207 @@
+// Package relay tunnels streams to a relay node over H2 or QUIC.
+//
+// The client POSTs to /tcp/HOST:PORT on the mTLS port of the relay, the
+// request body is the stream to the destination and the response body the
+// stream back - both directions are open until the request body is closed
+// and the relay closes the response. The relay dials the destination using
+// its gateway, with the same paths, policies and quotas as the captured
+// streams.
+//
+// Clients are ugate.MuxedConn, used as candidate paths by the gateway.
+package relay
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate"
+	"github.com/costinm/ugate/pkg/auth"
+)
+
+// Prefix is the path of the relay handler, followed by the destination.
+const Prefix = "/tcp/"
+
+// File is the ConfStore name of the relays, a map of path names to the URL
+// of the relay - for example {"h2": "https://relay.example.com:15028"}.
+// Names starting with "quic" use QUIC.
+const File = "relays.json"
+
+// ProxyDialer dials the stream for an accepted connection, and returns the
+// function proxying the client. Implemented by mesh.Gateway.
+type ProxyDialer interface {
+	DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+		ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error)
+}
+
+// Client is a relay, reached with an H2 or QUIC client.
+type Client struct {
+	// URL of the relay, without the path.
+	URL string
+
+	HTTP *http.Client
+
+	mutex sync.Mutex
+	vip   net.IP
+	done  chan struct{}
+}
+
+// NewClient returns a client for the relay at url.
+func NewClient(url string, hc *http.Client) *Client {
+	return &Client{
+		URL:  strings.TrimSuffix(url, "/"),
+		HTTP: hc,
+		done: make(chan struct{}),
+	}
+}
+
+// DialProxy opens a stream to tp.Dest through the relay. On success tp.In
+// and tp.Out are set - closing Out sends the FIN.
+func (c *Client) DialProxy(tp *ugate.Stream) error {
+	pr, pw := io.Pipe()
+	req, err := http.NewRequest("POST", c.URL+Prefix+tp.Dest, pr)
+	if err != nil {
+		return err
+	}
+	res, err := c.HTTP.Do(req)
+	if err != nil {
+		pw.Close()
+		return err
+	}
+	if res.StatusCode != 200 {
+		res.Body.Close()
+		pw.Close()
+		return errors.New("relay: " + res.Status)
+	}
+	if res.TLS != nil && len(res.TLS.PeerCertificates) > 0 {
+		c.mutex.Lock()
+		c.vip = auth.Pub2VIP(auth.MarshalPublicKey(res.TLS.PeerCertificates[0].PublicKey))
+		c.mutex.Unlock()
+	}
+	tp.In = res.Body
+	tp.Out = pw
+	return nil
+}
+
+// RemoteVIP returns the VIP of the relay, after the first stream.
+func (c *Client) RemoteVIP() net.IP {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.vip
+}
+
+// Wait blocks until the client is closed.
+func (c *Client) Wait() error {
+	<-c.done
+	return nil
+}
+
+// Close stops the client. Open streams are not interrupted.
+func (c *Client) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	select {
+	case <-c.done:
+	default:
+		close(c.done)
+	}
+}
+
+// Handler returns the relay handler, dialing with gw. It should be on the
+// mTLS mux - the callers are authenticated and authorized by the policy.
+func Handler(gw ProxyDialer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		dest := strings.TrimPrefix(r.URL.Path, Prefix)
+		if _, _, err := net.SplitHostPort(dest); err != nil || r.Method != "POST" {
+			http.Error(w, "invalid destination", http.StatusBadRequest)
+			return
+		}
+		f, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+		c := &conn{body: r.Body, w: w, f: f}
+		if ra, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			c.remote = ra
+		}
+		c.local, _ = r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+
+		var meta []string
+		if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+			vip := auth.Pub2VIP(auth.MarshalPublicKey(r.TLS.PeerCertificates[0].PublicKey))
+			meta = append(meta, "vip", vip.String())
+		}
+		_, pf, err := gw.DialProxy(r.Context(), stringAddr(dest), c.RemoteAddr(), "RELAY", meta...)
+		if err != nil {
+			log.Println("Relay: dial failed ", dest, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(200)
+		f.Flush()
+
+		// Blocking
+		pf(c)
+	}
+}
+
+// conn is the stream of a relay request: the request body and the flushed
+// response.
+type conn struct {
+	body io.ReadCloser
+	w    io.Writer
+	f    http.Flusher
+
+	local, remote net.Addr
+}
+
+func (c *conn) Read(b []byte) (int, error) {
+	return c.body.Read(b)
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	if err == nil {
+		c.f.Flush()
+	}
+	return n, err
+}
+
+func (c *conn) Close() error {
+	return c.body.Close()
+}
+
+func (c *conn) LocalAddr() net.Addr {
+	if c.local == nil {
+		return stringAddr("relay")
+	}
+	return c.local
+}
+
+func (c *conn) RemoteAddr() net.Addr {
+	if c.remote == nil {
+		return stringAddr("relay")
+	}
+	return c.remote
+}
+
+func (c *conn) SetDeadline(t time.Time) error      { return nil }
+func (c *conn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *conn) SetWriteDeadline(t time.Time) error { return nil }
+
+type stringAddr string
+
+func (s stringAddr) Network() string {
+	return "addr"
+}
+
+func (s stringAddr) String() string {
+	return string(s)
+}
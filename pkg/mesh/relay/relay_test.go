@@ -0,0 +1,107 @@
+package relay
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/costinm/ugate"
+	"github.com/costinm/wpgate/pkg/mesh/dialer"
+)
+
+type testGW struct{}
+
+func (gw *testGW) DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+	ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error) {
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func(client net.Conn) error {
+		go func() {
+			io.Copy(c, client)
+			c.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(client, c)
+		return c.Close()
+	}, nil
+}
+
+// echoServer replies with each line received.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				br := bufio.NewReader(c)
+				for {
+					line, err := br.ReadString('\n')
+					if err != nil {
+						return
+					}
+					c.Write([]byte("echo " + line))
+				}
+			}()
+		}
+	}()
+	return l
+}
+
+func TestRelayPath(t *testing.T) {
+	echo := echoServer(t)
+	defer echo.Close()
+
+	srv := httptest.NewUnstartedServer(Handler(&testGW{}))
+	srv.EnableHTTP2 = true
+	srv.StartTLS()
+	defer srv.Close()
+	rc := NewClient(srv.URL, srv.Client())
+	defer rc.Close()
+
+	// The direct path fails, the relay wins the race.
+	d := dialer.New(map[string]*dialer.HostStats{}, &sync.Mutex{})
+	d.Delay = 10 * time.Millisecond
+	direct := &dialer.Path{Name: "DIRECT", Dial: func(ctx context.Context) (*dialer.Conn, error) {
+		time.Sleep(50 * time.Millisecond)
+		return nil, errors.New("unreachable")
+	}}
+	p, c, err := d.Dial(context.Background(), echo.Addr().String(), []*dialer.Path{
+		direct,
+		dialer.MuxPath("IH2", rc, ugate.Stream{Dest: echo.Addr().String()}),
+	})
+	if err != nil || p.Name != "IH2" {
+		t.Fatal("Relay path not used", p, err)
+	}
+	defer c.Close()
+
+	// Both directions stream before the request ends.
+	br := bufio.NewReader(c.In)
+	for _, msg := range []string{"a", "b"} {
+		c.Out.Write([]byte(msg + "\n"))
+		if line, err := br.ReadString('\n'); err != nil || line != "echo "+msg+"\n" {
+			t.Fatal("Unexpected response", line, err)
+		}
+	}
+	if rc.RemoteVIP() == nil {
+		t.Error("Missing relay VIP")
+	}
+
+	// Invalid destination
+	if err := rc.DialProxy(&ugate.Stream{Dest: "nohost"}); err == nil {
+		t.Error("Expected invalid destination")
+	}
+}
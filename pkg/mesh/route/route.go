@@ -0,0 +1,278 @@
+// Package route implements the mesh routing table.
+//
+// Nodes exchange reachability with their neighbors - the nodes with a direct
+// connection, used as jump hosts - over the message mux. The table uses
+// distance-vector routing: each node advertises the VIPs it can reach and the
+// cost, and picks as next hop the neighbor with the lowest total cost.
+//
+// Adverts include the next hop of each route, and a node ignores routes that
+// go through itself (split horizon with poisoned reverse). Costs are capped
+// at Infinity, which bounds count-to-infinity when a node disappears. Routes
+// from a neighbor expire if no advert is received for MaxAge.
+package route
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// TopicRoute is the message topic for the adverts.
+	TopicRoute = "route"
+
+	// Infinity is the cost of an unreachable destination - also the max
+	// number of hops.
+	Infinity = 16
+
+	// DefaultInterval is the default time between adverts.
+	DefaultInterval = 30 * time.Second
+)
+
+// Route is a path to a destination VIP.
+type Route struct {
+	// VIP6 of the destination, as string.
+	VIP string `json:"vip"`
+
+	// Via is the next hop - a neighbor. Empty for neighbors.
+	Via string `json:"via,omitempty"`
+
+	// Cost is the sum of the link costs - the number of hops by default.
+	Cost int `json:"cost"`
+
+	// Updated is the time of the last advert including the route.
+	Updated time.Time `json:"t"`
+}
+
+// Advert is the reachability info sent by a node to its neighbors.
+type Advert struct {
+	// From is the VIP of the sender. Set by the receiver from the message
+	// meta, which is authenticated.
+	From string `json:"from,omitempty"`
+
+	// Seq increases with each advert from the sender - old adverts are ignored.
+	Seq uint64 `json:"seq"`
+
+	// Time the advert was sent, unix ms.
+	Time int64 `json:"t"`
+
+	// Routes of the sender, including its neighbors.
+	Routes []*Route `json:"routes"`
+}
+
+type neighbor struct {
+	cost     int
+	lastSeen time.Time
+	seq      uint64
+
+	// Routes advertised by the neighbor, by VIP, with the neighbor cost.
+	routes map[string]*Route
+}
+
+// Table holds the neighbors, their adverts, and the computed routes.
+type Table struct {
+	// Self is the VIP of this node.
+	Self string
+
+	// MaxAge is the expiration of the routes learned from a neighbor,
+	// default 3 * DefaultInterval.
+	MaxAge time.Duration
+
+	mutex     sync.RWMutex
+	seq       uint64
+	neighbors map[string]*neighbor
+	routes    map[string]*Route
+
+	// Counters, for the metrics.
+	advertsSent     int
+	advertsReceived int
+	advertsIgnored  int
+}
+
+// NewTable returns an empty table for the node.
+func NewTable(self string) *Table {
+	return &Table{
+		Self:      self,
+		MaxAge:    3 * DefaultInterval,
+		seq:       uint64(time.Now().UnixNano()),
+		neighbors: map[string]*neighbor{},
+		routes:    map[string]*Route{},
+	}
+}
+
+// SetNeighbor adds or updates a directly connected node, with the link cost.
+func (t *Table) SetNeighbor(vip string, cost int) {
+	if vip == t.Self {
+		return
+	}
+	if cost <= 0 {
+		cost = 1
+	}
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	n := t.neighbors[vip]
+	if n == nil {
+		n = &neighbor{routes: map[string]*Route{}}
+		t.neighbors[vip] = n
+	}
+	n.cost = cost
+	n.lastSeen = time.Now()
+	t.compute()
+}
+
+// RemoveNeighbor removes a neighbor and the routes through it.
+func (t *Table) RemoveNeighbor(vip string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.neighbors, vip)
+	t.compute()
+}
+
+// HandleAdvert updates the routes learned from a neighbor. Adverts from nodes
+// that are not neighbors, or older than the last advert, are ignored.
+// Returns true if the routing table changed.
+func (t *Table) HandleAdvert(a *Advert) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.advertsReceived++
+	n := t.neighbors[a.From]
+	if n == nil || (n.seq != 0 && a.Seq <= n.seq) {
+		t.advertsIgnored++
+		return false
+	}
+	n.seq = a.Seq
+	n.lastSeen = time.Now()
+	n.routes = map[string]*Route{}
+	for _, r := range a.Routes {
+		if r.VIP == "" || r.VIP == t.Self {
+			continue
+		}
+		cost := r.Cost
+		if r.Via == t.Self {
+			// Poisoned reverse: the neighbor reaches the destination through us.
+			cost = Infinity
+		}
+		n.routes[r.VIP] = &Route{VIP: r.VIP, Via: a.From, Cost: cost, Updated: n.lastSeen}
+	}
+	return t.compute()
+}
+
+// compute rebuilds the routes from the neighbors. Returns true if any route
+// changed. Called with the lock held.
+func (t *Table) compute() bool {
+	routes := map[string]*Route{}
+	for vip, n := range t.neighbors {
+		routes[vip] = &Route{VIP: vip, Cost: n.cost, Updated: n.lastSeen}
+	}
+	for vip, n := range t.neighbors {
+		for dst, r := range n.routes {
+			cost := n.cost + r.Cost
+			if cost >= Infinity {
+				continue
+			}
+			if cur := routes[dst]; cur == nil || cost < cur.Cost ||
+				(cost == cur.Cost && cur.Via != "" && vip < cur.Via) {
+				routes[dst] = &Route{VIP: dst, Via: vip, Cost: cost, Updated: r.Updated}
+			}
+		}
+	}
+
+	changed := len(routes) != len(t.routes)
+	for dst, r := range routes {
+		if old := t.routes[dst]; old == nil || old.Via != r.Via || old.Cost != r.Cost {
+			changed = true
+		}
+	}
+	t.routes = routes
+	return changed
+}
+
+// Expire removes the neighbors not seen for MaxAge. Neighbors with an active
+// connection should be refreshed with SetNeighbor.
+func (t *Table) Expire(now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	expired := false
+	for vip, n := range t.neighbors {
+		if now.Sub(n.lastSeen) > t.MaxAge {
+			delete(t.neighbors, vip)
+			expired = true
+		}
+	}
+	if !expired {
+		return false
+	}
+	return t.compute()
+}
+
+// Advert returns the advert to send to the neighbors.
+func (t *Table) Advert() *Advert {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	t.seq++
+	t.advertsSent++
+	a := &Advert{
+		From:   t.Self,
+		Seq:    t.seq,
+		Time:   time.Now().UnixNano() / int64(time.Millisecond),
+		Routes: make([]*Route, 0, len(t.routes)),
+	}
+	for _, r := range t.routes {
+		a.Routes = append(a.Routes, &Route{VIP: r.VIP, Via: r.Via, Cost: r.Cost})
+	}
+	sort.Slice(a.Routes, func(i, j int) bool { return a.Routes[i].VIP < a.Routes[j].VIP })
+	return a
+}
+
+// NextHop returns the neighbor to use to reach the VIP. For neighbors the
+// result is the VIP itself.
+func (t *Table) NextHop(vip string) (string, *Route) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	r := t.routes[vip]
+	if r == nil {
+		return "", nil
+	}
+	if r.Via == "" {
+		return r.VIP, r
+	}
+	return r.Via, r
+}
+
+// Routes returns the current routes, sorted by VIP.
+func (t *Table) Routes() []*Route {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	res := make([]*Route, 0, len(t.routes))
+	for _, r := range t.routes {
+		c := *r
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].VIP < res[j].VIP })
+	return res
+}
+
+// Stats are the route metrics, exposed at /dmesh/routes.
+type Stats struct {
+	Self            string   `json:"self"`
+	Neighbors       int      `json:"neighbors"`
+	AdvertsSent     int      `json:"adverts_sent"`
+	AdvertsReceived int      `json:"adverts_received"`
+	AdvertsIgnored  int      `json:"adverts_ignored"`
+	Routes          []*Route `json:"routes"`
+}
+
+// Stats returns the routes and counters.
+func (t *Table) Stats() *Stats {
+	routes := t.Routes()
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return &Stats{
+		Self:            t.Self,
+		Neighbors:       len(t.neighbors),
+		AdvertsSent:     t.advertsSent,
+		AdvertsReceived: t.advertsReceived,
+		AdvertsIgnored:  t.advertsIgnored,
+		Routes:          routes,
+	}
+}
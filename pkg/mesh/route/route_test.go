@@ -0,0 +1,98 @@
+package route
+
+import (
+	"testing"
+	"time"
+)
+
+// link connects 2 tables as neighbors.
+func link(a, b *Table) {
+	a.SetNeighbor(b.Self, 1)
+	b.SetNeighbor(a.Self, 1)
+}
+
+// converge exchanges adverts between neighbors until no table changes.
+func converge(t *testing.T, links map[*Table][]*Table) {
+	for i := 0; i < 2*Infinity; i++ {
+		changed := false
+		for from, to := range links {
+			adv := from.Advert()
+			for _, n := range to {
+				if n.HandleAdvert(adv) {
+					changed = true
+				}
+			}
+		}
+		if !changed {
+			return
+		}
+	}
+	t.Fatal("Routes not converging")
+}
+
+func TestRoutes(t *testing.T) {
+	a, b, c, d := NewTable("fd00::a"), NewTable("fd00::b"), NewTable("fd00::c"), NewTable("fd00::d")
+	link(a, b)
+	link(b, c)
+	link(c, d)
+	links := map[*Table][]*Table{a: {b}, b: {a, c}, c: {b, d}, d: {c}}
+	converge(t, links)
+
+	via, r := a.NextHop("fd00::d")
+	if via != "fd00::b" || r == nil || r.Cost != 3 {
+		t.Fatal("Unexpected route to d", via, r)
+	}
+	if via, _ := d.NextHop("fd00::a"); via != "fd00::c" {
+		t.Error("Unexpected route to a", via)
+	}
+	if via, _ := a.NextHop("fd00::b"); via != "fd00::b" {
+		t.Error("Neighbor route", via)
+	}
+
+	// Shortcut a-d
+	link(a, d)
+	links[a] = []*Table{b, d}
+	links[d] = []*Table{c, a}
+	converge(t, links)
+	if via, r := a.NextHop("fd00::d"); via != "fd00::d" || r.Cost != 1 {
+		t.Error("Direct link not used", via, r)
+	}
+	if via, r := a.NextHop("fd00::c"); r == nil || r.Cost != 2 {
+		t.Error("Unexpected route to c", via, r)
+	}
+
+	// d goes away
+	a.RemoveNeighbor("fd00::d")
+	c.RemoveNeighbor("fd00::d")
+	links[a] = []*Table{b}
+	links[c] = []*Table{b}
+	delete(links, d)
+	converge(t, links)
+	for _, tb := range []*Table{a, b, c} {
+		if via, r := tb.NextHop("fd00::d"); r != nil {
+			t.Error("Route to removed node", tb.Self, via, r)
+		}
+	}
+
+	// Replayed and unknown adverts are ignored.
+	adv := b.Advert()
+	a.HandleAdvert(adv)
+	if a.HandleAdvert(adv) {
+		t.Error("Replayed advert")
+	}
+	adv = d.Advert()
+	if a.HandleAdvert(adv) {
+		t.Error("Advert from non-neighbor")
+	}
+	if s := a.Stats(); s.AdvertsIgnored < 2 || s.Neighbors != 1 {
+		t.Error("Unexpected stats", s)
+	}
+
+	// Neighbors not refreshed expire.
+	if !a.Expire(time.Now().Add(2 * a.MaxAge)) {
+		t.Error("Routes not expired")
+	}
+	if len(a.Routes()) != 0 {
+		t.Error("Routes after expiration", a.Routes())
+	}
+}
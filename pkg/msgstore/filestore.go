@@ -0,0 +1,169 @@
+package msgstore
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+	"google.golang.org/protobuf/proto"
+)
+
+// FileStore is an embedded store using one directory per destination and one file per
+// message. File names start with the creation time, so a directory listing is in
+// delivery order. Files are written to a temp file and renamed.
+//
+// File format: expires, created, lastSent as unix nanos, attempts - all big endian,
+// followed by the WebpushMessage proto.
+type FileStore struct {
+	Dir string
+
+	mutex sync.Mutex
+}
+
+const fileHeaderSize = 28
+
+var enc = base64.RawURLEncoding
+
+// NewFileStore creates a store in the directory, creating it if needed.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileStore{Dir: dir}, nil
+}
+
+func (fs *FileStore) fileName(dst string, e *Entry) string {
+	return filepath.Join(fs.Dir, enc.EncodeToString([]byte(dst)),
+		fmt.Sprintf("%016x-%s", e.Created.UnixNano(), enc.EncodeToString([]byte(e.Msg.Id))))
+}
+
+func (fs *FileStore) Put(dst string, e *Entry) error {
+	data, err := proto.Marshal(e.Msg)
+	if err != nil {
+		return err
+	}
+	b := make([]byte, fileHeaderSize, fileHeaderSize+len(data))
+	binary.BigEndian.PutUint64(b[0:], uint64(e.Expires.UnixNano()))
+	binary.BigEndian.PutUint64(b[8:], uint64(e.Created.UnixNano()))
+	binary.BigEndian.PutUint64(b[16:], uint64(e.LastSent.UnixNano()))
+	binary.BigEndian.PutUint32(b[24:], uint32(e.Attempts))
+	b = append(b, data...)
+
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	fn := fs.fileName(dst, e)
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(fn+".tmp", b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(fn+".tmp", fn)
+}
+
+func (fs *FileStore) List(dst string) ([]*Entry, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	dir := filepath.Join(fs.Dir, enc.EncodeToString([]byte(dst)))
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return []*Entry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := []*Entry{}
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), ".tmp") {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, f.Name()))
+		if err != nil {
+			return nil, err
+		}
+		e, err := parseEntry(b)
+		if err != nil {
+			return nil, fmt.Errorf("msgstore: invalid entry %s: %v", f.Name(), err)
+		}
+		res = append(res, e)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res, nil
+}
+
+func parseEntry(b []byte) (*Entry, error) {
+	if len(b) < fileHeaderSize {
+		return nil, errors.New("short file")
+	}
+	e := &Entry{
+		Expires:  time.Unix(0, int64(binary.BigEndian.Uint64(b[0:]))),
+		Created:  time.Unix(0, int64(binary.BigEndian.Uint64(b[8:]))),
+		LastSent: time.Unix(0, int64(binary.BigEndian.Uint64(b[16:]))),
+		Attempts: int(binary.BigEndian.Uint32(b[24:])),
+		Msg:      &webpush.WebpushMessage{},
+	}
+	if err := proto.Unmarshal(b[fileHeaderSize:], e.Msg); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (fs *FileStore) Delete(dst string, id string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	dir := filepath.Join(fs.Dir, enc.EncodeToString([]byte(dst)))
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	suffix := "-" + enc.EncodeToString([]byte(id))
+	left := 0
+	for _, f := range files {
+		if strings.HasSuffix(f.Name(), suffix) {
+			if err := os.Remove(filepath.Join(dir, f.Name())); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+			continue
+		}
+		left++
+	}
+	if left == 0 {
+		os.Remove(dir)
+	}
+	return nil
+}
+
+func (fs *FileStore) Destinations() ([]string, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+	files, err := ioutil.ReadDir(fs.Dir)
+	if err != nil {
+		return nil, err
+	}
+	res := []string{}
+	for _, f := range files {
+		if !f.IsDir() {
+			continue
+		}
+		d, err := enc.DecodeString(f.Name())
+		if err != nil {
+			continue
+		}
+		res = append(res, string(d))
+	}
+	return res, nil
+}
@@ -0,0 +1,64 @@
+package msgstore
+
+import (
+	"sort"
+	"sync"
+)
+
+// MemStore keeps messages in memory - used for tests and nodes without storage.
+type MemStore struct {
+	mutex   sync.Mutex
+	entries map[string]map[string]*Entry
+}
+
+func NewMemStore() *MemStore {
+	return &MemStore{entries: map[string]map[string]*Entry{}}
+}
+
+func (ms *MemStore) Put(dst string, e *Entry) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	m := ms.entries[dst]
+	if m == nil {
+		m = map[string]*Entry{}
+		ms.entries[dst] = m
+	}
+	c := *e
+	m[e.Msg.Id] = &c
+	return nil
+}
+
+func (ms *MemStore) List(dst string) ([]*Entry, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	res := []*Entry{}
+	for _, e := range ms.entries[dst] {
+		c := *e
+		res = append(res, &c)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Created.Before(res[j].Created)
+	})
+	return res, nil
+}
+
+func (ms *MemStore) Delete(dst string, id string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	m := ms.entries[dst]
+	delete(m, id)
+	if len(m) == 0 {
+		delete(ms.entries, dst)
+	}
+	return nil
+}
+
+func (ms *MemStore) Destinations() ([]string, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	res := []string{}
+	for k := range ms.entries {
+		res = append(res, k)
+	}
+	return res, nil
+}
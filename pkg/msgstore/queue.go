@@ -0,0 +1,313 @@
+package msgstore
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+	"google.golang.org/protobuf/proto"
+)
+
+// SendFunc sends a message to a connected peer. Returning nil doesn't mean the
+// message was received - only an ack removes it from the store.
+type SendFunc func(m *webpush.WebpushMessage) error
+
+// Queue holds the messages for each destination VIP and tracks connected peers.
+type Queue struct {
+	Store Store
+
+	// Auth is used to add a signed Via to the message path, and to verify the path
+	// of received messages. If nil, the path is not changed or checked.
+	Auth *auth.Auth
+
+	// RedeliverAfter is the time to wait for an ack before resending to a connected peer.
+	RedeliverAfter time.Duration
+
+	// MaxAttempts drops a message after this many sends without ack. 0 means no limit,
+	// only the TTL applies.
+	MaxAttempts int
+
+	mutex sync.Mutex
+
+	// Connected peers - key is the VIP, the value is keyed by connection ID.
+	peers map[string]map[string]SendFunc
+
+	// Counters, for debug.
+	Stored    int
+	Delivered int
+	Acked     int
+	Expired   int
+}
+
+// TopicAck is the topic used by peers to ack a message, with the message ID in the 'id' meta.
+const TopicAck = "ack"
+
+// TopicQueue is the topic of the queued messages. The 'to' meta is the
+// destination VIP, 'ttl' the time to keep the message in seconds, 'id' and
+// 'from' identify the message and 'path' holds the signed Via path.
+const TopicQueue = "q"
+
+// MetaPeer is the meta with the VIP of the connection a message was received
+// from. Set by the transports, replacing any value sent by the peer.
+const MetaPeer = "peer"
+
+// ErrUnsigned is returned by Verify for messages without a signed path.
+var ErrUnsigned = errors.New("msgstore: unsigned message")
+
+// Sender returns the SendFunc for a connected peer: the message data is sent
+// as is on TopicQueue, with the routing fields as meta.
+func Sender(dst string, send func(meta map[string]string, data []byte) error) SendFunc {
+	return func(m *webpush.WebpushMessage) error {
+		meta := map[string]string{
+			"id":   m.Id,
+			"from": m.From,
+			"to":   dst,
+			"ttl":  strconv.Itoa(int(m.Ttl)),
+		}
+		if len(m.Path) > 0 {
+			p, err := proto.Marshal(&webpush.WebpushMessage{Path: m.Path})
+			if err != nil {
+				return err
+			}
+			meta["path"] = base64.RawURLEncoding.EncodeToString(p)
+		}
+		return send(meta, m.Data)
+	}
+}
+
+// Message returns the message sent by Sender.
+func Message(meta map[string]string, data []byte) (*webpush.WebpushMessage, error) {
+	ttl, _ := strconv.Atoi(meta["ttl"])
+	m := &webpush.WebpushMessage{}
+	if p := meta["path"]; p != "" {
+		b, err := base64.RawURLEncoding.DecodeString(p)
+		if err != nil {
+			return nil, err
+		}
+		if err := proto.Unmarshal(b, m); err != nil {
+			return nil, err
+		}
+	}
+	m.Id = meta["id"]
+	m.From = meta["from"]
+	m.Ttl = int32(ttl)
+	m.Data = data
+	return m, nil
+}
+
+// Verify returns the message received on the topic from the peer VIP, after
+// checking the signed path covers the message and the routing meta, and ends
+// with the peer - so a peer can't add hops before its own. If Auth is nil, the
+// path is not checked.
+func (q *Queue) Verify(peer, topic string, meta map[string]string, data []byte) (*webpush.WebpushMessage, error) {
+	m, err := Message(meta, data)
+	if err != nil {
+		return nil, err
+	}
+	if q.Auth == nil {
+		return m, nil
+	}
+	if len(m.Path) == 0 {
+		return nil, ErrUnsigned
+	}
+	if err := q.Auth.CheckPath(&auth.ReqContext{VIP: net.ParseIP(peer)}, m, topic, meta["to"]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OnMessage handles the store-and-forward messages received from a connected
+// peer: acks remove the message sent to the peer, and queued messages for
+// self are acked with the ack function. Returns true for acks - they are not
+// dispatched further.
+func (q *Queue) OnMessage(peer, self, topic string, meta map[string]string, ack func(meta map[string]string) error) bool {
+	switch topic {
+	case TopicAck:
+		q.Ack(peer, meta["id"])
+		return true
+	case TopicQueue:
+		if meta["to"] == self && meta["id"] != "" && ack != nil {
+			ack(map[string]string{"id": meta["id"]})
+		}
+	}
+	return false
+}
+
+// Default queue, used by transports. Nil if store-and-forward is disabled.
+var Default *Queue
+
+// NewQueue creates a queue using the store.
+func NewQueue(s Store) *Queue {
+	return &Queue{
+		Store:          s,
+		RedeliverAfter: 30 * time.Second,
+		peers:          map[string]map[string]SendFunc{},
+	}
+}
+
+// Send stores the message for the destination and sends it if the peer is connected.
+// A message without ID gets a random one. A message with 0 TTL is not stored - only
+// sent if the peer is connected, otherwise ErrNotConnected is returned.
+func (q *Queue) Send(dst string, m *webpush.WebpushMessage) error {
+	if m.Id == "" {
+		b := make([]byte, 12)
+		rand.Read(b)
+		m.Id = base64.RawURLEncoding.EncodeToString(b)
+	}
+	if q.Auth != nil {
+		q.Auth.SignVia(m, TopicQueue, dst, dst)
+	}
+	send := q.peer(dst)
+	now := time.Now()
+
+	if m.Ttl <= 0 {
+		if send == nil {
+			return ErrNotConnected
+		}
+		return send(m)
+	}
+
+	e := &Entry{
+		Msg:     m,
+		Created: now,
+		Expires: now.Add(time.Duration(m.Ttl) * time.Second),
+	}
+	if send != nil {
+		if err := send(m); err == nil {
+			e.Attempts = 1
+			e.LastSent = now
+		}
+	}
+	if err := q.Store.Put(dst, e); err != nil {
+		return err
+	}
+	q.mutex.Lock()
+	q.Stored++
+	q.mutex.Unlock()
+	return nil
+}
+
+// Ack removes a message delivered to the peer.
+func (q *Queue) Ack(dst, id string) error {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	q.Acked++
+	q.mutex.Unlock()
+	return q.Store.Delete(dst, id)
+}
+
+// Connect registers a connection to the peer and redelivers all pending messages.
+// The ID identifies the connection - a peer may be connected over multiple transports.
+func (q *Queue) Connect(dst, id string, send SendFunc) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	c := q.peers[dst]
+	if c == nil {
+		c = map[string]SendFunc{}
+		q.peers[dst] = c
+	}
+	c[id] = send
+	q.mutex.Unlock()
+
+	q.redeliver(dst, time.Now(), true)
+}
+
+// Disconnect removes a connection. Messages sent on the connection and not acked will
+// be redelivered on the next connection.
+func (q *Queue) Disconnect(dst, id string) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	if c := q.peers[dst]; c != nil {
+		delete(c, id)
+		if len(c) == 0 {
+			delete(q.peers, dst)
+		}
+	}
+	q.mutex.Unlock()
+}
+
+// Pending returns the number of stored messages for the destination.
+func (q *Queue) Pending(dst string) int {
+	l, err := q.Store.List(dst)
+	if err != nil {
+		return 0
+	}
+	return len(l)
+}
+
+// Sweep removes expired messages and resends messages that were not acked in
+// RedeliverAfter to connected peers. Should be called periodically.
+func (q *Queue) Sweep(now time.Time) {
+	dsts, err := q.Store.Destinations()
+	if err != nil {
+		log.Println("msgstore: sweep failed ", err)
+		return
+	}
+	for _, dst := range dsts {
+		q.redeliver(dst, now, false)
+	}
+}
+
+func (q *Queue) peer(dst string) SendFunc {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for _, s := range q.peers[dst] {
+		return s
+	}
+	return nil
+}
+
+// redeliver expires old messages and sends pending ones. If all is false, only
+// messages not sent in RedeliverAfter are sent.
+func (q *Queue) redeliver(dst string, now time.Time, all bool) {
+	l, err := q.Store.List(dst)
+	if err != nil {
+		log.Println("msgstore: list failed ", dst, err)
+		return
+	}
+	send := q.peer(dst)
+	for _, e := range l {
+		if e.Expires.Before(now) {
+			q.expire(dst, e)
+			continue
+		}
+		if send == nil || (!all && e.Attempts > 0 && now.Sub(e.LastSent) < q.RedeliverAfter) {
+			continue
+		}
+		if q.MaxAttempts > 0 && e.Attempts >= q.MaxAttempts {
+			q.expire(dst, e)
+			continue
+		}
+		if err := send(e.Msg); err != nil {
+			// Connection broken, wait for reconnect.
+			send = nil
+			continue
+		}
+		e.Attempts++
+		e.LastSent = now
+		q.Store.Put(dst, e)
+		q.mutex.Lock()
+		q.Delivered++
+		q.mutex.Unlock()
+	}
+}
+
+func (q *Queue) expire(dst string, e *Entry) {
+	q.Store.Delete(dst, e.Msg.Id)
+	q.mutex.Lock()
+	q.Expired++
+	q.mutex.Unlock()
+}
@@ -0,0 +1,236 @@
+package msgstore
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+)
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fs, err := NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name  string
+		store Store
+	}{
+		{"mem", NewMemStore()},
+		{"file", fs},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			q := NewQueue(tc.store)
+			dst := "fd00::1"
+
+			// Peer offline - stored
+			err := q.Send(dst, &webpush.WebpushMessage{Id: "m1", Ttl: 60, Data: []byte("1")})
+			if err != nil {
+				t.Fatal(err)
+			}
+			q.Send(dst, &webpush.WebpushMessage{Id: "m2", Ttl: 60, Data: []byte("2")})
+			q.Send(dst, &webpush.WebpushMessage{Id: "old", Ttl: 1})
+
+			if err := q.Send(dst, &webpush.WebpushMessage{Ttl: 0}); err != ErrNotConnected {
+				t.Error("Expected not connected for 0 TTL", err)
+			}
+
+			// Expire 'old'
+			q.Sweep(time.Now().Add(2 * time.Second))
+			if q.Pending(dst) != 2 {
+				t.Fatal("Expected 2 pending", q.Pending(dst))
+			}
+
+			// Reconnect - redelivered in order
+			got := []string{}
+			q.Connect(dst, "ssh", func(m *webpush.WebpushMessage) error {
+				got = append(got, m.Id)
+				return nil
+			})
+			if len(got) != 2 || got[0] != "m1" || got[1] != "m2" {
+				t.Fatal("Unexpected redelivery", got)
+			}
+
+			q.Ack(dst, "m1")
+
+			// Not acked and not due - not resent
+			got = got[:0]
+			q.Sweep(time.Now())
+			if len(got) != 0 {
+				t.Error("Unexpected resend", got)
+			}
+			q.Sweep(time.Now().Add(q.RedeliverAfter + time.Second))
+			if len(got) != 1 || got[0] != "m2" {
+				t.Error("Expected resend of unacked", got)
+			}
+
+			// Connected peer gets new messages directly
+			got = got[:0]
+			q.Send(dst, &webpush.WebpushMessage{Id: "m3", Ttl: 60})
+			if len(got) != 1 || got[0] != "m3" {
+				t.Error("Expected direct delivery", got)
+			}
+
+			// Disconnect and reconnect on another transport - unacked redelivered
+			q.Disconnect(dst, "ssh")
+			got = got[:0]
+			q.Connect(dst, "ws", func(m *webpush.WebpushMessage) error {
+				got = append(got, m.Id)
+				return nil
+			})
+			if len(got) != 2 {
+				t.Error("Expected redelivery on reconnect", got)
+			}
+			q.Ack(dst, "m2")
+			q.Ack(dst, "m3")
+			if q.Pending(dst) != 0 {
+				t.Error("Acked messages not removed", q.Pending(dst))
+			}
+			q.Disconnect(dst, "ws")
+
+			// Failed send - kept, attempts limited
+			q.MaxAttempts = 1
+			q.Send(dst, &webpush.WebpushMessage{Id: "f1", Ttl: 60})
+			q.Connect(dst, "bad", func(m *webpush.WebpushMessage) error {
+				return errors.New("closed")
+			})
+			if q.Pending(dst) != 1 {
+				t.Error("Message lost on failed send")
+			}
+			q.Disconnect(dst, "bad")
+			q.Connect(dst, "ws", func(m *webpush.WebpushMessage) error {
+				return nil
+			})
+			q.Sweep(time.Now().Add(q.RedeliverAfter + time.Second))
+			if q.Pending(dst) != 0 {
+				t.Error("Max attempts not enforced", q.Pending(dst))
+			}
+		})
+	}
+}
+
+func TestFileStoreReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "msgstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fs, _ := NewFileStore(dir)
+	q := NewQueue(fs)
+	q.Send("fd00::2", &webpush.WebpushMessage{Id: "https://push.example/m/1", Ttl: 60,
+		Data: []byte("persisted"), Path: []*webpush.Via{{Vip: "fd00::3", Time: 1}}})
+
+	// Simulate restart
+	fs2, _ := NewFileStore(dir)
+	d, _ := fs2.Destinations()
+	if len(d) != 1 || d[0] != "fd00::2" {
+		t.Fatal("Unexpected destinations", d)
+	}
+	l, err := fs2.List("fd00::2")
+	if err != nil || len(l) != 1 {
+		t.Fatal("Expected stored message", err, l)
+	}
+	if string(l[0].Msg.Data) != "persisted" || l[0].Msg.Path[0].Vip != "fd00::3" ||
+		l[0].Expires.Sub(l[0].Created) != 60*time.Second {
+		t.Error("Invalid entry", l[0])
+	}
+	fs2.Delete("fd00::2", "https://push.example/m/1")
+	d, _ = fs2.Destinations()
+	if len(d) != 0 {
+		t.Error("Destination not removed", d)
+	}
+}
+
+func TestDelivery(t *testing.T) {
+	q := NewQueue(NewMemStore())
+	dst, self := "fd00::2", "fd00::1"
+
+	// Raw data, with the routing fields.
+	var sent map[string]string
+	var data []byte
+	q.Connect(dst, "ws", Sender(dst, func(meta map[string]string, d []byte) error {
+		sent, data = meta, d
+		return nil
+	}))
+	q.Send(dst, &webpush.WebpushMessage{Id: "m1", From: self, Ttl: 60, Data: []byte(`{"a":1}`)})
+	if sent["to"] != dst || sent["ttl"] != "60" || sent["id"] != "m1" || sent["from"] != self ||
+		string(data) != `{"a":1}` {
+		t.Fatal("Unexpected delivery", sent, string(data))
+	}
+
+	// The receiver acks messages for itself only.
+	var acked []string
+	ack := func(meta map[string]string) error {
+		acked = append(acked, meta["id"])
+		return nil
+	}
+	if q.OnMessage(self, dst, TopicQueue, sent, ack) || len(acked) != 1 || acked[0] != "m1" {
+		t.Error("Delivery not acked", acked)
+	}
+	q.OnMessage(self, "fd00::3", TopicQueue, sent, ack)
+	if len(acked) != 1 {
+		t.Error("Acked message for another node")
+	}
+
+	// The ack removes the message.
+	if !q.OnMessage(dst, self, TopicAck, map[string]string{"id": "m1"}, nil) || q.Pending(dst) != 0 {
+		t.Error("Ack not applied", q.Pending(dst))
+	}
+}
+
+func TestSigned(t *testing.T) {
+	a := auth.NewAuth(nil, "a", "m.webinf.info")
+	b := auth.NewAuth(nil, "b", "m.webinf.info")
+	qa, qb := NewQueue(NewMemStore()), NewQueue(NewMemStore())
+	qa.Auth, qb.Auth = a, b
+
+	var sent map[string]string
+	var data []byte
+	qa.Connect(b.Self(), "ws", Sender(b.Self(), func(meta map[string]string, d []byte) error {
+		sent, data = meta, d
+		return nil
+	}))
+	qa.Send(b.Self(), &webpush.WebpushMessage{Id: "m1", From: a.Self(), Ttl: 60, Data: []byte("hi")})
+
+	m, err := qb.Verify(a.Self(), TopicQueue, sent, data)
+	if err != nil || len(m.Path) != 1 || m.Path[0].Vip != a.Self() || string(m.Data) != "hi" {
+		t.Fatal("Verify failed", err, m)
+	}
+	if _, err := qb.Verify(a.Self(), TopicAck, sent, data); err != auth.ErrForged {
+		t.Error("Expected topic mismatch", err)
+	}
+	for _, k := range []string{"to", "ttl", "from"} {
+		mod := map[string]string{}
+		for mk, mv := range sent {
+			mod[mk] = mv
+		}
+		mod[k] = "1"
+		if _, err := qb.Verify(a.Self(), TopicQueue, mod, data); err != auth.ErrForged {
+			t.Error("Expected forged", k, err)
+		}
+	}
+	// The last hop must be the peer the message was received from.
+	c := auth.NewAuth(nil, "c", "m.webinf.info")
+	if _, err := qb.Verify(c.Self(), TopicQueue, sent, data); err != auth.ErrForged {
+		t.Error("Expected peer mismatch", err)
+	}
+	if _, err := qb.Verify("", TopicQueue, sent, data); err != auth.ErrForged {
+		t.Error("Expected error without peer", err)
+	}
+
+	delete(sent, "path")
+	if _, err := qb.Verify(a.Self(), TopicQueue, sent, data); err != ErrUnsigned {
+		t.Error("Expected unsigned", err)
+	}
+}
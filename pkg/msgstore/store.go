@@ -0,0 +1,50 @@
+// Package msgstore implements store-and-forward for the messaging mux.
+//
+// Messages for a destination VIP are persisted until the peer acks them or the
+// TTL expires. When the peer connects - over SSH, websocket, eventstream or any
+// other transport - pending messages are redelivered. Delivery is at-least-once:
+// a message is resent on reconnect or after RedeliverAfter until acked.
+package msgstore
+
+import (
+	"errors"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/transport/xds/webpush"
+)
+
+// Entry is a stored message, with delivery state.
+type Entry struct {
+	Msg *webpush.WebpushMessage
+
+	// Created is the time the message was stored. Entries are listed in Created order.
+	Created time.Time
+
+	// Expires is computed from the message TTL.
+	Expires time.Time
+
+	// Attempts is the number of times the message was sent to the peer.
+	Attempts int
+
+	// LastSent is the time of the last attempt.
+	LastSent time.Time
+}
+
+// Store is the persistent queue, keyed by destination VIP and message ID.
+// Implementations must be safe for concurrent use.
+type Store interface {
+	// Put adds or replaces an entry for the destination.
+	Put(dst string, e *Entry) error
+
+	// List returns the entries for the destination, oldest first.
+	List(dst string) ([]*Entry, error)
+
+	// Delete removes an entry. Missing entries are not an error.
+	Delete(dst string, id string) error
+
+	// Destinations returns the VIPs with stored entries.
+	Destinations() ([]string, error)
+}
+
+// ErrNotConnected is returned by Send if the peer is not connected and the message has 0 TTL.
+var ErrNotConnected = errors.New("msgstore: peer not connected")
@@ -0,0 +1,227 @@
+package push
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/auth"
+)
+
+// Sender implements the application server side of Webpush (RFC 8030), sending
+// encrypted messages to a push service using VAPID (RFC 8292) authentication.
+//
+// The same API is used for browser subscriptions and for other wpgate nodes - a
+// subscription from a node has the node's EC256 key as p256dh.
+type Sender struct {
+	// Auth provides the VAPID key. Required.
+	Auth *auth.Auth
+
+	// Client used to POST messages. If nil, http.DefaultClient is used.
+	// For mesh nodes, use the H2 client with mesh certificates.
+	Client *http.Client
+
+	// OnExpired is called when the push service reports the subscription is
+	// no longer valid (404/410). The subscription should be removed.
+	OnExpired func(sub *auth.Subscription)
+
+	// MaxRetries for 429 and 5xx responses. Default 0 - no retry.
+	MaxRetries int
+
+	// MaxRetryAfter limits the delay requested by the push service with Retry-After.
+	// If the requested delay is larger, the error is returned without waiting.
+	MaxRetryAfter time.Duration
+}
+
+// Options for sending a single message.
+type Options struct {
+	// TTL in seconds - how long the push service keeps the message if the UA
+	// is not connected. 0 means deliver only if connected.
+	TTL int
+
+	// Urgency: very-low, low, normal, high. Empty is equivalent with normal.
+	Urgency string
+
+	// Topic replaces pending messages with the same topic. Max 32 base64url chars.
+	Topic string
+
+	// Padding bytes to add, to hide the message length.
+	Padding int
+
+	// RecordSize for the aes128gcm encoding. Browsers require the message to fit in
+	// a single record.
+	RecordSize int
+}
+
+// Result of sending a message.
+type Result struct {
+	// Status code returned by the push service.
+	StatusCode int
+
+	// Location of the created message resource - can be used to cancel.
+	Location string
+
+	// Retries done before the final response.
+	Retries int
+}
+
+var (
+	// ErrExpired is returned for 404 and 410 - the subscription is no longer valid.
+	ErrExpired = errors.New("push: subscription expired")
+
+	// ErrTooLarge is returned for 413 - the encrypted payload exceeds the push service limit.
+	ErrTooLarge = errors.New("push: payload too large")
+
+	// ErrRateLimited is returned for 429 after all retries failed, or if the
+	// Retry-After of a 429 exceeds MaxRetryAfter. 5xx responses return a server
+	// error.
+	ErrRateLimited = errors.New("push: rate limited")
+)
+
+const (
+	UrgencyVeryLow = "very-low"
+	UrgencyLow     = "low"
+	UrgencyNormal  = "normal"
+	UrgencyHigh    = "high"
+)
+
+// NewSender creates a sender using the node identity.
+func NewSender(a *auth.Auth, hc *http.Client) *Sender {
+	return &Sender{
+		Auth:          a,
+		Client:        hc,
+		MaxRetries:    3,
+		MaxRetryAfter: 1 * time.Minute,
+	}
+}
+
+// Send encrypts the payload for the subscription and posts it to the subscription
+// endpoint. A nil payload sends a message without body.
+func (s *Sender) Send(ctx context.Context, sub *auth.Subscription, payload []byte, opts *Options) (*Result, error) {
+	if opts == nil {
+		opts = &Options{}
+	}
+	switch opts.Urgency {
+	case "", UrgencyVeryLow, UrgencyLow, UrgencyNormal, UrgencyHigh:
+	default:
+		return nil, fmt.Errorf("push: invalid urgency %s", opts.Urgency)
+	}
+	if len(opts.Topic) > 32 {
+		return nil, fmt.Errorf("push: topic too long %d", len(opts.Topic))
+	}
+
+	var body []byte
+	if payload != nil {
+		ec := auth.NewContextSend(sub)
+		ec.Padding = opts.Padding
+		if opts.RecordSize != 0 {
+			ec.RecordSize = opts.RecordSize
+		}
+		var err error
+		body, err = ec.Encrypt(payload)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hc := s.Client
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+
+	res := &Result{}
+	for {
+		req, err := http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("TTL", strconv.Itoa(opts.TTL))
+		if opts.Urgency != "" {
+			req.Header.Set("Urgency", opts.Urgency)
+		}
+		if opts.Topic != "" {
+			req.Header.Set("Topic", opts.Topic)
+		}
+		if body != nil {
+			req.Header.Set("Content-Encoding", "aes128gcm")
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+		req.Header.Set("Authorization", s.Auth.VAPIDToken(sub.Endpoint))
+
+		resp, err := hc.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		io.Copy(ioutil.Discard, resp.Body)
+		resp.Body.Close()
+
+		res.StatusCode = resp.StatusCode
+		switch {
+		case resp.StatusCode == http.StatusCreated || resp.StatusCode == http.StatusOK ||
+			resp.StatusCode == http.StatusAccepted:
+			res.Location = resp.Header.Get("Location")
+			return res, nil
+
+		case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+			if s.OnExpired != nil {
+				s.OnExpired(sub)
+			}
+			return res, ErrExpired
+
+		case resp.StatusCode == http.StatusRequestEntityTooLarge:
+			return res, ErrTooLarge
+
+		case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+			if res.Retries >= s.MaxRetries {
+				return res, retryErr(resp.StatusCode)
+			}
+			delay := retryAfter(resp.Header.Get("Retry-After"), res.Retries)
+			if s.MaxRetryAfter > 0 && delay > s.MaxRetryAfter {
+				log.Println("push: retry-after too long ", sub.Endpoint, delay)
+				return res, retryErr(resp.StatusCode)
+			}
+			res.Retries++
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return res, ctx.Err()
+			}
+
+		default:
+			return res, fmt.Errorf("push: unexpected response %d", resp.StatusCode)
+		}
+	}
+}
+
+// retryErr returns the error for a 429 or 5xx response that is not retried.
+func retryErr(status int) error {
+	if status == http.StatusTooManyRequests {
+		return ErrRateLimited
+	}
+	return fmt.Errorf("push: server error %d", status)
+}
+
+// retryAfter parses the Retry-After header - seconds or HTTP date. If missing,
+// an exponential backoff starting at 1s is used.
+func retryAfter(h string, attempt int) time.Duration {
+	if h != "" {
+		if secs, err := strconv.Atoi(h); err == nil && secs >= 0 {
+			return time.Duration(secs) * time.Second
+		}
+		if t, err := http.ParseTime(h); err == nil {
+			d := time.Until(t)
+			if d < 0 {
+				d = 0
+			}
+			return d
+		}
+	}
+	return time.Second << uint(attempt)
+}
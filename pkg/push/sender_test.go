@@ -0,0 +1,108 @@
+package push
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	uauth "github.com/costinm/ugate/pkg/auth"
+	"github.com/costinm/wpgate/pkg/auth"
+)
+
+func TestSender(t *testing.T) {
+	ua := auth.NewAuth(nil, "ua", "m.webinf.info")
+	as := auth.NewAuth(nil, "as", "m.webinf.info")
+
+	statuses := []int{}
+	retry := "0"
+	var got []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := uauth.CheckVAPID(r.Header.Get("Authorization"), time.Now())
+		if err != nil {
+			t.Error("Invalid VAPID", err)
+		}
+		if r.Header.Get("TTL") != "60" || r.Header.Get("Urgency") != "high" ||
+			r.Header.Get("Content-Encoding") != "aes128gcm" {
+			t.Error("Invalid headers", r.Header)
+		}
+		got, _ = ioutil.ReadAll(r.Body)
+		st := http.StatusCreated
+		if len(statuses) > 0 {
+			st = statuses[0]
+			statuses = statuses[1:]
+		}
+		if st == http.StatusTooManyRequests || st == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", retry)
+		}
+		w.Header().Set("Location", "/m/1")
+		w.WriteHeader(st)
+	}))
+	defer srv.Close()
+
+	sub := ua.NewSubscription(srv.URL + "/push/1")
+	expired := false
+	s := NewSender(as, srv.Client())
+	s.OnExpired = func(sub *auth.Subscription) {
+		expired = true
+	}
+	opts := &Options{TTL: 60, Urgency: UrgencyHigh}
+	ctx := context.Background()
+
+	res, err := s.Send(ctx, sub, []byte("hello"), opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Location != "/m/1" {
+		t.Error("Missing location", res)
+	}
+	plain, err := ua.Decrypt(sub, got)
+	if err != nil || string(plain) != "hello" {
+		t.Error("Decrypt failed", err, string(plain))
+	}
+
+	statuses = []int{http.StatusTooManyRequests, http.StatusServiceUnavailable}
+	res, err = s.Send(ctx, sub, []byte("hello"), opts)
+	if err != nil || res.Retries != 2 {
+		t.Error("Retry failed", err, res)
+	}
+
+	statuses = []int{http.StatusTooManyRequests, http.StatusTooManyRequests,
+		http.StatusTooManyRequests, http.StatusTooManyRequests}
+	_, err = s.Send(ctx, sub, []byte("hello"), opts)
+	if err != ErrRateLimited {
+		t.Error("Expected rate limit", err)
+	}
+
+	// Retry-After over MaxRetryAfter - only 429 is a rate limit.
+	retry = "3600"
+	statuses = []int{http.StatusServiceUnavailable}
+	res, err = s.Send(ctx, sub, []byte("hello"), opts)
+	if err == nil || err == ErrRateLimited || res.Retries != 0 {
+		t.Error("Expected server error", err, res)
+	}
+	statuses = []int{http.StatusTooManyRequests}
+	if _, err = s.Send(ctx, sub, []byte("hello"), opts); err != ErrRateLimited {
+		t.Error("Expected rate limit", err)
+	}
+	retry = "0"
+
+	statuses = []int{http.StatusRequestEntityTooLarge}
+	_, err = s.Send(ctx, sub, []byte("hello"), opts)
+	if err != ErrTooLarge {
+		t.Error("Expected too large", err)
+	}
+
+	statuses = []int{http.StatusGone}
+	_, err = s.Send(ctx, sub, []byte("hello"), opts)
+	if err != ErrExpired || !expired {
+		t.Error("Expected expired", err)
+	}
+
+	_, err = s.Send(ctx, sub, []byte("hello"), &Options{Urgency: "urgent"})
+	if err == nil {
+		t.Error("Invalid urgency accepted")
+	}
+}
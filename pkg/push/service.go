@@ -0,0 +1,714 @@
+package push
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	uauth "github.com/costinm/ugate/pkg/auth"
+)
+
+// Service implements the push service side of Webpush (RFC 8030):
+//
+//   - UA creates a subscription with POST /subscribe, receives the subscription
+//     resource (private to the UA), the push resource (shared with the AS) and the
+//     push set.
+//   - AS posts messages to the push resource. Messages are kept until acked or TTL expires.
+//   - UA monitors the subscription or the set with GET. Messages are delivered as HTTP/2
+//     push promises for the message resource, or - if push is not supported by the client -
+//     the first pending message is returned as the response (long poll).
+//   - UA acks with DELETE on the message resource. If the AS requested a receipt, it is
+//     delivered on the receipt subscription.
+//
+// All resources are identified by unguessable random IDs - knowing the URL is the
+// authorization, as in the spec. Subscriptions may be restricted to a VAPID key.
+type Service struct {
+	mutex sync.Mutex
+
+	// Prefix of all paths, for example "/wp". Empty means mounted at root.
+	Prefix string
+
+	// MaxTTL caps the TTL requested by the AS.
+	MaxTTL time.Duration
+
+	// LongPollTimeout is the max time a monitor request without push support will wait.
+	LongPollTimeout time.Duration
+
+	// MaxMessageSize is the max push message body. Default 4096, per spec.
+	MaxMessageSize int
+
+	// MaxPending is the max number of pending messages for a subscription. Pushes
+	// over the limit get 429. Default 100.
+	MaxPending int
+
+	// MaxMessages is the max number of pending messages in the service. Pushes
+	// over the limit get 507. Default 10000.
+	MaxMessages int
+
+	// Key is the ID of the subscription resource
+	subs map[string]*Subscription
+
+	// Key is the ID of the push resource
+	pushRes map[string]*Subscription
+
+	sets map[string]*pushSet
+
+	messages map[string]*Message
+
+	receipts map[string]*receiptSub
+
+	// Closed and replaced when a message or receipt is added, to wake up monitors.
+	notify chan struct{}
+}
+
+// Subscription resource in the push service.
+type Subscription struct {
+	ID string
+
+	// ID of the push resource, used by the AS.
+	PushID string
+
+	// Set the subscription belongs to.
+	SetID string
+
+	// If set, only AS signing with this VAPID key can push.
+	AppServerKey []byte
+
+	Created time.Time
+
+	// Pending messages, oldest first.
+	messages []*Message
+
+	// Number of active monitors for the subscription.
+	monitors int
+}
+
+type pushSet struct {
+	id   string
+	subs map[string]*Subscription
+
+	// Number of active monitors for the set.
+	monitors int
+}
+
+type receiptSub struct {
+	id string
+
+	// Paths of the acked messages, not yet delivered to the AS.
+	acked []string
+}
+
+// Message resource, pending delivery or ack.
+type Message struct {
+	ID string
+
+	Sub *Subscription
+
+	Data            []byte
+	ContentEncoding string
+	Urgency         string
+	Topic           string
+
+	Created time.Time
+	Expires time.Time
+
+	// Receipt subscription ID, if the AS requested a receipt.
+	Receipt string
+
+	// Set when the message was sent to the UA at least once.
+	Delivered bool
+}
+
+var urgencyLevels = map[string]int{
+	UrgencyVeryLow: 0,
+	UrgencyLow:     1,
+	"":             2,
+	UrgencyNormal:  2,
+	UrgencyHigh:    3,
+}
+
+// NewService creates an in-memory push service.
+func NewService(prefix string) *Service {
+	return &Service{
+		Prefix:          prefix,
+		MaxTTL:          7 * 24 * time.Hour,
+		LongPollTimeout: 60 * time.Second,
+		MaxMessageSize:  4096,
+		MaxPending:      100,
+		MaxMessages:     10000,
+		subs:            map[string]*Subscription{},
+		pushRes:         map[string]*Subscription{},
+		sets:            map[string]*pushSet{},
+		messages:        map[string]*Message{},
+		receipts:        map[string]*receiptSub{},
+		notify:          make(chan struct{}),
+	}
+}
+
+// InitMux registers the push service handlers - typically on H2.MTLSMux.
+func (s *Service) InitMux(mux *http.ServeMux) {
+	mux.HandleFunc(s.Prefix+"/subscribe", s.HandleSubscribe)
+	mux.HandleFunc(s.Prefix+"/subscription/", s.HandleSubscription)
+	mux.HandleFunc(s.Prefix+"/subscription-set/", s.HandleSubscriptionSet)
+	mux.HandleFunc(s.Prefix+"/push/", s.HandlePush)
+	mux.HandleFunc(s.Prefix+"/message/", s.HandleMessage)
+	mux.HandleFunc(s.Prefix+"/receipts", s.HandleReceipts)
+	mux.HandleFunc(s.Prefix+"/receipt-subscription/", s.HandleReceiptSubscription)
+}
+
+func newID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// HandleSubscribe creates a new subscription (RFC8030 section 4).
+// If the request includes a subscription set link, the subscription is added to
+// the set, otherwise a new set is created.
+//
+// A 'Crypto-Key: p256ecdsa=KEY' header restricts the subscription to an AS key (RFC8292 section 4)
+func (s *Service) HandleSubscribe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	sub := &Subscription{
+		ID:      newID(),
+		PushID:  newID(),
+		Created: time.Now(),
+	}
+	if ck := r.Header.Get("Crypto-Key"); ck != "" {
+		for _, p := range strings.Split(ck, ";") {
+			kv := strings.SplitN(strings.TrimSpace(p), "=", 2)
+			if len(kv) == 2 && kv[0] == "p256ecdsa" {
+				k, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(kv[1], "="))
+				if err != nil || len(k) != 65 {
+					w.WriteHeader(http.StatusBadRequest)
+					return
+				}
+				sub.AppServerKey = k
+			}
+		}
+	}
+
+	setPath := s.Prefix + "/subscription-set/"
+	s.mutex.Lock()
+	var set *pushSet
+	for _, l := range linkRel(r.Header, "urn:ietf:params:push:set") {
+		if strings.HasPrefix(l, setPath) {
+			set = s.sets[l[len(setPath):]]
+		}
+	}
+	if set == nil {
+		set = &pushSet{id: newID(), subs: map[string]*Subscription{}}
+		s.sets[set.id] = set
+	}
+	sub.SetID = set.id
+	set.subs[sub.ID] = sub
+	s.subs[sub.ID] = sub
+	s.pushRes[sub.PushID] = sub
+	s.mutex.Unlock()
+
+	w.Header().Add("Link", "<"+s.Prefix+"/push/"+sub.PushID+">; rel=\"urn:ietf:params:push\"")
+	w.Header().Add("Link", "<"+setPath+set.id+">; rel=\"urn:ietf:params:push:set\"")
+	w.Header().Set("Location", s.Prefix+"/subscription/"+sub.ID)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleReceipts creates a receipt subscription for an AS (RFC8030 section 5.1)
+func (s *Service) HandleReceipts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rs := &receiptSub{id: newID()}
+	s.mutex.Lock()
+	s.receipts[rs.id] = rs
+	s.mutex.Unlock()
+
+	w.Header().Add("Link", "<"+s.Prefix+"/receipt-subscription/"+rs.id+">; rel=\"urn:ietf:params:push:receipt\"")
+	w.Header().Set("Location", s.Prefix+"/receipt-subscription/"+rs.id)
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandlePush receives a message from the AS (RFC8030 section 5).
+func (s *Service) HandlePush(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Path[len(s.Prefix+"/push/"):]
+
+	s.mutex.Lock()
+	sub := s.pushRes[id]
+	s.mutex.Unlock()
+	if sub == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if sub.AppServerKey != nil {
+		_, pub, err := uauth.CheckVAPID(r.Header.Get("Authorization"), time.Now())
+		if err != nil || !bytes.Equal(pub, sub.AppServerKey) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+	}
+
+	ttlH := r.Header.Get("TTL")
+	ttl, err := strconv.Atoi(ttlH)
+	if ttlH == "" || err != nil || ttl < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing or invalid TTL"))
+		return
+	}
+	maxTTL := int(s.MaxTTL / time.Second)
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	urgency := r.Header.Get("Urgency")
+	if _, ok := urgencyLevels[urgency]; !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	topic := r.Header.Get("Topic")
+	if len(topic) > 32 {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.MaxMessageSize)+1))
+	if err != nil || len(data) > s.MaxMessageSize {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	now := time.Now()
+	m := &Message{
+		ID:              newID(),
+		Sub:             sub,
+		Data:            data,
+		ContentEncoding: r.Header.Get("Content-Encoding"),
+		Urgency:         urgency,
+		Topic:           topic,
+		Created:         now,
+		Expires:         now.Add(time.Duration(ttl) * time.Second),
+	}
+
+	if pr := r.Header.Get("Push-Receipt"); pr != "" {
+		rid := pr
+		if i := strings.LastIndex(pr, "/receipt-subscription/"); i >= 0 {
+			rid = pr[i+len("/receipt-subscription/"):]
+		}
+		s.mutex.Lock()
+		_, f := s.receipts[rid]
+		s.mutex.Unlock()
+		if !f {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Invalid Push-Receipt"))
+			return
+		}
+		m.Receipt = rid
+	}
+
+	s.mutex.Lock()
+	if topic != "" {
+		// Replace pending message with same topic (RFC8030 section 5.4)
+		for i, old := range sub.messages {
+			if old.Topic == topic {
+				delete(s.messages, old.ID)
+				sub.messages = append(sub.messages[:i], sub.messages[i+1:]...)
+				break
+			}
+		}
+	}
+	if len(sub.messages) >= s.MaxPending {
+		s.mutex.Unlock()
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+	if len(s.messages) >= s.MaxMessages {
+		s.mutex.Unlock()
+		w.WriteHeader(http.StatusInsufficientStorage)
+		return
+	}
+	// Messages with 0 TTL are only delivered to currently connected monitors.
+	if ttl > 0 || s.monitoredLocked(sub) {
+		sub.messages = append(sub.messages, m)
+		s.messages[m.ID] = m
+		s.notifyLocked()
+	}
+	s.mutex.Unlock()
+
+	w.Header().Set("Location", s.Prefix+"/message/"+m.ID)
+	w.Header().Set("TTL", strconv.Itoa(ttl))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// HandleSubscription is used by the UA to monitor (GET) or remove (DELETE) a subscription.
+func (s *Service) HandleSubscription(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len(s.Prefix+"/subscription/"):]
+	s.mutex.Lock()
+	sub := s.subs[id]
+	if sub != nil && r.Method == "DELETE" {
+		delete(s.subs, sub.ID)
+		delete(s.pushRes, sub.PushID)
+		if set := s.sets[sub.SetID]; set != nil {
+			delete(set.subs, sub.ID)
+			if len(set.subs) == 0 {
+				delete(s.sets, set.id)
+			}
+		}
+		for _, m := range sub.messages {
+			delete(s.messages, m.ID)
+		}
+		sub.messages = nil
+	}
+	s.mutex.Unlock()
+
+	if sub == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		s.mutex.Lock()
+		sub.monitors++
+		s.mutex.Unlock()
+		defer func() {
+			s.mutex.Lock()
+			sub.monitors--
+			s.dropUnmonitoredLocked(sub)
+			s.mutex.Unlock()
+		}()
+		s.monitor(w, r, func() []*Message {
+			return sub.messages
+		})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleSubscriptionSet monitors all subscriptions in a set.
+func (s *Service) HandleSubscriptionSet(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Path[len(s.Prefix+"/subscription-set/"):]
+	s.mutex.Lock()
+	set := s.sets[id]
+	if set == nil {
+		s.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	set.monitors++
+	s.mutex.Unlock()
+	defer func() {
+		s.mutex.Lock()
+		set.monitors--
+		for _, sub := range set.subs {
+			s.dropUnmonitoredLocked(sub)
+		}
+		s.mutex.Unlock()
+	}()
+	s.monitor(w, r, func() []*Message {
+		var res []*Message
+		for _, sub := range set.subs {
+			res = append(res, sub.messages...)
+		}
+		return res
+	})
+}
+
+// HandleMessage returns (GET) a message - used for push promises - or acks/cancels
+// it (DELETE). If the message was delivered to the UA, DELETE is an ack and the
+// receipt is sent to the AS.
+func (s *Service) HandleMessage(w http.ResponseWriter, r *http.Request) {
+	id := r.URL.Path[len(s.Prefix+"/message/"):]
+	s.mutex.Lock()
+	m := s.messages[id]
+	if m != nil && m.expired(time.Now()) {
+		s.removeLocked(m)
+		m = nil
+	}
+	if m != nil && r.Method == "DELETE" {
+		s.removeLocked(m)
+		if m.Delivered && m.Receipt != "" {
+			if rs := s.receipts[m.Receipt]; rs != nil {
+				rs.acked = append(rs.acked, s.Prefix+"/message/"+m.ID)
+				s.notifyLocked()
+			}
+		}
+	}
+	s.mutex.Unlock()
+
+	if m == nil {
+		// Acked or expired - also the response used for receipts.
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	switch r.Method {
+	case "DELETE":
+		w.WriteHeader(http.StatusNoContent)
+	case "GET":
+		s.writeMessage(w, m)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// HandleReceiptSubscription is used by the AS to monitor delivery receipts.
+// Receipts are push promises for the acked message, with a 410 response. Without
+// push support, the acked message path is returned in the Location header of a
+// 410 response.
+func (s *Service) HandleReceiptSubscription(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id := r.URL.Path[len(s.Prefix+"/receipt-subscription/"):]
+	s.mutex.Lock()
+	rs := s.receipts[id]
+	s.mutex.Unlock()
+	if rs == nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	ctx := r.Context()
+	pusher, canPush := w.(http.Pusher)
+	to := time.After(s.LongPollTimeout)
+	for {
+		s.mutex.Lock()
+		acked := rs.acked
+		rs.acked = nil
+		ch := s.notify
+		s.mutex.Unlock()
+
+		for i, p := range acked {
+			if canPush {
+				err := pusher.Push(p, nil)
+				if err == nil {
+					continue
+				}
+				canPush = false
+			}
+			// Long poll - one receipt per response, put back the rest.
+			s.mutex.Lock()
+			rs.acked = append(acked[i+1:], rs.acked...)
+			s.mutex.Unlock()
+			w.Header().Set("Location", p)
+			w.WriteHeader(http.StatusGone)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok && len(acked) > 0 {
+			f.Flush()
+		}
+
+		select {
+		case <-ch:
+		case <-to:
+			if !canPush {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// monitor delivers pending messages returned by the filter, using push promises or long poll.
+// The request Urgency header filters the messages by min urgency (RFC8030 section 5.3).
+func (s *Service) monitor(w http.ResponseWriter, r *http.Request, pending func() []*Message) {
+	minUrgency := urgencyLevels[r.Header.Get("Urgency")]
+	if r.Header.Get("Urgency") == "" {
+		minUrgency = 0
+	}
+	ctx := r.Context()
+	pusher, canPush := w.(http.Pusher)
+	sent := map[string]bool{}
+	to := time.After(s.LongPollTimeout)
+
+	for {
+		now := time.Now()
+		var msgs []*Message
+		s.mutex.Lock()
+		for _, m := range pending() {
+			if m.expired(now) {
+				s.removeLocked(m)
+				continue
+			}
+			if urgencyLevels[m.Urgency] >= minUrgency && !sent[m.ID] {
+				msgs = append(msgs, m)
+			}
+		}
+		ch := s.notify
+		s.mutex.Unlock()
+
+		for _, m := range msgs {
+			if canPush {
+				err := pusher.Push(s.Prefix+"/message/"+m.ID, nil)
+				if err == nil {
+					sent[m.ID] = true
+					s.mutex.Lock()
+					m.Delivered = true
+					s.mutex.Unlock()
+					continue
+				}
+				if len(sent) > 0 {
+					log.Println("push: promise failed ", err)
+					return
+				}
+				// Client disabled push - use long poll.
+				canPush = false
+			}
+			s.writeMessage(w, m)
+			return
+		}
+		if f, ok := w.(http.Flusher); ok && len(msgs) > 0 {
+			f.Flush()
+		}
+
+		select {
+		case <-ch:
+		case <-to:
+			if !canPush {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *Service) writeMessage(w http.ResponseWriter, m *Message) {
+	s.mutex.Lock()
+	m.Delivered = true
+	if m.Expires.Equal(m.Created) {
+		// 0 TTL - not kept after the delivery attempt.
+		s.removeLocked(m)
+	}
+	s.mutex.Unlock()
+
+	if m.ContentEncoding != "" {
+		w.Header().Set("Content-Encoding", m.ContentEncoding)
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+	if m.Topic != "" {
+		w.Header().Set("Topic", m.Topic)
+	}
+	w.Header().Set("Location", s.Prefix+"/message/"+m.ID)
+	w.Header().Set("Last-Modified", m.Created.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusOK)
+	w.Write(m.Data)
+}
+
+// Sweep removes expired messages. Should be called periodically, messages are also
+// checked on access.
+func (s *Service) Sweep() int {
+	now := time.Now()
+	n := 0
+	s.mutex.Lock()
+	for _, m := range s.messages {
+		if m.expired(now) {
+			s.removeLocked(m)
+			n++
+		}
+	}
+	s.mutex.Unlock()
+	return n
+}
+
+// Pending returns the number of pending messages for a subscription.
+func (s *Service) Pending(subID string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sub := s.subs[subID]
+	if sub == nil {
+		return 0, errors.New("push: subscription not found")
+	}
+	return len(sub.messages), nil
+}
+
+func (s *Service) removeLocked(m *Message) {
+	delete(s.messages, m.ID)
+	msgs := m.Sub.messages
+	for i, old := range msgs {
+		if old == m {
+			m.Sub.messages = append(msgs[:i:i], msgs[i+1:]...)
+			break
+		}
+	}
+}
+
+// monitoredLocked returns true if the subscription or its set has an active monitor.
+func (s *Service) monitoredLocked(sub *Subscription) bool {
+	if sub.monitors > 0 {
+		return true
+	}
+	set := s.sets[sub.SetID]
+	return set != nil && set.monitors > 0
+}
+
+// dropUnmonitoredLocked removes the 0 TTL messages of a subscription without
+// monitors - they can't be delivered.
+func (s *Service) dropUnmonitoredLocked(sub *Subscription) {
+	if s.monitoredLocked(sub) {
+		return
+	}
+	for _, m := range append([]*Message{}, sub.messages...) {
+		if m.Expires.Equal(m.Created) {
+			s.removeLocked(m)
+		}
+	}
+}
+
+func (s *Service) notifyLocked() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// linkRel returns the targets of the Link headers with the given rel.
+func linkRel(h http.Header, rel string) []string {
+	res := []string{}
+	for _, lh := range h["Link"] {
+		for _, l := range strings.Split(lh, ",") {
+			parts := strings.Split(l, ";")
+			if len(parts) < 2 {
+				continue
+			}
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, p := range parts[1:] {
+				p = strings.TrimSpace(p)
+				if p == "rel=\""+rel+"\"" || p == "rel="+rel {
+					res = append(res, target)
+				}
+			}
+		}
+	}
+	return res
+}
+
+// expired returns true if the message TTL has passed. Messages with 0 TTL are
+// removed after the delivery attempt, or when the last monitor is gone.
+func (m *Message) expired(now time.Time) bool {
+	if m.Expires.Equal(m.Created) {
+		return false
+	}
+	return m.Expires.Before(now)
+}
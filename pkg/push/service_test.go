@@ -0,0 +1,226 @@
+package push
+
+import (
+	"context"
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/costinm/wpgate/pkg/auth"
+)
+
+func TestService(t *testing.T) {
+	ua := auth.NewAuth(nil, "ua", "m.webinf.info")
+	as := auth.NewAuth(nil, "as", "m.webinf.info")
+
+	ps := NewService("/wp")
+	ps.LongPollTimeout = 200 * time.Millisecond
+	mux := http.NewServeMux()
+	ps.InitMux(mux)
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	hc := srv.Client()
+
+	do := func(method, path string, h map[string]string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, nil)
+		for k, v := range h {
+			req.Header.Set(k, v)
+		}
+		res, err := hc.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	res := do("POST", "/wp/subscribe", nil)
+	if res.StatusCode != http.StatusCreated {
+		t.Fatal("Subscribe failed", res.StatusCode)
+	}
+	subPath := res.Header.Get("Location")
+	links := linkRel(res.Header, "urn:ietf:params:push")
+	if len(links) != 1 || len(linkRel(res.Header, "urn:ietf:params:push:set")) != 1 {
+		t.Fatal("Missing links", res.Header)
+	}
+	sub := ua.NewSubscription(srv.URL + links[0])
+
+	res = do("POST", "/wp/receipts", nil)
+	receiptPath := res.Header.Get("Location")
+	if res.StatusCode != http.StatusCreated || receiptPath == "" {
+		t.Fatal("Receipt subscription failed", res.StatusCode)
+	}
+
+	s := NewSender(as, hc)
+	ctx := context.Background()
+
+	t.Run("deliver", func(t *testing.T) {
+		_, err := s.Send(ctx, sub, []byte("hello"), &Options{TTL: 60})
+		if err != nil {
+			t.Fatal(err)
+		}
+		res := do("GET", subPath, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("Monitor failed", res.StatusCode)
+		}
+		body, _ := ioutil.ReadAll(res.Body)
+		plain, err := ua.Decrypt(sub, body)
+		if err != nil || string(plain) != "hello" {
+			t.Fatal("Decrypt failed", err, string(plain))
+		}
+
+		// Not acked - redelivered
+		res = do("GET", subPath, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("Redelivery failed", res.StatusCode)
+		}
+		res = do("DELETE", res.Header.Get("Location"), nil)
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatal("Ack failed", res.StatusCode)
+		}
+
+		res = do("GET", subPath, nil)
+		if res.StatusCode != http.StatusNoContent {
+			t.Fatal("Expected no message after ack", res.StatusCode)
+		}
+	})
+
+	t.Run("longpoll", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			s.Send(ctx, sub, []byte("later"), &Options{TTL: 60})
+		}()
+		res := do("GET", subPath, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Fatal("Long poll failed", res.StatusCode)
+		}
+		do("DELETE", res.Header.Get("Location"), nil)
+	})
+
+	t.Run("receipt", func(t *testing.T) {
+		req, _ := http.NewRequest("POST", sub.Endpoint, strings.NewReader("r"))
+		req.Header.Set("TTL", "60")
+		req.Header.Set("Push-Receipt", srv.URL+receiptPath)
+		res, err := hc.Do(req)
+		if err != nil || res.StatusCode != http.StatusCreated {
+			t.Fatal("Push failed", err)
+		}
+		msgPath := res.Header.Get("Location")
+
+		res = do("GET", subPath, nil)
+		do("DELETE", res.Header.Get("Location"), nil)
+
+		res = do("GET", receiptPath, nil)
+		if res.StatusCode != http.StatusGone || res.Header.Get("Location") != msgPath {
+			t.Fatal("Missing receipt", res.StatusCode, res.Header)
+		}
+	})
+
+	t.Run("topic", func(t *testing.T) {
+		s.Send(ctx, sub, []byte("1"), &Options{TTL: 60, Topic: "t1"})
+		s.Send(ctx, sub, []byte("2"), &Options{TTL: 60, Topic: "t1"})
+		n, _ := ps.Pending(subPath[len("/wp/subscription/"):])
+		if n != 1 {
+			t.Fatal("Topic not replaced", n)
+		}
+		res := do("GET", subPath, nil)
+		body, _ := ioutil.ReadAll(res.Body)
+		plain, _ := ua.Decrypt(sub, body)
+		if string(plain) != "2" {
+			t.Error("Expected replaced message", string(plain))
+		}
+		do("DELETE", res.Header.Get("Location"), nil)
+	})
+
+	t.Run("urgency", func(t *testing.T) {
+		s.Send(ctx, sub, []byte("low"), &Options{TTL: 60, Urgency: UrgencyLow})
+		res := do("GET", subPath, map[string]string{"Urgency": UrgencyHigh})
+		if res.StatusCode != http.StatusNoContent {
+			t.Error("Low urgency delivered", res.StatusCode)
+		}
+		res = do("GET", subPath, nil)
+		if res.StatusCode != http.StatusOK {
+			t.Error("Missing low urgency", res.StatusCode)
+		}
+		do("DELETE", res.Header.Get("Location"), nil)
+	})
+
+	t.Run("ttl", func(t *testing.T) {
+		res, _ := s.Send(ctx, sub, []byte("expired"), &Options{TTL: 1})
+		ps.messages[res.Location[len("/wp/message/"):]].Expires = time.Now().Add(-time.Second)
+		if ps.Sweep() != 1 {
+			t.Error("Expired message not removed")
+		}
+
+		// No monitor - dropped.
+		s.Send(ctx, sub, []byte("zero"), &Options{TTL: 0})
+		n, _ := ps.Pending(subPath[len("/wp/subscription/"):])
+		if n != 0 {
+			t.Error("TTL 0 message kept", n)
+		}
+
+		// Delivered to a connected monitor, and removed after delivery.
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			s.Send(ctx, sub, []byte("zero"), &Options{TTL: 0})
+		}()
+		mres := do("GET", subPath, nil)
+		if mres.StatusCode != http.StatusOK {
+			t.Fatal("TTL 0 message not delivered", mres.StatusCode)
+		}
+		n, _ = ps.Pending(subPath[len("/wp/subscription/"):])
+		if n != 0 {
+			t.Error("TTL 0 message kept after delivery", n)
+		}
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		push := func() int {
+			return do("POST", links[0], map[string]string{"TTL": "60"}).StatusCode
+		}
+		ps.MaxPending = 2
+		for i := 0; i < 2; i++ {
+			if c := push(); c != http.StatusCreated {
+				t.Fatal("Push failed", c)
+			}
+		}
+		if c := push(); c != http.StatusTooManyRequests {
+			t.Error("Expected 429", c)
+		}
+		ps.MaxPending = 100
+		ps.MaxMessages = 2
+		if c := push(); c != http.StatusInsufficientStorage {
+			t.Error("Expected 507", c)
+		}
+		ps.MaxMessages = 10000
+		for i := 0; i < 2; i++ {
+			res := do("GET", subPath, nil)
+			do("DELETE", res.Header.Get("Location"), nil)
+		}
+	})
+
+	t.Run("restricted", func(t *testing.T) {
+		res := do("POST", "/wp/subscribe", map[string]string{
+			"Crypto-Key": "p256ecdsa=" + base64.RawURLEncoding.EncodeToString(as.EC256Pub)})
+		rsub := ua.NewSubscription(srv.URL + linkRel(res.Header, "urn:ietf:params:push")[0])
+		_, err := s.Send(ctx, rsub, []byte("ok"), &Options{TTL: 60})
+		if err != nil {
+			t.Error("Authorized AS rejected", err)
+		}
+		_, err = NewSender(ua, hc).Send(ctx, rsub, []byte("no"), &Options{TTL: 60})
+		if err == nil {
+			t.Error("Unauthorized AS accepted")
+		}
+	})
+
+	t.Run("unsubscribe", func(t *testing.T) {
+		do("DELETE", subPath, nil)
+		_, err := s.Send(ctx, sub, []byte("gone"), &Options{TTL: 60})
+		if err != ErrExpired {
+			t.Error("Expected expired", err)
+		}
+	})
+}
@@ -0,0 +1,385 @@
+package streams
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/costinm/ugate"
+)
+
+// Bandwidth shaping and byte quotas for the proxied streams.
+//
+// Limits are set by caller VIP or by role in QuotaFile. The streams of a
+// caller share a token bucket, limiting the rate, and daily/monthly byte
+// counters. A role limit is shared by all the VIPs with the role - a VIP entry
+// is needed for an individual limit. The default limit applies to each caller
+// VIP or IP separately. Both directions are counted.
+//
+// The usage is saved periodically in QuotaUsageFile, so quotas survive
+// restarts.
+
+const (
+	// QuotaFile is the ConfStore name of the QuotaConfig.
+	QuotaFile = "quotas.json"
+
+	// QuotaUsageFile is the ConfStore name of the saved usage.
+	QuotaUsageFile = "quota_usage.json"
+
+	// Min burst - a rate lower than the copy buffer would otherwise stall.
+	minBurst = 32 * 1024
+
+	// Key prefix of the default limit quotas, followed by the caller.
+	defaultQuota = "default/"
+)
+
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Limit for a VIP or role. Zero values are unlimited.
+type Limit struct {
+	// Rate in bytes per second.
+	Rate int64 `json:"rate,omitempty"`
+
+	// Burst is the bucket size, default Rate.
+	Burst int64 `json:"burst,omitempty"`
+
+	// Daily and Monthly are the max bytes per UTC day and month.
+	Daily   int64 `json:"daily,omitempty"`
+	Monthly int64 `json:"monthly,omitempty"`
+}
+
+// QuotaConfig has the limits, loaded from QuotaFile.
+type QuotaConfig struct {
+	// Default applies to callers without a VIP or role limit - each caller
+	// has its own quota.
+	Default *Limit `json:"default,omitempty"`
+
+	// Limits by VIP or role.
+	Limits map[string]*Limit `json:"limits,omitempty"`
+}
+
+// Usage is the byte count of a quota, in the current day and month.
+type Usage struct {
+	Day        string `json:"day"`
+	DayBytes   int64  `json:"day_bytes"`
+	Month      string `json:"month"`
+	MonthBytes int64  `json:"month_bytes"`
+}
+
+// Quota is the state of a VIP or role limit, shared by its streams.
+type Quota struct {
+	Key   string
+	Limit Limit
+
+	mutex  sync.Mutex
+	tokens float64
+	last   time.Time
+	usage  Usage
+}
+
+func (q *Quota) MarshalJSON() ([]byte, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return json.Marshal(struct {
+		Key   string `json:"key"`
+		Limit Limit  `json:"limit"`
+		Usage Usage  `json:"usage"`
+	}{q.Key, q.Limit, q.usage})
+}
+
+// Usage returns the current usage.
+func (q *Quota) Usage() Usage {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.usage
+}
+
+// maxRead returns the max bytes to read at once - the burst, if the rate is
+// limited.
+func (q *Quota) maxRead(n int) int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.Limit.Rate > 0 && int64(n) > q.burst() {
+		return int(q.burst())
+	}
+	return n
+}
+
+func (q *Quota) burst() int64 {
+	b := q.Limit.Burst
+	if b == 0 {
+		b = q.Limit.Rate
+	}
+	if b < minBurst {
+		b = minBurst
+	}
+	return b
+}
+
+// rollover resets the counters at the start of a day or month. Called with
+// the lock held.
+func (q *Quota) rollover(now time.Time) {
+	now = now.UTC()
+	if d := now.Format("2006-01-02"); q.usage.Day != d {
+		q.usage.Day = d
+		q.usage.DayBytes = 0
+	}
+	if m := now.Format("2006-01"); q.usage.Month != m {
+		q.usage.Month = m
+		q.usage.MonthBytes = 0
+	}
+}
+
+// allow returns ErrQuotaExceeded if the daily or monthly bytes are used.
+func (q *Quota) allow(now time.Time) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.rollover(now)
+	if (q.Limit.Daily > 0 && q.usage.DayBytes >= q.Limit.Daily) ||
+		(q.Limit.Monthly > 0 && q.usage.MonthBytes >= q.Limit.Monthly) {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// take counts n bytes, and returns the time to wait to stay within the rate.
+func (q *Quota) take(n int, now time.Time) time.Duration {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.rollover(now)
+	q.usage.DayBytes += int64(n)
+	q.usage.MonthBytes += int64(n)
+	if q.Limit.Rate <= 0 {
+		return 0
+	}
+	burst := float64(q.burst())
+	if q.last.IsZero() {
+		q.tokens = burst
+	} else {
+		q.tokens += now.Sub(q.last).Seconds() * float64(q.Limit.Rate)
+		if q.tokens > burst {
+			q.tokens = burst
+		}
+	}
+	q.last = now
+	q.tokens -= float64(n)
+	if q.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-q.tokens / float64(q.Limit.Rate) * float64(time.Second))
+}
+
+// Reader returns a reader applying the quota - used in the copy loops. If r
+// is a net.Conn the result is a net.Conn too, so the copy can set the read
+// deadline.
+func (q *Quota) Reader(r io.Reader) io.Reader {
+	qr := &quotaReader{q: q, r: r}
+	if c, ok := r.(net.Conn); ok {
+		return &quotaConn{Conn: c, qr: qr}
+	}
+	return qr
+}
+
+// QuotaErr returns ErrQuotaExceeded if the reader returned by Quota.Reader
+// stopped because of the quota. Copy loops may not return the read errors.
+func QuotaErr(r io.Reader) error {
+	switch qr := r.(type) {
+	case *quotaReader:
+		return qr.err
+	case *quotaConn:
+		return qr.qr.err
+	}
+	return nil
+}
+
+type quotaReader struct {
+	q   *Quota
+	r   io.Reader
+	err error
+}
+
+type quotaConn struct {
+	net.Conn
+	qr *quotaReader
+}
+
+func (qc *quotaConn) Read(p []byte) (int, error) {
+	return qc.qr.Read(p)
+}
+
+func (qr *quotaReader) Read(p []byte) (int, error) {
+	if err := qr.q.allow(time.Now()); err != nil {
+		qr.err = err
+		return 0, err
+	}
+	n, err := qr.r.Read(p[:qr.q.maxRead(len(p))])
+	if n > 0 {
+		if wait := qr.q.take(n, time.Now()); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+	return n, err
+}
+
+// Quotas holds the config and the quota of each VIP or role.
+type Quotas struct {
+	// Config is used to load the limits and save the usage.
+	Config ugate.ConfStore
+
+	// Role returns the role of a caller VIP.
+	Role func(vip net.IP) string
+
+	mutex  sync.Mutex
+	cfg    *QuotaConfig
+	quotas map[string]*Quota
+	saved  map[string]Usage
+}
+
+// NewQuotas loads the config and the saved usage.
+func NewQuotas(cs ugate.ConfStore) *Quotas {
+	qs := &Quotas{
+		Config: cs,
+		cfg:    &QuotaConfig{},
+		quotas: map[string]*Quota{},
+		saved:  map[string]Usage{},
+	}
+	if cs == nil {
+		return qs
+	}
+	if data, err := cs.Get(QuotaFile); err == nil && data != nil {
+		cfg := &QuotaConfig{}
+		if err := json.Unmarshal(data, cfg); err != nil {
+			log.Println("Invalid quotas ", err)
+		} else {
+			qs.cfg = cfg
+		}
+	}
+	if data, err := cs.Get(QuotaUsageFile); err == nil && data != nil {
+		json.Unmarshal(data, &qs.saved)
+	}
+	return qs
+}
+
+// SetConfig replaces the limits. The usage is kept, and the active streams
+// use the new limits - unlimited if the VIP or role was removed.
+func (qs *Quotas) SetConfig(cfg *QuotaConfig) {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+	qs.cfg = cfg
+	for k, q := range qs.quotas {
+		l := cfg.Limits[k]
+		if strings.HasPrefix(k, defaultQuota) {
+			l = cfg.Default
+		}
+		q.mutex.Lock()
+		if l != nil {
+			q.Limit = *l
+		} else {
+			q.Limit = Limit{}
+		}
+		q.mutex.Unlock()
+	}
+}
+
+// For returns the quota of a caller, nil if unlimited. Local callers are not
+// limited.
+func (qs *Quotas) For(client net.Addr) *Quota {
+	var ip net.IP
+	if ta, ok := client.(*net.TCPAddr); ok {
+		ip = ta.IP
+	} else if client != nil {
+		host, _, _ := net.SplitHostPort(client.String())
+		ip = net.ParseIP(host)
+	}
+	return qs.ForVIP(ip)
+}
+
+// ForVIP returns the quota of a caller VIP or IP - for example the VIP of a
+// caller behind a trusted proxy. Nil if unlimited or local.
+func (qs *Quotas) ForVIP(ip net.IP) *Quota {
+	if ip == nil || ip.IsLoopback() {
+		return nil
+	}
+
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+	caller := ip.String()
+	key := caller
+	l := qs.cfg.Limits[key]
+	if l == nil && qs.Role != nil {
+		key = qs.Role(ip)
+		l = qs.cfg.Limits[key]
+	}
+	return qs.quota(key, l, caller)
+}
+
+// ForRole returns the quota of a role, for callers authenticated without a
+// VIP - for example SOCKS users. The role is the caller for the default
+// limit. Nil if unlimited.
+func (qs *Quotas) ForRole(role string) *Quota {
+	qs.mutex.Lock()
+	defer qs.mutex.Unlock()
+	return qs.quota(role, qs.cfg.Limits[role], role)
+}
+
+// quota returns the quota for the key and limit, using the default limit of
+// the caller if nil. Called with the lock held.
+func (qs *Quotas) quota(key string, l *Limit, caller string) *Quota {
+	if l == nil {
+		key = defaultQuota + caller
+		l = qs.cfg.Default
+	}
+	if l == nil {
+		return nil
+	}
+	q := qs.quotas[key]
+	if q == nil {
+		q = &Quota{Key: key, Limit: *l, usage: qs.saved[key]}
+		qs.quotas[key] = q
+	}
+	return q
+}
+
+// Save writes the usage to the ConfStore.
+func (qs *Quotas) Save() error {
+	qs.mutex.Lock()
+	usage := map[string]Usage{}
+	for k, u := range qs.saved {
+		usage[k] = u
+	}
+	for k, q := range qs.quotas {
+		usage[k] = q.Usage()
+	}
+	qs.mutex.Unlock()
+	if qs.Config == nil || len(usage) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(usage)
+	if err != nil {
+		return err
+	}
+	return qs.Config.Set(QuotaUsageFile, data)
+}
+
+// SavePeriodic saves the usage at each interval, until the context is done.
+func (qs *Quotas) SavePeriodic(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			qs.Save()
+			return
+		case <-t.C:
+			if err := qs.Save(); err != nil {
+				log.Println("Failed to save quotas ", err)
+			}
+		}
+	}
+}
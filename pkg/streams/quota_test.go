@@ -0,0 +1,174 @@
+package streams
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type memConf map[string][]byte
+
+func (m memConf) Get(name string) ([]byte, error) {
+	return m[name], nil
+}
+
+func (m memConf) Set(name string, data []byte) error {
+	m[name] = data
+	return nil
+}
+
+func (m memConf) List(name string, tp string) ([]string, error) {
+	res := []string{}
+	for k := range m {
+		if strings.HasPrefix(k, name) {
+			res = append(res, k)
+		}
+	}
+	return res, nil
+}
+
+func TestQuotas(t *testing.T) {
+	conf := memConf{QuotaFile: []byte(`{
+		"default": {"daily": 1000},
+		"limits": {
+			"fd00::1": {"monthly": 5000},
+			"guest": {"rate": 100000, "burst": 50000}
+		}}`)}
+	qs := NewQuotas(conf)
+	qs.Role = func(vip net.IP) string {
+		if vip.String() == "fd00::2" {
+			return "guest"
+		}
+		return "member"
+	}
+
+	if q := qs.For(&net.TCPAddr{IP: net.ParseIP("127.0.0.1")}); q != nil {
+		t.Error("Local caller limited", q)
+	}
+	vq := qs.For(&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1})
+	if vq == nil || vq.Key != "fd00::1" || vq.Limit.Monthly != 5000 {
+		t.Fatal("VIP limit", vq)
+	}
+	gq := qs.For(&net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 1})
+	if gq == nil || gq.Key != "guest" {
+		t.Fatal("Role limit", gq)
+	}
+	dq := qs.For(&net.TCPAddr{IP: net.ParseIP("fd00::3"), Port: 1})
+	if dq == nil || dq.Key != "default/fd00::3" || qs.For(&net.TCPAddr{IP: net.ParseIP("fd00::3")}) != dq {
+		t.Fatal("Default limit", dq)
+	}
+	// Each caller has its own default quota.
+	if q := qs.For(&net.TCPAddr{IP: net.ParseIP("fd00::4")}); q == nil || q == dq || q.Limit.Daily != 1000 {
+		t.Fatal("Default limit shared", q)
+	}
+	if q := qs.ForVIP(net.ParseIP("fd00::1")); q != vq {
+		t.Error("VIP quota", q)
+	}
+
+	// Daily quota: the read exceeding the quota completes, the next fails.
+	qr := dq.Reader(io.LimitReader(zeros{}, 3000))
+	data, err := ioutil.ReadAll(qr)
+	if err != ErrQuotaExceeded || len(data) < 1000 || QuotaErr(qr) != ErrQuotaExceeded {
+		t.Error("Expected quota exceeded", err, len(data))
+	}
+	if u := dq.Usage(); u.DayBytes != int64(len(data)) || u.Day != time.Now().UTC().Format("2006-01-02") {
+		t.Error("Unexpected usage", u)
+	}
+
+	// Rate: 50k burst, then 100k/s.
+	t0 := time.Now()
+	n, err := io.Copy(ioutil.Discard, gq.Reader(io.LimitReader(zeros{}, 80000)))
+	if err != nil || n != 80000 {
+		t.Fatal("Copy", n, err)
+	}
+	if d := time.Since(t0); d < 200*time.Millisecond || d > 2*time.Second {
+		t.Error("Rate not applied", d)
+	}
+
+	// Usage is saved and restored.
+	if err := qs.Save(); err != nil {
+		t.Fatal(err)
+	}
+	usage := map[string]Usage{}
+	json.Unmarshal(conf[QuotaUsageFile], &usage)
+	if usage["guest"].MonthBytes != 80000 {
+		t.Error("Usage not saved", usage)
+	}
+	qs2 := NewQuotas(conf)
+	if q := qs2.For(&net.TCPAddr{IP: net.ParseIP("fd00::3")}); q.Usage().DayBytes != int64(len(data)) {
+		t.Error("Usage not restored", q.Usage())
+	}
+
+	if q := qs.ForRole("guest"); q != gq {
+		t.Error("Role quota", q)
+	}
+	if q := qs.ForRole("admin"); q == nil || q == dq || q.Key != "default/admin" {
+		t.Error("Default role quota", q)
+	}
+
+	// New limits apply to the active quotas.
+	qs.SetConfig(&QuotaConfig{Default: &Limit{Daily: 1 << 20}})
+	if _, err := dq.Reader(bytes.NewReader([]byte("x"))).Read(make([]byte, 1)); err != nil {
+		t.Error("New limit not applied", err)
+	}
+	if gq.Limit.Rate != 0 {
+		t.Error("Removed limit", gq.Limit)
+	}
+
+	// Exposed in HttpTCP.
+	js, _ := json.Marshal(&TcpProxy{Quota: gq})
+	if !strings.Contains(string(js), `"key":"guest"`) {
+		t.Error("Quota not in JSON", string(js))
+	}
+}
+
+func TestQuotaCopy(t *testing.T) {
+	q := &Quota{Key: "default/fd00::1", Limit: Limit{Daily: 1000}}
+	tp := &TcpProxy{Quota: q}
+
+	c, s := net.Pipe()
+	defer c.Close()
+	go func() {
+		for i := 0; i < 4; i++ {
+			s.Write(make([]byte, 500))
+		}
+		s.Close()
+	}()
+	if _, ok := q.Reader(c).(net.Conn); !ok {
+		t.Error("Deadline hidden by the quota reader")
+	}
+	n, err := tp.copyQuota(ioutil.Discard, c, true)
+	if err != ErrQuotaExceeded || n < 1000 || n >= 2000 {
+		t.Error("Expected quota exceeded", n, err)
+	}
+}
+
+func TestQuotaRollover(t *testing.T) {
+	q := &Quota{Limit: Limit{Daily: 10, Monthly: 15}}
+	day1 := time.Date(2020, 1, 31, 12, 0, 0, 0, time.UTC)
+	q.take(10, day1)
+	if q.allow(day1) != ErrQuotaExceeded {
+		t.Error("Daily quota")
+	}
+	q.take(4, day1.Add(time.Hour*24))
+	if q.allow(day1.Add(time.Hour*24)) != nil {
+		t.Error("Daily quota not reset")
+	}
+	if q.usage.MonthBytes != 4 || q.usage.Month != "2020-02" {
+		t.Error("Monthly quota not reset", q.usage)
+	}
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 0
+	}
+	return len(p), nil
+}
@@ -71,7 +71,7 @@ var (
 type TcpProxy struct {
 	ugate.Stream
 
-	OnProxyClose func(proxy *TcpProxy)
+	OnProxyClose func(proxy *TcpProxy) `json:"-"`
 
 	// The inbound stream.
 
@@ -82,11 +82,11 @@ type TcpProxy struct {
 	// - For accept, a net.Conn
 	// - for TCP-over-HTTP server - req.Body
 	// - ...
-	ClientIn io.ReadCloser
+	ClientIn io.ReadCloser `json:"-"`
 
 	// A chunk of initial data, to be sent before localIn.
 	// Currently not used - SNI proxy and other cases where data is sent along var-len header might use it.
-	Initial []byte
+	Initial []byte `json:"-"`
 
 	// Client stream writer.
 	//
@@ -96,10 +96,10 @@ type TcpProxy struct {
 	//
 	// When the remoteIn is closed, the appropriate CloseWrite must be called, to send the FIN to the other side.
 	// Note that reading from clientIn might continue.
-	ClientOut io.Writer
+	ClientOut io.Writer `json:"-"`
 
 	// remoteCtx is a context associated with the remote side connection, for example in http cases.
-	RemoteCtx context.CancelFunc
+	RemoteCtx context.CancelFunc `json:"-"`
 
 	// Address of the connected endpoint, previous hop.
 	// OriginIP/OriginPort track the real client, and PrevPath
@@ -123,6 +123,15 @@ type TcpProxy struct {
 	// DestPort is set
 	DestPort int
 
+	// Quota, if set, limits the rate and bytes of the stream, in both
+	// directions. Shared with the other streams of the caller VIP or role.
+	Quota *Quota
+
+	// VIP and Role of the caller, if authenticated by the capture or set in
+	// a trusted PROXY header. Sent to the PROXY protocol backends.
+	VIP  net.IP `json:"vip,omitempty"`
+	Role string `json:"role,omitempty"`
+
 }
 
 //func (tp *TcpProxy) Write(b []byte) (n int, err error) {
@@ -286,7 +295,7 @@ func (tp *TcpProxy) proxyServerToClient(errch chan error) (int64, error) {
 		err = io.EOF
 		log.Println("NULL ", tp.In, tp.ClientOut)
 	} else {
-		if n, err = tp.CopyBuffered(tp.ClientOut, tp.In, true); err != nil {
+		if n, err = tp.copyQuota(tp.ClientOut, tp.In, true); err != nil {
 			if err1, ok := err.(*net.OpError); ok && err1.Err == syscall.EPIPE {
 				// typical close
 				err = io.EOF
@@ -311,6 +320,21 @@ func (tp *TcpProxy) proxyServerToClient(errch chan error) (int64, error) {
 }
 
 
+// copyQuota copies src to dst, applying the quota if set. CopyBuffered doesn't
+// return the read errors - ErrQuotaExceeded is returned if the quota stopped
+// the copy.
+func (tp *TcpProxy) copyQuota(dst io.Writer, src io.Reader, srcIsRemote bool) (int64, error) {
+	if tp.Quota == nil {
+		return tp.CopyBuffered(dst, src, srcIsRemote)
+	}
+	src = tp.Quota.Reader(src)
+	n, err := tp.CopyBuffered(dst, src, srcIsRemote)
+	if qerr := QuotaErr(src); qerr != nil {
+		err = qerr
+	}
+	return n, err
+}
+
 func closeRead(src io.ReadCloser) {
 	if src == nil {
 		return
@@ -378,7 +402,7 @@ func (tp *TcpProxy) proxyClientToServer(remoteOut io.Writer, localIn io.ReadClos
 		err = io.EOF
 		log.Println("NULL ", localIn, tp.Out)
 	} else {
-		if _, err = tp.CopyBuffered(tp.Out, localIn, false); err != nil {
+		if _, err = tp.copyQuota(tp.Out, localIn, false); err != nil {
 			if err1, ok := err.(*net.OpError); ok && err1.Err == syscall.EPIPE {
 				// typical close
 				err = io.EOF
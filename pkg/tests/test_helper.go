@@ -61,10 +61,10 @@ func TestGateway(baseport int) *mesh.Gateway {
 	// ingress only via SSHClientConn and accepted connections
 	//gw.InitMux(h2c.MTLSMux)
 
-	//accept.NewForwarder(gw, &mesh.Listener{
+	//gw.Forward.Apply([]*forward.Listener{{
 	//	Local:  fmt.Sprintf(":%d", baseport+3),
 	//	Remote: "localhost:8000",
-	//})
+	//}})
 	//
 	return gw
 }
@@ -10,7 +10,9 @@ import (
 	"strings"
 	"time"
 
+	"github.com/costinm/ugate/pkg/auth"
 	"github.com/costinm/ugate/pkg/msgs"
+	"github.com/costinm/wpgate/pkg/msgstore"
 )
 
 // Client or server event-stream connection.
@@ -50,6 +52,18 @@ func Handler(gate *msgs.Mux) func(w http.ResponseWriter, req *http.Request) {
 
 		msgs.DefaultMux.AddConnection(id, mc)
 
+		// Store and forward, for peers authenticated with mTLS. The acks are
+		// sent as messages on the msgstore.TopicAck topic.
+		if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+			peer := auth.Pub2VIP(auth.MarshalPublicKey(req.TLS.PeerCertificates[0].PublicKey)).String()
+			msgstore.Default.Connect(peer, id, msgstore.Sender(peer, func(meta map[string]string, data []byte) error {
+				ev := msgs.NewMessage("/"+msgstore.TopicQueue, meta)
+				ev.Data = data
+				return mc.SendMessageToRemote(ev)
+			}))
+			defer msgstore.Default.Disconnect(peer, id)
+		}
+
 		log.Println("DM HTTP EVENT STREAM ", id)
 
 		defer func() {
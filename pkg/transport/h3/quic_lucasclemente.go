@@ -92,6 +92,12 @@ func NewH3(certs *auth.Auth) *H3 {
 
 
 
+// CertSource, if set, provides the current certificate for new QUIC connections.
+// Used for rotation, implemented by wpgate auth.Auth.
+var CertSource interface {
+	Certificate() *tls.Certificate
+}
+
 // InitQuicServer starts a regular QUIC server, bound to a port, using the H2 certificates.
 func InitQuicServer(h2 *auth.Auth, port int, handler http.Handler) error {
 	c, err := net.ListenUDP("udp",
@@ -139,6 +145,12 @@ func InitQuicServerConn(auth *auth.Auth,port int,
 		return nil
 	}
 	mtlsServerConfig.ClientAuth = tls.RequireAnyClientCert // only one supported by mint?
+	if CertSource != nil {
+		mtlsServerConfig.Certificates = nil
+		mtlsServerConfig.GetCertificate = func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return CertSource.Certificate(), nil
+		}
+	}
 
 	quicServer := &h2quic.Server{
 		QuicConfig: &quic.Config{
@@ -0,0 +1,459 @@
+// Package proxyproto implements the HAProxy PROXY protocol, v1 and v2.
+//
+// The header is sent by a proxy before the stream, with the address of the
+// original client. Connections accepted by forward listeners from trusted
+// proxies are wrapped in a Conn, so the gateway sees the real client in
+// RemoteAddr - the SOCKS, SNI and HTTP captures don't accept the header. On
+// dials to
+// the configured Backends the gateway sends the header, and in v2 the TLVs
+// with the VIP and role of the caller - backends behind the gateway see the
+// mesh identity without terminating the mesh TLS.
+//
+// See https://www.haproxy.org/download/2.3/doc/proxy-protocol.txt
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	V1 = "v1"
+	V2 = "v2"
+
+	// BackendsFile is the ConfStore name of the Backends - a JSON map of
+	// destinations to the version.
+	BackendsFile = "proxy_backends.json"
+)
+
+// TLV types.
+const (
+	TypeALPN      = 0x01
+	TypeAuthority = 0x02
+	TypeCRC32C    = 0x03
+	TypeNoop      = 0x04
+	TypeUniqueID  = 0x05
+	TypeSSL       = 0x20
+	TypeNetNS     = 0x30
+
+	// Custom types, in the range reserved for applications.
+
+	// TypeVIP is the mesh VIP of the caller, 16 bytes.
+	TypeVIP = 0xE0
+
+	// TypeRole is the role of the caller.
+	TypeRole = 0xE1
+)
+
+var (
+	ErrNoHeader = errors.New("proxyproto: missing header")
+	ErrInvalid  = errors.New("proxyproto: invalid header")
+	ErrVersion  = errors.New("proxyproto: unsupported version")
+)
+
+const (
+	// Max length of a v1 header, including the CRLF.
+	maxV1 = 107
+
+	headerTimeout = 10 * time.Second
+)
+
+var sigV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// TLV is a v2 extension.
+type TLV struct {
+	Type  byte
+	Value []byte
+}
+
+// Header is a PROXY header.
+type Header struct {
+	Version string
+
+	// Local is set for the LOCAL command - connections from the proxy itself,
+	// like health checks. The addresses are not used.
+	Local bool
+
+	// Source is the original client, Dest the address it connected to. Nil
+	// for UNKNOWN or unsupported families.
+	Source *net.TCPAddr
+	Dest   *net.TCPAddr
+
+	// TLVs are the v2 extensions.
+	TLVs []TLV
+}
+
+// TLV returns the value of the first TLV of the type, nil if missing.
+func (h *Header) TLV(t byte) []byte {
+	for _, tlv := range h.TLVs {
+		if tlv.Type == t {
+			return tlv.Value
+		}
+	}
+	return nil
+}
+
+// VIP returns the caller VIP from the TypeVIP TLV.
+func (h *Header) VIP() net.IP {
+	if v := h.TLV(TypeVIP); len(v) == net.IPv6len {
+		return net.IP(v)
+	}
+	return nil
+}
+
+// Role returns the caller role from the TypeRole TLV.
+func (h *Header) Role() string {
+	return string(h.TLV(TypeRole))
+}
+
+// Format returns the header bytes. TLVs are dropped in v1.
+func (h *Header) Format() ([]byte, error) {
+	switch h.Version {
+	case V1:
+		return h.formatV1(), nil
+	case V2:
+		return h.formatV2()
+	}
+	return nil, ErrVersion
+}
+
+func (h *Header) formatV1() []byte {
+	if h.Local || h.Source == nil || h.Dest == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	src, dst := h.Source.IP.To4(), h.Dest.IP.To4()
+	if src != nil && dst != nil {
+		return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src, dst, h.Source.Port, h.Dest.Port))
+	}
+	return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", ip6(h.Source.IP), ip6(h.Dest.IP), h.Source.Port, h.Dest.Port))
+}
+
+// ip6 formats IPv4 addresses in the IPv4-mapped form.
+func ip6(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return "::ffff:" + ip4.String()
+	}
+	return ip.String()
+}
+
+func (h *Header) formatV2() ([]byte, error) {
+	var addr []byte
+	cmd, fam := byte(0x21), byte(0x00)
+	if h.Local {
+		cmd = 0x20
+	} else if h.Source != nil && h.Dest != nil {
+		src, dst := h.Source.IP.To4(), h.Dest.IP.To4()
+		fam = 0x11
+		if src == nil || dst == nil {
+			fam = 0x21
+			src, dst = h.Source.IP.To16(), h.Dest.IP.To16()
+		}
+		if src == nil || dst == nil {
+			return nil, ErrInvalid
+		}
+		addr = append(addr, src...)
+		addr = append(addr, dst...)
+		addr = appendUint16(addr, uint16(h.Source.Port))
+		addr = appendUint16(addr, uint16(h.Dest.Port))
+	}
+	for _, tlv := range h.TLVs {
+		addr = append(addr, tlv.Type)
+		addr = appendUint16(addr, uint16(len(tlv.Value)))
+		addr = append(addr, tlv.Value...)
+	}
+	if len(addr) > 0xFFFF {
+		return nil, ErrInvalid
+	}
+	b := make([]byte, 0, 16+len(addr))
+	b = append(b, sigV2...)
+	b = append(b, cmd, fam)
+	b = appendUint16(b, uint16(len(addr)))
+	return append(b, addr...), nil
+}
+
+// Read parses the header at the start of the stream. Returns ErrNoHeader,
+// without consuming any bytes, if the stream doesn't start with a header.
+func Read(br *bufio.Reader) (*Header, error) {
+	b, err := br.Peek(1)
+	if err != nil {
+		return nil, err
+	}
+	switch b[0] {
+	case 'P':
+		return readV1(br)
+	case '\r':
+		return readV2(br)
+	}
+	return nil, ErrNoHeader
+}
+
+func readV1(br *bufio.Reader) (*Header, error) {
+	b, err := br.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(b) != "PROXY " {
+		return nil, ErrNoHeader
+	}
+	line := make([]byte, 0, maxV1)
+	for len(line) < maxV1 {
+		c, err := br.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, c)
+		if c == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, ErrInvalid
+	}
+	f := strings.Split(string(line[:len(line)-2]), " ")
+	h := &Header{Version: V1}
+	if len(f) >= 2 && f[1] == "UNKNOWN" {
+		return h, nil
+	}
+	if len(f) != 6 || (f[1] != "TCP4" && f[1] != "TCP6") {
+		return nil, ErrInvalid
+	}
+	if h.Source, err = parseAddr(f[2], f[4]); err != nil {
+		return nil, err
+	}
+	if h.Dest, err = parseAddr(f[3], f[5]); err != nil {
+		return nil, err
+	}
+	if f[1] == "TCP4" && (h.Source.IP.To4() == nil || h.Dest.IP.To4() == nil) {
+		return nil, ErrInvalid
+	}
+	return h, nil
+}
+
+func parseAddr(ip, port string) (*net.TCPAddr, error) {
+	a := &net.TCPAddr{IP: net.ParseIP(ip)}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if a.IP == nil || err != nil {
+		return nil, ErrInvalid
+	}
+	a.Port = int(p)
+	return a, nil
+}
+
+func readV2(br *bufio.Reader) (*Header, error) {
+	b, err := br.Peek(16)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(b[:12], sigV2) {
+		return nil, ErrNoHeader
+	}
+	if b[12]>>4 != 2 {
+		return nil, ErrVersion
+	}
+	h := &Header{Version: V2}
+	switch b[12] & 0xF {
+	case 0:
+		h.Local = true
+	case 1:
+	default:
+		return nil, ErrInvalid
+	}
+	fam := b[13]
+	data := make([]byte, 16+int(binary.BigEndian.Uint16(b[14:])))
+	if _, err := io.ReadFull(br, data); err != nil {
+		return nil, err
+	}
+	data = data[16:]
+
+	// TCP and UDP addresses are used, unix addresses skipped. The TLVs of
+	// unknown families are ignored.
+	alen := 0
+	switch fam {
+	case 0x00:
+	case 0x11, 0x12:
+		alen = 12
+	case 0x21, 0x22:
+		alen = 36
+	case 0x31, 0x32:
+		alen = 216
+	default:
+		alen = len(data)
+	}
+	if len(data) < alen {
+		return nil, ErrInvalid
+	}
+	if alen == 12 || alen == 36 {
+		n := (alen - 4) / 2
+		h.Source = &net.TCPAddr{IP: net.IP(data[:n]), Port: int(binary.BigEndian.Uint16(data[2*n:]))}
+		h.Dest = &net.TCPAddr{IP: net.IP(data[n : 2*n]), Port: int(binary.BigEndian.Uint16(data[2*n+2:]))}
+	}
+	for tlvs := data[alen:]; len(tlvs) > 0; {
+		if len(tlvs) < 3 {
+			return nil, ErrInvalid
+		}
+		l := int(binary.BigEndian.Uint16(tlvs[1:]))
+		if len(tlvs) < 3+l {
+			return nil, ErrInvalid
+		}
+		h.TLVs = append(h.TLVs, TLV{Type: tlvs[0], Value: tlvs[3 : 3+l]})
+		tlvs = tlvs[3+l:]
+	}
+	return h, nil
+}
+
+// Conn is an accepted connection with a PROXY header. The header is read on
+// the first Read, RemoteAddr or Header call.
+type Conn struct {
+	net.Conn
+
+	// Required rejects connections without a header. If false, the
+	// connection is used as is.
+	Required bool
+
+	once   sync.Once
+	br     *bufio.Reader
+	header *Header
+	err    error
+}
+
+// NewConn wraps an accepted connection.
+func NewConn(c net.Conn, required bool) *Conn {
+	return &Conn{Conn: c, Required: required, br: bufio.NewReader(c)}
+}
+
+// Header returns the header, nil if the connection doesn't have one. The
+// read deadline is reset.
+func (c *Conn) Header() (*Header, error) {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(headerTimeout))
+		c.header, c.err = Read(c.br)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err == ErrNoHeader && !c.Required {
+			c.err = nil
+		}
+	})
+	return c.header, c.err
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if _, err := c.Header(); err != nil {
+		return 0, err
+	}
+	return c.br.Read(p)
+}
+
+// RemoteAddr returns the original client, if the header has one.
+func (c *Conn) RemoteAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Source != nil && !h.Local {
+		return h.Source
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, if the header has
+// one.
+func (c *Conn) LocalAddr() net.Addr {
+	if h, _ := c.Header(); h != nil && h.Dest != nil && !h.Local {
+		return h.Dest
+	}
+	return c.Conn.LocalAddr()
+}
+
+// CloseWrite sends the FIN to the client, if supported.
+func (c *Conn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// Listener wraps the accepted connections from trusted peers in a Conn.
+type Listener struct {
+	net.Listener
+
+	// Trusted returns true for the peers allowed to send a header.
+	// Connections from other peers - or all if not set - are used as is.
+	Trusted func(addr net.Addr) bool
+
+	// Required rejects the connections from trusted peers without a header.
+	Required bool
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if l.Trusted == nil || !l.Trusted(c.RemoteAddr()) {
+		return c, nil
+	}
+	return NewConn(c, l.Required), nil
+}
+
+// TrustCIDRs returns a Trusted function for the networks.
+func TrustCIDRs(cidrs []string) (func(addr net.Addr) bool, error) {
+	nets := []*net.IPNet{}
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return func(addr net.Addr) bool {
+		ta, ok := addr.(*net.TCPAddr)
+		if !ok {
+			return false
+		}
+		for _, n := range nets {
+			if n.Contains(ta.IP) {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+// Backends maps the destinations getting a header - host:port or host - to
+// the version.
+type Backends map[string]string
+
+// ParseBackends parses a BackendsFile.
+func ParseBackends(data []byte) (Backends, error) {
+	b := Backends{}
+	if err := json.Unmarshal(data, &b); err != nil {
+		return nil, err
+	}
+	for _, v := range b {
+		if v != V1 && v != V2 {
+			return nil, ErrVersion
+		}
+	}
+	return b, nil
+}
+
+// Version returns the version for a destination - the host:port, then the
+// host. Empty if no header should be sent.
+func (b Backends) Version(dest string) string {
+	if v, ok := b[dest]; ok {
+		return v
+	}
+	if host, _, err := net.SplitHostPort(dest); err == nil {
+		return b[host]
+	}
+	return ""
+}
+
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
@@ -0,0 +1,190 @@
+package proxyproto
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestV1(t *testing.T) {
+	for _, tc := range []struct {
+		h    *Header
+		want string
+	}{
+		{&Header{Version: V1,
+			Source: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+			Dest:   &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}},
+			"PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\r\n"},
+		{&Header{Version: V1,
+			Source: &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 5000},
+			Dest:   &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 80}},
+			"PROXY TCP6 fd00::1 ::ffff:10.0.0.2 5000 80\r\n"},
+		{&Header{Version: V1}, "PROXY UNKNOWN\r\n"},
+	} {
+		b, err := tc.h.Format()
+		if err != nil || string(b) != tc.want {
+			t.Error("Unexpected v1 header", string(b), err)
+		}
+		h, err := Read(bufio.NewReader(strings.NewReader(string(b) + "data")))
+		if err != nil || h.Version != V1 {
+			t.Fatal("Failed to parse", string(b), err)
+		}
+		if tc.h.Source != nil && (h.Source.String() != tc.h.Source.String() || h.Dest.Port != 80) {
+			t.Error("Unexpected addresses", h.Source, h.Dest)
+		}
+	}
+
+	for _, bad := range []string{
+		"PROXY TCP4 10.0.0.1 10.0.0.2 5000\r\n",
+		"PROXY TCP4 fd00::1 10.0.0.2 5000 80\r\n",
+		"PROXY TCP4 10.0.0.1 10.0.0.2 5000 80000\r\n",
+		"PROXY TCP4 10.0.0.1 10.0.0.2 5000 80\n",
+		"PROXY " + strings.Repeat("x", 200) + "\r\n",
+	} {
+		if _, err := Read(bufio.NewReader(strings.NewReader(bad))); err != ErrInvalid {
+			t.Error("Expected invalid header", bad, err)
+		}
+	}
+}
+
+func TestV2(t *testing.T) {
+	vip := net.ParseIP("fd00::5")
+	h := &Header{Version: V2,
+		Source: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000},
+		Dest:   &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 443},
+		TLVs: []TLV{
+			{Type: TypeVIP, Value: vip},
+			{Type: TypeRole, Value: []byte("admin")},
+		},
+	}
+	b, err := h.Format()
+	if err != nil || !bytes.HasPrefix(b, sigV2) || len(b) != 16+12+3+16+3+5 {
+		t.Fatal("Unexpected v2 header", b, err)
+	}
+	br := bufio.NewReader(bytes.NewReader(append(b, "data"...)))
+	h2, err := Read(br)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h2.Source.String() != "10.0.0.1:5000" || h2.Dest.String() != "10.0.0.2:443" ||
+		!h2.VIP().Equal(vip) || h2.Role() != "admin" || h2.Local {
+		t.Error("Unexpected header", h2)
+	}
+	if rest, _ := ioutil.ReadAll(br); string(rest) != "data" {
+		t.Error("Header not consumed", string(rest))
+	}
+
+	// IPv6, LOCAL
+	h = &Header{Version: V2,
+		Source: &net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 1},
+		Dest:   &net.TCPAddr{IP: net.ParseIP("fd00::2"), Port: 2}}
+	b, _ = h.Format()
+	if h2, err := Read(bufio.NewReader(bytes.NewReader(b))); err != nil || h2.Source.String() != "[fd00::1]:1" {
+		t.Error("Unexpected IPv6 header", h2, err)
+	}
+	b, _ = (&Header{Version: V2, Local: true}).Format()
+	if h2, err := Read(bufio.NewReader(bytes.NewReader(b))); err != nil || !h2.Local || h2.Source != nil {
+		t.Error("Unexpected LOCAL header", h2, err)
+	}
+
+	// Truncated TLV
+	b, _ = (&Header{Version: V2, TLVs: []TLV{{Type: TypeRole, Value: []byte("x")}}}).Format()
+	b[15]--
+	if _, err := Read(bufio.NewReader(bytes.NewReader(b[:len(b)-1]))); err != ErrInvalid {
+		t.Error("Expected invalid TLV", err)
+	}
+}
+
+func TestNoHeader(t *testing.T) {
+	br := bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if _, err := Read(br); err != ErrNoHeader {
+		t.Error("Expected no header", err)
+	}
+	if br.Buffered() != 16 {
+		t.Error("Bytes consumed")
+	}
+	if _, err := Read(bufio.NewReader(strings.NewReader("POST / HTTP/1.1\r\n"))); err != ErrNoHeader {
+		t.Error("Expected no header", err)
+	}
+}
+
+func TestListener(t *testing.T) {
+	nl, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	trusted, err := TrustCIDRs([]string{"127.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := &Listener{Listener: nl, Trusted: trusted}
+	defer l.Close()
+
+	send := func(data string) (net.Conn, string) {
+		c, err := net.Dial("tcp", nl.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(data))
+		c.(*net.TCPConn).CloseWrite()
+		defer c.Close()
+		ac, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ac.Close()
+		body, _ := ioutil.ReadAll(ac)
+		return ac, string(body)
+	}
+
+	ac, body := send("PROXY TCP4 192.168.1.1 10.0.0.1 1234 80\r\nhello")
+	if ac.RemoteAddr().String() != "192.168.1.1:1234" || ac.LocalAddr().String() != "10.0.0.1:80" || body != "hello" {
+		t.Error("Unexpected conn", ac.RemoteAddr(), ac.LocalAddr(), body)
+	}
+
+	// Optional header
+	ac, body = send("hello")
+	if !strings.HasPrefix(ac.RemoteAddr().String(), "127.0.0.1:") || body != "hello" {
+		t.Error("Unexpected conn", ac.RemoteAddr(), body)
+	}
+
+	l.Required = true
+	if _, body = send("hello"); body != "" {
+		t.Error("Expected rejected conn", body)
+	}
+
+	// Untrusted peers are not parsed.
+	l.Required = false
+	l.Trusted, _ = TrustCIDRs([]string{"10.0.0.0/8"})
+	ac, body = send("PROXY TCP4 192.168.1.1 10.0.0.1 1234 80\r\nhello")
+	if _, ok := ac.(*Conn); ok || !strings.HasPrefix(body, "PROXY") {
+		t.Error("Untrusted header parsed", body)
+	}
+}
+
+func TestBackends(t *testing.T) {
+	b, err := ParseBackends([]byte(`{"10.0.0.1:80": "v1", "backend.local": "v2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for dest, want := range map[string]string{
+		"10.0.0.1:80":        V1,
+		"10.0.0.1:81":        "",
+		"backend.local:8080": V2,
+		"other:80":           "",
+	} {
+		if v := b.Version(dest); v != want {
+			t.Error("Unexpected version", dest, v)
+		}
+	}
+	if _, err := ParseBackends([]byte(`{"a": "v3"}`)); err != ErrVersion {
+		t.Error("Expected invalid version", err)
+	}
+	var none Backends
+	if none.Version("a:1") != "" {
+		t.Error("Expected no version")
+	}
+}
@@ -0,0 +1,199 @@
+// Package sni routes TLS connections by the ServerName of the ClientHello,
+// without terminating TLS.
+//
+// The ClientHello is read and replayed to the destination, which completes
+// the handshake with the client - the router only sees the name. Streams are
+// dialed with the gateway, so apps without proxy support can reach the mesh
+// by resolving names to the router address.
+package sni
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPort of the destinations without a route.
+	DefaultPort = 443
+
+	// RoutesFile is the ConfStore name of the routes - a JSON map of server
+	// names to host:port.
+	RoutesFile = "sni_routes.json"
+)
+
+var (
+	ErrNoServerName = errors.New("sni: missing server name")
+	ErrNoRoute      = errors.New("sni: no route")
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// ProxyDialer dials the stream for a captured connection, and returns the
+// function proxying the client. Implemented by mesh.Gateway.
+type ProxyDialer interface {
+	DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+		ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error)
+}
+
+// Router forwards TLS connections based on the ServerName.
+type Router struct {
+	GW ProxyDialer
+
+	// Port of the destinations without a route, default 443.
+	Port int
+
+	// Strict rejects names without a route.
+	Strict bool
+
+	mutex sync.RWMutex
+
+	// routes maps server names to host:port. A "*.example.com" key matches
+	// the subdomains.
+	routes map[string]string
+}
+
+// SetRoutes replaces the routes.
+func (r *Router) SetRoutes(routes map[string]string) {
+	r.mutex.Lock()
+	r.routes = routes
+	r.mutex.Unlock()
+}
+
+// Route returns the destination for a server name: the exact route, then the
+// closest wildcard, then the name itself if not Strict.
+func (r *Router) Route(name string) (string, error) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	if d, ok := r.routes[name]; ok {
+		return d, nil
+	}
+	for n := name; ; {
+		i := strings.Index(n, ".")
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+		if d, ok := r.routes["*."+n]; ok {
+			return d, nil
+		}
+	}
+	if r.Strict {
+		return "", ErrNoRoute
+	}
+	port := r.Port
+	if port == 0 {
+		port = DefaultPort
+	}
+	return net.JoinHostPort(name, strconv.Itoa(port)), nil
+}
+
+// Serve accepts TLS connections and forwards them.
+func (r *Router) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go r.handle(c)
+	}
+}
+
+func (r *Router) handle(c net.Conn) {
+	c.SetReadDeadline(time.Now().Add(handshakeTimeout))
+	name, hello, err := ServerName(c)
+	c.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Println("SNI: invalid ClientHello ", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	dest, err := r.Route(name)
+	if err != nil {
+		log.Println("SNI: no route ", c.RemoteAddr(), name)
+		c.Close()
+		return
+	}
+	_, pf, err := r.GW.DialProxy(context.Background(), stringAddr(dest), c.RemoteAddr(), "SNI", "sni", name)
+	if err != nil {
+		log.Println("SNI: dial failed ", name, dest, err)
+		c.Close()
+		return
+	}
+
+	// Blocking
+	pf(&prefixConn{Conn: c, r: io.MultiReader(bytes.NewReader(hello), c)})
+}
+
+// ServerName reads the ClientHello from the reader, and returns the server
+// name and the bytes read, to replay to the destination.
+func ServerName(r io.Reader) (string, []byte, error) {
+	var buf bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(&readOnlyConn{r: io.TeeReader(r, &buf)}, &tls.Config{
+		GetConfigForClient: func(chi *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = chi
+			// Stop the handshake - the hello was read.
+			return nil, ErrNoServerName
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+	if hello.ServerName == "" {
+		return "", nil, ErrNoServerName
+	}
+	return hello.ServerName, buf.Bytes(), nil
+}
+
+// readOnlyConn is used to parse the ClientHello with the TLS stack - writes
+// are dropped.
+type readOnlyConn struct {
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *readOnlyConn) Write(p []byte) (int, error)        { return 0, io.ErrClosedPipe }
+func (c *readOnlyConn) Close() error                       { return nil }
+func (c *readOnlyConn) LocalAddr() net.Addr                { return nil }
+func (c *readOnlyConn) RemoteAddr() net.Addr               { return nil }
+func (c *readOnlyConn) SetDeadline(t time.Time) error      { return nil }
+func (c *readOnlyConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *readOnlyConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// prefixConn replays the ClientHello before the rest of the stream.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite sends the FIN to the client, if supported.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+type stringAddr string
+
+func (s stringAddr) Network() string {
+	return "addr"
+}
+
+func (s stringAddr) String() string {
+	return string(s)
+}
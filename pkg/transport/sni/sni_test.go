@@ -0,0 +1,109 @@
+package sni
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testGW struct {
+	dest string
+}
+
+func (gw *testGW) DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+	ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error) {
+	gw.dest = addr.String()
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func(client net.Conn) error {
+		go func() {
+			io.Copy(c, client)
+			c.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(client, c)
+		client.Close()
+		return c.Close()
+	}, nil
+}
+
+func TestRoute(t *testing.T) {
+	r := &Router{}
+	r.SetRoutes(map[string]string{
+		"a.example.com":   "10.0.0.1:8443",
+		"*.example.com":   "10.0.0.2:443",
+		"*.b.example.com": "10.0.0.3:443",
+	})
+	for name, want := range map[string]string{
+		"a.example.com":     "10.0.0.1:8443",
+		"A.Example.com.":    "10.0.0.1:8443",
+		"c.example.com":     "10.0.0.2:443",
+		"x.b.example.com":   "10.0.0.3:443",
+		"y.x.b.example.com": "10.0.0.3:443",
+		"other.com":         "other.com:443",
+	} {
+		if d, err := r.Route(name); err != nil || d != want {
+			t.Error("Unexpected route", name, d, err)
+		}
+	}
+	r.Strict = true
+	if _, err := r.Route("other.com"); err != ErrNoRoute {
+		t.Error("Expected no route", err)
+	}
+}
+
+func TestRouter(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok " + r.TLS.ServerName))
+	}))
+	defer ts.Close()
+
+	gw := &testGW{}
+	r := &Router{GW: gw, Strict: true}
+	r.SetRoutes(map[string]string{"*.mesh.test": ts.Listener.Addr().String()})
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go r.Serve(l)
+
+	// The handshake is done with the destination.
+	hc := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", l.Addr().String())
+		},
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+	}}
+	res, err := hc.Get("https://svc.mesh.test/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if string(body) != "ok svc.mesh.test" || res.TLS.PeerCertificates[0].Raw == nil {
+		t.Error("Unexpected response", string(body))
+	}
+	if gw.dest != ts.Listener.Addr().String() {
+		t.Error("Unexpected dest", gw.dest)
+	}
+
+	// No route - closed.
+	_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "other.com", InsecureSkipVerify: true})
+	if err == nil {
+		t.Error("Expected error for unknown name")
+	}
+}
+
+func TestServerName(t *testing.T) {
+	if _, _, err := ServerName(strings.NewReader("GET / HTTP/1.1\r\n\r\n")); err == nil {
+		t.Error("Expected error for plain text")
+	}
+}
@@ -0,0 +1,512 @@
+// Package socks implements a SOCKS5 server, capturing the streams of apps
+// with SOCKS support into the gateway.
+//
+//	curl -x socks5h://127.0.0.1:5224 ...
+//
+// CONNECT streams are dialed with the gateway. UDP ASSOCIATE is relayed from
+// this node, directly to the destination: the gateway routes, quotas and idle
+// limits (connmgr) only apply to streams, UDP is only checked by Authorize.
+// Without Users only the no-auth method is accepted - the listener
+// should be bound to localhost. With Users, username/password auth (RFC 1929)
+// is required and the user role is passed to the gateway and the policy.
+package socks
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// UsersFile is the ConfStore name of the SOCKS users.
+const UsersFile = "socks_users.json"
+
+const (
+	socksVersion = uint8(5)
+
+	ConnectCommand   = uint8(1)
+	BindCommand      = uint8(2)
+	AssociateCommand = uint8(3)
+
+	ipv4Address = uint8(1)
+	fqdnAddress = uint8(3)
+	ipv6Address = uint8(4)
+)
+
+const (
+	successReply uint8 = iota
+	serverFailure
+	ruleFailure
+	networkUnreachable
+	hostUnreachable
+	connectionRefused
+	ttlExpired
+	commandNotSupported
+	addrTypeNotSupported
+)
+
+const (
+	NoAuth          = uint8(0)
+	UserPassAuth    = uint8(2)
+	noAcceptable    = uint8(255)
+	userAuthVersion = uint8(1)
+	authSuccess     = uint8(0)
+	authFailure     = uint8(1)
+)
+
+var (
+	ErrVersion      = errors.New("socks: unsupported version")
+	ErrNoMethod     = errors.New("socks: no acceptable auth method")
+	ErrAuth         = errors.New("socks: invalid username or password")
+	ErrAddressType  = errors.New("socks: unsupported address type")
+	ErrUDPFragments = errors.New("socks: UDP fragments not supported")
+)
+
+const handshakeTimeout = 10 * time.Second
+
+// ProxyDialer dials the stream for a captured connection, and returns the
+// function proxying the client. Implemented by mesh.Gateway.
+type ProxyDialer interface {
+	DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+		ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error)
+}
+
+// User is a SOCKS user, with a bcrypt password hash.
+type User struct {
+	Password string `json:"password"`
+	Role     string `json:"role"`
+}
+
+// Users by name, loaded from UsersFile.
+type Users map[string]*User
+
+// ParseUsers parses the JSON users file.
+func ParseUsers(data []byte) (Users, error) {
+	u := Users{}
+	if err := json.Unmarshal(data, &u); err != nil {
+		return nil, err
+	}
+	return u, nil
+}
+
+// HashPassword returns the hash to save in the users file.
+func HashPassword(pass string) (string, error) {
+	h, err := bcrypt.GenerateFromPassword([]byte(pass), bcrypt.DefaultCost)
+	return string(h), err
+}
+
+// Check returns the role of the user if the password matches.
+func (u Users) Check(user, pass string) (string, error) {
+	e := u[user]
+	if e == nil || bcrypt.CompareHashAndPassword([]byte(e.Password), []byte(pass)) != nil {
+		return "", ErrAuth
+	}
+	return e.Role, nil
+}
+
+// Server is a SOCKS5 server.
+type Server struct {
+	GW ProxyDialer
+
+	// Users, if set, require username/password auth.
+	Users Users
+
+	// Authorize, if set, checks the role and client for the destination,
+	// for CONNECT and UDP.
+	Authorize func(role string, client net.Addr, dest string) error
+
+	// ListenPacket returns the socket for the UDP to the destinations. Default
+	// is an UDP socket on a random port.
+	ListenPacket func() (net.PacketConn, error)
+}
+
+// maxUDPDests limits the resolved destinations cached for an UDP association.
+const maxUDPDests = 256
+
+// Serve accepts SOCKS connections.
+func (s *Server) Serve(l net.Listener) error {
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(c)
+	}
+}
+
+// request is a parsed SOCKS request.
+type request struct {
+	cmd  uint8
+	dest string
+	ip   net.IP
+	port int
+}
+
+func (s *Server) handle(c net.Conn) {
+	c.SetDeadline(time.Now().Add(handshakeTimeout))
+	user, role, err := s.negotiate(c)
+	if err != nil {
+		log.Println("SOCKS: auth failed ", c.RemoteAddr(), err)
+		c.Close()
+		return
+	}
+	req, err := readRequest(c)
+	if err != nil {
+		if err == ErrAddressType {
+			writeReply(c, addrTypeNotSupported, nil)
+		}
+		c.Close()
+		return
+	}
+	c.SetDeadline(time.Time{})
+
+	switch req.cmd {
+	case ConnectCommand:
+		s.connect(c, req, user, role)
+	case AssociateCommand:
+		s.associate(c, role)
+	default:
+		writeReply(c, commandNotSupported, nil)
+		c.Close()
+	}
+}
+
+// negotiate selects the auth method, and checks the username and password.
+// Returns the user and role.
+func (s *Server) negotiate(c net.Conn) (string, string, error) {
+	hdr := make([]byte, 2)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != socksVersion {
+		return "", "", ErrVersion
+	}
+	methods := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, methods); err != nil {
+		return "", "", err
+	}
+	want := NoAuth
+	if s.Users != nil {
+		want = UserPassAuth
+	}
+	found := false
+	for _, m := range methods {
+		if m == want {
+			found = true
+		}
+	}
+	if !found {
+		c.Write([]byte{socksVersion, noAcceptable})
+		return "", "", ErrNoMethod
+	}
+	if _, err := c.Write([]byte{socksVersion, want}); err != nil {
+		return "", "", err
+	}
+	if want == NoAuth {
+		return "", "", nil
+	}
+
+	// RFC 1929: VER ULEN UNAME PLEN PASSWD
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return "", "", err
+	}
+	if hdr[0] != userAuthVersion {
+		return "", "", ErrVersion
+	}
+	user := make([]byte, hdr[1])
+	if _, err := io.ReadFull(c, user); err != nil {
+		return "", "", err
+	}
+	if _, err := io.ReadFull(c, hdr[:1]); err != nil {
+		return "", "", err
+	}
+	pass := make([]byte, hdr[0])
+	if _, err := io.ReadFull(c, pass); err != nil {
+		return "", "", err
+	}
+	role, err := s.Users.Check(string(user), string(pass))
+	if err != nil {
+		c.Write([]byte{userAuthVersion, authFailure})
+		return "", "", err
+	}
+	_, err = c.Write([]byte{userAuthVersion, authSuccess})
+	return string(user), role, err
+}
+
+// readAddr reads ATYP DST.ADDR DST.PORT.
+func readAddr(r io.Reader) (host string, ip net.IP, port int, err error) {
+	atyp := make([]byte, 1)
+	if _, err = io.ReadFull(r, atyp); err != nil {
+		return
+	}
+	switch atyp[0] {
+	case ipv4Address:
+		ip = make([]byte, net.IPv4len)
+	case ipv6Address:
+		ip = make([]byte, net.IPv6len)
+	case fqdnAddress:
+		l := make([]byte, 1)
+		if _, err = io.ReadFull(r, l); err != nil {
+			return
+		}
+		name := make([]byte, l[0])
+		if _, err = io.ReadFull(r, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		err = ErrAddressType
+		return
+	}
+	if ip != nil {
+		if _, err = io.ReadFull(r, ip); err != nil {
+			return
+		}
+		host = ip.String()
+	}
+	p := make([]byte, 2)
+	if _, err = io.ReadFull(r, p); err != nil {
+		return
+	}
+	port = int(binary.BigEndian.Uint16(p))
+	return
+}
+
+// readRequest reads VER CMD RSV and the destination.
+func readRequest(c io.Reader) (*request, error) {
+	hdr := make([]byte, 3)
+	if _, err := io.ReadFull(c, hdr); err != nil {
+		return nil, err
+	}
+	if hdr[0] != socksVersion {
+		return nil, ErrVersion
+	}
+	host, ip, port, err := readAddr(c)
+	if err != nil {
+		return nil, err
+	}
+	return &request{cmd: hdr[1], dest: net.JoinHostPort(host, strconv.Itoa(port)), ip: ip, port: port}, nil
+}
+
+// appendAddr appends ATYP ADDR PORT for the address.
+func appendAddr(b []byte, addr net.Addr) []byte {
+	var ip net.IP
+	port := 0
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		ip, port = a.IP, a.Port
+	case *net.UDPAddr:
+		ip, port = a.IP, a.Port
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		b = append(b, ipv4Address)
+		b = append(b, ip4...)
+	} else if ip != nil {
+		b = append(b, ipv6Address)
+		b = append(b, ip.To16()...)
+	} else {
+		b = append(b, ipv4Address, 0, 0, 0, 0)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// writeReply sends VER REP RSV BND.ADDR BND.PORT.
+func writeReply(c net.Conn, rep uint8, bind net.Addr) error {
+	_, err := c.Write(appendAddr([]byte{socksVersion, rep, 0}, bind))
+	return err
+}
+
+func (s *Server) connect(c net.Conn, req *request, user, role string) {
+	if s.Authorize != nil {
+		if err := s.Authorize(role, c.RemoteAddr(), req.dest); err != nil {
+			log.Println("SOCKS: denied ", c.RemoteAddr(), user, req.dest, err)
+			writeReply(c, ruleFailure, nil)
+			c.Close()
+			return
+		}
+	}
+
+	var addr net.Addr = stringAddr(req.dest)
+	if req.ip != nil {
+		addr = &net.TCPAddr{IP: req.ip, Port: req.port}
+	}
+	meta := []string{}
+	if role != "" {
+		meta = append(meta, "role", role, "user", user)
+	}
+	_, pf, err := s.GW.DialProxy(context.Background(), addr, c.RemoteAddr(), "SOCKS", meta...)
+	if err != nil {
+		log.Println("SOCKS: dial failed ", req.dest, err)
+		writeReply(c, hostUnreachable, nil)
+		c.Close()
+		return
+	}
+	if err := writeReply(c, successReply, c.LocalAddr()); err != nil {
+		c.Close()
+		return
+	}
+
+	// Blocking
+	pf(c)
+}
+
+// associate relays UDP for the client, until the TCP connection is closed.
+//
+// Datagrams from the client have a RSV(2) FRAG ATYP DST.ADDR DST.PORT header,
+// and are sent to the destination from a dedicated socket. Responses get the
+// same header, with the source address.
+//
+// The datagrams don't go through the gateway - there is no UDP path in the mesh.
+func (s *Server) associate(c net.Conn, role string) {
+	defer c.Close()
+	tcpLocal, _ := c.LocalAddr().(*net.TCPAddr)
+	tcpClient, _ := c.RemoteAddr().(*net.TCPAddr)
+	if tcpLocal == nil || tcpClient == nil {
+		writeReply(c, serverFailure, nil)
+		return
+	}
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: tcpLocal.IP})
+	if err != nil {
+		writeReply(c, serverFailure, nil)
+		return
+	}
+	defer relay.Close()
+	listen := s.ListenPacket
+	if listen == nil {
+		listen = func() (net.PacketConn, error) {
+			return net.ListenPacket("udp", ":0")
+		}
+	}
+	out, err := listen()
+	if err != nil {
+		writeReply(c, serverFailure, nil)
+		return
+	}
+	defer out.Close()
+
+	if err := writeReply(c, successReply, relay.LocalAddr()); err != nil {
+		return
+	}
+
+	// The client address is set by the first datagram from the client IP.
+	clientCh := make(chan *net.UDPAddr, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go s.relayOut(relay, out, tcpClient, role, clientCh)
+	go relayIn(relay, out, clientCh, done)
+
+	// The association ends when the TCP connection is closed.
+	io.Copy(ioutil.Discard, c)
+}
+
+// relayOut sends the datagrams from the client to the destinations.
+func (s *Server) relayOut(relay *net.UDPConn, out net.PacketConn, tcpClient *net.TCPAddr, role string, clientCh chan *net.UDPAddr) {
+	buf := make([]byte, 64*1024)
+	var client *net.UDPAddr
+	// Resolved and authorized destinations - nil if denied.
+	dsts := map[string]*net.UDPAddr{}
+	for {
+		n, from, err := relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(tcpClient.IP) {
+			continue
+		}
+		if client == nil {
+			client = from
+			clientCh <- client
+		} else if from.Port != client.Port {
+			continue
+		}
+		req, data, err := parseUDP(buf[:n])
+		if err != nil {
+			continue
+		}
+		dst, ok := dsts[req.dest]
+		if !ok {
+			dst, err = s.udpDest(req, role, tcpClient)
+			if err != nil {
+				continue
+			}
+			if len(dsts) >= maxUDPDests {
+				dsts = map[string]*net.UDPAddr{}
+			}
+			dsts[req.dest] = dst
+		}
+		if dst == nil {
+			continue
+		}
+		out.WriteTo(data, dst)
+	}
+}
+
+// udpDest authorizes and resolves the destination of a datagram. Returns nil
+// if denied by the policy, and an error if the name can't be resolved.
+func (s *Server) udpDest(req *request, role string, tcpClient *net.TCPAddr) (*net.UDPAddr, error) {
+	if s.Authorize != nil && s.Authorize(role, tcpClient, req.dest) != nil {
+		return nil, nil
+	}
+	if req.ip != nil {
+		return &net.UDPAddr{IP: req.ip, Port: req.port}, nil
+	}
+	return net.ResolveUDPAddr("udp", req.dest)
+}
+
+// relayIn sends the responses to the client. Returns without a datagram from
+// the client if the association is done.
+func relayIn(relay *net.UDPConn, out net.PacketConn, clientCh chan *net.UDPAddr, done chan struct{}) {
+	var client *net.UDPAddr
+	select {
+	case client = <-clientCh:
+	case <-done:
+		return
+	}
+	buf := make([]byte, 64*1024)
+	for {
+		n, from, err := out.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		pkt := appendAddr([]byte{0, 0, 0}, from)
+		pkt = append(pkt, buf[:n]...)
+		relay.WriteToUDP(pkt, client)
+	}
+}
+
+// parseUDP parses the header of a datagram from the client. Names are not
+// resolved.
+func parseUDP(pkt []byte) (*request, []byte, error) {
+	if len(pkt) < 4 {
+		return nil, nil, io.ErrUnexpectedEOF
+	}
+	if pkt[2] != 0 {
+		return nil, nil, ErrUDPFragments
+	}
+	r := bytes.NewReader(pkt[3:])
+	host, ip, port, err := readAddr(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	data := pkt[len(pkt)-r.Len():]
+	return &request{dest: net.JoinHostPort(host, strconv.Itoa(port)), ip: ip, port: port}, data, nil
+}
+
+type stringAddr string
+
+func (s stringAddr) Network() string {
+	return "addr"
+}
+
+func (s stringAddr) String() string {
+	return string(s)
+}
@@ -0,0 +1,202 @@
+package socks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+// testGW dials the destination directly, and records the meta.
+type testGW struct {
+	meta []string
+}
+
+func (gw *testGW) DialProxy(ctx context.Context, addr net.Addr, directClientAddr net.Addr,
+	ctype string, meta ...string) (net.Conn, func(client net.Conn) error, error) {
+	gw.meta = append([]string{ctype}, meta...)
+	c, err := net.Dial("tcp", addr.String())
+	if err != nil {
+		return nil, nil, err
+	}
+	return c, func(client net.Conn) error {
+		go func() {
+			io.Copy(c, client)
+			c.(*net.TCPConn).CloseWrite()
+		}()
+		io.Copy(client, c)
+		client.Close()
+		return c.Close()
+	}, nil
+}
+
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+func startServer(t *testing.T, s *Server) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	return l
+}
+
+func echo(t *testing.T, c net.Conn) {
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte("hello"))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Error("Echo failed", err, string(buf))
+	}
+	c.Close()
+}
+
+func TestConnect(t *testing.T) {
+	el := echoServer(t)
+	defer el.Close()
+
+	gw := &testGW{}
+	hash, _ := HashPassword("secret")
+	s := &Server{GW: gw, Users: Users{"alice": {Password: hash, Role: "member"}}}
+	s.Authorize = func(role string, client net.Addr, dest string) error {
+		if dest != el.Addr().String() {
+			return errors.New("denied")
+		}
+		return nil
+	}
+	sl := startServer(t, s)
+	defer sl.Close()
+
+	d, _ := proxy.SOCKS5("tcp", sl.Addr().String(), &proxy.Auth{User: "alice", Password: "secret"}, proxy.Direct)
+	c, err := d.Dial("tcp", el.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c)
+	if len(gw.meta) != 5 || gw.meta[0] != "SOCKS" || gw.meta[2] != "member" || gw.meta[4] != "alice" {
+		t.Error("Unexpected meta", gw.meta)
+	}
+
+	// Denied by the policy
+	if _, err := d.Dial("tcp", "127.0.0.1:1"); err == nil {
+		t.Error("Expected denied")
+	}
+
+	// Wrong password
+	d, _ = proxy.SOCKS5("tcp", sl.Addr().String(), &proxy.Auth{User: "alice", Password: "x"}, proxy.Direct)
+	if _, err := d.Dial("tcp", el.Addr().String()); err == nil {
+		t.Error("Expected auth failure")
+	}
+
+	// No auth, with users configured
+	d, _ = proxy.SOCKS5("tcp", sl.Addr().String(), nil, proxy.Direct)
+	if _, err := d.Dial("tcp", el.Addr().String()); err == nil {
+		t.Error("Expected no method")
+	}
+
+	// No users - no auth.
+	sl2 := startServer(t, &Server{GW: gw})
+	defer sl2.Close()
+	d, _ = proxy.SOCKS5("tcp", sl2.Addr().String(), nil, proxy.Direct)
+	c, err = d.Dial("tcp", "localhost"+el.Addr().String()[len("127.0.0.1"):])
+	if err != nil {
+		t.Fatal(err)
+	}
+	echo(t, c)
+}
+
+func TestAssociate(t *testing.T) {
+	// UDP echo
+	ue, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ue.Close()
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := ue.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			ue.WriteTo(buf[:n], from)
+		}
+	}()
+
+	sl := startServer(t, &Server{GW: &testGW{}})
+	defer sl.Close()
+
+	c, err := net.Dial("tcp", sl.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	c.Write([]byte{socksVersion, 1, NoAuth})
+	c.Write([]byte{socksVersion, AssociateCommand, 0, ipv4Address, 0, 0, 0, 0, 0, 0})
+	resp := make([]byte, 2+10)
+	if _, err := io.ReadFull(c, resp); err != nil || resp[3] != successReply {
+		t.Fatal("Associate failed", err, resp)
+	}
+	relay := &net.UDPAddr{IP: net.IP(resp[6:10]), Port: int(resp[10])<<8 | int(resp[11])}
+
+	uc, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer uc.Close()
+	pkt := appendAddr([]byte{0, 0, 0}, ue.LocalAddr())
+	uc.WriteTo(append(pkt, []byte("ping")...), relay)
+
+	uc.SetDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 1500)
+	n, _, err := uc.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf[:n], append(pkt, []byte("ping")...)) {
+		t.Error("Unexpected response", buf[:n])
+	}
+
+	// Names are resolved once for the association.
+	port := ue.LocalAddr().(*net.UDPAddr).Port
+	named := append([]byte{0, 0, 0, fqdnAddress, 9}, "localhost"...)
+	named = append(named, byte(port>>8), byte(port))
+	for i := 0; i < 2; i++ {
+		uc.WriteTo(append(named, []byte("pong")...), relay)
+		n, _, err = uc.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.HasSuffix(buf[:n], []byte("pong")) {
+			t.Error("Unexpected response", buf[:n])
+		}
+	}
+
+	if _, _, err := parseUDP([]byte{0, 0, 1, ipv4Address, 1, 2, 3, 4, 0, 1}); err != ErrUDPFragments {
+		t.Error("Expected fragment error", err)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"github.com/costinm/ugate"
 	"github.com/costinm/ugate/pkg/auth"
 	"github.com/costinm/ugate/pkg/msgs"
+	wpauth "github.com/costinm/wpgate/pkg/auth"
 	"github.com/costinm/wpgate/pkg/mesh"
 	"github.com/costinm/wpgate/pkg/streams"
 	"golang.org/x/crypto/ssh"
@@ -80,9 +81,71 @@ type SSHGate struct {
 
 	certs *auth.Auth
 
+	// CA validates SSH certificates. If nil, certificates are rejected.
+	CA CertAuthority
+
+	// Policy, if set, authorizes port forwarding (direct-tcpip and tcpip-forward).
+	Policy Authorizer
+
 	ConnectTimeout time.Duration
 }
 
+// CertAuthority validates SSH user and host certificates, using the trusted CAs from
+// authorized_keys and known_hosts, and provides the signers of the node, including
+// certificates issued by the CA.
+type CertAuthority interface {
+	// AuthenticateSSHCert returns the permissions and role for a client cert.
+	AuthenticateSSHCert(conn ssh.ConnMetadata, cert *ssh.Certificate) (*ssh.Permissions, string, error)
+
+	// CheckSSHHostCert validates a server cert for the address used to connect.
+	CheckSSHHostCert(addr string, remote net.Addr, cert *ssh.Certificate) error
+
+	SSHHostSigner() (ssh.Signer, error)
+	SSHUserSigner() (ssh.Signer, error)
+
+	// IsRevoked returns true if the public key, in marshalled form, was revoked.
+	IsRevoked(pub []byte) bool
+
+	// AuthenticateSSHKey checks the authorized_keys options for a plain key, and
+	// returns the permissions to enforce.
+	AuthenticateSSHKey(conn ssh.ConnMetadata, pub []byte) (*ssh.Permissions, error)
+}
+
+// Authorizer checks a request against the authorization policy - implemented
+// by wpgate auth.Auth.
+type Authorizer interface {
+	Authorize(r *wpauth.PolicyRequest) error
+}
+
+// CloseRevoked closes all client and server connections using the revoked key,
+// or authenticated with a cert signed by the revoked key.
+func (sshGate *SSHGate) CloseRevoked(pub []byte) {
+	closers := []io.Closer{}
+	sshGate.mutex.RLock()
+	for _, c := range sshGate.SshClients {
+		if c.usesKey(pub) {
+			closers = append(closers, c)
+		}
+	}
+	for _, c := range sshGate.SshConn {
+		if c.usesKey(pub) {
+			closers = append(closers, c)
+		}
+	}
+	sshGate.mutex.RUnlock()
+
+	for _, c := range closers {
+		log.Println("SSH: closing revoked ", auth.Pub2VIP(pub))
+		c.Close()
+	}
+}
+
+// usesKey returns true if the connection was authenticated with the key, or with
+// a cert signed by the key.
+func (sc *SSHConn) usesKey(pub []byte) bool {
+	return bytes.Equal(sc.pubKey, pub) || (sc.caKey != nil && bytes.Equal(sc.caKey, pub))
+}
+
 const SSH_MESH_PORT = 5222
 const H2_MESH_PORT = 5228
 
@@ -98,6 +161,9 @@ type SSHConn struct {
 
 	// Key of the remote side ( received )
 	pubKey              []byte
+
+	// Key of the CA that signed the remote cert, nil if not using a cert.
+	caKey []byte
 	Connect             time.Time
 	SubscriptionsToSend []string
 
@@ -111,6 +177,14 @@ type SSHConn struct {
 	// TODO: list
 	role string
 
+	// Set if the client cert has a force-command critical option, or the key
+	// a command option in authorized_keys.
+	forceCommand string
+
+	// Permissions of the client, with the authorized_keys forwarding
+	// restrictions. Server side only.
+	permissions *ssh.Permissions
+
 	msgChannel ssh.Channel
 	vip        uint64
 	VIP6       net.IP
@@ -267,6 +341,9 @@ func (sshGate *SSHGate) DialCon(conn net.Conn, addr string,
 type dmeshChannelData struct {
 	Dest string
 	RemoteAddr string
+
+	// meshPath of routed streams.
+	Rest []byte `ssh:"rest"`
 }
 
 func (sshGate *SSHGate)	onConnect(sshC *SSHConn, client *ssh.Client, addr string) {
@@ -278,8 +355,8 @@ func (sshGate *SSHGate)	onConnect(sshC *SSHConn, client *ssh.Client, addr string
 
 	sshGate.mutex.Lock()
 	sshGate.SshClients[addr] = sshC
-	sshGate.gw.JumpHosts[sshC.VIP6.String()] = sshC
 	sshGate.mutex.Unlock()
+	sshGate.gw.AddJumpHost(sshC.VIP6, sshC)
 
 	if string(client.ServerVersion()) == version {
 		dmCh := client.HandleChannelOpen("dmesh")
@@ -292,6 +369,7 @@ func (sshGate *SSHGate)	onConnect(sshC *SSHConn, client *ssh.Client, addr string
 
 				ra, _ := net.ResolveTCPAddr("tcp", dmeshCh.RemoteAddr)
 				p := sshC.gate.gw.NewTcpProxy(ra, "SSHRSOCKS", nil, cha, cha)
+				p.PrevPath = unmarshalPath(dmeshCh.Rest)
 
 				err := sshC.gate.gw.Dial(p, dmeshCh.Dest, nil)
 				if err != nil {
@@ -366,6 +444,7 @@ func (sshC *SSHConn) Close() error {
 	sshC.gate.mutex.Lock()
 	delete(sshC.gate.SshClients, sshC.Addr)
 	sshC.gate.mutex.Unlock()
+	sshC.gate.gw.RemoveJumpHost(sshC.VIP6, sshC)
 	if sshC.Node.TunClient == sshC {
 		sshC.Node.TunClient = nil
 	}
@@ -395,6 +474,9 @@ func (sshC *SSHConn) DialProxy(tp *ugate.Stream) error {
 
 	msg.Laddr = sshC.gate.certs.VIP6.String() // tp.OriginIP.String(),
 	msg.Lport = uint32(tp.StreamId)
+	if string(sshC.sshclient.ServerVersion()) == version {
+		msg.Rest = marshalPath(tp.PrevPath)
+	}
 
 	var ch ssh.Channel = nil
 	time.AfterFunc(5*time.Second, func() {
@@ -596,6 +678,12 @@ const version = "SSH-2.0-dmesh"
 
 func (sshGate *SSHGate) clientConfig(sshC *SSHConn, pub []byte) *ssh.ClientConfig {
 	signer, _ := ssh.NewSignerFromKey(sshGate.certs.EC256Cert.PrivateKey) // ssh.Signer
+	if sshGate.CA != nil {
+		// Includes the user cert, if one was issued.
+		if s, err := sshGate.CA.SSHUserSigner(); err == nil {
+			signer = s
+		}
+	}
 	user := "dmesh"
 	sshGate.cmetrics.Total.Add(1)
 
@@ -627,10 +715,25 @@ func (sshGate *SSHGate) clientConfig(sshC *SSHConn, pub []byte) *ssh.ClientConfi
 		//	MACs: []string{},
 		//},
 		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			if cert, ok := key.(*ssh.Certificate); ok {
+				if sshGate.CA == nil {
+					return errors.New("ssh: host certificates not accepted")
+				}
+				// Signed by a CA trusted for the hostname in known_hosts.
+				if err := sshGate.CA.CheckSSHHostCert(hostname, remote, cert); err != nil {
+					log.Println("SSHC: host cert rejected ", hostname, err)
+					return err
+				}
+				sshC.caKey = wpauth.SSHKeyBytes(cert.SignatureKey)
+				key = cert.Key
+			}
 			if cpk, ok := key.(ssh.CryptoPublicKey); ok {
 				pubk := cpk.CryptoPublicKey()
 
 				kbytes := auth.MarshalPublicKey(pubk)
+				if sshGate.CA != nil && sshGate.CA.IsRevoked(kbytes) {
+					return errors.New("ssh: revoked host key")
+				}
 
 				sshC.pubKey = kbytes
 
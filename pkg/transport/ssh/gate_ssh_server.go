@@ -14,6 +14,7 @@ import (
 	"github.com/costinm/ugate"
 	"github.com/costinm/ugate/pkg/auth"
 	"github.com/costinm/ugate/pkg/msgs"
+	wpauth "github.com/costinm/wpgate/pkg/auth"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -22,41 +23,37 @@ func (sshGate *SSHGate) authPub(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.
 	// SSH certificates are different from HTTP - one layer only.
 	//
 	if cert, ok := key.(*ssh.Certificate); ok {
-		if cert.CertType != ssh.UserCert {
-			return nil, fmt.Errorf("ssh: cert has type %d", cert.CertType)
+		if sshGate.CA == nil {
+			return nil, fmt.Errorf("ssh: certificates not accepted")
+		}
+		// Signed by a trusted CA, principals, validity and critical options.
+		// conn.User() is usually set to 'dmesh' - the CA may restrict principals.
+		perms, role, err := sshGate.CA.AuthenticateSSHCert(conn, cert)
+		if err != nil {
+			log.Println("SSHD: cert rejected ", conn.RemoteAddr(), err)
+			return nil, err
 		}
-		// 1. Verify cert.SignatureKey is a CA
-
-		//cert.SignatureKey.(ssh.CryptoPublicKey)
-
-		// conn.User() is usually set to 'dmesh' - and ignored.
-		//
-
-		// cert.ValidPrincipals
 
 		// for ED: 51 bytes,  19 (4 + 11 ssh-ed25519 + 4) + 32
 		if cpk, ok := cert.Key.(ssh.CryptoPublicKey); ok {
 			pubk := cpk.CryptoPublicKey()
 
 			kbytes := auth.MarshalPublicKey(pubk)
-			kbs := string(kbytes)
 			vip := auth.Pub2VIP(kbytes)
 
-			var role string
-			if role = sshGate.certs.Auth(kbytes, ""); role == "" {
-				role = "guest"
+			if role == "" {
+				role = ROLE_GUEST
 			}
-			log.Println("SSHClientConn Key ", key.Type(), role, base64.StdEncoding.EncodeToString(kbytes))
-
-			return &ssh.Permissions{
-				Extensions: map[string]string{
-					"key":    kbs,
-					"role":   role,
-					"vip":    vip.String(),
-					"user":   conn.User(),
-					"remote": conn.RemoteAddr().String(),
-				},
-			}, nil
+			log.Println("SSHClientConn Cert ", cert.KeyId, role, base64.StdEncoding.EncodeToString(kbytes))
+
+			// source-address is also checked by the ssh server, force-command
+			// replaces the shell and exec commands.
+			perms.Extensions["key"] = string(kbytes)
+			perms.Extensions["role"] = role
+			perms.Extensions["vip"] = vip.String()
+			perms.Extensions["user"] = conn.User()
+			perms.Extensions["remote"] = conn.RemoteAddr().String()
+			return perms, nil
 		}
 		return nil, fmt.Errorf("key rejected for %s", key.Type())
 	}
@@ -68,6 +65,10 @@ func (sshGate *SSHGate) authPub(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.
 		kbytes := auth.MarshalPublicKey(pubk)
 		kbs := string(kbytes)
 		vip := auth.Pub2VIP(kbytes)
+		if sshGate.CA != nil && sshGate.CA.IsRevoked(kbytes) {
+			log.Println("SSHD: revoked key ", conn.RemoteAddr(), vip)
+			return nil, fmt.Errorf("key revoked")
+		}
 
 		var role string
 		if role = sshGate.certs.Auth(kbytes, ""); role == "" {
@@ -75,15 +76,25 @@ func (sshGate *SSHGate) authPub(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.
 		}
 		log.Println("SSHClientConn Key ", key.Type(), role, base64.StdEncoding.EncodeToString(kbytes))
 
-		return &ssh.Permissions{
-			Extensions: map[string]string{
-				"key":    kbs,
-				"role":   role,
-				"vip":    vip.String(),
-				"user":   conn.User(),
-				"remote": conn.RemoteAddr().String(),
-			},
-		}, nil
+		perms := &ssh.Permissions{
+			Extensions: map[string]string{},
+		}
+		if sshGate.CA != nil {
+			// authorized_keys options: from, expiry-time, command and
+			// forwarding restrictions, enforced on forward requests.
+			var err error
+			perms, err = sshGate.CA.AuthenticateSSHKey(conn, kbytes)
+			if err != nil {
+				log.Println("SSHD: key rejected ", conn.RemoteAddr(), vip, err)
+				return nil, err
+			}
+		}
+		perms.Extensions["key"] = kbs
+		perms.Extensions["role"] = role
+		perms.Extensions["vip"] = vip.String()
+		perms.Extensions["user"] = conn.User()
+		perms.Extensions["remote"] = conn.RemoteAddr().String()
+		return perms, nil
 
 	}
 
@@ -113,9 +124,19 @@ func (sshGate *SSHGate) InitServer() error {
 	}
 
 	privateKey, err := ssh.NewSignerFromKey(sshGate.certs.EC256Cert.PrivateKey) // ssh.Signer
+	if sshGate.CA != nil {
+		// Includes the host cert, if one was issued.
+		privateKey, err = sshGate.CA.SSHHostSigner()
+	}
+	if err != nil {
+		return err
+	}
 	config.AddHostKey(privateKey)
 
+	// May be called again on cert rotation - new connections use the new config.
+	sshGate.mutex.Lock()
 	sshGate.serverConfig = config
+	sshGate.mutex.Unlock()
 
 	return err
 }
@@ -162,7 +183,10 @@ func (sshGate *SSHGate) HandleServerConn(nConn net.Conn) {
 
 	// Before use, a handshake must be performed on the incoming
 	// net.Conn. Handshake results in conn.Permissions.
-	conn, chans, globalSrvReqs, err := ssh.NewServerConn(nConn, sshGate.serverConfig)
+	sshGate.mutex.RLock()
+	serverConfig := sshGate.serverConfig
+	sshGate.mutex.RUnlock()
+	conn, chans, globalSrvReqs, err := ssh.NewServerConn(nConn, serverConfig)
 	if err != nil {
 		nConn.Close()
 		log.Println("SSHD: handshake error ", err, nConn.RemoteAddr())
@@ -194,10 +218,15 @@ func (sshGate *SSHGate) HandleServerConn(nConn net.Conn) {
 	scon.vip = auth.Pub2ID(vipsb)
 	scon.VIP6 = auth.Pub2VIP(vipsb)
 	scon.pubKey = vipsb
+	if ca := conn.Permissions.Extensions[wpauth.SSHExtCA]; ca != "" {
+		scon.caKey = []byte(ca)
+	}
 
 	scon.role = role
+	scon.forceCommand = conn.Permissions.CriticalOptions["force-command"]
+	scon.permissions = conn.Permissions
 
-	sshGate.gw.JumpHosts[scon.VIP6.String()] = scon
+	sshGate.gw.AddJumpHost(scon.VIP6, scon)
 
 	vipHex := fmt.Sprintf("%x", scon.vip)
 	//scon.key =
@@ -229,8 +258,8 @@ func (sshGate *SSHGate) HandleServerConn(nConn net.Conn) {
 		if existing == scon {
 			delete(sshGate.SshConn, scon.vip)
 		}
-		delete(sshGate.gw.JumpHosts, scon.VIP6.String())
 		sshGate.mutex.Unlock()
+		sshGate.gw.RemoveJumpHost(scon.VIP6, scon)
 
 		// TODO: remove from list of active
 		scon.Close()
@@ -275,9 +304,18 @@ func (sshGate *SSHGate) HandleServerConn(nConn net.Conn) {
 					scon.VIP6.String())
 				continue
 			}
+			if err := wpauth.SSHPermitOpen(scon.permissions, req.Raddr, req.Rport); err != nil {
+				log.Println("-L: rejected ", scon.VIP6, req.Raddr, req.Rport, err)
+				newChannel.Reject(ssh.Prohibited, err.Error())
+				continue
+			}
+			if err := scon.authorize("direct-tcpip", req.Raddr, req.Rport); err != nil {
+				newChannel.Reject(ssh.Prohibited, err.Error())
+				continue
+			}
 			log.Println("-L: forward request", req.Laddr, req.Lport, req.Raddr, req.Rport, role)
 
-			go scon.handleDirectTcpip(newChannel, req.Raddr, req.Rport, req.Laddr, req.Lport)
+			go scon.handleDirectTcpip(newChannel, req.Raddr, req.Rport, req.Laddr, req.Lport, unmarshalPath(req.Rest))
 			conId++
 
 		case "session":
@@ -331,6 +369,15 @@ func (sshS *SSHServerConn) handleServerConnRequests(reqs <-chan *ssh.Request, n
 				r.Reply(false, nil)
 				continue
 			}
+			if err := wpauth.SSHPermitListen(sshS.permissions, req.BindIP, req.BindPort); err != nil {
+				log.Println("-R: rejected ", sshS.VIP6, req.BindIP, req.BindPort, err)
+				r.Reply(false, nil)
+				continue
+			}
+			if err := sshS.authorize("tcpip-forward", req.BindIP, req.BindPort); err != nil {
+				r.Reply(false, nil)
+				continue
+			}
 
 			if req.BindPort == SSH_MESH_PORT || req.BindPort != H2_MESH_PORT {
 				sshS.handleMeshNodeForward(req, n, r, vipHex)
@@ -365,6 +412,21 @@ func (sshS *SSHServerConn) handleServerConnRequests(reqs <-chan *ssh.Request, n
 	}
 }
 
+// authorize checks a port forwarding request against the policy. Host is the
+// destination for direct-tcpip, or the bind address for tcpip-forward.
+func (sshS *SSHServerConn) authorize(method string, host string, port uint32) error {
+	if sshS.gate.Policy == nil {
+		return nil
+	}
+	return sshS.gate.Policy.Authorize(&wpauth.PolicyRequest{
+		Kind:   wpauth.PolicySSH,
+		Role:   sshS.role,
+		VIP:    sshS.VIP6,
+		Method: method,
+		Host:   net.JoinHostPort(host, strconv.Itoa(int(port))),
+	})
+}
+
 // For -R on 5222, special reverse TCP mode similar with SOCKS.
 // No listener is created - this is used internally
 func (sshS *SSHServerConn) handleMeshNodeForward(req tcpipForwardRequest,
@@ -647,6 +709,7 @@ func (sshS *SSHServerConn) DialProxy(tp *ugate.Stream) error {
 	req := dmeshChannelData {
 		Dest: tp.Dest,
 		RemoteAddr: "",
+		Rest: marshalPath(tp.PrevPath),
 	}
 
 	channel, reqs, err := sshS.sshConn.OpenChannel("dmesh",
@@ -745,7 +808,7 @@ func extractAddress(c net.Conn) string {
 
 // Handles SOCKS (-D) and local fwd (-L), mapping remote ports to connections to a host:port
 // It is equivalent with /dmesh/tcp/IP/port request.
-func (sshS *SSHServerConn) handleDirectTcpip(newChannel ssh.NewChannel, host string, port uint32, localAddr string, localPort uint32) {
+func (sshS *SSHServerConn) handleDirectTcpip(newChannel ssh.NewChannel, host string, port uint32, localAddr string, localPort uint32, path []string) {
 	channel, requests, err := newChannel.Accept()
 	if err != nil {
 		log.Println("could not accept channel.", err)
@@ -767,6 +830,7 @@ func (sshS *SSHServerConn) handleDirectTcpip(newChannel ssh.NewChannel, host str
 	addr, _ := net.ResolveIPAddr("ip", localAddr)
 
 	proxy := sshS.gate.gw.NewTcpProxy(&net.TCPAddr{IP: addr.IP, Port: int(localPort)}, "SSHL", nil, channel, channel)
+	proxy.PrevPath = path
 	err = sshS.gate.gw.Dial(proxy, net.JoinHostPort(host, strconv.Itoa(int(port))), nil)
 	if err != nil {
 		channel.Close()
@@ -785,27 +849,40 @@ const ROLE_GUEST = "guest"
 
 // As a server, handle out-of-band requests on a session.
 // server may have multiple sessions
-func (sshS *SSHServerConn) handleServerRequestChan(n *ugate.DMNode, in <-chan *ssh.Request) {
+//
+// Like OpenSSH, a force-command from the cert or authorized_keys replaces the
+// command of the shell and exec requests. Sessions forced to run a command the
+// gate doesn't implement are refused.
+func (sshS *SSHServerConn) handleServerRequestChan(n *ugate.DMNode, channel ssh.Channel, in <-chan *ssh.Request) {
+	started := false
 	for req := range in {
 		switch req.Type {
-		case "shell":
-			log.Println("shell request, closing ", sshS.vip, req.Type, string(req.Payload))
-			if len(req.Payload) > 0 {
-				// We don't accept any
-				// commands, only the
-				// default shell.
-			}
-			req.Reply(true, nil)
-		case "exec":
+		case "shell", "exec":
 			sshExec := execRequest{}
-			if len(req.Payload) > 0 {
-				ssh.Unmarshal(req.Payload, &sshExec)
-				// We don't accept any
-				// commands, only the
-				// default shell.
+			if req.Type == "exec" {
+				if err := ssh.Unmarshal(req.Payload, &sshExec); err != nil {
+					req.Reply(false, nil)
+					continue
+				}
+			}
+			if started {
+				// One command per session.
+				req.Reply(false, nil)
+				continue
+			}
+			cmd, err := wpauth.SSHSessionCommand(sshS.permissions, sshExec.Command)
+			if err != nil {
+				log.Println("SSHD: force-command ", sshS.vip, req.Type, sshS.forceCommand, err)
+				req.Reply(false, nil)
+				continue
 			}
-			log.Println("exec ", sshS.vip, sshExec.Command)
+			if cmd != sshExec.Command {
+				log.Println("SSHD: force-command ", sshS.vip, req.Type, sshExec.Command, cmd)
+			}
+			sshExec.Command = cmd
+			started = true
 			req.Reply(true, nil)
+			sshS.startSessionCommand(n, channel, sshExec.Command)
 		case "pty-req":
 			req.Reply(false, nil)
 		case "env":
@@ -859,4 +936,29 @@ type channelOpenDirectMsg struct {
 
 	Laddr string
 	Lport uint32
+
+	// Mesh extension, only sent to dmesh servers: meshPath of routed streams.
+	Rest []byte `ssh:"rest"`
+}
+
+// meshPath is the list of nodes that routed a stream - ugate.Stream.PrevPath.
+type meshPath struct {
+	Path []string
+}
+
+// marshalPath returns the extra channel data for the routed stream, or nil.
+func marshalPath(path []string) []byte {
+	if len(path) == 0 {
+		return nil
+	}
+	return ssh.Marshal(&meshPath{Path: path})
+}
+
+// unmarshalPath returns the path from the extra channel data.
+func unmarshalPath(rest []byte) []string {
+	mp := meshPath{}
+	if len(rest) == 0 || ssh.Unmarshal(rest, &mp) != nil {
+		return nil
+	}
+	return mp.Path
 }
@@ -9,6 +9,7 @@ import (
 
 	"github.com/costinm/ugate"
 	"github.com/costinm/ugate/pkg/msgs"
+	"github.com/costinm/wpgate/pkg/msgstore"
 	"golang.org/x/crypto/ssh"
 )
 
@@ -24,16 +25,17 @@ func (sshS *SSHServerConn) handleServerSessionChannel(node *ugate.DMNode, newCha
 		return
 	}
 
-	sshS.msgChannel = channel
-
 	// Sessions have out-of-band requests such as "shell",
-	// "pty-req" and "env".  Here we handle only the
-	// "shell" request.
-	go sshS.handleServerRequestChan(node, requests)
+	// "pty-req" and "env". The messages start on "shell" or "exec".
+	go sshS.handleServerRequestChan(node, channel, requests)
+}
 
-	// ssh: pty-req, shell session req
-	// exec - command passed when env and exec is received.
-	// We use this just for one command right now - dmeshMsg
+// startSessionCommand runs the command of a session. The gate has one command
+// for all shell and exec requests - the message stream, with the peer using
+// stdin and stdout. Forced commands are checked by wpauth.SSHSessionCommand.
+func (sshS *SSHServerConn) startSessionCommand(node *ugate.DMNode, channel ssh.Channel, command string) {
+	log.Println("SSHD: session ", sshS.vip, command)
+	sshS.msgChannel = channel
 
 	mconn := &msgs.MsgConnection{
 		SubscriptionsToSend: nil, // Don't send all messages down - only if explicit subscription.
@@ -45,6 +47,7 @@ func (sshS *SSHServerConn) handleServerSessionChannel(node *ugate.DMNode, newCha
 	id := "sshs-"+node.VIP.String()
 	msgs.DefaultMux.AddConnection(id, mconn)
 	//}
+	msgstore.Default.Connect(node.VIP.String(), id, storedSender(node.VIP.String(), mconn))
 
 	br := bufio.NewReader(channel)
 
@@ -58,6 +61,16 @@ func (sshS *SSHServerConn) handleServerSessionChannel(node *ugate.DMNode, newCha
 	}))
 }
 
+// storedSender delivers messages from the store-and-forward queue. The peer acks
+// with a message on the msgstore.TopicAck topic.
+func storedSender(vip string, mconn *msgs.MsgConnection) msgstore.SendFunc {
+	return msgstore.Sender(vip, func(meta map[string]string, data []byte) error {
+		ev := msgs.NewMessage("/"+msgstore.TopicQueue, meta)
+		ev.Data = data
+		return mconn.SendMessageToRemote(ev)
+	})
+}
+
 func (sc *SSHConn) SendMessageToRemote(ev *msgs.Message) error {
 	if sc == nil || sc.msgChannel == nil {
 		return nil
@@ -80,6 +93,12 @@ func handleMessageStream(mux *msgs.Mux, id string, node *ugate.DMNode,
 			mconn *msgs.MsgConnection, isServer bool) {
 	t0 := time.Now()
 	mconn.HandleMessageStream(func(ev *msgs.Message) {
+		// The authenticated peer, for the signed path of queued messages.
+		if ev.Meta == nil {
+			ev.Meta = map[string]string{}
+		}
+		ev.Meta[msgstore.MetaPeer] = from
+
 		// Direct message from the client, with its own info
 		if ev.Topic == "endpoint" {
 			if node.NodeAnnounce == nil {
@@ -87,12 +106,20 @@ func handleMessageStream(mux *msgs.Mux, id string, node *ugate.DMNode,
 			}
 			node.NodeAnnounce.UA = ev.Meta["ua"]
 		}
+		// Acks for the messages we queued, and acks for the messages
+		// queued for us.
+		if msgstore.Default.OnMessage(node.VIP.String(), self, ev.Topic, ev.Meta, func(meta map[string]string) error {
+			return mconn.SendMessageToRemote(msgs.NewMessage("/"+msgstore.TopicAck, meta))
+		}) {
+			return
+		}
 		newEv, _ := json.Marshal(ev)
 		fmt.Println(string(newEv))
 
 	}, br, from)
 
 	mux.RemoveConnection(id, mconn)
+	msgstore.Default.Disconnect(node.VIP.String(), id)
 	log.Println("Message con close", id, time.Since(t0))
 }
 
@@ -166,6 +193,7 @@ func (sshC *SSHConn) handleClientMsgChannel(node *ugate.DMNode, channel ssh.Chan
 
 	id := "sshc-"+sshC.VIP6.String()
 	msgs.DefaultMux.AddConnection(id, mconn)
+	msgstore.Default.Connect(node.VIP.String(), id, storedSender(node.VIP.String(), mconn))
 
 	// From and path will be populated by forwarder code.
 	mconn.SendMessageToRemote(msgs.NewMessage("/endpoint/sshc", map[string]string{
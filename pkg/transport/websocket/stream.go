@@ -8,6 +8,7 @@ import (
 
 	"github.com/costinm/ugate/pkg/auth"
 	"github.com/costinm/ugate/pkg/msgs"
+	"github.com/costinm/wpgate/pkg/msgstore"
 	ws "golang.org/x/net/websocket"
 )
 
@@ -44,9 +45,40 @@ func websocketStream(gate *msgs.Mux, conn *ws.Conn, s string) {
 		Conn: conn,
 	}
 	msgs.DefaultMux.AddConnection("", mconn)
-	br := bufio.NewReader(conn)
-	mconn.HandleMessageStream(nil, br, "")
 
+	send := func(ev *msgs.Message) error {
+		_, err := conn.Write(append(ev.MarshalJSON(), '\n'))
+		return err
+	}
+
+	// Store and forward, for peers authenticated with mTLS.
+	peer, self := "", ""
+	if r := conn.Request(); r != nil && r.TLS != nil && len(r.TLS.PeerCertificates) > 0 {
+		peer = auth.Pub2VIP(auth.MarshalPublicKey(r.TLS.PeerCertificates[0].PublicKey)).String()
+	}
+	if gate.Auth != nil {
+		self = gate.Auth.VIP6.String()
+	}
+	if peer != "" {
+		msgstore.Default.Connect(peer, s, msgstore.Sender(peer, func(meta map[string]string, data []byte) error {
+			ev := msgs.NewMessage("/"+msgstore.TopicQueue, meta)
+			ev.Data = data
+			return send(ev)
+		}))
+		defer msgstore.Default.Disconnect(peer, s)
+	}
+
+	br := bufio.NewReader(conn)
+	mconn.HandleMessageStream(func(ev *msgs.Message) {
+		// The authenticated peer, for the signed path of queued messages.
+		if ev.Meta == nil {
+			ev.Meta = map[string]string{}
+		}
+		ev.Meta[msgstore.MetaPeer] = peer
+		msgstore.Default.OnMessage(peer, self, ev.Topic, ev.Meta, func(meta map[string]string) error {
+			return send(msgs.NewMessage("/"+msgstore.TopicAck, meta))
+		})
+	}, br, peer)
 }
 
 func WSGateClient(a *auth.Auth, dest string) (net.Conn, error) {
@@ -15,6 +15,7 @@ import (
 	"time"
 
 	"github.com/costinm/ugate/pkg/msgs"
+	"github.com/costinm/wpgate/pkg/auth"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
@@ -40,6 +41,15 @@ type GrpcService struct {
 	clients map[string]*Connection
 
 	connectionNumber int
+
+	// Revocation, if set, is checked when a stream starts. Streams from revoked
+	// keys are closed by CloseRevoked.
+	Revocation Revocation
+}
+
+// Revocation checks if a public key was revoked - implemented by wpgate auth.Auth.
+type Revocation interface {
+	IsRevoked(pub []byte) bool
 }
 
 // Connection represents a single endpoint.
@@ -59,6 +69,12 @@ type Connection struct {
 	// Currently based on the node name and a counter.
 	ConID string
 
+	// Public key of the peer, from the mTLS cert.
+	Pub []byte
+
+	// Public key of the CA that signed the peer cert, if the peer sent the chain.
+	CAPub []byte
+
 	// doneChannel will be closed when the client is closed.
 	doneChannel chan int
 
@@ -92,8 +108,19 @@ func NewXDS(mux *msgs.Mux) *GrpcService {
 func (s *GrpcService) StreamAggregatedResources(stream AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
 	peerInfo, ok := peer.FromContext(stream.Context())
 	peerAddr := "0.0.0.0"
+	var pub, caPub []byte
 	if ok {
 		peerAddr = peerInfo.Addr.String()
+		if ti, ok := peerInfo.AuthInfo.(credentials.TLSInfo); ok && len(ti.State.PeerCertificates) > 0 {
+			pub = auth.KeyBytes(ti.State.PeerCertificates[0].PublicKey)
+			if len(ti.State.PeerCertificates) > 1 {
+				caPub = auth.KeyBytes(ti.State.PeerCertificates[1].PublicKey)
+			}
+		}
+	}
+	if s.Revocation != nil && (s.Revocation.IsRevoked(pub) || (caPub != nil && s.Revocation.IsRevoked(caPub))) {
+		log.Printf("ADS: %q revoked key %v", peerAddr, auth.Pub2VIP(pub))
+		return status.Error(codes.PermissionDenied, "revoked")
 	}
 
 	t0 := time.Now()
@@ -101,6 +128,8 @@ func (s *GrpcService) StreamAggregatedResources(stream AggregatedDiscoveryServic
 	con := &Connection{
 		Connect:     t0,
 		PeerAddr:    peerAddr,
+		Pub:         pub,
+		CAPub:       caPub,
 		SStream:     stream,
 		NonceSent:   map[string]string{},
 		Metadata:    map[string]string{},
@@ -117,16 +146,22 @@ func (s *GrpcService) StreamAggregatedResources(stream AggregatedDiscoveryServic
 	// connections and close.
 	firstReq := true
 
+	// Tracked for CloseRevoked.
+	s.mutex.Lock()
+	s.connectionNumber++
+	con.ConID = fmt.Sprintf("%s-%d", peerAddr, s.connectionNumber)
+	s.clients[con.ConID] = con
+	s.mutex.Unlock()
+
 	defer func() {
+		s.mutex.Lock()
+		delete(s.clients, con.ConID)
+		s.mutex.Unlock()
 		if firstReq {
 			return // didn't get first req, not added
 		}
 		close(con.resChannel)
 		close(con.doneChannel)
-		s.mutex.Lock()
-		delete(s.clients, con.ConID)
-		s.mutex.Unlock()
-
 	}()
 
 	go func() {
@@ -167,6 +202,22 @@ func (s *GrpcService) StreamAggregatedResources(stream AggregatedDiscoveryServic
 	return nil
 }
 
+// CloseRevoked terminates the streams of peers using the revoked key, or a cert
+// signed by the revoked key.
+func (s *GrpcService) CloseRevoked(pub []byte) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	for _, con := range s.clients {
+		if (len(con.Pub) > 0 && string(con.Pub) == string(pub)) ||
+			(len(con.CAPub) > 0 && string(con.CAPub) == string(pub)) {
+			select {
+			case con.errChannel <- status.Error(codes.PermissionDenied, "revoked"):
+			default:
+			}
+		}
+	}
+}
+
 func (s *GrpcService) process(connection *Connection, request *Request) error {
 	for _, r := range request.Resources {
 		s.Mux.SendMessage(&msgs.Message{
@@ -201,7 +252,8 @@ func (fx *GrpcService) Send(con *Connection, r *Response) {
 	con.resChannel <- r
 }
 
-func Connect(addr string, clientPem string) (*grpc.ClientConn, AggregatedDiscoveryServiceClient, error) {
+// Connect dials an ADS server. Extra options can add per-RPC credentials.
+func Connect(addr string, clientPem string, extra ...grpc.DialOption) (*grpc.ClientConn, AggregatedDiscoveryServiceClient, error) {
 	opts := []grpc.DialOption{}
 
 	// Cert file is a PEM, it is loaded into a x509.CertPool,
@@ -264,42 +316,9 @@ func Connect(addr string, clientPem string) (*grpc.ClientConn, AggregatedDiscove
 	// WithInsecure() == no auth, plain http. Either that or TransportCred
 	// required.
 
-	// grpc/credentials/oauth defines a number of options - it's
-	// an interface called on each request, returning headers
-	//
-	// GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error)
-	// TODO: vapid option
-
-	// json has client_email, private_key.
-	// Aud: "https://accounts.google.com/o/oauth2/token"
-	// Scope: ...
-	// Iss: Email
-	// Signed and posted to google, which returns an oauth2 token
-
-	// Uses 2-legged auth
-	// RS256/JWT, with Iss = email, Sub = email, Aud = (google url)
-	// Iat, Exp = 1h
-	//json := []byte("{}")
-	//jwtCreds, err := oauth.NewJWTAccessFromKey(json)
-
-	// Other option: NewServiceAccountFromFile ( dev console service account
-	// -- application default credentials )
-
-	// golang.org/x/oauth2/google/DefaultTokenSource(ctx, scope...)
-	// GOOGLE_APPLICATION_CREDENTIALS env file
-	// .config/gcloud/application_default_credentials.json
-	// appengine or compute engine get it from env
-
-	// file has client_id, client_secret, refresh_token - for creds
-	// and private key/key id for service accounts
-	// Still goes trough Oauth2 flow.
-	//gcreds, err := oauth.NewApplicationDefault(context.Background(), "test_scope")
-	//gcreds.GetRequestMetadata(context.Background(), "url")
-
-	// also NewOauthAccess - seems to allow arbitrary type/value
-	// could be IID token !!!!
-
-	//opts = append(opts, grpc.WithPerRPCCredentials(jwtCreds))
+	// Per-RPC credentials - for example a K8S service account token:
+	// grpc.WithPerRPCCredentials(&wpauth.BearerCredentials{File: ...})
+	opts = append(opts, extra...)
 
 	conn, err := grpc.Dial(addr, opts...)
 	if err != nil {
@@ -106,7 +106,11 @@ func NewUI(dm *mesh.Gateway, h2 *h2.H2, hgate *httpproxy.HTTPGate) (*DMUI, error
 		h2.LocalMux.HandleFunc("/dmesh/dns", dmui.dm.DNS.(*dns.DmDns).HttpDebugDNS)
 	}
 
-	h2.LocalMux.HandleFunc("/quitquitquit", QuitHandler)
+	h2.LocalMux.HandleFunc("/quitquitquit", func(w http.ResponseWriter, r *http.Request) {
+		// Let the active streams finish.
+		dmui.dm.Close()
+		QuitHandler(w, r)
+	})
 
 	h2.LocalMux.HandleFunc("/dmesh/uds/", msgs.DefaultMux.HTTPUDS)
 
@@ -117,9 +121,12 @@ func NewUI(dm *mesh.Gateway, h2 *h2.H2, hgate *httpproxy.HTTPGate) (*DMUI, error
 
 	mux.HandleFunc("/dmesh/tcpa", dmui.dm.HttpTCP)
 	mux.HandleFunc("/dmesh/tcp", dmui.dm.HttpAllTCP)
+	mux.HandleFunc("/dmesh/conns", dmui.dm.HttpConns)
+	mux.HandleFunc("/dmesh/forward", dmui.dm.HttpForward)
 
 	mux.HandleFunc("/dmesh/rd", dmui.HttpRefreshAndRegister)
 	mux.HandleFunc("/dmesh/ip6", dmui.dm.HttpGetNodes)
+	mux.HandleFunc("/dmesh/routes", dmui.dm.HttpGetRoutes)
 
 	////mux.HandleFunc("/dmesh/rr", lm.HttpGetRoutes)
 	//if dmui.ld != nil {